@@ -0,0 +1,127 @@
+package client
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mdkelley02/message-queue/server"
+	"github.com/mdkelley02/message-queue/storage"
+)
+
+func Test_acl(t *testing.T) {
+	dataDir := t.TempDir()
+	start := func() (*server.Server, chan error) {
+		s := server.NewServer(server.ServerConfig{
+			ServerAddr:      ":8089",
+			DataDir:         dataDir,
+			MakeStorageFunc: storage.NewStorage,
+			RequireAuth:     true,
+			Authenticators: []server.IAuthenticator{
+				server.NewAPIKeyAuthenticator([]server.APIKey{
+					{Name: "root", Key: "admin-key", Roles: []string{"admin"}},
+					{Name: "billing", Key: "billing-key"},
+				}),
+			},
+			ACL: &server.ACLConfig{Rules: []server.ACLRule{
+				{Role: "admin", Topic: "*", Actions: []string{server.ActionAdmin}},
+				{Principal: "billing", Topic: "invoices.*", Actions: []string{server.ActionPublish}},
+			}},
+		})
+		stopped := make(chan error, 1)
+		go func() {
+			stopped <- s.Start()
+		}()
+		waitForServer(t, "localhost:8089")
+		return s, stopped
+	}
+
+	assertForbidden := func(t *testing.T, err error) {
+		var respErr *ResponseError
+		if assert.True(t, errors.As(err, &respErr)) {
+			assert.Equal(t, http.StatusForbidden, respErr.StatusCode)
+		}
+	}
+
+	s, stopped := start()
+	admin := NewMessageQueueClient("localhost:8089", false, WithAPIKey("admin-key"))
+	billing := NewMessageQueueClient("localhost:8089", false, WithAPIKey("billing-key"))
+
+	t.Run("principals only reach the topics they are granted", func(t *testing.T) {
+		if _, err := billing.Publish("invoices.eu", "i1"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := admin.Publish("audit", "a1"); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := billing.Publish("audit", "a2")
+		assertForbidden(t, err)
+
+		_, err = billing.Subscribe("invoices.eu", func(server.Delivery) error { return nil })
+		assertForbidden(t, err)
+
+		assertForbidden(t, billing.DeleteTopic("invoices.eu"))
+
+		_, err = billing.GetACLs()
+		assertForbidden(t, err)
+
+		topics, err := billing.GetTopics()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, []string{"invoices.eu"}, topics)
+
+		topics, err = admin.GetTopics()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.ElementsMatch(t, []string{"audit", "invoices.eu"}, topics)
+	})
+
+	var granted server.ACLRule
+	t.Run("rules are managed at runtime", func(t *testing.T) {
+		var err error
+		granted, err = admin.AddACL(server.ACLRule{Principal: "billing", Topic: "audit", Actions: []string{server.ActionSubscribe}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		messages, err := billing.BrowseMessages("audit", 0, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, messages.Messages, 1)
+
+		var respErr *ResponseError
+		err = admin.DeleteACL("static-0")
+		if assert.True(t, errors.As(err, &respErr)) {
+			assert.Equal(t, http.StatusConflict, respErr.StatusCode)
+		}
+	})
+
+	stopServer(t, s, stopped)
+	s, stopped = start()
+	defer stopServer(t, s, stopped)
+
+	t.Run("runtime rules survive a restart", func(t *testing.T) {
+		rules, err := admin.GetACLs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, rules, 3)
+		assert.Contains(t, rules, granted)
+
+		if _, err := billing.BrowseMessages("audit", 0, 0, 10); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := admin.DeleteACL(granted.Id); err != nil {
+			t.Fatal(err)
+		}
+		_, err = billing.BrowseMessages("audit", 0, 0, 10)
+		assertForbidden(t, err)
+	})
+}
@@ -0,0 +1,186 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mdkelley02/message-queue/server"
+	"github.com/mdkelley02/message-queue/storage"
+)
+
+func Test_audit(t *testing.T) {
+	auditFile := filepath.Join(t.TempDir(), "audit.jsonl")
+	s := server.NewServer(server.ServerConfig{
+		ServerAddr:      ":8096",
+		MakeStorageFunc: storage.NewStorage,
+		Authenticators: []server.IAuthenticator{
+			server.NewAPIKeyAuthenticator([]server.APIKey{
+				{Name: "root", Key: "admin-key", Roles: []string{"admin"}},
+				{Name: "billing", Key: "billing-key"},
+			}),
+		},
+		ACL: &server.ACLConfig{Rules: []server.ACLRule{
+			{Role: "admin", Topic: "*", Actions: []string{server.ActionAdmin}},
+		}},
+		Audit: &server.AuditConfig{File: auditFile},
+	})
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- s.Start()
+	}()
+	waitForServer(t, "localhost:8096")
+	defer stopServer(t, s, stopped)
+
+	admin := NewMessageQueueClient("localhost:8096", false, WithAPIKey("admin-key"))
+	billing := NewMessageQueueClient("localhost:8096", false, WithAPIKey("billing-key"))
+
+	readEvents := func(t *testing.T) []server.AuditEvent {
+		content, err := os.ReadFile(auditFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var events []server.AuditEvent
+		for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+			var event server.AuditEvent
+			if err := json.Unmarshal([]byte(line), &event); err != nil {
+				t.Fatal(err)
+			}
+			events = append(events, event)
+		}
+		return events
+	}
+
+	t.Run("topic changes are recorded with their state", func(t *testing.T) {
+		req, err := http.NewRequest(http.MethodPost, "http://localhost:8096/topics", strings.NewReader(`{"name":"orders","config":{"maxSize":10}}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set(server.APIKeyHeader, "admin-key")
+		req.Header.Set(server.RequestIdHeader, "create-orders")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		assert.Equal(t, http.StatusCreated, resp.StatusCode)
+		assert.Equal(t, "create-orders", resp.Header.Get(server.RequestIdHeader))
+
+		if _, err := admin.UpdateTopicConfig("orders", server.TopicConfig{MaxSize: 20}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := admin.Publish("orders", "o1"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := admin.PurgeTopic("orders"); err != nil {
+			t.Fatal(err)
+		}
+		if err := admin.DeleteTopic("orders"); err != nil {
+			t.Fatal(err)
+		}
+
+		events := readEvents(t)
+		if !assert.Len(t, events, 4) {
+			return
+		}
+
+		create := events[0]
+		assert.Equal(t, server.AuditTopicCreate, create.Action)
+		assert.Equal(t, "root", create.Principal)
+		assert.Equal(t, server.AuthMethodAPIKey, create.AuthMethod)
+		assert.Equal(t, "127.0.0.1", create.SourceIP)
+		assert.Equal(t, "create-orders", create.RequestId)
+		assert.Equal(t, "orders", create.Resource)
+		assert.Nil(t, create.Before)
+		assert.Equal(t, float64(10), create.After.(map[string]any)["maxSize"])
+		assert.False(t, create.Time.IsZero())
+
+		config := events[1]
+		assert.Equal(t, server.AuditTopicConfig, config.Action)
+		assert.Equal(t, float64(10), config.Before.(map[string]any)["maxSize"])
+		assert.Equal(t, float64(20), config.After.(map[string]any)["maxSize"])
+		assert.Len(t, config.RequestId, 32)
+		assert.NotEqual(t, create.RequestId, config.RequestId)
+
+		purge := events[2]
+		assert.Equal(t, server.AuditTopicPurge, purge.Action)
+		assert.Equal(t, float64(1), purge.Before.(map[string]any)["depth"])
+		assert.Equal(t, float64(0), purge.After.(map[string]any)["depth"])
+
+		assert.Equal(t, server.AuditTopicDelete, events[3].Action)
+		assert.NotNil(t, events[3].Before)
+		assert.Nil(t, events[3].After)
+	})
+
+	t.Run("acl changes and failed access are recorded", func(t *testing.T) {
+		rule, err := admin.AddACL(server.ACLRule{Principal: "billing", Topic: "invoices", Actions: []string{server.ActionPublish}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := admin.DeleteACL(rule.Id); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = billing.Publish("invoices", "i1")
+		assert.Error(t, err)
+
+		_, err = NewMessageQueueClient("localhost:8096", false, WithAPIKey("wrong-key")).GetTopics()
+		assert.Error(t, err)
+
+		events := readEvents(t)[4:]
+		if !assert.Len(t, events, 4) {
+			return
+		}
+
+		assert.Equal(t, server.AuditACLAdd, events[0].Action)
+		assert.Equal(t, rule.Id, events[0].Resource)
+		assert.Equal(t, "invoices", events[0].After.(map[string]any)["topic"])
+
+		assert.Equal(t, server.AuditACLDelete, events[1].Action)
+		assert.Equal(t, "invoices", events[1].Before.(map[string]any)["topic"])
+
+		assert.Equal(t, server.AuditPermissionDenied, events[2].Action)
+		assert.Equal(t, "billing", events[2].Principal)
+		assert.Equal(t, "invoices", events[2].Resource)
+
+		assert.Equal(t, server.AuditAuthFailure, events[3].Action)
+		assert.Empty(t, events[3].Principal)
+		assert.NotEmpty(t, events[3].Reason)
+	})
+
+	t.Run("events are published to the audit topic which only admins read", func(t *testing.T) {
+		page, err := admin.BrowseMessages(server.AuditTopic, 0, 0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, page.Messages, 8) {
+			assert.Equal(t, server.AuditTopicCreate, page.Messages[0].Key)
+
+			var event server.AuditEvent
+			if err := json.Unmarshal([]byte(page.Messages[0].Value), &event); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, "create-orders", event.RequestId)
+		}
+
+		var respErr *ResponseError
+		_, err = admin.Publish(server.AuditTopic, "forged")
+		if assert.True(t, errors.As(err, &respErr)) {
+			assert.Equal(t, http.StatusForbidden, respErr.StatusCode)
+		}
+		if assert.True(t, errors.As(admin.DeleteTopic(server.AuditTopic), &respErr)) {
+			assert.Equal(t, http.StatusForbidden, respErr.StatusCode)
+		}
+		_, err = billing.BrowseMessages(server.AuditTopic, 0, 0, 100)
+		if assert.True(t, errors.As(err, &respErr)) {
+			assert.Equal(t, http.StatusForbidden, respErr.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,66 @@
+package client
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"github.com/mdkelley02/message-queue/server"
+)
+
+// WithAPIKey authenticates every request with key.
+func WithAPIKey(key string) ClientOption {
+	return func(c *MessageQueueClient) {
+		c.header.Set(server.APIKeyHeader, key)
+	}
+}
+
+// WithToken authenticates every request with a bearer token.
+func WithToken(token string) ClientOption {
+	return func(c *MessageQueueClient) {
+		c.header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// WhoAmI returns the principal the broker sees the client as.
+func (c *MessageQueueClient) WhoAmI() (server.Principal, error) {
+	var response server.Principal
+	if err := c.doJSON(http.MethodGet, "/whoami", nil, &response); err != nil {
+		slog.Error("could not get principal", "err", err)
+		return server.Principal{}, err
+	}
+
+	return response, nil
+}
+
+// GetACLs lists the access control rules of the namespace of the client.
+func (c *MessageQueueClient) GetACLs() ([]server.ACLRule, error) {
+	var response server.ACLRulesResponse
+	if err := c.doJSON(http.MethodGet, "/acls", nil, &response); err != nil {
+		slog.Error("could not get acl rules", "err", err)
+		return nil, err
+	}
+
+	return response.Rules, nil
+}
+
+// AddACL adds rule and returns it with its id.
+func (c *MessageQueueClient) AddACL(rule server.ACLRule) (server.ACLRule, error) {
+	var response server.ACLRule
+	if err := c.doJSON(http.MethodPost, "/acls", rule, &response); err != nil {
+		slog.Error("could not add acl rule", "err", err)
+		return server.ACLRule{}, err
+	}
+
+	return response, nil
+}
+
+func (c *MessageQueueClient) DeleteACL(id string) error {
+	if err := c.doJSON(http.MethodDelete, fmt.Sprintf("/acls/%s", url.PathEscape(id)), nil, nil); err != nil {
+		slog.Error("could not delete acl rule", "err", err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package client
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mdkelley02/message-queue/server"
+	"github.com/mdkelley02/message-queue/storage"
+)
+
+func Test_auth(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+
+	s := server.NewServer(server.ServerConfig{
+		ServerAddr:      ":8088",
+		MakeStorageFunc: storage.NewStorage,
+		RequireAuth:     true,
+		Authenticators: []server.IAuthenticator{
+			server.NewAPIKeyAuthenticator([]server.APIKey{{Name: "billing", Key: "k1"}}),
+			server.NewJWTAuthenticator(server.JWTConfig{Secret: secret}),
+		},
+	})
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- s.Start()
+	}()
+	waitForServer(t, "localhost:8088")
+	defer stopServer(t, s, stopped)
+
+	t.Run("requests without valid credentials are rejected", func(t *testing.T) {
+		var respErr *ResponseError
+
+		_, err := NewMessageQueueClient("localhost:8088", false).Publish("MY_AUTH_TOPIC", "a")
+		assert.True(t, errors.As(err, &respErr))
+		assert.Equal(t, http.StatusUnauthorized, respErr.StatusCode)
+
+		_, err = NewMessageQueueClient("localhost:8088", false, WithAPIKey("k2")).GetTopics()
+		assert.True(t, errors.As(err, &respErr))
+		assert.Equal(t, http.StatusUnauthorized, respErr.StatusCode)
+
+		_, err = NewMessageQueueClient("localhost:8088", false, WithToken("abc")).Subscribe("MY_AUTH_TOPIC", func(server.Delivery) error {
+			return nil
+		})
+		assert.True(t, errors.As(err, &respErr))
+		assert.Equal(t, http.StatusUnauthorized, respErr.StatusCode)
+	})
+
+	t.Run("api keys authenticate requests", func(t *testing.T) {
+		principal, err := NewMessageQueueClient("localhost:8088", false, WithAPIKey("k1")).WhoAmI()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, server.Principal{Name: "billing", Method: server.AuthMethodAPIKey}, principal)
+	})
+
+	t.Run("tokens authenticate requests and subscriptions", func(t *testing.T) {
+		token, err := server.SignToken(secret, server.TokenClaims{
+			Subject:   "alice",
+			ExpiresAt: time.Now().Add(time.Minute).Unix(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		client := NewMessageQueueClient("localhost:8088", false, WithToken(token))
+
+		principal, err := client.WhoAmI()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, server.Principal{Name: "alice", Method: server.AuthMethodJWT}, principal)
+
+		received := make(chan string, 1)
+		quit, err := client.Subscribe("MY_AUTH_TOPIC", func(d server.Delivery) error {
+			received <- d.Value
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer close(quit)
+
+		if _, err := client.Publish("MY_AUTH_TOPIC", "hello"); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case v := <-received:
+			assert.Equal(t, "hello", v)
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for delivery")
+		}
+	})
+}
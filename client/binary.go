@@ -0,0 +1,424 @@
+package client
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/mdkelley02/message-queue/protocol"
+	"github.com/mdkelley02/message-queue/server"
+)
+
+// IBinaryClient produces and fetches messages over the binary protocol of
+// the broker, see the protocol package.
+type IBinaryClient interface {
+	Produce(topic string, requests []server.PublishRequest) ([]server.PublishResponse, error)
+	Fetch(topic string, partition int, offset int, maxMessages int) (server.BrowseMessagesResponse, error)
+	Ack(topic string, group string, partition int, offset int) error
+	CommitOffset(topic string, group string, partition int, offset int) error
+	Close() error
+}
+
+var errClientClosed = errors.New("client is closed")
+
+// BinaryClient keeps one connection to the broker, which it opens on first
+// use and again after it broke. It is safe for concurrent use: the requests
+// of concurrent callers are pipelined on the connection instead of waiting
+// for each other's responses.
+type BinaryClient struct {
+	addr        string
+	namespace   string
+	credentials map[string]string
+	tlsConfig   *tls.Config
+
+	// mu guards the connection and the writes to it. writers counts the
+	// callers writing or waiting to, the last one flushes.
+	mu      sync.Mutex
+	writers atomic.Int32
+	conn    *binaryConn
+	nextId  uint32
+	buf     []byte
+	closed  bool
+}
+
+// NewBinaryClient returns a client of the binary protocol served at addr.
+// It takes the credentials, TLS config and namespace of opts, the other
+// options only apply to the HTTP API.
+func NewBinaryClient(addr string, opts ...ClientOption) IBinaryClient {
+	settings := &MessageQueueClient{header: http.Header{}}
+	for _, opt := range opts {
+		opt(settings)
+	}
+
+	credentials := make(map[string]string, len(settings.header))
+	for name := range settings.header {
+		credentials[name] = settings.header.Get(name)
+	}
+
+	return &BinaryClient{
+		addr:        addr,
+		namespace:   settings.namespace,
+		credentials: credentials,
+		tlsConfig:   settings.tlsConfig,
+	}
+}
+
+// ProduceError reports the messages of a batch the broker did not store,
+// by their index in the batch. The other messages are stored.
+type ProduceError struct {
+	Failed map[int]*ResponseError
+}
+
+func (e *ProduceError) Error() string {
+	indexes := make([]int, 0, len(e.Failed))
+	for i := range e.Failed {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+
+	failures := make([]string, 0, len(indexes))
+	for _, i := range indexes {
+		failures = append(failures, fmt.Sprintf("message %d: %v", i, e.Failed[i]))
+	}
+	return fmt.Sprintf("%d messages were not published: %s", len(failures), strings.Join(failures, ", "))
+}
+
+// Produce publishes requests to topic in one batch. The responses are in
+// the order of the requests, those of messages that were not stored are
+// zero and the error is a *ProduceError.
+func (c *BinaryClient) Produce(topic string, requests []server.PublishRequest) ([]server.PublishResponse, error) {
+	req := &protocol.ProduceRequest{
+		Namespace: c.namespace,
+		Topic:     topic,
+		Messages:  make([]protocol.Message, len(requests)),
+	}
+	for i, r := range requests {
+		partition := int32(protocol.AnyPartition)
+		if r.Partition != nil {
+			partition = int32(*r.Partition)
+		}
+		req.Messages[i] = protocol.Message{
+			Key:         r.Key,
+			Partition:   partition,
+			Value:       r.Body,
+			Headers:     r.Headers,
+			TraceParent: r.Trace.TraceParent,
+			TraceState:  r.Trace.TraceState,
+		}
+	}
+
+	var response protocol.ProduceResponse
+	err := c.call(protocol.OpProduce, req, &response)
+	if err == nil && len(response.Results) != len(requests) {
+		err = fmt.Errorf("%w: %d results for %d messages", protocol.ErrMalformed, len(response.Results), len(requests))
+	}
+	if err != nil {
+		slog.Error("could not produce messages", "err", err)
+		return nil, err
+	}
+
+	responses := make([]server.PublishResponse, len(requests))
+	failed := make(map[int]*ResponseError)
+	for i, result := range response.Results {
+		if result.Status != protocol.StatusOK {
+			failed[i] = &ResponseError{StatusCode: int(result.Status), Message: result.Error}
+			continue
+		}
+		responses[i] = server.PublishResponse{
+			Partition: int(result.Partition),
+			Offset:    int(result.Offset),
+			MessageId: fmt.Sprintf("%s-%d-%d", topic, result.Partition, result.Offset),
+		}
+	}
+
+	if len(failed) > 0 {
+		err := &ProduceError{Failed: failed}
+		slog.Error("could not produce messages", "err", err)
+		return responses, err
+	}
+
+	return responses, nil
+}
+
+// Fetch reads up to maxMessages messages of a partition from offset on
+// without claiming them, like BrowseMessages. The messages carry no
+// delivery state.
+func (c *BinaryClient) Fetch(topic string, partition int, offset int, maxMessages int) (server.BrowseMessagesResponse, error) {
+	var response protocol.FetchResponse
+	if err := c.call(protocol.OpFetch, &protocol.FetchRequest{
+		Namespace:   c.namespace,
+		Topic:       topic,
+		Partition:   int32(partition),
+		Offset:      int64(offset),
+		MaxMessages: int32(maxMessages),
+	}, &response); err != nil {
+		slog.Error("could not fetch messages", "err", err)
+		return server.BrowseMessagesResponse{}, err
+	}
+
+	fetched := server.BrowseMessagesResponse{
+		Topic:      topic,
+		Partition:  partition,
+		Messages:   make([]server.MessageResponse, 0, len(response.Records)),
+		NextOffset: int(response.NextOffset),
+	}
+	for _, record := range response.Records {
+		fetched.Messages = append(fetched.Messages, server.MessageResponse{
+			Id:        fmt.Sprintf("%s-%d-%d", topic, partition, record.Offset),
+			Topic:     topic,
+			Partition: partition,
+			Offset:    int(record.Offset),
+			Key:       record.Key,
+			Value:     record.Value,
+			Timestamp: record.Timestamp,
+			Headers:   record.Headers,
+		})
+	}
+
+	return fetched, nil
+}
+
+// Ack acknowledges the message at offset for the group, the default group
+// when group is empty.
+func (c *BinaryClient) Ack(topic string, group string, partition int, offset int) error {
+	if err := c.call(protocol.OpAck, c.offsetRequest(topic, group, partition, offset), &protocol.Empty{}); err != nil {
+		slog.Error("could not ack message", "err", err)
+		return err
+	}
+
+	return nil
+}
+
+// CommitOffset acknowledges every message below offset for the group, the
+// default group when group is empty.
+func (c *BinaryClient) CommitOffset(topic string, group string, partition int, offset int) error {
+	if err := c.call(protocol.OpCommit, c.offsetRequest(topic, group, partition, offset), &protocol.Empty{}); err != nil {
+		slog.Error("could not commit offset", "err", err)
+		return err
+	}
+
+	return nil
+}
+
+func (c *BinaryClient) offsetRequest(topic string, group string, partition int, offset int) *protocol.OffsetRequest {
+	return &protocol.OffsetRequest{
+		Namespace: c.namespace,
+		Topic:     topic,
+		Group:     group,
+		Partition: int32(partition),
+		Offset:    int64(offset),
+	}
+}
+
+// Close closes the connection. Requests waiting for their response fail.
+func (c *BinaryClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	if c.conn != nil {
+		c.conn.fail(errClientClosed)
+	}
+	return nil
+}
+
+// call sends req and decodes the response into resp. A failed response is
+// returned as a *ResponseError.
+func (c *BinaryClient) call(op protocol.Op, req protocol.Body, resp protocol.Body) error {
+	result, err := c.send(op, req)
+	if err != nil {
+		return err
+	}
+
+	res := <-result
+	if res.err != nil {
+		return responseError(res.err)
+	}
+
+	resp.Decode(res.dec)
+	return res.dec.Err()
+}
+
+// responseError returns a failed response as a *ResponseError, and other
+// errors as they are.
+func responseError(err error) error {
+	var protocolErr *protocol.Error
+	if errors.As(err, &protocolErr) {
+		return &ResponseError{
+			StatusCode: int(protocolErr.Status),
+			Message:    protocolErr.Message,
+			Leader:     protocolErr.Leader,
+			RetryAfter: protocolErr.RetryAfter,
+		}
+	}
+	return err
+}
+
+// send writes a request and returns where its response arrives.
+func (c *BinaryClient) send(op protocol.Op, req protocol.Body) (<-chan binaryResult, error) {
+	c.writers.Add(1)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	conn, err := c.connectLocked()
+	if err != nil {
+		c.writers.Add(-1)
+		return nil, err
+	}
+
+	result, err := c.writeLocked(conn, op, req)
+	// flush when no other caller is about to write, so that concurrent
+	// requests share a write
+	last := c.writers.Add(-1) == 0
+	if err == nil && last {
+		err = conn.w.Flush()
+	}
+	if err != nil {
+		conn.fail(err)
+	}
+	return result, nil
+}
+
+func (c *BinaryClient) writeLocked(conn *binaryConn, op protocol.Op, req protocol.Body) (<-chan binaryResult, error) {
+	c.nextId++
+	h := protocol.Header{Op: op, CorrelationId: c.nextId}
+
+	result := conn.register(h.CorrelationId)
+	c.buf = protocol.AppendRequest(c.buf[:0], h, req)
+	_, err := conn.w.Write(c.buf)
+	return result, err
+}
+
+// connectLocked returns the connection, opening a new one when there is
+// none or it broke. A new connection authenticates before it is used.
+func (c *BinaryClient) connectLocked() (*binaryConn, error) {
+	if c.closed {
+		return nil, errClientClosed
+	}
+	if c.conn != nil && c.conn.broken() == nil {
+		return c.conn, nil
+	}
+
+	var netConn net.Conn
+	var err error
+	if c.tlsConfig != nil {
+		netConn, err = tls.Dial("tcp", c.addr, c.tlsConfig)
+	} else {
+		netConn, err = net.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &binaryConn{
+		conn:    netConn,
+		w:       bufio.NewWriterSize(netConn, binaryBufferSize),
+		pending: make(map[uint32]chan binaryResult),
+	}
+	go conn.readResponses()
+
+	if len(c.credentials) > 0 {
+		result, err := c.writeLocked(conn, protocol.OpAuth, &protocol.AuthRequest{Credentials: c.credentials})
+		if err == nil {
+			err = conn.w.Flush()
+		}
+		if err == nil {
+			err = (<-result).err
+		}
+		if err != nil {
+			conn.fail(err)
+			return nil, responseError(err)
+		}
+	}
+
+	c.conn = conn
+	return conn, nil
+}
+
+const binaryBufferSize = 64 << 10
+
+// binaryConn is a connection of a BinaryClient together with the requests
+// waiting for their response on it.
+type binaryConn struct {
+	conn net.Conn
+	w    *bufio.Writer
+
+	mu      sync.Mutex
+	pending map[uint32]chan binaryResult
+	err     error
+}
+
+// binaryResult is the body of a response, or why there is none.
+type binaryResult struct {
+	dec *protocol.Decoder
+	err error
+}
+
+// register returns where the response to the request with the correlation
+// id arrives. On a broken connection it arrives right away.
+func (c *binaryConn) register(id uint32) <-chan binaryResult {
+	result := make(chan binaryResult, 1)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		result <- binaryResult{err: c.err}
+		return result
+	}
+	c.pending[id] = result
+	return result
+}
+
+func (c *binaryConn) broken() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err
+}
+
+// fail closes the connection and fails the requests waiting on it.
+func (c *binaryConn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	c.conn.Close()
+	for id, result := range c.pending {
+		result <- binaryResult{err: err}
+		delete(c.pending, id)
+	}
+}
+
+func (c *binaryConn) readResponses() {
+	r := bufio.NewReaderSize(c.conn, binaryBufferSize)
+	for {
+		frame, err := protocol.ReadFrame(r)
+		if err != nil {
+			c.fail(fmt.Errorf("connection to broker lost: %w", err))
+			return
+		}
+
+		h, dec, err := protocol.ParseResponse(frame)
+
+		c.mu.Lock()
+		result, ok := c.pending[h.CorrelationId]
+		delete(c.pending, h.CorrelationId)
+		c.mu.Unlock()
+
+		if ok {
+			result <- binaryResult{dec: dec, err: err}
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mdkelley02/message-queue/server"
+	"github.com/mdkelley02/message-queue/storage"
+)
+
+func Test_binary(t *testing.T) {
+	s := server.NewServer(server.ServerConfig{
+		ServerAddr:      ":8106",
+		BinaryAddr:      ":8107",
+		MakeStorageFunc: storage.NewStorage,
+		RequireAuth:     true,
+		Authenticators: []server.IAuthenticator{
+			server.NewAPIKeyAuthenticator([]server.APIKey{{Name: "billing", Key: "k1"}}),
+		},
+	})
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- s.Start()
+	}()
+	waitForServer(t, "localhost:8106")
+	waitForServer(t, "localhost:8107")
+	defer stopServer(t, s, stopped)
+
+	c := NewBinaryClient("localhost:8107", WithAPIKey("k1"))
+	defer c.Close()
+	httpClient := NewMessageQueueClient("localhost:8106", false, WithAPIKey("k1"))
+
+	t.Run("batches are produced and fetched by offset", func(t *testing.T) {
+		if _, err := httpClient.CreateTopic("MY_BINARY_TOPIC", server.TopicConfig{Partitions: 2}); err != nil {
+			t.Fatal(err)
+		}
+
+		requests := make([]server.PublishRequest, 6)
+		for i := range requests {
+			partition := i % 2
+			requests[i] = server.PublishRequest{
+				Body:      fmt.Sprintf("m%d", i),
+				Key:       "k",
+				Partition: &partition,
+				Headers:   map[string]string{"n": fmt.Sprint(i)},
+			}
+		}
+
+		responses, err := c.Produce("MY_BINARY_TOPIC", requests)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, responses, 6) {
+			assert.Equal(t, server.PublishResponse{Partition: 1, Offset: 2, MessageId: "MY_BINARY_TOPIC-1-2"}, responses[5])
+		}
+
+		fetched, err := c.Fetch("MY_BINARY_TOPIC", 0, 1, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 3, fetched.NextOffset)
+		if assert.Len(t, fetched.Messages, 2) {
+			msg := fetched.Messages[0]
+			assert.Equal(t, "MY_BINARY_TOPIC-0-1", msg.Id)
+			assert.Equal(t, 1, msg.Offset)
+			assert.Equal(t, "m2", msg.Value)
+			assert.Equal(t, "k", msg.Key)
+			assert.Equal(t, map[string]string{"n": "2"}, msg.Headers)
+			assert.False(t, msg.Timestamp.IsZero())
+		}
+
+		// the HTTP API sees the same messages
+		browsed, err := httpClient.BrowseMessages("MY_BINARY_TOPIC", 1, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, browsed.Messages, 3)
+	})
+
+	t.Run("requests of concurrent callers are pipelined", func(t *testing.T) {
+		var wg sync.WaitGroup
+		offsets := make(chan int, 200)
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				batch := make([]server.PublishRequest, 10)
+				for j := range batch {
+					batch[j] = server.PublishRequest{Body: "m"}
+				}
+				responses, err := c.Produce("MY_PIPELINED_TOPIC", batch)
+				if !assert.NoError(t, err) {
+					return
+				}
+				for _, r := range responses {
+					offsets <- r.Offset
+				}
+			}()
+		}
+		wg.Wait()
+		close(offsets)
+
+		// a batch is stored in order, and no two batches share an offset
+		seen := make(map[int]bool)
+		for offset := range offsets {
+			assert.False(t, seen[offset], "offset %d stored twice", offset)
+			seen[offset] = true
+		}
+		assert.Len(t, seen, 200)
+
+		fetched, err := c.Fetch("MY_PIPELINED_TOPIC", 0, 0, 1000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, fetched.Messages, 200)
+		assert.Equal(t, 200, fetched.NextOffset)
+	})
+
+	t.Run("acks and commits move the offsets of a group", func(t *testing.T) {
+		if _, err := c.Produce("MY_OFFSETS_TOPIC", make([]server.PublishRequest, 5)); err != nil {
+			t.Fatal(err)
+		}
+
+		committed := func() int {
+			lag, err := httpClient.GetLag("MY_OFFSETS_TOPIC")
+			if err != nil || len(lag.Groups) != 1 {
+				return -1
+			}
+			return lag.Groups[0].Partitions[0].CommittedOffset
+		}
+
+		// an ack out of order holds until the offsets before it are acked
+		assert.NoError(t, c.Ack("MY_OFFSETS_TOPIC", "g", 0, 1))
+		assert.Equal(t, 0, committed())
+		assert.NoError(t, c.Ack("MY_OFFSETS_TOPIC", "g", 0, 0))
+		assert.Equal(t, 2, committed())
+
+		assert.NoError(t, c.CommitOffset("MY_OFFSETS_TOPIC", "g", 0, 4))
+		assert.Equal(t, 4, committed())
+
+		// the messages every group committed are removed
+		fetched, err := c.Fetch("MY_OFFSETS_TOPIC", 0, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, fetched.Messages, 1) {
+			assert.Equal(t, 4, fetched.Messages[0].Offset)
+		}
+
+		var respErr *ResponseError
+		err = c.CommitOffset("MY_OFFSETS_TOPIC", "g", 0, 6)
+		if assert.True(t, errors.As(err, &respErr)) {
+			assert.Equal(t, http.StatusBadRequest, respErr.StatusCode)
+		}
+	})
+
+	t.Run("connections count against the connection quota of a namespace", func(t *testing.T) {
+		if _, err := httpClient.CreateNamespace("binary-team", server.NamespaceConfig{
+			Quotas: server.NamespaceQuotas{MaxConnections: 1},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		first := NewBinaryClient("localhost:8107", WithAPIKey("k1"), WithNamespace("binary-team"))
+		if _, err := first.Produce("events", []server.PublishRequest{{Body: "e"}}); err != nil {
+			t.Fatal(err)
+		}
+		// further requests of the same connection are not counted again
+		if _, err := first.Produce("events", []server.PublishRequest{{Body: "e"}}); err != nil {
+			t.Fatal(err)
+		}
+
+		second := NewBinaryClient("localhost:8107", WithAPIKey("k1"), WithNamespace("binary-team"))
+		defer second.Close()
+		var respErr *ResponseError
+		_, err := second.Produce("events", []server.PublishRequest{{Body: "e"}})
+		if assert.True(t, errors.As(err, &respErr)) {
+			assert.Equal(t, http.StatusTooManyRequests, respErr.StatusCode)
+		}
+
+		first.Close()
+		assert.Eventually(t, func() bool {
+			_, err := second.Produce("events", []server.PublishRequest{{Body: "e"}})
+			return err == nil
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("failures are reported per request and per message", func(t *testing.T) {
+		var respErr *ResponseError
+
+		_, err := NewBinaryClient("localhost:8107").Fetch("MY_BINARY_TOPIC", 0, 0, 10)
+		if assert.True(t, errors.As(err, &respErr)) {
+			assert.Equal(t, http.StatusUnauthorized, respErr.StatusCode)
+		}
+
+		_, err = NewBinaryClient("localhost:8107", WithAPIKey("k2")).Fetch("MY_BINARY_TOPIC", 0, 0, 10)
+		if assert.True(t, errors.As(err, &respErr)) {
+			assert.Equal(t, http.StatusUnauthorized, respErr.StatusCode)
+		}
+
+		_, err = c.Fetch("MY_MISSING_TOPIC", 0, 0, 10)
+		if assert.True(t, errors.As(err, &respErr)) {
+			assert.Equal(t, http.StatusNotFound, respErr.StatusCode)
+		}
+
+		invalid := 5
+		responses, err := c.Produce("MY_BINARY_TOPIC", []server.PublishRequest{
+			{Body: "a"},
+			{Body: "b", Partition: &invalid},
+			{Body: "c"},
+		})
+		var produceErr *ProduceError
+		if assert.True(t, errors.As(err, &produceErr)) && assert.Len(t, produceErr.Failed, 1) {
+			assert.Equal(t, http.StatusBadRequest, produceErr.Failed[1].StatusCode)
+		}
+		if assert.Len(t, responses, 3) {
+			assert.NotEmpty(t, responses[0].MessageId)
+			assert.Empty(t, responses[1].MessageId)
+			assert.NotEmpty(t, responses[2].MessageId)
+		}
+	})
+}
+
+func BenchmarkPublish(b *testing.B) {
+	s := server.NewServer(server.ServerConfig{
+		ServerAddr:      ":8108",
+		BinaryAddr:      ":8109",
+		MakeStorageFunc: storage.NewStorage,
+	})
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- s.Start()
+	}()
+	waitForServer(b, "localhost:8108")
+	waitForServer(b, "localhost:8109")
+	defer stopServer(b, s, stopped)
+
+	httpClient := NewMessageQueueClient("localhost:8108", false)
+	binaryClient := NewBinaryClient("localhost:8109")
+	defer binaryClient.Close()
+
+	request := server.PublishRequest{Body: "a message of about a hundred bytes, which is what most of the messages of the tests are"}
+
+	b.Run("http", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := httpClient.PublishMessage("BENCH_HTTP", request); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("http parallel", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if _, err := httpClient.PublishMessage("BENCH_HTTP_PARALLEL", request); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+
+	b.Run("binary", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := binaryClient.Produce("BENCH_BINARY", []server.PublishRequest{request}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("binary parallel", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				if _, err := binaryClient.Produce("BENCH_BINARY_PARALLEL", []server.PublishRequest{request}); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+
+	// b.N counts messages, sent in batches of 100
+	b.Run("binary batch", func(b *testing.B) {
+		batch := make([]server.PublishRequest, 100)
+		for i := range batch {
+			batch[i] = request
+		}
+		for sent := 0; sent < b.N; sent += len(batch) {
+			if _, err := binaryClient.Produce("BENCH_BINARY_BATCH", batch[:min(len(batch), b.N-sent)]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkFetch(b *testing.B) {
+	s := server.NewServer(server.ServerConfig{
+		ServerAddr:      ":8108",
+		BinaryAddr:      ":8109",
+		MakeStorageFunc: storage.NewStorage,
+	})
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- s.Start()
+	}()
+	waitForServer(b, "localhost:8108")
+	waitForServer(b, "localhost:8109")
+	defer stopServer(b, s, stopped)
+
+	httpClient := NewMessageQueueClient("localhost:8108", false)
+	binaryClient := NewBinaryClient("localhost:8109")
+	defer binaryClient.Close()
+
+	batch := make([]server.PublishRequest, 1000)
+	for i := range batch {
+		batch[i] = server.PublishRequest{Body: "a message of about a hundred bytes, which is what most of the messages of the tests are"}
+	}
+	if _, err := binaryClient.Produce("BENCH_FETCH", batch); err != nil {
+		b.Fatal(err)
+	}
+
+	// every iteration reads 100 messages
+	b.Run("http", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := httpClient.BrowseMessages("BENCH_FETCH", 0, (i%10)*100, 100); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("binary", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := binaryClient.Fetch("BENCH_FETCH", 0, (i%10)*100, 100); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -2,48 +2,134 @@ package client
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/mdkelley02/message-queue/server"
 )
 
+var (
+	errSubscriptionQuit  = errors.New("subscription was quit")
+	errSubscriptionLimit = errors.New("subscription reached its limit")
+)
+
 type IMessageQueueClient interface {
 	GetTopics() ([]string, error)
 	Publish(topic string, message string) (server.PublishResponse, error)
-	Subscribe(topic string, callback func(server.Delivery) error) (chan struct{}, error)
+	PublishMessage(topic string, request server.PublishRequest) (server.PublishResponse, error)
+	Subscribe(topic string, callback func(server.Delivery) error, opts ...SubscribeOption) (chan struct{}, error)
+	RegisterSchema(topic string, schema string) (server.SchemaResponse, error)
+	GetSchemas(topic string) (server.GetSchemasResponse, error)
+	SetSchemaCompatibility(topic string, compatibility string) error
+	Redrive(topic string, request server.RedriveRequest) (server.RedriveResponse, error)
+	CreateTopic(topic string, config server.TopicConfig) (server.TopicResponse, error)
+	GetTopic(topic string) (server.TopicResponse, error)
+	UpdateTopicConfig(topic string, config server.TopicConfig) (server.TopicResponse, error)
+	PurgeTopic(topic string) (int, error)
+	DeleteTopic(topic string) error
+	GetLag(topic string) (server.TopicLagResponse, error)
+	BrowseMessages(topic string, partition int, from int, limit int) (server.BrowseMessagesResponse, error)
+	GetMessage(topic string, messageId string) (server.MessageResponse, error)
+	WhoAmI() (server.Principal, error)
+	GetACLs() ([]server.ACLRule, error)
+	AddACL(rule server.ACLRule) (server.ACLRule, error)
+	DeleteACL(id string) error
+	GetNamespaces() ([]server.NamespaceResponse, error)
+	CreateNamespace(name string, config server.NamespaceConfig) (server.NamespaceResponse, error)
+	GetNamespace(name string) (server.NamespaceResponse, error)
+	UpdateNamespaceConfig(name string, config server.NamespaceConfig) (server.NamespaceResponse, error)
+	DeleteNamespace(name string) error
+	GetRateLimits() ([]server.RateLimiterResponse, error)
+	GetReplication() (server.ReplicationResponse, error)
+	Promote() (server.ReplicationResponse, error)
+	Follow(leader string) (server.ReplicationResponse, error)
+	GetCluster() (server.ClusterResponse, error)
+	AddClusterMember(id string, addr string) (server.ClusterResponse, error)
+	RemoveClusterMember(id string) (server.ClusterResponse, error)
+	GetMirrors() ([]server.MirrorStatus, error)
 }
 
 type MessageQueueClient struct {
+	// addr is the broker the client talks to, it moves to the leader when
+	// the client follows redirects
+	addrMu            sync.RWMutex
 	addr              string
+	followLeader      bool
 	deadLetterEnabled bool
+	httpClient        *http.Client
+	dialer            *websocket.Dialer
+	tlsConfig         *tls.Config
+	// header holds the credentials sent with every request
+	header http.Header
+	// namespace is the namespace of the topics the client uses, the default
+	// namespace when empty
+	namespace string
 }
 
-func NewMessageQueueClient(addr string, deadLetterEnabled bool) IMessageQueueClient {
-	return &MessageQueueClient{
+func NewMessageQueueClient(addr string, deadLetterEnabled bool, opts ...ClientOption) IMessageQueueClient {
+	c := &MessageQueueClient{
 		addr:              addr,
 		deadLetterEnabled: deadLetterEnabled,
+		httpClient:        http.DefaultClient,
+		dialer:            websocket.DefaultDialer,
+		header:            http.Header{},
+	}
+
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	// the transport adds h2 to the protocols of its config, which the
+	// websocket handshake must not offer, so each gets a copy
+	if c.tlsConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = c.tlsConfig.Clone()
+		c.httpClient = &http.Client{Transport: transport}
+
+		dialer := *websocket.DefaultDialer
+		dialer.TLSClientConfig = c.tlsConfig.Clone()
+		c.dialer = &dialer
 	}
+
+	return c
+}
+
+// url returns the address of path on the broker, using https when the
+// client is configured for TLS.
+func (c *MessageQueueClient) url(path string) string {
+	scheme := "http"
+	if c.tlsConfig != nil {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, c.broker(), c.namespacePath(path))
 }
 
 func (c *MessageQueueClient) GetTopics() ([]string, error) {
-	resp, err := http.Get(fmt.Sprintf("http://%s/topics", c.addr))
+	resp, err := c.do(http.MethodGet, "/topics", nil, "")
 	if err != nil {
-		slog.Error("could not get topics: %v", err)
+		slog.Error("could not get topics", "err", err)
 		return nil, err
 	}
+	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		slog.Error("could not get topics: %v", err)
+	if err := checkResponse(resp); err != nil {
+		slog.Error("could not get topics", "err", err)
 		return nil, err
 	}
 
 	var response server.GetTopicsResponse
 	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		slog.Error("could not get topics: %v", err)
+		slog.Error("could not get topics", "err", err)
 		return nil, err
 	}
 
@@ -51,73 +137,313 @@ func (c *MessageQueueClient) GetTopics() ([]string, error) {
 }
 
 func (c *MessageQueueClient) Publish(topic string, message string) (server.PublishResponse, error) {
-	request, err := json.Marshal(server.PublishRequest{
+	return c.PublishMessage(topic, server.PublishRequest{
 		Body: message,
 	})
+}
+
+// PublishMessage publishes request to topic, letting the caller pick the
+// partition or the key used to choose it. The message joins the trace of
+// req.Trace when it is set.
+func (c *MessageQueueClient) PublishMessage(topic string, req server.PublishRequest) (server.PublishResponse, error) {
+	request, err := json.Marshal(req)
 	if err != nil {
-		slog.Error("could not marshal request: %v", err)
+		slog.Error("could not marshal request", "err", err)
 		return server.PublishResponse{}, err
 	}
 
-	resp, err := http.Post(fmt.Sprintf("http://%s/topics/%s", c.addr, topic), "application/json", bytes.NewReader(request))
+	httpReq, err := c.newRequest(http.MethodPost, fmt.Sprintf("/topics/%s", topic), bytes.NewReader(request), "application/json")
 	if err != nil {
-		slog.Error("could not marshal request: %v", err)
+		slog.Error("could not create request", "err", err)
+		return server.PublishResponse{}, err
+	}
+	req.Trace.Inject(httpReq.Header)
+
+	resp, err := c.send(httpReq)
+	if err != nil {
+		slog.Error("could not marshal request", "err", err)
+		return server.PublishResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		slog.Error("could not publish message", "err", err)
 		return server.PublishResponse{}, err
 	}
 
 	var response server.PublishResponse
 	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-		slog.Error("could not publish message: %v", err)
+		slog.Error("could not publish message", "err", err)
 		return server.PublishResponse{}, err
 	}
 
 	if err != nil {
-		slog.Error("could not publish message: %v", err)
+		slog.Error("could not publish message", "err", err)
 		return server.PublishResponse{}, err
 	}
 
 	return response, nil
 }
 
-func (c *MessageQueueClient) Subscribe(topic string, callback func(server.Delivery) error) (chan struct{}, error) {
-	return c.subscribeWithConn(topic, func(conn *websocket.Conn) {
+func (c *MessageQueueClient) Subscribe(topic string, callback func(server.Delivery) error, opts ...SubscribeOption) (chan struct{}, error) {
+	options := subscribeOptions{}
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	handled := 0
+	return c.subscribeWithConn(topic, options, func(conn *websocket.Conn) error {
 		var message server.Delivery
 		if err := conn.ReadJSON(&message); err != nil {
-			slog.Error("could not read message: %v", err)
-			return
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				slog.Error("could not read message", "err", err)
+			}
+			return err
+		}
+
+		response := server.DeliveryResponse{
+			MessageId: message.MessageId,
+			Ack:       true,
 		}
 
 		if err := callback(message); err != nil {
-			slog.Error("could not process message: %v", err)
+			slog.Error("could not process message", "err", err)
+			response.Ack = false
+			response.Err = err.Error()
 
 			if c.deadLetterEnabled {
-				if _, err := c.Publish(fmt.Sprintf("%s.deadletter", topic), message.Value); err != nil {
-					slog.Error("could not publish message to dead letter queue: %v", err)
+				if _, err := c.PublishMessage(server.DeadLetterTopic(message.Topic), server.PublishRequest{
+					Body:  message.Value,
+					Key:   message.Key,
+					Trace: message.TraceContext,
+				}); err != nil {
+					slog.Error("could not publish message to dead letter queue", "err", err)
+				} else {
+					// the message is safe in the dead letter queue, so it must
+					// not be redelivered
+					response.Ack = true
 				}
 			}
 		}
+
+		if message.AckRequired {
+			if err := conn.WriteJSON(response); err != nil {
+				slog.Error("could not acknowledge message", "err", err)
+				return err
+			}
+		}
+
+		handled++
+		if options.limit > 0 && handled >= options.limit {
+			return errSubscriptionLimit
+		}
+		return nil
 	})
 }
 
-func (c *MessageQueueClient) subscribeWithConn(topic string, callback func(*websocket.Conn)) (chan struct{}, error) {
-	conn, _, err := websocket.DefaultDialer.Dial(fmt.Sprintf("ws://%s/topics/%s/subscribe", c.addr, topic), nil)
+// Redrive moves messages from the dead letter topic of topic back to topic,
+// or to request.Destination when it is set.
+func (c *MessageQueueClient) Redrive(topic string, request server.RedriveRequest) (server.RedriveResponse, error) {
+	var response server.RedriveResponse
+	if err := c.doJSON(http.MethodPost, fmt.Sprintf("/topics/%s/redrive", topic), request, &response); err != nil {
+		slog.Error("could not redrive topic", "err", err)
+		return server.RedriveResponse{}, err
+	}
+
+	return response, nil
+}
+
+func (c *MessageQueueClient) subscribeWithConn(topic string, options subscribeOptions, callback func(*websocket.Conn) error) (chan struct{}, error) {
+	scheme := "ws"
+	if c.tlsConfig != nil {
+		scheme = "wss"
+	}
+
+	u := url.URL{
+		Scheme:   scheme,
+		Host:     c.broker(),
+		Path:     c.namespacePath(fmt.Sprintf("/topics/%s/subscribe", topic)),
+		RawQuery: options.query().Encode(),
+	}
+
+	conn, resp, err := c.dialer.Dial(u.String(), c.header)
+	if resp != nil && c.redirect(resp) {
+		u.Host = c.broker()
+		conn, resp, err = c.dialer.Dial(u.String(), c.header)
+	}
 	if err != nil {
-		slog.Error("could not subscribe: %v", err)
+		if resp != nil {
+			// report why the broker refused the upgrade
+			if respErr := checkResponse(resp); respErr != nil {
+				err = respErr
+			}
+		}
+		slog.Error("could not subscribe", "err", err)
 		return nil, err
 	}
 
 	quit := make(chan struct{})
+	done := make(chan struct{})
+
+	// closing the connection unblocks a pending read when quit fires
+	go func() {
+		select {
+		case <-quit:
+			conn.Close()
+		case <-done:
+		}
+	}()
 
 	go func() {
-		for {
+		defer close(done)
+		defer conn.Close()
+
+		var err error
+		for err == nil {
 			select {
 			case <-quit:
-				return
+				err = errSubscriptionQuit
+			default:
+				err = callback(conn)
+			}
+		}
+
+		select {
+		case <-quit:
+			// the read failed because quit closed the connection
+			err = nil
+		default:
+		}
+		if errors.Is(err, errSubscriptionLimit) {
+			err = nil
+		}
+		if options.done != nil {
+			select {
+			case options.done <- err:
 			default:
-				callback(conn)
 			}
 		}
 	}()
 
 	return quit, nil
 }
+
+// doJSON sends body as JSON to the broker and decodes the response into out
+// when out is not nil.
+func (c *MessageQueueClient) doJSON(method string, path string, body any, out any) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	contentType := ""
+	if body != nil {
+		contentType = "application/json"
+	}
+
+	resp, err := c.do(method, path, reader, contentType)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkResponse(resp); err != nil {
+		return err
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// do sends a request with the credentials of the client.
+func (c *MessageQueueClient) do(method string, path string, body io.Reader, contentType string) (*http.Response, error) {
+	req, err := c.newRequest(method, path, body, contentType)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.send(req)
+}
+
+// send sends req and, when the client follows redirects, sends it once more
+// to the leader if the broker is not the leader.
+func (c *MessageQueueClient) send(req *http.Request) (*http.Response, error) {
+	resp, err := c.httpClient.Do(req)
+	if err != nil || !c.redirect(resp) {
+		return resp, err
+	}
+	resp.Body.Close()
+
+	retry := req.Clone(req.Context())
+	retry.URL.Host = c.broker()
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+
+	return c.httpClient.Do(retry)
+}
+
+// newRequest creates a request with the credentials of the client.
+func (c *MessageQueueClient) newRequest(method string, path string, body io.Reader, contentType string) (*http.Request, error) {
+	req, err := http.NewRequest(method, c.url(path), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range c.header {
+		req.Header[name] = values
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	return req, nil
+}
+
+// ResponseError is returned when the broker answers with a non-2xx status.
+// Errors holds the individual validation failures when the broker sent them.
+// RetryAfter is set when a rate limit was hit, Leader when a follower
+// refused a request only its leader serves.
+type ResponseError struct {
+	StatusCode int
+	Message    string
+	Errors     []string
+	RetryAfter time.Duration
+	Leader     string
+}
+
+func (e *ResponseError) Error() string {
+	if len(e.Errors) > 0 {
+		return fmt.Sprintf("%d: %s: %v", e.StatusCode, e.Message, e.Errors)
+	}
+	return fmt.Sprintf("%d: %s", e.StatusCode, e.Message)
+}
+
+func checkResponse(resp *http.Response) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+
+	respErr := &ResponseError{StatusCode: resp.StatusCode, Message: string(bytes.TrimSpace(body)), Leader: resp.Header.Get(server.LeaderHeader)}
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		respErr.RetryAfter = time.Duration(seconds) * time.Second
+	}
+
+	var errResp server.ErrorResponse
+	if err := json.Unmarshal(body, &errResp); err == nil && errResp.Error != "" {
+		respErr.Message = errResp.Error
+		respErr.Errors = errResp.Errors
+	}
+
+	return respErr
+}
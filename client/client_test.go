@@ -1,6 +1,10 @@
 package client
 
 import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
 	"testing"
 	"time"
 
@@ -15,11 +19,12 @@ func Test_integration(t *testing.T) {
 		ServerAddr:      ":8080",
 		MakeStorageFunc: storage.NewStorage,
 	})
+	stopped := make(chan error, 1)
 	go func() {
-		if err := s.Start(); err != nil {
-			panic(err)
-		}
+		stopped <- s.Start()
 	}()
+	waitForServer(t, "localhost:8080")
+	defer stopServer(t, s, stopped)
 
 	t.Run("topic is upserted if it does not exist, topic is found in GetTopics response after creation", func(t *testing.T) {
 		topic := "MY_TOPIC_1"
@@ -64,4 +69,735 @@ func Test_integration(t *testing.T) {
 
 		time.Sleep(100 * time.Millisecond)
 	})
+
+	t.Run("messages that do not match the topic schema are rejected and valid ones carry the schema id", func(t *testing.T) {
+		topic := "MY_TOPIC_3"
+		client := NewMessageQueueClient("localhost:8080", false)
+
+		registered, err := client.RegisterSchema(topic, `{
+			"type": "object",
+			"properties": {"id": {"type": "integer"}},
+			"required": ["id"]
+		}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = client.Publish(topic, `{"name": "missing id"}`)
+
+		var respErr *ResponseError
+		if !errors.As(err, &respErr) {
+			t.Fatalf("expected response error, got %v", err)
+		}
+		assert.Equal(t, http.StatusUnprocessableEntity, respErr.StatusCode)
+		assert.Equal(t, []string{`$: missing required property "id"`}, respErr.Errors)
+
+		_, err = client.RegisterSchema(topic, `{
+			"type": "object",
+			"properties": {"id": {"type": "integer"}},
+			"required": ["id", "name"]
+		}`)
+		if !errors.As(err, &respErr) {
+			t.Fatalf("expected response error, got %v", err)
+		}
+		assert.Equal(t, http.StatusConflict, respErr.StatusCode)
+
+		received := make(chan server.Delivery, 1)
+		if _, err := client.Subscribe(topic, func(d server.Delivery) error {
+			received <- d
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := client.Publish(topic, `{"id": 1}`); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case d := <-received:
+			assert.Equal(t, registered.Id, d.SchemaId)
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for delivery")
+		}
+	})
+
+	t.Run("dead lettered messages are redriven to the destination topic", func(t *testing.T) {
+		topic := "MY_TOPIC_4"
+		destination := "MY_TOPIC_4.retry"
+		client := NewMessageQueueClient("localhost:8080", false)
+
+		if _, err := client.RegisterSchema(destination, `{"type": "object"}`); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, msg := range []string{`{"n": 1}`, `{"n": 2}`, `not json`, `{"n": 3}`} {
+			if _, err := client.Publish(server.DeadLetterTopic(topic), msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		resp, err := client.Redrive(topic, server.RedriveRequest{
+			Destination: destination,
+			FromOffset:  1,
+			RateLimit:   100,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, server.DeadLetterTopic(topic), resp.Source)
+		assert.Equal(t, 2, resp.Moved)
+		assert.Equal(t, 1, resp.Failed)
+
+		// the failed message stays in the dead letter topic and can be filtered out
+		resp, err = client.Redrive(topic, server.RedriveRequest{
+			Destination: destination,
+			Filter:      `"n"`,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, 1, resp.Moved)
+		assert.Equal(t, 0, resp.Failed)
+
+		// a rate too high to throttle is refused
+		_, err = client.Redrive(topic, server.RedriveRequest{RateLimit: 3e9})
+		var respErr *ResponseError
+		if assert.True(t, errors.As(err, &respErr)) {
+			assert.Equal(t, http.StatusBadRequest, respErr.StatusCode)
+		}
+
+		received := make(chan string, 3)
+		if _, err := client.Subscribe(destination, func(d server.Delivery) error {
+			received <- d.Value
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		values := make([]string, 0, 3)
+		for len(values) < 3 {
+			select {
+			case v := <-received:
+				values = append(values, v)
+			case <-time.After(time.Second):
+				t.Fatalf("timed out waiting for redriven messages, got %v", values)
+			}
+		}
+
+		assert.ElementsMatch(t, []string{`{"n": 1}`, `{"n": 2}`, `{"n": 3}`}, values)
+	})
+
+	t.Run("topics can be created, configured, purged and deleted", func(t *testing.T) {
+		topic := "MY_TOPIC_5"
+		client := NewMessageQueueClient("localhost:8080", false)
+
+		created, err := client.CreateTopic(topic, server.TopicConfig{
+			DeliveryMode: server.DeliveryAtLeastOnce,
+			MaxSize:      2,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, server.StorageMemory, created.Config.Storage)
+
+		_, err = client.CreateTopic(topic, server.TopicConfig{})
+		var respErr *ResponseError
+		if !errors.As(err, &respErr) {
+			t.Fatalf("expected response error, got %v", err)
+		}
+		assert.Equal(t, http.StatusConflict, respErr.StatusCode)
+
+		for _, msg := range []string{"a", "b"} {
+			if _, err := client.Publish(topic, msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		_, err = client.Publish(topic, "c")
+		if !errors.As(err, &respErr) {
+			t.Fatalf("expected response error, got %v", err)
+		}
+		assert.Equal(t, http.StatusInsufficientStorage, respErr.StatusCode)
+
+		updated, err := client.UpdateTopicConfig(topic, server.TopicConfig{
+			DeliveryMode: server.DeliveryAtLeastOnce,
+			Retention:    server.Duration(time.Hour),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, server.Duration(time.Hour), updated.Config.Retention)
+		assert.Equal(t, 2, updated.Depth)
+
+		purged, err := client.PurgeTopic(topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 2, purged)
+
+		// a nacked message is redelivered and only removed once acked
+		received := make(chan string, 2)
+		attempts := 0
+		if _, err := client.Subscribe(topic, func(d server.Delivery) error {
+			attempts++
+			received <- d.Value
+			if attempts == 1 {
+				return errors.New("not yet")
+			}
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := client.Publish(topic, "d"); err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 2; i++ {
+			select {
+			case v := <-received:
+				assert.Equal(t, "d", v)
+			case <-time.After(time.Second):
+				t.Fatal("timed out waiting for delivery")
+			}
+		}
+
+		assert.Eventually(t, func() bool {
+			info, err := client.GetTopic(topic)
+			return err == nil && info.Depth == 0 && info.Subscribers == 1
+		}, time.Second, 10*time.Millisecond)
+
+		if err := client.DeleteTopic(topic); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = client.GetTopic(topic)
+		if !errors.As(err, &respErr) {
+			t.Fatalf("expected response error, got %v", err)
+		}
+		assert.Equal(t, http.StatusNotFound, respErr.StatusCode)
+	})
+
+	t.Run("a subscription stops at its limit and reports when the server ends it", func(t *testing.T) {
+		topic := "MY_TOPIC_10"
+		client := NewMessageQueueClient("localhost:8080", false)
+
+		if _, err := client.CreateTopic(topic, server.TopicConfig{DeliveryMode: server.DeliveryAtLeastOnce}); err != nil {
+			t.Fatal(err)
+		}
+		for _, msg := range []string{"a", "b", "c"} {
+			if _, err := client.Publish(topic, msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		received := make(chan string, 3)
+		done := make(chan error, 1)
+		if _, err := client.Subscribe(topic, func(d server.Delivery) error {
+			received <- d.Value
+			return nil
+		}, WithLimit(2), WithDone(done)); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case err := <-done:
+			assert.NoError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("subscription did not stop at its limit")
+		}
+		assert.Equal(t, "a", <-received)
+		assert.Equal(t, "b", <-received)
+
+		// the message past the limit was not taken from the broker
+		assert.Eventually(t, func() bool {
+			info, err := client.GetTopic(topic)
+			return err == nil && info.Depth == 1 && info.Subscribers == 0
+		}, time.Second, 10*time.Millisecond)
+
+		if _, err := client.Subscribe(topic, func(d server.Delivery) error {
+			received <- d.Value
+			return nil
+		}, WithDone(done)); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "c", <-received)
+
+		if err := client.DeleteTopic(topic); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case err := <-done:
+			assert.Error(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("subscription did not report its end")
+		}
+	})
+
+	t.Run("messages are partitioned by key and subscribers can pick partitions", func(t *testing.T) {
+		topic := "MY_TOPIC_6"
+		client := NewMessageQueueClient("localhost:8080", false)
+
+		if _, err := client.CreateTopic(topic, server.TopicConfig{Partitions: 3}); err != nil {
+			t.Fatal(err)
+		}
+
+		first, err := client.PublishMessage(topic, server.PublishRequest{Body: "k1", Key: "customer-1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		second, err := client.PublishMessage(topic, server.PublishRequest{Body: "k2", Key: "customer-1"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, first.Partition, second.Partition)
+		assert.Equal(t, first.Offset+1, second.Offset)
+
+		explicit := (first.Partition + 1) % 3
+		pinned, err := client.PublishMessage(topic, server.PublishRequest{Body: "pinned", Partition: &explicit})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, explicit, pinned.Partition)
+		assert.Equal(t, 0, pinned.Offset)
+
+		invalid := 3
+		_, err = client.PublishMessage(topic, server.PublishRequest{Body: "nope", Partition: &invalid})
+		var respErr *ResponseError
+		if !errors.As(err, &respErr) {
+			t.Fatalf("expected response error, got %v", err)
+		}
+		assert.Equal(t, http.StatusBadRequest, respErr.StatusCode)
+
+		received := make(chan server.Delivery, 3)
+		if _, err := client.Subscribe(topic, func(d server.Delivery) error {
+			received <- d
+			return nil
+		}, WithPartitions(explicit)); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case d := <-received:
+			assert.Equal(t, "pinned", d.Value)
+			assert.Equal(t, explicit, d.Partition)
+			assert.Equal(t, pinned.MessageId, d.MessageId)
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for delivery")
+		}
+
+		select {
+		case d := <-received:
+			t.Fatalf("unexpected delivery from partition %d", d.Partition)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		info, err := client.GetTopic(topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 2, info.Partitions[first.Partition].Depth)
+		assert.Equal(t, 0, info.Partitions[explicit].Depth)
+	})
+
+	t.Run("every consumer group receives each message and reports its lag", func(t *testing.T) {
+		topic := "MY_TOPIC_7"
+		client := NewMessageQueueClient("localhost:8080", false)
+
+		if _, err := client.CreateTopic(topic, server.TopicConfig{DeliveryMode: server.DeliveryAtLeastOnce}); err != nil {
+			t.Fatal(err)
+		}
+
+		release := make(chan struct{})
+		slow := make(chan string, 3)
+		if _, err := client.Subscribe(topic, func(d server.Delivery) error {
+			<-release
+			slow <- d.Value
+			return nil
+		}, WithGroup("slow")); err != nil {
+			t.Fatal(err)
+		}
+
+		fast := make(chan string, 3)
+		if _, err := client.Subscribe(topic, func(d server.Delivery) error {
+			fast <- d.Value
+			return nil
+		}, WithGroup("fast")); err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Eventually(t, func() bool {
+			info, err := client.GetTopic(topic)
+			return err == nil && info.Subscribers == 2
+		}, time.Second, 10*time.Millisecond)
+
+		for _, msg := range []string{"a", "b", "c"} {
+			if _, err := client.Publish(topic, msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for i := 0; i < 3; i++ {
+			select {
+			case <-fast:
+			case <-time.After(time.Second):
+				t.Fatal("timed out waiting for delivery")
+			}
+		}
+
+		var slowLag server.GroupLagResponse
+		assert.Eventually(t, func() bool {
+			lag, err := client.GetLag(topic)
+			if err != nil || len(lag.Groups) != 2 {
+				return false
+			}
+			slowLag = lag.Groups[1]
+			return lag.Groups[0].Group == "fast" && lag.Groups[0].Lag == 0 && slowLag.InFlight == 1
+		}, time.Second, 10*time.Millisecond)
+
+		assert.Equal(t, "slow", slowLag.Group)
+		assert.Equal(t, 3, slowLag.Lag)
+		assert.Equal(t, 3, slowLag.Partitions[0].HighWatermark)
+		assert.Equal(t, 0, slowLag.Partitions[0].CommittedOffset)
+		assert.Greater(t, slowLag.OldestUnackedAge, 0.0)
+
+		// messages stay stored until the slowest group has acknowledged them
+		info, err := client.GetTopic(topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 3, info.Depth)
+
+		close(release)
+		for i := 0; i < 3; i++ {
+			select {
+			case <-slow:
+			case <-time.After(time.Second):
+				t.Fatal("timed out waiting for delivery")
+			}
+		}
+
+		assert.Eventually(t, func() bool {
+			lag, err := client.GetLag(topic)
+			info, infoErr := client.GetTopic(topic)
+			return err == nil && infoErr == nil && lag.Groups[1].Lag == 0 && lag.Groups[1].Partitions[0].CommittedOffset == 3 && info.Depth == 0
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("stored messages can be browsed and looked up without consuming them", func(t *testing.T) {
+		topic := "MY_TOPIC_8"
+		client := NewMessageQueueClient("localhost:8080", false)
+
+		if _, err := client.CreateTopic(topic, server.TopicConfig{DeliveryMode: server.DeliveryAtLeastOnce}); err != nil {
+			t.Fatal(err)
+		}
+
+		published := make([]server.PublishResponse, 0, 5)
+		for i := 0; i < 5; i++ {
+			resp, err := client.PublishMessage(topic, server.PublishRequest{Body: fmt.Sprintf("m%d", i), Key: "k"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			published = append(published, resp)
+		}
+
+		page, err := client.BrowseMessages(topic, 0, 1, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 3, page.NextOffset)
+		assert.Equal(t, []string{"m1", "m2"}, []string{page.Messages[0].Value, page.Messages[1].Value})
+
+		page, err = client.BrowseMessages(topic, 0, page.NextOffset, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 5, page.NextOffset)
+		assert.Len(t, page.Messages, 2)
+
+		// hold the first delivery so it stays in flight
+		release := make(chan struct{})
+		if _, err := client.Subscribe(topic, func(d server.Delivery) error {
+			<-release
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		defer close(release)
+
+		var msg server.MessageResponse
+		assert.Eventually(t, func() bool {
+			msg, err = client.GetMessage(topic, published[0].MessageId)
+			return err == nil && len(msg.Delivery) == 1 && msg.Delivery[0].State == server.DeliveryStateInFlight
+		}, time.Second, 10*time.Millisecond)
+
+		assert.Equal(t, "m0", msg.Value)
+		assert.Equal(t, "k", msg.Key)
+		assert.Equal(t, server.DefaultGroup, msg.Delivery[0].Group)
+
+		msg, err = client.GetMessage(topic, published[1].MessageId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, server.DeliveryStatePending, msg.Delivery[0].State)
+
+		// browsing did not consume anything
+		lag, err := client.GetLag(topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 5, lag.Groups[0].Lag)
+		assert.Equal(t, 1, lag.Groups[0].InFlight)
+
+		_, err = client.GetMessage(topic, topic+"-0-99")
+		var respErr *ResponseError
+		if !errors.As(err, &respErr) {
+			t.Fatalf("expected response error, got %v", err)
+		}
+		assert.Equal(t, http.StatusNotFound, respErr.StatusCode)
+	})
+
+	t.Run("nacked messages are retried with backoff and dead lettered once attempts run out", func(t *testing.T) {
+		topic := "MY_TOPIC_9"
+		client := NewMessageQueueClient("localhost:8080", false)
+
+		if _, err := client.CreateTopic(topic, server.TopicConfig{
+			DeliveryMode: server.DeliveryAtLeastOnce,
+			Retry: &server.RetryPolicy{
+				InitialDelay: server.Duration(50 * time.Millisecond),
+				Multiplier:   2,
+				MaxAttempts:  3,
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		type attempt struct {
+			n  int
+			at time.Time
+		}
+		received := make(chan attempt, 3)
+		if _, err := client.Subscribe(topic, func(d server.Delivery) error {
+			received <- attempt{n: d.Attempt, at: time.Now()}
+			return errors.New("downstream unavailable")
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := client.Publish(topic, "a"); err != nil {
+			t.Fatal(err)
+		}
+
+		attempts := make([]attempt, 0, 3)
+		for i := 0; i < 3; i++ {
+			select {
+			case a := <-received:
+				attempts = append(attempts, a)
+			case <-time.After(2 * time.Second):
+				t.Fatal("timed out waiting for delivery")
+			}
+		}
+
+		assert.Equal(t, []int{1, 2, 3}, []int{attempts[0].n, attempts[1].n, attempts[2].n})
+		assert.GreaterOrEqual(t, attempts[1].at.Sub(attempts[0].at), 50*time.Millisecond)
+		assert.GreaterOrEqual(t, attempts[2].at.Sub(attempts[1].at), 100*time.Millisecond)
+
+		var page server.BrowseMessagesResponse
+		assert.Eventually(t, func() bool {
+			var err error
+			page, err = client.BrowseMessages(server.DeadLetterTopic(topic), 0, 0, 10)
+			return err == nil && len(page.Messages) == 1
+		}, time.Second, 10*time.Millisecond)
+		assert.Equal(t, "a", page.Messages[0].Value)
+
+		lag, err := client.GetLag(topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 0, lag.Groups[0].Lag)
+
+		select {
+		case a := <-received:
+			t.Fatalf("unexpected delivery attempt %d after dead lettering", a.n)
+		case <-time.After(200 * time.Millisecond):
+		}
+	})
+}
+
+func Test_topicPersistence(t *testing.T) {
+	dataDir := t.TempDir()
+	topic := "MY_PERSISTENT_TOPIC"
+
+	first := server.NewServer(server.ServerConfig{
+		ServerAddr:      ":8082",
+		DataDir:         dataDir,
+		MakeStorageFunc: storage.NewStorage,
+	})
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- first.Start()
+	}()
+	waitForServer(t, "localhost:8082")
+
+	client := NewMessageQueueClient("localhost:8082", false)
+	if _, err := client.CreateTopic(topic, server.TopicConfig{
+		Storage:   server.StorageFile,
+		Retention: server.Duration(time.Hour),
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, msg := range []string{"a", "b", "c"} {
+		if _, err := client.Publish(topic, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stopServer(t, first, stopped)
+
+	second := server.NewServer(server.ServerConfig{
+		ServerAddr:      ":8083",
+		DataDir:         dataDir,
+		MakeStorageFunc: storage.NewStorage,
+	})
+	go second.Start()
+	waitForServer(t, "localhost:8083")
+	defer second.Stop()
+
+	client = NewMessageQueueClient("localhost:8083", false)
+	info, err := client.GetTopic(topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, server.StorageFile, info.Config.Storage)
+	assert.Equal(t, server.Duration(time.Hour), info.Config.Retention)
+	assert.Equal(t, 3, info.Depth)
+	assert.Equal(t, 3, info.Partitions[0].HighWatermark)
+}
+
+func Test_gracefulShutdown(t *testing.T) {
+	start := func(addr string, timeout time.Duration) (*server.Server, chan error) {
+		s := server.NewServer(server.ServerConfig{
+			ServerAddr:      addr,
+			MakeStorageFunc: storage.NewStorage,
+			ShutdownTimeout: timeout,
+		})
+		stopped := make(chan error, 1)
+		go func() {
+			stopped <- s.Start()
+		}()
+		waitForServer(t, "localhost"+addr)
+		return s, stopped
+	}
+
+	// subscribe delivers every message to received and acknowledges it once
+	// release is closed
+	subscribe := func(client IMessageQueueClient, topic string, release chan struct{}) chan string {
+		if _, err := client.CreateTopic(topic, server.TopicConfig{DeliveryMode: server.DeliveryAtLeastOnce}); err != nil {
+			t.Fatal(err)
+		}
+
+		received := make(chan string, 2)
+		if _, err := client.Subscribe(topic, func(d server.Delivery) error {
+			received <- d.Value
+			<-release
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, msg := range []string{"a", "b"} {
+			if _, err := client.Publish(topic, msg); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		select {
+		case v := <-received:
+			assert.Equal(t, "a", v)
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for delivery")
+		}
+
+		return received
+	}
+
+	t.Run("in-flight deliveries are acknowledged before the server stops", func(t *testing.T) {
+		s, stopped := start(":8084", 5*time.Second)
+		client := NewMessageQueueClient("localhost:8084", false)
+
+		release := make(chan struct{})
+		received := subscribe(client, "MY_DRAINED_TOPIC", release)
+
+		s.Stop()
+
+		assert.Eventually(t, func() bool {
+			_, err := client.Publish("MY_DRAINED_TOPIC", "c")
+			return err != nil
+		}, time.Second, 10*time.Millisecond)
+
+		select {
+		case err := <-stopped:
+			t.Fatalf("server stopped with a delivery in flight: %v", err)
+		case <-time.After(100 * time.Millisecond):
+		}
+
+		close(release)
+
+		select {
+		case err := <-stopped:
+			assert.NoError(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for shutdown")
+		}
+
+		// nothing new is claimed once shutdown started
+		assert.Empty(t, received)
+	})
+
+	t.Run("shutdown gives up on unacknowledged deliveries after the timeout", func(t *testing.T) {
+		s, stopped := start(":8085", 100*time.Millisecond)
+		client := NewMessageQueueClient("localhost:8085", false)
+
+		release := make(chan struct{})
+		defer close(release)
+		subscribe(client, "MY_STUCK_TOPIC", release)
+
+		s.Stop()
+
+		select {
+		case <-stopped:
+		case <-time.After(2 * time.Second):
+			t.Fatal("timed out waiting for shutdown")
+		}
+	})
+}
+
+// stopServer stops s and waits for Start to return. Idle client connections
+// are closed first, the server would otherwise wait for them to send a
+// request.
+func stopServer(t testing.TB, s *server.Server, stopped <-chan error) {
+	http.DefaultClient.CloseIdleConnections()
+	s.Stop()
+	if err := <-stopped; err != nil {
+		t.Error(err)
+	}
+}
+
+func waitForServer(t testing.TB, addr string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("server at %s did not start", addr)
 }
@@ -0,0 +1,80 @@
+package client
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+
+	"github.com/mdkelley02/message-queue/server"
+)
+
+// WithLeaderRedirects makes the client follow a broker that is not the
+// leader to the leader it names. The client sends the request again to the
+// leader and keeps talking to it from then on.
+func WithLeaderRedirects() ClientOption {
+	return func(c *MessageQueueClient) {
+		c.followLeader = true
+	}
+}
+
+func (c *MessageQueueClient) broker() string {
+	c.addrMu.RLock()
+	defer c.addrMu.RUnlock()
+
+	return c.addr
+}
+
+// redirect moves the client to the leader named by resp, it reports
+// whether it did.
+func (c *MessageQueueClient) redirect(resp *http.Response) bool {
+	if !c.followLeader || resp.StatusCode != http.StatusMisdirectedRequest {
+		return false
+	}
+
+	leader, err := url.Parse(resp.Header.Get(server.LeaderHeader))
+	if err != nil || leader.Host == "" {
+		return false
+	}
+
+	c.addrMu.Lock()
+	defer c.addrMu.Unlock()
+
+	slog.Info("following the broker to its leader", "broker", c.addr, "leader", leader.Host)
+	c.addr = leader.Host
+	return true
+}
+
+// GetCluster returns the state of the cluster of the broker.
+func (c *MessageQueueClient) GetCluster() (server.ClusterResponse, error) {
+	var response server.ClusterResponse
+	if err := c.doJSON(http.MethodGet, "/cluster", nil, &response); err != nil {
+		slog.Error("could not get cluster state", "err", err)
+		return server.ClusterResponse{}, err
+	}
+
+	return response, nil
+}
+
+// AddClusterMember adds the broker id serving at the addr URL to the
+// cluster, or moves it to addr.
+func (c *MessageQueueClient) AddClusterMember(id string, addr string) (server.ClusterResponse, error) {
+	var response server.ClusterResponse
+	if err := c.doJSON(http.MethodPost, "/cluster/members", server.ClusterMember{Id: id, Addr: addr}, &response); err != nil {
+		slog.Error("could not add cluster member", "err", err)
+		return server.ClusterResponse{}, err
+	}
+
+	return response, nil
+}
+
+// RemoveClusterMember removes the broker id from the cluster.
+func (c *MessageQueueClient) RemoveClusterMember(id string) (server.ClusterResponse, error) {
+	var response server.ClusterResponse
+	if err := c.doJSON(http.MethodDelete, fmt.Sprintf("/cluster/members/%s", id), nil, &response); err != nil {
+		slog.Error("could not remove cluster member", "err", err)
+		return server.ClusterResponse{}, err
+	}
+
+	return response, nil
+}
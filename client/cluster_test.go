@@ -0,0 +1,314 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mdkelley02/message-queue/server"
+	"github.com/mdkelley02/message-queue/storage"
+)
+
+func Test_cluster(t *testing.T) {
+	members := []server.ClusterMember{
+		{Id: "a", Addr: "http://localhost:8100"},
+		{Id: "b", Addr: "http://localhost:8101"},
+		{Id: "c", Addr: "http://localhost:8102"},
+	}
+
+	type node struct {
+		s       *server.Server
+		stopped chan error
+		addr    string
+		client  IMessageQueueClient
+	}
+
+	// nodes are the running members of the cluster
+	nodes := make(map[string]*node)
+	start := func(id string, port int) {
+		s := server.NewServer(server.ServerConfig{
+			ServerAddr:      fmt.Sprintf(":%d", port),
+			MakeStorageFunc: storage.NewStorage,
+			Replication: &server.ReplicationConfig{
+				NodeId:       id,
+				LagTimeout:   time.Second,
+				AckTimeout:   time.Second,
+				SyncInterval: 50 * time.Millisecond,
+			},
+			Cluster: &server.ClusterConfig{
+				Members:           members,
+				HeartbeatInterval: 50 * time.Millisecond,
+				ElectionTimeout:   300 * time.Millisecond,
+			},
+		})
+		stopped := make(chan error, 1)
+		go func() {
+			stopped <- s.Start()
+		}()
+
+		addr := fmt.Sprintf("localhost:%d", port)
+		waitForServer(t, addr)
+		nodes[id] = &node{s: s, stopped: stopped, addr: addr, client: NewMessageQueueClient(addr, false)}
+	}
+	stop := func(id string) {
+		stopServer(t, nodes[id].s, nodes[id].stopped)
+		delete(nodes, id)
+	}
+	defer func() {
+		for id := range nodes {
+			stop(id)
+		}
+	}()
+
+	for i, m := range members {
+		start(m.Id, 8100+i)
+	}
+
+	// awaitLeader waits until every running member knows the same leader
+	// and the leader took over the partitions
+	awaitLeader := func(t *testing.T) string {
+		var leader string
+		assert.Eventually(t, func() bool {
+			leader = ""
+			for _, n := range nodes {
+				cluster, err := n.client.GetCluster()
+				if err != nil || cluster.Leader == "" || (leader != "" && cluster.Leader != leader) {
+					return false
+				}
+				leader = cluster.Leader
+			}
+			if nodes[leader] == nil {
+				return false
+			}
+
+			// the leader only serves once it took over the partitions
+			_, err := nodes[leader].client.PurgeTopic("probe")
+			var respErr *ResponseError
+			return errors.As(err, &respErr) && respErr.StatusCode == http.StatusNotFound
+		}, 10*time.Second, 20*time.Millisecond)
+		if leader == "" {
+			t.FailNow()
+		}
+		return leader
+	}
+
+	// follower returns a running member that does not lead
+	follower := func(leader string) string {
+		for id := range nodes {
+			if id != leader {
+				return id
+			}
+		}
+		return ""
+	}
+
+	committed := func(client IMessageQueueClient, group string) int {
+		lag, err := client.GetLag("orders")
+		if err != nil {
+			return -1
+		}
+		for _, g := range lag.Groups {
+			if g.Group != group {
+				continue
+			}
+			total := 0
+			for _, p := range g.Partitions {
+				total += p.CommittedOffset
+			}
+			return total
+		}
+		return 0
+	}
+
+	subscribe := func(t *testing.T, client IMessageQueueClient) (chan struct{}, func() []string) {
+		var mu sync.Mutex
+		var values []string
+		var quit chan struct{}
+		assert.Eventually(t, func() bool {
+			var err error
+			quit, err = client.Subscribe("orders", func(d server.Delivery) error {
+				mu.Lock()
+				defer mu.Unlock()
+				values = append(values, d.Value)
+				return nil
+			}, WithGroup("g"))
+			return err == nil
+		}, 5*time.Second, 20*time.Millisecond)
+
+		return quit, func() []string {
+			mu.Lock()
+			defer mu.Unlock()
+			sorted := append([]string{}, values...)
+			sort.Strings(sorted)
+			return sorted
+		}
+	}
+
+	var oldLeader string
+	var epoch int
+
+	t.Run("the members elect a leader and clients are redirected to it", func(t *testing.T) {
+		leader := awaitLeader(t)
+		client := NewMessageQueueClient(nodes[follower(leader)].addr, false, WithLeaderRedirects())
+
+		_, err := nodes[follower(leader)].client.CreateTopic("orders", server.TopicConfig{Partitions: 2})
+		var respErr *ResponseError
+		if assert.True(t, errors.As(err, &respErr)) {
+			assert.Equal(t, http.StatusMisdirectedRequest, respErr.StatusCode)
+			assert.Equal(t, fmt.Sprintf("http://%s", nodes[leader].addr), respErr.Leader)
+		}
+
+		if _, err := client.CreateTopic("orders", server.TopicConfig{Partitions: 2, MinInSyncReplicas: 1}); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, n := range nodes {
+			assert.Eventually(t, func() bool {
+				topic, err := n.client.GetTopic("orders")
+				return err == nil && topic.Config.Partitions == 2 && topic.Config.MinInSyncReplicas == 1
+			}, 5*time.Second, 20*time.Millisecond)
+
+			cluster, err := n.client.GetCluster()
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Len(t, cluster.Members, 3)
+			if assert.Len(t, cluster.Partitions, 2) {
+				assert.Equal(t, leader, cluster.Partitions[0].Leader)
+				assert.Equal(t, []string{"a", "b", "c"}, cluster.Partitions[0].Replicas)
+				epoch = cluster.Partitions[0].Epoch
+			}
+		}
+	})
+
+	t.Run("consumer group offsets are replicated", func(t *testing.T) {
+		leader := awaitLeader(t)
+		client := NewMessageQueueClient(nodes[follower(leader)].addr, false, WithLeaderRedirects())
+
+		for _, value := range []string{"o1", "o2", "o3"} {
+			if _, err := client.Publish("orders", value); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		quit, received := subscribe(t, client)
+		assert.Eventually(t, func() bool {
+			return len(received()) == 3
+		}, 5*time.Second, 20*time.Millisecond)
+		close(quit)
+
+		for _, n := range nodes {
+			assert.Eventually(t, func() bool {
+				return committed(n.client, "g") == 3
+			}, 5*time.Second, 20*time.Millisecond)
+		}
+	})
+
+	t.Run("leadership of the partitions moves when the leader fails", func(t *testing.T) {
+		oldLeader = awaitLeader(t)
+		client := NewMessageQueueClient(nodes[follower(oldLeader)].addr, false, WithLeaderRedirects())
+
+		for _, value := range []string{"o4", "o5"} {
+			if _, err := client.Publish("orders", value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, n := range nodes {
+			assert.Eventually(t, func() bool {
+				lag, err := n.client.GetLag("orders")
+				return err == nil && len(lag.Groups) == 1 && lag.Groups[0].Lag == 2
+			}, 5*time.Second, 20*time.Millisecond)
+		}
+
+		// schemas are committed by the cluster before they are registered
+		registered, err := client.RegisterSchema("invoices", `{"type":"object"}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := client.SetSchemaCompatibility("invoices", "none"); err != nil {
+			t.Fatal(err)
+		}
+
+		stop(oldLeader)
+
+		leader := awaitLeader(t)
+		assert.NotEqual(t, oldLeader, leader)
+
+		schemas, err := nodes[leader].client.GetSchemas("invoices")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "none", schemas.Compatibility)
+		if assert.Len(t, schemas.Schemas, 1) {
+			assert.Equal(t, registered.Id, schemas.Schemas[0].Id)
+		}
+
+		cluster, err := nodes[leader].client.GetCluster()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, cluster.Partitions, 2) {
+			assert.Equal(t, leader, cluster.Partitions[0].Leader)
+			assert.Greater(t, cluster.Partitions[0].Epoch, epoch)
+		}
+
+		// the group resumes on the new leader where it was
+		client = NewMessageQueueClient(nodes[follower(leader)].addr, false, WithLeaderRedirects())
+		quit, received := subscribe(t, client)
+		defer close(quit)
+		assert.Eventually(t, func() bool {
+			return len(received()) == 2
+		}, 5*time.Second, 20*time.Millisecond)
+		assert.Never(t, func() bool {
+			return len(received()) > 2
+		}, 200*time.Millisecond, 20*time.Millisecond)
+		assert.Equal(t, []string{"o4", "o5"}, received())
+	})
+
+	t.Run("members are added and removed", func(t *testing.T) {
+		leader := awaitLeader(t)
+		client := NewMessageQueueClient(nodes[follower(leader)].addr, false, WithLeaderRedirects())
+
+		// the broker knows no leader until it is a member
+		start("d", 8103)
+
+		cluster, err := client.AddClusterMember("d", "http://localhost:8103")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, cluster.Members, 4)
+
+		assert.Eventually(t, func() bool {
+			cluster, err := nodes["d"].client.GetCluster()
+			return err == nil && cluster.Leader == leader && len(cluster.Members) == 4
+		}, 5*time.Second, 20*time.Millisecond)
+		assert.Eventually(t, func() bool {
+			lag, err := nodes["d"].client.GetLag("orders")
+			return err == nil && len(lag.Groups) == 1 && lag.Groups[0].Lag == 0
+		}, 5*time.Second, 20*time.Millisecond)
+
+		cluster, err = client.RemoveClusterMember(oldLeader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := make([]string, 0, len(cluster.Members))
+		for _, m := range cluster.Members {
+			ids = append(ids, m.Id)
+		}
+		assert.NotContains(t, ids, oldLeader)
+		assert.Contains(t, ids, "d")
+		assert.Len(t, ids, 3)
+
+		_, err = client.RemoveClusterMember("nobody")
+		var respErr *ResponseError
+		if assert.True(t, errors.As(err, &respErr)) {
+			assert.Equal(t, http.StatusNotFound, respErr.StatusCode)
+		}
+	})
+}
@@ -0,0 +1,135 @@
+package client
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mdkelley02/message-queue/server"
+	"github.com/mdkelley02/message-queue/storage"
+)
+
+func Test_dashboard(t *testing.T) {
+	s := server.NewServer(server.ServerConfig{
+		ServerAddr:      ":8094",
+		MakeStorageFunc: storage.NewStorage,
+		Authenticators: []server.IAuthenticator{
+			server.NewAPIKeyAuthenticator([]server.APIKey{
+				{Name: "root", Key: "admin-key", Roles: []string{"admin"}},
+				{Name: "billing", Key: "billing-key"},
+			}),
+		},
+		ACL: &server.ACLConfig{Rules: []server.ACLRule{
+			{Role: "admin", Topic: "*", Actions: []string{server.ActionAdmin}},
+			{Principal: "billing", Topic: "invoices", Actions: []string{server.ActionPublish}},
+		}},
+	})
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- s.Start()
+	}()
+	waitForServer(t, "localhost:8094")
+	defer stopServer(t, s, stopped)
+
+	get := func(t *testing.T, path string, key string, header bool) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, "http://localhost:8094"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != "" {
+			req.SetBasicAuth("", key)
+		}
+		if header {
+			req.Header.Set(server.DashboardHeader, "test")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+
+	t.Run("the dashboard asks browsers to log in as an admin", func(t *testing.T) {
+		resp := get(t, "/dashboard/", "", false)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+		assert.Contains(t, resp.Header.Values("WWW-Authenticate"), `Basic realm="message-queue"`)
+
+		resp = get(t, "/dashboard/", "wrong-key", false)
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+		resp = get(t, "/dashboard/", "billing-key", false)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	})
+
+	t.Run("the page and its assets are served", func(t *testing.T) {
+		resp := get(t, "/dashboard/", "admin-key", false)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Contains(t, resp.Header.Get("Content-Type"), "text/html")
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Contains(t, string(body), `<script src="app.js"></script>`)
+
+		for _, asset := range []string{"app.js", "style.css"} {
+			resp := get(t, "/dashboard/"+asset, "admin-key", false)
+			assert.Equal(t, http.StatusOK, resp.StatusCode, asset)
+		}
+	})
+
+	t.Run("the api is served to the dashboard with the same authorization", func(t *testing.T) {
+		billing := NewMessageQueueClient("localhost:8094", false, WithAPIKey("billing-key"))
+		if _, err := billing.Publish("invoices", "i1"); err != nil {
+			t.Fatal(err)
+		}
+
+		// without the header other sites could use the login of a browser
+		resp := get(t, "/dashboard/api/topics", "admin-key", false)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+		resp = get(t, "/dashboard/api/topics/invoices", "billing-key", true)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+		resp = get(t, "/dashboard/api/topics/invoices/messages", "billing-key", true)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+
+		resp = get(t, "/dashboard/api/ns/default/topics/invoices", "admin-key", true)
+		if assert.Equal(t, http.StatusOK, resp.StatusCode) {
+			var topic server.TopicResponse
+			if err := json.NewDecoder(resp.Body).Decode(&topic); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, "invoices", topic.Name)
+			assert.Equal(t, int64(1), topic.Published)
+		}
+	})
+
+	t.Run("topics count the messages they publish and deliver", func(t *testing.T) {
+		admin := NewMessageQueueClient("localhost:8094", false, WithAPIKey("admin-key"))
+		received := make(chan struct{}, 1)
+		quit, err := admin.Subscribe("invoices", func(server.Delivery) error {
+			received <- struct{}{}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer close(quit)
+
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for delivery")
+		}
+
+		assert.Eventually(t, func() bool {
+			topic, err := admin.GetTopic("invoices")
+			return err == nil && topic.Published == 1 && topic.Delivered == 1
+		}, time.Second, 10*time.Millisecond)
+	})
+}
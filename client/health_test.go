@@ -0,0 +1,189 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mdkelley02/message-queue/server"
+	"github.com/mdkelley02/message-queue/storage"
+)
+
+func Test_health(t *testing.T) {
+	dataDir := t.TempDir()
+	s := server.NewServer(server.ServerConfig{
+		ServerAddr:      ":8092",
+		MetricsAddr:     ":8093",
+		DataDir:         dataDir,
+		MakeStorageFunc: storage.NewStorage,
+		ShutdownDelay:   300 * time.Millisecond,
+		RequireAuth:     true,
+		Authenticators: []server.IAuthenticator{
+			server.NewAPIKeyAuthenticator([]server.APIKey{{Name: "ops", Key: "ops-key"}}),
+		},
+	})
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- s.Start()
+	}()
+	waitForServer(t, "localhost:8092")
+
+	probe := func(t *testing.T, url string) (int, server.HealthResponse) {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		var health server.HealthResponse
+		if err := json.NewDecoder(resp.Body).Decode(&health); err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, health
+	}
+
+	t.Run("probes need no credentials and are served by both listeners", func(t *testing.T) {
+		for _, addr := range []string{"localhost:8092", "localhost:8093"} {
+			status, health := probe(t, "http://"+addr+"/healthz")
+			assert.Equal(t, http.StatusOK, status)
+			assert.Equal(t, server.HealthOK, health.Status)
+
+			status, health = probe(t, "http://"+addr+"/readyz")
+			assert.Equal(t, http.StatusOK, status)
+			assert.Equal(t, server.HealthOK, health.Status)
+		}
+
+		_, err := NewMessageQueueClient("localhost:8092", false).GetTopics()
+		assert.Error(t, err)
+	})
+
+	t.Run("readiness reports the storage health of every topic", func(t *testing.T) {
+		client := NewMessageQueueClient("localhost:8092", false, WithAPIKey("ops-key"))
+		for _, topic := range []string{"MY_FILE_TOPIC", "MY_MEMORY_TOPIC"} {
+			storageType := server.StorageMemory
+			if topic == "MY_FILE_TOPIC" {
+				storageType = server.StorageFile
+			}
+			if _, err := client.CreateTopic(topic, server.TopicConfig{Storage: storageType}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		_, health := probe(t, "http://localhost:8092/readyz")
+		assert.Equal(t, []server.TopicHealth{
+			{Namespace: server.DefaultNamespace, Topic: "MY_FILE_TOPIC", Status: server.HealthOK},
+			{Namespace: server.DefaultNamespace, Topic: "MY_MEMORY_TOPIC", Status: server.HealthOK},
+		}, health.Topics)
+
+		// pull the log out from under the file storage
+		if err := os.RemoveAll(filepath.Join(dataDir, "topics", "MY_FILE_TOPIC")); err != nil {
+			t.Fatal(err)
+		}
+
+		status, health := probe(t, "http://localhost:8092/readyz")
+		assert.Equal(t, http.StatusServiceUnavailable, status)
+		assert.Equal(t, server.HealthUnavailable, health.Status)
+		assert.Equal(t, "storage of 1 topics is unhealthy", health.Reason)
+		if assert.Len(t, health.Topics, 2) {
+			assert.Equal(t, server.HealthUnavailable, health.Topics[0].Status)
+			assert.Len(t, health.Topics[0].Errors, 1)
+		}
+
+		if err := client.DeleteTopic("MY_FILE_TOPIC"); err != nil {
+			t.Fatal(err)
+		}
+		status, _ = probe(t, "http://localhost:8092/readyz")
+		assert.Equal(t, http.StatusOK, status)
+	})
+
+	t.Run("queue metrics are exported per topic", func(t *testing.T) {
+		client := NewMessageQueueClient("localhost:8092", false, WithAPIKey("ops-key"))
+		if _, err := client.CreateTopic("MY_METRICS_TOPIC", server.TopicConfig{
+			DeliveryMode: server.DeliveryAtLeastOnce,
+			Retry:        &server.RetryPolicy{MaxAttempts: 2},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		for _, body := range []string{"ok", "fail"} {
+			if _, err := client.Publish("MY_METRICS_TOPIC", body); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		quit, err := client.Subscribe("MY_METRICS_TOPIC", func(d server.Delivery) error {
+			if d.Value == "fail" {
+				return errors.New("downstream unavailable")
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer close(quit)
+
+		assert.Eventually(t, func() bool {
+			lag, err := client.GetLag("MY_METRICS_TOPIC")
+			return err == nil && len(lag.Groups) == 1 && lag.Groups[0].Lag == 0
+		}, time.Second, 10*time.Millisecond)
+
+		resp, err := http.Get("http://localhost:8093/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		metrics := string(body)
+
+		labels := `{namespace="default",topic="MY_METRICS_TOPIC"}`
+		for _, line := range []string{
+			"mq_messages_published_total" + labels + " 2",
+			"mq_messages_delivered_total" + labels + " 3",
+			"mq_messages_acked_total" + labels + " 1",
+			"mq_messages_nacked_total" + labels + " 2",
+			"mq_messages_redelivered_total" + labels + " 1",
+			"mq_messages_dead_lettered_total" + labels + " 1",
+			`mq_messages_published_total{namespace="default",topic="MY_METRICS_TOPIC.deadletter"} 1`,
+			`mq_topic_depth_messages{namespace="default",topic="MY_METRICS_TOPIC.deadletter"} 1`,
+			`mq_topic_bytes{namespace="default",topic="MY_METRICS_TOPIC.deadletter"} 4`,
+			"mq_topic_in_flight_messages" + labels + " 0",
+			"mq_topic_subscribers" + labels + " 1",
+			"mq_publish_to_deliver_latency_seconds_count" + labels + " 3",
+			"mq_ack_latency_seconds_count" + labels + " 1",
+			"mq_message_payload_bytes_sum" + labels + " 6",
+		} {
+			assert.Contains(t, metrics, line+"\n")
+		}
+
+		// the series of deleted topics are dropped
+		assert.NotContains(t, metrics, `topic="MY_FILE_TOPIC"`)
+	})
+
+	t.Run("readiness fails while the broker shuts down", func(t *testing.T) {
+		http.DefaultClient.CloseIdleConnections()
+		s.Stop()
+
+		assert.Eventually(t, func() bool {
+			status, health := probe(t, "http://localhost:8092/readyz")
+			return status == http.StatusServiceUnavailable && health.Reason == "shutting down"
+		}, 200*time.Millisecond, 10*time.Millisecond)
+
+		// the broker still serves during the shutdown delay
+		status, _ := probe(t, "http://localhost:8092/healthz")
+		assert.Equal(t, http.StatusOK, status)
+
+		http.DefaultClient.CloseIdleConnections()
+		if err := <-stopped; err != nil {
+			t.Error(err)
+		}
+	})
+}
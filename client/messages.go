@@ -0,0 +1,38 @@
+package client
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/mdkelley02/message-queue/server"
+)
+
+// BrowseMessages returns up to limit stored messages of a partition starting
+// at offset from. Browsing does not affect delivery.
+func (c *MessageQueueClient) BrowseMessages(topic string, partition int, from int, limit int) (server.BrowseMessagesResponse, error) {
+	query := url.Values{}
+	query.Set("partition", strconv.Itoa(partition))
+	query.Set("from", strconv.Itoa(from))
+	query.Set("limit", strconv.Itoa(limit))
+
+	var response server.BrowseMessagesResponse
+	if err := c.doJSON(http.MethodGet, fmt.Sprintf("/topics/%s/messages?%s", topic, query.Encode()), nil, &response); err != nil {
+		slog.Error("could not browse messages", "err", err)
+		return server.BrowseMessagesResponse{}, err
+	}
+
+	return response, nil
+}
+
+func (c *MessageQueueClient) GetMessage(topic string, messageId string) (server.MessageResponse, error) {
+	var response server.MessageResponse
+	if err := c.doJSON(http.MethodGet, fmt.Sprintf("/topics/%s/messages/%s", topic, url.PathEscape(messageId)), nil, &response); err != nil {
+		slog.Error("could not get message", "err", err)
+		return server.MessageResponse{}, err
+	}
+
+	return response, nil
+}
@@ -0,0 +1,19 @@
+package client
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/mdkelley02/message-queue/server"
+)
+
+// GetMirrors returns the status of the mirrors of the broker.
+func (c *MessageQueueClient) GetMirrors() ([]server.MirrorStatus, error) {
+	var response server.MirrorsResponse
+	if err := c.doJSON(http.MethodGet, "/mirrors", nil, &response); err != nil {
+		slog.Error("could not get mirrors", "err", err)
+		return nil, err
+	}
+
+	return response.Mirrors, nil
+}
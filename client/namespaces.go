@@ -0,0 +1,81 @@
+package client
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/mdkelley02/message-queue/server"
+)
+
+// WithNamespace makes the client use the topics, schemas and access control
+// rules of the named namespace instead of the default one.
+func WithNamespace(namespace string) ClientOption {
+	return func(c *MessageQueueClient) {
+		c.namespace = namespace
+	}
+}
+
+// namespacePath returns where path lives for the namespace of the client.
+// The routes that manage the broker as a whole are not namespaced.
+func (c *MessageQueueClient) namespacePath(path string) string {
+	if c.namespace == "" || path == "/whoami" || path == "/ratelimits" || path == "/mirrors" || strings.HasPrefix(path, "/namespaces") || strings.HasPrefix(path, "/replication") || strings.HasPrefix(path, "/cluster") {
+		return path
+	}
+	return fmt.Sprintf("/ns/%s%s", url.PathEscape(c.namespace), path)
+}
+
+// GetNamespaces lists the namespaces of the broker.
+func (c *MessageQueueClient) GetNamespaces() ([]server.NamespaceResponse, error) {
+	var response server.GetNamespacesResponse
+	if err := c.doJSON(http.MethodGet, "/namespaces", nil, &response); err != nil {
+		slog.Error("could not get namespaces", "err", err)
+		return nil, err
+	}
+
+	return response.Namespaces, nil
+}
+
+func (c *MessageQueueClient) CreateNamespace(name string, config server.NamespaceConfig) (server.NamespaceResponse, error) {
+	var response server.NamespaceResponse
+	if err := c.doJSON(http.MethodPost, "/namespaces", server.CreateNamespaceRequest{Name: name, Config: config}, &response); err != nil {
+		slog.Error("could not create namespace", "err", err)
+		return server.NamespaceResponse{}, err
+	}
+
+	return response, nil
+}
+
+func (c *MessageQueueClient) GetNamespace(name string) (server.NamespaceResponse, error) {
+	var response server.NamespaceResponse
+	if err := c.doJSON(http.MethodGet, fmt.Sprintf("/namespaces/%s", url.PathEscape(name)), nil, &response); err != nil {
+		slog.Error("could not get namespace", "err", err)
+		return server.NamespaceResponse{}, err
+	}
+
+	return response, nil
+}
+
+// UpdateNamespaceConfig replaces the quotas and dead letter settings of the
+// namespace.
+func (c *MessageQueueClient) UpdateNamespaceConfig(name string, config server.NamespaceConfig) (server.NamespaceResponse, error) {
+	var response server.NamespaceResponse
+	if err := c.doJSON(http.MethodPut, fmt.Sprintf("/namespaces/%s", url.PathEscape(name)), config, &response); err != nil {
+		slog.Error("could not update namespace config", "err", err)
+		return server.NamespaceResponse{}, err
+	}
+
+	return response, nil
+}
+
+// DeleteNamespace removes the namespace with all of its topics and messages.
+func (c *MessageQueueClient) DeleteNamespace(name string) error {
+	if err := c.doJSON(http.MethodDelete, fmt.Sprintf("/namespaces/%s", url.PathEscape(name)), nil, nil); err != nil {
+		slog.Error("could not delete namespace", "err", err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,222 @@
+package client
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mdkelley02/message-queue/server"
+	"github.com/mdkelley02/message-queue/storage"
+)
+
+func Test_namespaces(t *testing.T) {
+	dataDir := t.TempDir()
+	start := func() (*server.Server, chan error) {
+		s := server.NewServer(server.ServerConfig{
+			ServerAddr:      ":8090",
+			DataDir:         dataDir,
+			MakeStorageFunc: storage.NewStorage,
+		})
+		stopped := make(chan error, 1)
+		go func() {
+			stopped <- s.Start()
+		}()
+		waitForServer(t, "localhost:8090")
+		return s, stopped
+	}
+
+	assertStatus := func(t *testing.T, status int, err error) {
+		var respErr *ResponseError
+		if assert.True(t, errors.As(err, &respErr), "got %v", err) {
+			assert.Equal(t, status, respErr.StatusCode)
+		}
+	}
+
+	s, stopped := start()
+	admin := NewMessageQueueClient("localhost:8090", false)
+	teamA := NewMessageQueueClient("localhost:8090", false, WithNamespace("team-a"))
+	teamB := NewMessageQueueClient("localhost:8090", false, WithNamespace("team-b"))
+
+	t.Run("namespaces keep topics of the same name apart", func(t *testing.T) {
+		for _, name := range []string{"team-a", "team-b"} {
+			if _, err := admin.CreateNamespace(name, server.NamespaceConfig{}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if _, err := teamA.Publish("orders", "from a"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := teamB.Publish("orders", "from b"); err != nil {
+			t.Fatal(err)
+		}
+
+		page, err := teamA.BrowseMessages("orders", 0, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, page.Messages, 1) {
+			assert.Equal(t, "from a", page.Messages[0].Value)
+		}
+
+		topics, err := admin.GetTopics()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NotContains(t, topics, "orders")
+
+		_, err = NewMessageQueueClient("localhost:8090", false, WithNamespace("nobody")).GetTopics()
+		assertStatus(t, http.StatusNotFound, err)
+
+		_, err = admin.CreateNamespace("team-a", server.NamespaceConfig{})
+		assertStatus(t, http.StatusConflict, err)
+
+		assertStatus(t, http.StatusConflict, admin.DeleteNamespace(server.DefaultNamespace))
+	})
+
+	t.Run("topic and storage quotas are enforced", func(t *testing.T) {
+		if _, err := admin.UpdateNamespaceConfig("team-a", server.NamespaceConfig{
+			Quotas: server.NamespaceQuotas{MaxTopics: 1, MaxBytes: 12},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := teamA.CreateTopic("invoices", server.TopicConfig{})
+		assertStatus(t, http.StatusInsufficientStorage, err)
+
+		if _, err := teamA.Publish("orders", "12345"); err != nil {
+			t.Fatal(err)
+		}
+		_, err = teamA.Publish("orders", "12345")
+		assertStatus(t, http.StatusInsufficientStorage, err)
+
+		// the other namespace is not affected
+		if _, err := teamB.Publish("orders", "12345"); err != nil {
+			t.Fatal(err)
+		}
+
+		ns, err := admin.GetNamespace("team-a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 1, ns.Topics)
+		assert.Equal(t, 11, ns.Bytes)
+	})
+
+	t.Run("publish rate and connection quotas are enforced", func(t *testing.T) {
+		if _, err := admin.UpdateNamespaceConfig("team-b", server.NamespaceConfig{
+			Quotas: server.NamespaceQuotas{MaxPublishRate: 2, MaxConnections: 1},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		var err error
+		for i := 0; i < 10 && err == nil; i++ {
+			_, err = teamB.Publish("events", "e")
+		}
+		assertStatus(t, http.StatusTooManyRequests, err)
+
+		quit, err := teamB.Subscribe("events", func(server.Delivery) error { return nil })
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = teamB.Subscribe("events", func(server.Delivery) error { return nil })
+		assertStatus(t, http.StatusTooManyRequests, err)
+
+		close(quit)
+		assert.Eventually(t, func() bool {
+			quit, err := teamB.Subscribe("events", func(server.Delivery) error { return nil })
+			if err != nil {
+				return false
+			}
+			close(quit)
+			return true
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("messages are dropped when dead lettering is disabled", func(t *testing.T) {
+		if _, err := admin.CreateNamespace("no-dlq", server.NamespaceConfig{
+			DeadLetter: server.DeadLetterConfig{Disabled: true},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		client := NewMessageQueueClient("localhost:8090", false, WithNamespace("no-dlq"))
+
+		if _, err := client.CreateTopic("jobs", server.TopicConfig{
+			DeliveryMode: server.DeliveryAtLeastOnce,
+			Retry:        &server.RetryPolicy{MaxAttempts: 1},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		received := make(chan struct{}, 1)
+		quit, err := client.Subscribe("jobs", func(server.Delivery) error {
+			received <- struct{}{}
+			return errors.New("downstream unavailable")
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer close(quit)
+
+		if _, err := client.Publish("jobs", "j1"); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case <-received:
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for delivery")
+		}
+
+		assert.Eventually(t, func() bool {
+			lag, err := client.GetLag("jobs")
+			return err == nil && len(lag.Groups) == 1 && lag.Groups[0].Lag == 0
+		}, time.Second, 10*time.Millisecond)
+
+		topics, err := client.GetTopics()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, []string{"jobs"}, topics)
+	})
+
+	stopServer(t, s, stopped)
+
+	t.Run("namespaces, their config and their topics survive a restart", func(t *testing.T) {
+		s, stopped := start()
+		defer stopServer(t, s, stopped)
+
+		ns, err := admin.GetNamespace("team-a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, server.NamespaceQuotas{MaxTopics: 1, MaxBytes: 12}, ns.Config.Quotas)
+
+		topics, err := teamB.GetTopics()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, []string{"events", "orders"}, topics)
+
+		if err := admin.DeleteNamespace("team-b"); err != nil {
+			t.Fatal(err)
+		}
+		_, err = teamB.GetTopics()
+		assertStatus(t, http.StatusNotFound, err)
+
+		namespaces, err := admin.GetNamespaces()
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := make([]string, 0, len(namespaces))
+		for _, ns := range namespaces {
+			names = append(names, ns.Name)
+		}
+		assert.Equal(t, []string{server.DefaultNamespace, "no-dlq", "team-a"}, names)
+	})
+}
@@ -0,0 +1,76 @@
+package client
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ClientOption configures a MessageQueueClient.
+type ClientOption func(*MessageQueueClient)
+
+type subscribeOptions struct {
+	partitions []int
+	group      string
+	limit      int
+	done       chan<- error
+}
+
+type SubscribeOption func(*subscribeOptions)
+
+// WithPartitions restricts a subscription to the given partitions. By default
+// a subscription receives messages from every partition of the topic.
+func WithPartitions(partitions ...int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.partitions = partitions
+	}
+}
+
+// WithGroup joins the named consumer group. Every group receives each
+// message once, shared between the subscribers of the group. Subscribers
+// join the default group unless told otherwise.
+func WithGroup(group string) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.group = group
+	}
+}
+
+// WithLimit ends a subscription once it handled n messages. The broker sends
+// no more than n, so none past the limit is taken from the topic. A limit of
+// 0 means no limit.
+func WithLimit(n int) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.limit = n
+	}
+}
+
+// WithDone reports the end of a subscription on done: the error that ended
+// it, or nil when it was quit or reached its limit. The subscription does
+// not wait for a receiver, so done needs room for one error.
+func WithDone(done chan<- error) SubscribeOption {
+	return func(o *subscribeOptions) {
+		o.done = done
+	}
+}
+
+func (o subscribeOptions) query() url.Values {
+	query := url.Values{}
+
+	if o.group != "" {
+		query.Set("group", o.group)
+	}
+
+	if len(o.partitions) > 0 {
+		ids := make([]string, 0, len(o.partitions))
+		for _, id := range o.partitions {
+			ids = append(ids, strconv.Itoa(id))
+		}
+		query.Set("partitions", strings.Join(ids, ","))
+	}
+
+	if o.limit > 0 {
+		query.Set("limit", strconv.Itoa(o.limit))
+	}
+
+	return query
+}
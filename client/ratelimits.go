@@ -0,0 +1,19 @@
+package client
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/mdkelley02/message-queue/server"
+)
+
+// GetRateLimits returns the state of the rate limiters of the broker.
+func (c *MessageQueueClient) GetRateLimits() ([]server.RateLimiterResponse, error) {
+	var response server.RateLimitsResponse
+	if err := c.doJSON(http.MethodGet, "/ratelimits", nil, &response); err != nil {
+		slog.Error("could not get rate limits", "err", err)
+		return nil, err
+	}
+
+	return response.Limiters, nil
+}
@@ -0,0 +1,109 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mdkelley02/message-queue/server"
+	"github.com/mdkelley02/message-queue/storage"
+)
+
+func Test_rateLimits(t *testing.T) {
+	s := server.NewServer(server.ServerConfig{
+		ServerAddr:      ":8091",
+		MakeStorageFunc: storage.NewStorage,
+		Authenticators: []server.IAuthenticator{
+			server.NewAPIKeyAuthenticator([]server.APIKey{
+				{Name: "alice", Key: "alice-key"},
+				{Name: "bob", Key: "bob-key"},
+			}),
+		},
+		RateLimits: server.RateLimitConfig{
+			Publish: server.RateLimits{Principal: server.RateLimit{MessagesPerSecond: 2}},
+			Consume: server.RateLimits{Topic: server.RateLimit{MessagesPerSecond: 5}},
+		},
+	})
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- s.Start()
+	}()
+	waitForServer(t, "localhost:8091")
+	defer stopServer(t, s, stopped)
+
+	alice := NewMessageQueueClient("localhost:8091", false, WithAPIKey("alice-key"))
+	bob := NewMessageQueueClient("localhost:8091", false, WithAPIKey("bob-key"))
+
+	t.Run("publishes over the rate of a principal are refused with retry-after", func(t *testing.T) {
+		var err error
+		for i := 0; i < 10 && err == nil; i++ {
+			_, err = alice.Publish("MY_LIMITED_TOPIC", "m")
+		}
+
+		var respErr *ResponseError
+		if assert.True(t, errors.As(err, &respErr), "got %v", err) {
+			assert.Equal(t, http.StatusTooManyRequests, respErr.StatusCode)
+			assert.Equal(t, time.Second, respErr.RetryAfter)
+		}
+
+		// other principals are not affected
+		if _, err := bob.Publish("MY_LIMITED_TOPIC", "m"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("deliveries over the rate of a topic are throttled, not dropped", func(t *testing.T) {
+		// anonymous publishers have no principal to be limited by
+		anonymous := NewMessageQueueClient("localhost:8091", false)
+		for i := 0; i < 10; i++ {
+			if _, err := anonymous.Publish("MY_THROTTLED_TOPIC", fmt.Sprint(i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		received := make(chan string, 10)
+		start := time.Now()
+		quit, err := anonymous.Subscribe("MY_THROTTLED_TOPIC", func(d server.Delivery) error {
+			received <- d.Value
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer close(quit)
+
+		for i := 0; i < 10; i++ {
+			select {
+			case v := <-received:
+				assert.Equal(t, fmt.Sprint(i), v)
+			case <-time.After(3 * time.Second):
+				t.Fatal("timed out waiting for delivery")
+			}
+		}
+
+		// a burst of five, then five more at five per second
+		assert.GreaterOrEqual(t, time.Since(start), 900*time.Millisecond)
+	})
+
+	t.Run("the limiter state is visible through the admin api", func(t *testing.T) {
+		limiters, err := alice.GetRateLimits()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys := make(map[string]server.RateLimiterResponse)
+		for _, l := range limiters {
+			keys[l.Direction+" "+l.Kind+" "+l.Key] = l
+		}
+
+		if assert.Contains(t, keys, "publish principal alice") {
+			assert.Equal(t, server.RateLimit{MessagesPerSecond: 2}, keys["publish principal alice"].Limit)
+		}
+		assert.Contains(t, keys, "publish principal bob")
+		assert.Contains(t, keys, "consume topic default/MY_THROTTLED_TOPIC")
+	})
+}
@@ -0,0 +1,41 @@
+package client
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/mdkelley02/message-queue/server"
+)
+
+// GetReplication returns the replication state of the broker.
+func (c *MessageQueueClient) GetReplication() (server.ReplicationResponse, error) {
+	var response server.ReplicationResponse
+	if err := c.doJSON(http.MethodGet, "/replication", nil, &response); err != nil {
+		slog.Error("could not get replication state", "err", err)
+		return server.ReplicationResponse{}, err
+	}
+
+	return response, nil
+}
+
+// Promote makes a follower the leader.
+func (c *MessageQueueClient) Promote() (server.ReplicationResponse, error) {
+	var response server.ReplicationResponse
+	if err := c.doJSON(http.MethodPost, "/replication/promote", nil, &response); err != nil {
+		slog.Error("could not promote broker", "err", err)
+		return server.ReplicationResponse{}, err
+	}
+
+	return response, nil
+}
+
+// Follow makes the broker a follower of the broker at the leader URL.
+func (c *MessageQueueClient) Follow(leader string) (server.ReplicationResponse, error) {
+	var response server.ReplicationResponse
+	if err := c.doJSON(http.MethodPost, "/replication/follow", server.FollowRequest{Leader: leader}, &response); err != nil {
+		slog.Error("could not follow leader", "err", err)
+		return server.ReplicationResponse{}, err
+	}
+
+	return response, nil
+}
@@ -0,0 +1,220 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mdkelley02/message-queue/server"
+	"github.com/mdkelley02/message-queue/storage"
+)
+
+func Test_replication(t *testing.T) {
+	start := func(port int, nodeId string, leader string) (*server.Server, chan error) {
+		s := server.NewServer(server.ServerConfig{
+			ServerAddr:      fmt.Sprintf(":%d", port),
+			MakeStorageFunc: storage.NewStorage,
+			Replication: &server.ReplicationConfig{
+				NodeId:       nodeId,
+				Leader:       leader,
+				LagTimeout:   time.Second,
+				AckTimeout:   time.Second,
+				SyncInterval: 50 * time.Millisecond,
+			},
+		})
+		stopped := make(chan error, 1)
+		go func() {
+			stopped <- s.Start()
+		}()
+		waitForServer(t, fmt.Sprintf("localhost:%d", port))
+		return s, stopped
+	}
+
+	leader, leaderStopped := start(8097, "a", "")
+	defer stopServer(t, leader, leaderStopped)
+	first, firstStopped := start(8098, "b", "http://localhost:8097")
+	defer stopServer(t, first, firstStopped)
+	second, secondStopped := start(8099, "c", "http://localhost:8097")
+
+	a := NewMessageQueueClient("localhost:8097", false)
+	b := NewMessageQueueClient("localhost:8098", false)
+	c := NewMessageQueueClient("localhost:8099", false)
+
+	inSync := func(client IMessageQueueClient, topic string, want int) func() bool {
+		return func() bool {
+			replication, err := client.GetReplication()
+			if err != nil {
+				return false
+			}
+			for _, p := range replication.Partitions {
+				if p.Topic != topic {
+					continue
+				}
+				n := 0
+				for _, r := range p.Replicas {
+					if r.InSync {
+						n++
+					}
+				}
+				if n != want {
+					return false
+				}
+			}
+			return true
+		}
+	}
+
+	browse := func(t *testing.T, client IMessageQueueClient, topic string, partition int) []string {
+		page, err := client.BrowseMessages(topic, partition, 0, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := make([]string, 0, len(page.Messages))
+		for _, m := range page.Messages {
+			values = append(values, fmt.Sprintf("%d:%s", m.Offset, m.Value))
+		}
+		return values
+	}
+
+	assertStatus := func(t *testing.T, err error, status int) *ResponseError {
+		var respErr *ResponseError
+		if assert.True(t, errors.As(err, &respErr)) {
+			assert.Equal(t, status, respErr.StatusCode)
+		}
+		return respErr
+	}
+
+	t.Run("a synchronous publish is on every in-sync follower when it is acknowledged", func(t *testing.T) {
+		if _, err := a.CreateTopic("orders", server.TopicConfig{Partitions: 2, MinInSyncReplicas: 2}); err != nil {
+			t.Fatal(err)
+		}
+		assert.Eventually(t, inSync(a, "orders", 2), 5*time.Second, 20*time.Millisecond)
+
+		for i := 0; i < 4; i++ {
+			partition := i % 2
+			if _, err := a.PublishMessage("orders", server.PublishRequest{Body: fmt.Sprintf("o%d", i), Partition: &partition}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, follower := range []IMessageQueueClient{b, c} {
+			assert.Equal(t, []string{"0:o0", "1:o2"}, browse(t, follower, "orders", 0))
+			assert.Equal(t, []string{"0:o1", "1:o3"}, browse(t, follower, "orders", 1))
+
+			topic, err := follower.GetTopic("orders")
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, 2, topic.Config.MinInSyncReplicas)
+		}
+	})
+
+	t.Run("asynchronous topics catch up and followers report their lag", func(t *testing.T) {
+		if _, err := a.Publish("events", "e1"); err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Eventually(t, func() bool {
+			replication, err := b.GetReplication()
+			if err != nil {
+				return false
+			}
+			for _, p := range replication.Partitions {
+				if p.Topic == "events" {
+					return p.LastFetch != nil && p.Lag == 0 && p.HighWatermark == 1
+				}
+			}
+			return false
+		}, 5*time.Second, 20*time.Millisecond)
+
+		replication, err := b.GetReplication()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, server.RoleFollower, replication.Role)
+		assert.Equal(t, "http://localhost:8097", replication.Leader)
+		assert.Equal(t, []string{"0:e1"}, browse(t, b, "events", 0))
+	})
+
+	t.Run("schemas are copied to followers with their ids", func(t *testing.T) {
+		registered, err := a.RegisterSchema("payments", `{"type":"object","properties":{"amount":{"type":"number"}}}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := a.SetSchemaCompatibility("payments", "full"); err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Eventually(t, func() bool {
+			schemas, err := b.GetSchemas("payments")
+			return err == nil && schemas.Compatibility == "full" && len(schemas.Schemas) == 1 &&
+				schemas.Schemas[0].Id == registered.Id && schemas.Schemas[0].Version == registered.Version
+		}, 5*time.Second, 20*time.Millisecond)
+	})
+
+	t.Run("followers refuse writes and name the leader", func(t *testing.T) {
+		_, err := b.Publish("events", "e2")
+		if respErr := assertStatus(t, err, http.StatusMisdirectedRequest); respErr != nil {
+			assert.Equal(t, "http://localhost:8097", respErr.Leader)
+		}
+
+		_, err = b.CreateTopic("other", server.TopicConfig{})
+		assertStatus(t, err, http.StatusMisdirectedRequest)
+
+		_, err = b.Subscribe("events", func(server.Delivery) error { return nil })
+		assert.Error(t, err)
+	})
+
+	t.Run("publishes fail when too few followers are in sync", func(t *testing.T) {
+		stopServer(t, second, secondStopped)
+		assert.Eventually(t, inSync(a, "orders", 1), 5*time.Second, 20*time.Millisecond)
+
+		_, err := a.Publish("orders", "o4")
+		assertStatus(t, err, http.StatusServiceUnavailable)
+
+		// asynchronous topics are not affected
+		if _, err := a.Publish("events", "e2"); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("a follower is promoted and the old leader follows it", func(t *testing.T) {
+		assert.Eventually(t, func() bool {
+			return len(browse(t, b, "events", 0)) == 2
+		}, 5*time.Second, 20*time.Millisecond)
+
+		replication, err := b.Promote()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, server.RoleLeader, replication.Role)
+
+		if _, err := a.Follow("http://localhost:8098"); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = a.Publish("events", "e3")
+		assertStatus(t, err, http.StatusMisdirectedRequest)
+
+		if _, err := b.Publish("events", "e3"); err != nil {
+			t.Fatal(err)
+		}
+		assert.Eventually(t, func() bool {
+			return len(browse(t, a, "events", 0)) == 3
+		}, 5*time.Second, 20*time.Millisecond)
+		assert.Equal(t, []string{"0:e1", "1:e2", "2:e3"}, browse(t, a, "events", 0))
+
+		// the old leader is back in sync, enough for orders again
+		assert.Eventually(t, inSync(b, "orders", 1), 5*time.Second, 20*time.Millisecond)
+		if _, err := b.UpdateTopicConfig("orders", server.TopicConfig{Partitions: 2, MinInSyncReplicas: 1}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := b.Publish("orders", "o4"); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,48 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/mdkelley02/message-queue/server"
+)
+
+func (c *MessageQueueClient) RegisterSchema(topic string, schema string) (server.SchemaResponse, error) {
+	if !json.Valid([]byte(schema)) {
+		return server.SchemaResponse{}, errors.New("schema is not valid json")
+	}
+
+	var response server.SchemaResponse
+	if err := c.doJSON(http.MethodPost, fmt.Sprintf("/topics/%s/schemas", topic), server.RegisterSchemaRequest{
+		Schema: json.RawMessage(schema),
+	}, &response); err != nil {
+		slog.Error("could not register schema", "err", err)
+		return server.SchemaResponse{}, err
+	}
+
+	return response, nil
+}
+
+func (c *MessageQueueClient) GetSchemas(topic string) (server.GetSchemasResponse, error) {
+	var response server.GetSchemasResponse
+	if err := c.doJSON(http.MethodGet, fmt.Sprintf("/topics/%s/schemas", topic), nil, &response); err != nil {
+		slog.Error("could not get schemas", "err", err)
+		return server.GetSchemasResponse{}, err
+	}
+
+	return response, nil
+}
+
+func (c *MessageQueueClient) SetSchemaCompatibility(topic string, compatibility string) error {
+	if err := c.doJSON(http.MethodPut, fmt.Sprintf("/topics/%s/schemas/compatibility", topic), server.SchemaCompatibilityRequest{
+		Compatibility: compatibility,
+	}, nil); err != nil {
+		slog.Error("could not set schema compatibility", "err", err)
+		return err
+	}
+
+	return nil
+}
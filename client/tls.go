@@ -0,0 +1,45 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// WithTLS connects to the broker over https and wss using cfg.
+func WithTLS(cfg *tls.Config) ClientOption {
+	return func(c *MessageQueueClient) {
+		c.tlsConfig = cfg
+	}
+}
+
+// NewTLSConfig builds a TLS config that trusts the CAs in caFile, or the
+// system roots when it is empty, and presents the certificate in certFile
+// and keyFile for mutual TLS when they are given.
+func NewTLSConfig(caFile string, certFile string, keyFile string) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if caFile != "" {
+		data, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in %s", caFile)
+		}
+		cfg.RootCAs = pool
+	}
+
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,245 @@
+package client
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mdkelley02/message-queue/server"
+	"github.com/mdkelley02/message-queue/storage"
+)
+
+// testCA issues certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCA{
+		cert: cert,
+		key:  key,
+		pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// issue writes a certificate for name signed by the CA and its key to dir
+// and returns their paths.
+func (ca *testCA) issue(t *testing.T, dir string, name string, serial int64, usage x509.ExtKeyUsage) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, name+".crt")
+	keyFile := filepath.Join(dir, name+".key")
+	writeTestFile(t, certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	writeTestFile(t, keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}))
+	return certFile, keyFile
+}
+
+func writeTestFile(t *testing.T, path string, data []byte) {
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_tls(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	caFile := filepath.Join(dir, "ca.crt")
+	writeTestFile(t, caFile, ca.pem)
+
+	serverCert, serverKey := ca.issue(t, dir, "localhost", 2, x509.ExtKeyUsageServerAuth)
+	aliceCert, aliceKey := ca.issue(t, dir, "alice", 3, x509.ExtKeyUsageClientAuth)
+
+	s := server.NewServer(server.ServerConfig{
+		ServerAddr:      ":8087",
+		BinaryAddr:      ":8110",
+		MakeStorageFunc: storage.NewStorage,
+		TLS: &server.TLSConfig{
+			CertFile:     serverCert,
+			KeyFile:      serverKey,
+			ClientCAFile: caFile,
+			ClientAuth:   server.ClientAuthRequire,
+		},
+	})
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- s.Start()
+	}()
+	waitForServer(t, "localhost:8087")
+	waitForServer(t, "localhost:8110")
+	defer stopServer(t, s, stopped)
+
+	aliceConfig, err := NewTLSConfig(caFile, aliceCert, aliceKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("a client certificate is mapped to a principal", func(t *testing.T) {
+		client := NewMessageQueueClient("localhost:8087", false, WithTLS(aliceConfig))
+
+		principal, err := client.WhoAmI()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, server.Principal{Name: "alice", Method: server.AuthMethodTLS}, principal)
+	})
+
+	t.Run("messages are published and delivered over tls", func(t *testing.T) {
+		client := NewMessageQueueClient("localhost:8087", false, WithTLS(aliceConfig))
+
+		received := make(chan string, 1)
+		quit, err := client.Subscribe("MY_TLS_TOPIC", func(d server.Delivery) error {
+			received <- d.Value
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer close(quit)
+
+		if _, err := client.Publish("MY_TLS_TOPIC", "secret"); err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case v := <-received:
+			assert.Equal(t, "secret", v)
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for delivery")
+		}
+	})
+
+	t.Run("the binary protocol is served over tls", func(t *testing.T) {
+		client := NewBinaryClient("localhost:8110", WithTLS(aliceConfig))
+		defer client.Close()
+
+		if _, err := client.Produce("MY_BINARY_TLS_TOPIC", []server.PublishRequest{{Body: "secret"}}); err != nil {
+			t.Fatal(err)
+		}
+		fetched, err := client.Fetch("MY_BINARY_TLS_TOPIC", 0, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, fetched.Messages, 1) {
+			assert.Equal(t, "secret", fetched.Messages[0].Value)
+		}
+
+		_, err = NewBinaryClient("localhost:8110", WithTLS(&tls.Config{})).Fetch("MY_BINARY_TLS_TOPIC", 0, 0, 10)
+		assert.Error(t, err)
+	})
+
+	t.Run("http/2 is negotiated", func(t *testing.T) {
+		config := aliceConfig.Clone()
+		config.NextProtos = []string{"h2", "http/1.1"}
+		conn, err := tls.Dial("tcp", "localhost:8087", config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		assert.Equal(t, "h2", conn.ConnectionState().NegotiatedProtocol)
+	})
+
+	t.Run("clients without a certificate or trust are rejected", func(t *testing.T) {
+		anonymousConfig, err := NewTLSConfig(caFile, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = NewMessageQueueClient("localhost:8087", false, WithTLS(anonymousConfig)).WhoAmI()
+		assert.Error(t, err)
+
+		_, err = NewMessageQueueClient("localhost:8087", false, WithTLS(&tls.Config{})).WhoAmI()
+		assert.Error(t, err)
+
+		_, err = NewMessageQueueClient("localhost:8087", false).GetTopics()
+		assert.Error(t, err)
+	})
+
+	t.Run("a rotated certificate is served without a restart", func(t *testing.T) {
+		peerSerial := func() int64 {
+			conn, err := tls.Dial("tcp", "localhost:8087", aliceConfig)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+		}
+
+		assert.Equal(t, int64(2), peerSerial())
+
+		ca.issue(t, dir, "localhost", 4, x509.ExtKeyUsageServerAuth)
+		// make sure the rotation is noticed on file systems with coarse
+		// modification times
+		later := time.Now().Add(time.Minute)
+		for _, path := range []string{serverCert, serverKey} {
+			if err := os.Chtimes(path, later, later); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// the files are checked once a second at most
+		assert.Eventually(t, func() bool {
+			return peerSerial() == 4
+		}, 3*time.Second, 100*time.Millisecond)
+	})
+
+	_, err = NewTLSConfig(filepath.Join(dir, "localhost.key"), "", "")
+	assert.ErrorContains(t, err, "no certificates found")
+}
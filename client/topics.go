@@ -0,0 +1,71 @@
+package client
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/mdkelley02/message-queue/server"
+)
+
+func (c *MessageQueueClient) CreateTopic(topic string, config server.TopicConfig) (server.TopicResponse, error) {
+	var response server.TopicResponse
+	if err := c.doJSON(http.MethodPost, "/topics", server.CreateTopicRequest{
+		Name:   topic,
+		Config: config,
+	}, &response); err != nil {
+		slog.Error("could not create topic", "err", err)
+		return server.TopicResponse{}, err
+	}
+
+	return response, nil
+}
+
+func (c *MessageQueueClient) GetTopic(topic string) (server.TopicResponse, error) {
+	var response server.TopicResponse
+	if err := c.doJSON(http.MethodGet, fmt.Sprintf("/topics/%s", topic), nil, &response); err != nil {
+		slog.Error("could not get topic", "err", err)
+		return server.TopicResponse{}, err
+	}
+
+	return response, nil
+}
+
+func (c *MessageQueueClient) UpdateTopicConfig(topic string, config server.TopicConfig) (server.TopicResponse, error) {
+	var response server.TopicResponse
+	if err := c.doJSON(http.MethodPut, fmt.Sprintf("/topics/%s/config", topic), config, &response); err != nil {
+		slog.Error("could not update topic config", "err", err)
+		return server.TopicResponse{}, err
+	}
+
+	return response, nil
+}
+
+func (c *MessageQueueClient) PurgeTopic(topic string) (int, error) {
+	var response server.PurgeTopicResponse
+	if err := c.doJSON(http.MethodPost, fmt.Sprintf("/topics/%s/purge", topic), nil, &response); err != nil {
+		slog.Error("could not purge topic", "err", err)
+		return 0, err
+	}
+
+	return response.Purged, nil
+}
+
+func (c *MessageQueueClient) DeleteTopic(topic string) error {
+	if err := c.doJSON(http.MethodDelete, fmt.Sprintf("/topics/%s", topic), nil, nil); err != nil {
+		slog.Error("could not delete topic", "err", err)
+		return err
+	}
+
+	return nil
+}
+
+func (c *MessageQueueClient) GetLag(topic string) (server.TopicLagResponse, error) {
+	var response server.TopicLagResponse
+	if err := c.doJSON(http.MethodGet, fmt.Sprintf("/topics/%s/lag", topic), nil, &response); err != nil {
+		slog.Error("could not get lag", "err", err)
+		return server.TopicLagResponse{}, err
+	}
+
+	return response, nil
+}
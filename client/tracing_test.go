@@ -0,0 +1,141 @@
+package client
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mdkelley02/message-queue/server"
+	"github.com/mdkelley02/message-queue/storage"
+)
+
+// spanRecorder collects the spans the broker exports.
+type spanRecorder chan server.Span
+
+func (r spanRecorder) ExportSpan(span server.Span) error {
+	r <- span
+	return nil
+}
+
+func (r spanRecorder) next(t *testing.T) server.Span {
+	select {
+	case span := <-r:
+		return span
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for span")
+		return server.Span{}
+	}
+}
+
+func Test_tracing(t *testing.T) {
+	spans := make(spanRecorder, 100)
+	s := server.NewServer(server.ServerConfig{
+		ServerAddr:      ":8095",
+		MakeStorageFunc: storage.NewStorage,
+		SpanExporter:    spans,
+	})
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- s.Start()
+	}()
+	waitForServer(t, "localhost:8095")
+	defer stopServer(t, s, stopped)
+
+	client := NewMessageQueueClient("localhost:8095", false)
+	parent := server.TraceContext{
+		TraceParent: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		TraceState:  "vendor=value",
+	}
+
+	t.Run("deliveries continue the trace of the publisher", func(t *testing.T) {
+		if _, err := client.CreateTopic("MY_TRACED_TOPIC", server.TopicConfig{
+			DeliveryMode: server.DeliveryAtLeastOnce,
+			Retry:        &server.RetryPolicy{MaxAttempts: 1},
+		}); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := client.PublishMessage("MY_TRACED_TOPIC", server.PublishRequest{Body: "m1", Trace: parent}); err != nil {
+			t.Fatal(err)
+		}
+
+		publish := spans.next(t)
+		assert.Equal(t, "publish MY_TRACED_TOPIC", publish.Name)
+		assert.Equal(t, server.SpanKindProducer, publish.Kind)
+		assert.Equal(t, parent.TraceId(), publish.TraceId)
+		assert.Equal(t, parent.SpanId(), publish.ParentSpanId)
+		assert.Equal(t, "MY_TRACED_TOPIC-0-0", publish.Attributes["messageId"])
+
+		received := make(chan server.Delivery, 1)
+		quit, err := client.Subscribe("MY_TRACED_TOPIC", func(d server.Delivery) error {
+			received <- d
+			return errors.New("downstream unavailable")
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer close(quit)
+
+		var delivery server.Delivery
+		select {
+		case delivery = <-received:
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for delivery")
+		}
+		assert.Equal(t, parent.TraceId(), delivery.TraceId())
+		assert.Equal(t, publish.SpanId, delivery.SpanId())
+		assert.Equal(t, parent.TraceState, delivery.TraceState)
+
+		// the failed message is dead lettered within the same trace
+		deadLetter := spans.next(t)
+		assert.Equal(t, "publish MY_TRACED_TOPIC.deadletter", deadLetter.Name)
+		assert.Equal(t, publish.SpanId, deadLetter.ParentSpanId)
+
+		deliver := spans.next(t)
+		assert.Equal(t, "deliver MY_TRACED_TOPIC", deliver.Name)
+		assert.Equal(t, server.SpanKindConsumer, deliver.Kind)
+		assert.Equal(t, parent.TraceId(), deliver.TraceId)
+		assert.Equal(t, publish.SpanId, deliver.ParentSpanId)
+		assert.Equal(t, "default", deliver.Attributes["group"])
+
+		page, err := client.BrowseMessages("MY_TRACED_TOPIC.deadletter", 0, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, page.Messages, 1) {
+			assert.Equal(t, deadLetter.SpanId, page.Messages[0].SpanId())
+		}
+	})
+
+	t.Run("messages published without a trace start one", func(t *testing.T) {
+		if _, err := client.Publish("MY_UNTRACED_TOPIC", "m1"); err != nil {
+			t.Fatal(err)
+		}
+
+		publish := spans.next(t)
+		assert.Len(t, publish.TraceId, 32)
+		assert.Empty(t, publish.ParentSpanId)
+
+		message, err := client.GetMessage("MY_UNTRACED_TOPIC", "MY_UNTRACED_TOPIC-0-0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, publish.TraceId, message.TraceId())
+	})
+
+	t.Run("traces that are not sampled are passed on but not exported", func(t *testing.T) {
+		unsampled := server.TraceContext{TraceParent: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00"}
+		if _, err := client.PublishMessage("MY_UNTRACED_TOPIC", server.PublishRequest{Body: "m2", Trace: unsampled}); err != nil {
+			t.Fatal(err)
+		}
+
+		message, err := client.GetMessage("MY_UNTRACED_TOPIC", "MY_UNTRACED_TOPIC-0-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, unsampled.TraceId(), message.TraceId())
+		assert.Empty(t, spans)
+	})
+}
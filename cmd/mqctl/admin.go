@@ -0,0 +1,417 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mdkelley02/message-queue/server"
+)
+
+var lagHeader = []string{"TOPIC", "GROUP", "PARTITION", "COMMITTED", "HIGH", "LAG", "IN FLIGHT", "OLDEST UNACKED"}
+
+// groupRows lists every partition of every group of the topic.
+func groupRows(lag server.TopicLagResponse) [][]string {
+	var rows [][]string
+	for _, group := range lag.Groups {
+		for _, p := range group.Partitions {
+			rows = append(rows, []string{
+				lag.Topic,
+				group.Group,
+				strconv.Itoa(p.Partition),
+				strconv.Itoa(p.CommittedOffset),
+				strconv.Itoa(p.HighWatermark),
+				strconv.Itoa(p.Lag),
+				strconv.Itoa(p.InFlight),
+				fmt.Sprintf("%.1fs", p.OldestUnackedAge),
+			})
+		}
+	}
+	return rows
+}
+
+func runLag(e *env, args []string) error {
+	fs := newFlagSet(e, "lag")
+	positional, err := parseArgs(fs, args, 0, 1)
+	if err != nil {
+		return err
+	}
+
+	topics := positional
+	if len(topics) == 0 {
+		if topics, err = e.client.GetTopics(); err != nil {
+			return err
+		}
+	}
+
+	response := server.GetLagResponse{Topics: make([]server.TopicLagResponse, 0, len(topics))}
+	var rows [][]string
+	for _, topic := range topics {
+		lag, err := e.client.GetLag(topic)
+		if err != nil {
+			return err
+		}
+		response.Topics = append(response.Topics, lag)
+		rows = append(rows, groupRows(lag)...)
+	}
+
+	return e.out.print(response, lagHeader, rows)
+}
+
+func runRedrive(e *env, args []string) error {
+	fs := newFlagSet(e, "redrive")
+	destination := fs.String("destination", "", "topic to move the messages to, the original topic if empty")
+	filter := fs.String("filter", "", "only move messages whose value matches this regular expression")
+	from := fs.Int("from", 0, "first offset to move")
+	to := fs.Int("to", -1, "last offset to move, -1 for all")
+	rate := fs.Float64("rate", 0, "messages per second, 0 for no limit")
+	positional, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	request := server.RedriveRequest{
+		Destination: *destination,
+		Filter:      *filter,
+		FromOffset:  *from,
+		RateLimit:   *rate,
+	}
+	if *to >= 0 {
+		request.ToOffset = to
+	}
+
+	response, err := e.client.Redrive(positional[0], request)
+	if err != nil {
+		return err
+	}
+
+	return e.out.print(response, []string{"SOURCE", "DESTINATION", "MOVED", "FAILED"}, [][]string{{
+		response.Source,
+		response.Destination,
+		strconv.Itoa(response.Moved),
+		strconv.Itoa(response.Failed),
+	}})
+}
+
+func runWhoAmI(e *env, args []string) error {
+	fs := newFlagSet(e, "whoami")
+	if _, err := parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	principal, err := e.client.WhoAmI()
+	if err != nil {
+		return err
+	}
+
+	return e.out.print(principal, []string{"NAME", "METHOD", "ROLES"}, [][]string{
+		{orDash(principal.Name), principal.Method, orDash(strings.Join(principal.Roles, ","))},
+	})
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
+
+var aclHeader = []string{"ID", "PRINCIPAL", "ROLE", "TOPIC", "ACTIONS", "STATIC"}
+
+func aclRow(rule server.ACLRule) []string {
+	return []string{
+		rule.Id,
+		orDash(rule.Principal),
+		orDash(rule.Role),
+		rule.Topic,
+		strings.Join(rule.Actions, ","),
+		strconv.FormatBool(rule.Static),
+	}
+}
+
+func runACLs(e *env, args []string) error {
+	fs := newFlagSet(e, "acls")
+	if _, err := parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	rules, err := e.client.GetACLs()
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(rules))
+	for _, rule := range rules {
+		rows = append(rows, aclRow(rule))
+	}
+
+	return e.out.print(server.ACLRulesResponse{Rules: rules}, aclHeader, rows)
+}
+
+func runGrant(e *env, args []string) error {
+	fs := newFlagSet(e, "grant")
+	principal := fs.String("principal", "", "principal the rule applies to, * for everyone")
+	role := fs.String("role", "", "role the rule applies to")
+	positional, err := parseArgs(fs, args, 2, 2)
+	if err != nil {
+		return err
+	}
+
+	rule, err := e.client.AddACL(server.ACLRule{
+		Principal: *principal,
+		Role:      *role,
+		Topic:     positional[0],
+		Actions:   strings.Split(positional[1], ","),
+	})
+	if err != nil {
+		return err
+	}
+
+	return e.out.print(rule, aclHeader, [][]string{aclRow(rule)})
+}
+
+func runRevoke(e *env, args []string) error {
+	fs := newFlagSet(e, "revoke")
+	positional, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	return e.client.DeleteACL(positional[0])
+}
+
+func runLimits(e *env, args []string) error {
+	fs := newFlagSet(e, "limits")
+	if _, err := parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	limiters, err := e.client.GetRateLimits()
+	if err != nil {
+		return err
+	}
+
+	rate := func(limit float64, tokens float64) string {
+		if limit == 0 {
+			return "-"
+		}
+		return fmt.Sprintf("%.1f/%g", tokens, limit)
+	}
+
+	rows := make([][]string, 0, len(limiters))
+	for _, l := range limiters {
+		rows = append(rows, []string{
+			l.Direction,
+			l.Kind,
+			l.Key,
+			rate(l.Limit.MessagesPerSecond, l.MessageTokens),
+			rate(l.Limit.BytesPerSecond, l.ByteTokens),
+		})
+	}
+
+	return e.out.print(server.RateLimitsResponse{Limiters: limiters}, []string{"DIRECTION", "KIND", "KEY", "MESSAGES", "BYTES"}, rows)
+}
+
+func printReplication(e *env, response server.ReplicationResponse) error {
+	role := response.Role
+	if response.Leader != "" {
+		role += " of " + response.Leader
+	}
+
+	var rows [][]string
+	for _, p := range response.Partitions {
+		partition := []string{p.Namespace, p.Topic, strconv.Itoa(p.Partition), strconv.Itoa(p.HighWatermark)}
+		if response.Role == server.RoleFollower {
+			rows = append(rows, append(partition, "leader", strconv.Itoa(p.Lag), strconv.FormatBool(p.LastFetch != nil && p.Lag == 0)))
+			continue
+		}
+		for _, r := range p.Replicas {
+			rows = append(rows, append(partition, r.Id, strconv.Itoa(r.Lag), strconv.FormatBool(r.InSync)))
+		}
+	}
+
+	if e.out.format == formatJSON {
+		return e.out.print(response, nil, nil)
+	}
+
+	if err := e.out.print(nil, nil, [][]string{{"Node:", response.NodeId}, {"Role:", role}}); err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+
+	fmt.Fprintln(e.out.w)
+	return e.out.print(nil, []string{"NAMESPACE", "TOPIC", "PARTITION", "HIGH", "REPLICA", "LAG", "IN SYNC"}, rows)
+}
+
+func runReplication(e *env, args []string) error {
+	fs := newFlagSet(e, "replication")
+	if _, err := parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	response, err := e.client.GetReplication()
+	if err != nil {
+		return err
+	}
+
+	return printReplication(e, response)
+}
+
+func runPromote(e *env, args []string) error {
+	fs := newFlagSet(e, "promote")
+	if _, err := parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	response, err := e.client.Promote()
+	if err != nil {
+		return err
+	}
+
+	return printReplication(e, response)
+}
+
+func runFollow(e *env, args []string) error {
+	fs := newFlagSet(e, "follow")
+	positional, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	response, err := e.client.Follow(positional[0])
+	if err != nil {
+		return err
+	}
+
+	return printReplication(e, response)
+}
+
+func printCluster(e *env, response server.ClusterResponse) error {
+	if e.out.format == formatJSON {
+		return e.out.print(response, nil, nil)
+	}
+
+	leader := response.Leader
+	if leader == "" {
+		leader = "-"
+	}
+	summary := [][]string{
+		{"Node:", response.NodeId},
+		{"Role:", response.Role},
+		{"Term:", strconv.Itoa(response.Term)},
+		{"Leader:", leader},
+		{"Commit:", strconv.Itoa(response.CommitIndex)},
+	}
+	if err := e.out.print(nil, nil, summary); err != nil {
+		return err
+	}
+
+	members := make([][]string, 0, len(response.Members))
+	for _, m := range response.Members {
+		contact := "-"
+		if m.LastContact != nil {
+			contact = m.LastContact.Format(time.RFC3339)
+		}
+		members = append(members, []string{m.Id, m.Addr, strconv.FormatBool(m.Leader), strconv.Itoa(m.MatchIndex), contact})
+	}
+	fmt.Fprintln(e.out.w)
+	if err := e.out.print(nil, []string{"MEMBER", "ADDR", "LEADER", "MATCH", "LAST CONTACT"}, members); err != nil {
+		return err
+	}
+
+	if len(response.Partitions) == 0 {
+		return nil
+	}
+
+	partitions := make([][]string, 0, len(response.Partitions))
+	for _, p := range response.Partitions {
+		partitions = append(partitions, []string{p.Namespace, p.Topic, strconv.Itoa(p.Partition), p.Leader, strings.Join(p.Replicas, ","), strconv.Itoa(p.Epoch)})
+	}
+	fmt.Fprintln(e.out.w)
+	return e.out.print(nil, []string{"NAMESPACE", "TOPIC", "PARTITION", "LEADER", "REPLICAS", "EPOCH"}, partitions)
+}
+
+func runCluster(e *env, args []string) error {
+	fs := newFlagSet(e, "cluster")
+	if _, err := parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	response, err := e.client.GetCluster()
+	if err != nil {
+		return err
+	}
+
+	return printCluster(e, response)
+}
+
+func runJoin(e *env, args []string) error {
+	fs := newFlagSet(e, "join")
+	positional, err := parseArgs(fs, args, 2, 2)
+	if err != nil {
+		return err
+	}
+
+	response, err := e.client.AddClusterMember(positional[0], positional[1])
+	if err != nil {
+		return err
+	}
+
+	return printCluster(e, response)
+}
+
+func runLeave(e *env, args []string) error {
+	fs := newFlagSet(e, "leave")
+	positional, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	response, err := e.client.RemoveClusterMember(positional[0])
+	if err != nil {
+		return err
+	}
+
+	return printCluster(e, response)
+}
+
+func runMirrors(e *env, args []string) error {
+	fs := newFlagSet(e, "mirrors")
+	if _, err := parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	mirrors, err := e.client.GetMirrors()
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0)
+	for _, m := range mirrors {
+		for _, p := range m.Partitions {
+			lastMirrored := "-"
+			if p.LastMirrored != nil {
+				lastMirrored = p.LastMirrored.Format(time.RFC3339)
+			}
+			rows = append(rows, []string{
+				m.Source,
+				p.SourceTopic,
+				strconv.Itoa(p.Partition),
+				p.Topic,
+				strconv.Itoa(p.Offset),
+				strconv.Itoa(p.Lag),
+				strconv.FormatInt(p.Mirrored, 10),
+				strconv.FormatInt(p.Skipped, 10),
+				lastMirrored,
+			})
+		}
+		if m.LastError != "" {
+			fmt.Fprintf(e.stderr, "mirror of %s: %s\n", m.Source, m.LastError)
+		}
+	}
+
+	return e.out.print(server.MirrorsResponse{Mirrors: mirrors}, []string{"SOURCE", "TOPIC", "PARTITION", "DESTINATION", "OFFSET", "LAG", "MIRRORED", "SKIPPED", "LAST MIRRORED"}, rows)
+}
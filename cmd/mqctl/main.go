@@ -0,0 +1,237 @@
+// Command mqctl publishes, consumes and administers topics of a message
+// queue broker.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/mdkelley02/message-queue/client"
+)
+
+const defaultAddr = "localhost:8080"
+
+// env holds everything a command needs from its surroundings so that
+// commands can be run in tests.
+type env struct {
+	client client.IMessageQueueClient
+	out    printer
+	stdin  io.Reader
+	stderr io.Writer
+	// interrupt is closed when the command should stop, e.g. on ctrl-c
+	interrupt <-chan struct{}
+	// usage of the command being run
+	usage string
+}
+
+type command struct {
+	usage   string
+	summary string
+	run     func(e *env, args []string) error
+}
+
+var commands = map[string]command{
+	"topics":      {"topics", "list topics", runTopics},
+	"describe":    {"describe <topic>", "show a topic with its partitions and consumer groups", runDescribe},
+	"create":      {"create [config flags] <topic>", "create a topic", runCreate},
+	"config":      {"config [config flags] <topic>", "change the config of a topic, keeping what is not given", runConfig},
+	"delete":      {"delete <topic>", "delete a topic and its messages", runDelete},
+	"purge":       {"purge <topic>", "remove every message of a topic", runPurge},
+	"publish":     {"publish [--key k] [--partition n] [--file f] <topic> [message...]", "publish the messages, the lines of a file or of stdin", runPublish},
+	"consume":     {"consume [--group g] [--partitions 0,1] [--count n] [--nack] <topic>", "consume and acknowledge messages", runConsume},
+	"tail":        {"tail [--partition n] [--from-beginning] [--count n] <topic>", "follow stored messages without consuming them", runTail},
+	"lag":         {"lag [topic]", "show consumer group lag", runLag},
+	"redrive":     {"redrive [--destination d] [--filter re] [--from n] [--to n] [--rate r] <topic>", "move dead lettered messages back", runRedrive},
+	"whoami":      {"whoami", "show the principal the broker sees", runWhoAmI},
+	"acls":        {"acls", "list access control rules", runACLs},
+	"grant":       {"grant --principal p | --role r <topic pattern> <publish,subscribe,admin>", "add an access control rule", runGrant},
+	"revoke":      {"revoke <rule id>", "remove an access control rule", runRevoke},
+	"limits":      {"limits", "show the tokens left of every rate limited principal, address and topic", runLimits},
+	"namespaces":  {"namespaces", "list namespaces with their usage and quotas", runNamespaces},
+	"ns-create":   {"ns-create [quota flags] [--dead-letter=false] <namespace>", "create a namespace", runNamespaceCreate},
+	"ns-config":   {"ns-config [quota flags] [--dead-letter=false] <namespace>", "change the quotas of a namespace, keeping what is not given", runNamespaceConfig},
+	"ns-delete":   {"ns-delete <namespace>", "delete a namespace with its topics and messages", runNamespaceDelete},
+	"replication": {"replication", "show the replication role of the broker and the lag of every partition", runReplication},
+	"promote":     {"promote", "make a follower the leader", runPromote},
+	"follow":      {"follow <leader url>", "make the broker follow a leader", runFollow},
+	"cluster":     {"cluster", "show the members of the cluster, its leader and who leads every partition", runCluster},
+	"join":        {"join <member id> <member url>", "add a broker to the cluster", runJoin},
+	"leave":       {"leave <member id>", "remove a broker from the cluster", runLeave},
+	"mirrors":     {"mirrors", "show how far the mirrors copied the topics of other brokers", runMirrors},
+}
+
+func main() {
+	interrupt := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-signals
+		close(interrupt)
+	}()
+
+	if err := run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr, interrupt); err != nil {
+		if !errors.Is(err, flag.ErrHelp) {
+			fmt.Fprintln(os.Stderr, "mqctl:", err)
+		}
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer, interrupt <-chan struct{}) error {
+	fs := flag.NewFlagSet("mqctl", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { usage(stderr) }
+
+	addr := fs.String("addr", envOr("MQCTL_ADDR", defaultAddr), "broker address, also MQCTL_ADDR")
+	output := fs.String("o", "table", "output format, table or json")
+	verbose := fs.Bool("v", false, "log client errors")
+	useTLS := fs.Bool("tls", false, "connect over TLS, implied by --ca and --cert")
+	caFile := fs.String("ca", envOr("MQCTL_CA", ""), "CA bundle to verify the broker with, also MQCTL_CA")
+	certFile := fs.String("cert", envOr("MQCTL_CERT", ""), "client certificate for mutual TLS, also MQCTL_CERT")
+	keyFile := fs.String("key", envOr("MQCTL_KEY", ""), "private key of the client certificate, also MQCTL_KEY")
+	apiKey := fs.String("api-key", envOr("MQCTL_API_KEY", ""), "API key, also MQCTL_API_KEY")
+	token := fs.String("token", envOr("MQCTL_TOKEN", ""), "bearer token, also MQCTL_TOKEN")
+	namespace := fs.String("n", envOr("MQCTL_NAMESPACE", ""), "namespace of the topics, also MQCTL_NAMESPACE")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	// the client logs every failed request; the error is reported anyway
+	level := slog.LevelError + 1
+	if *verbose {
+		level = slog.LevelDebug
+	}
+	slog.SetDefault(slog.New(slog.NewTextHandler(stderr, &slog.HandlerOptions{Level: level})))
+
+	if *output != formatTable && *output != formatJSON {
+		return fmt.Errorf("unknown output format %q", *output)
+	}
+
+	if fs.NArg() == 0 {
+		usage(stderr)
+		return flag.ErrHelp
+	}
+
+	cmd, ok := commands[fs.Arg(0)]
+	if !ok {
+		usage(stderr)
+		return fmt.Errorf("unknown command %q", fs.Arg(0))
+	}
+
+	var opts []client.ClientOption
+	if *useTLS || *caFile != "" || *certFile != "" {
+		tlsConfig, err := client.NewTLSConfig(*caFile, *certFile, *keyFile)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, client.WithTLS(tlsConfig))
+	}
+	if *apiKey != "" {
+		opts = append(opts, client.WithAPIKey(*apiKey))
+	}
+	if *token != "" {
+		opts = append(opts, client.WithToken(*token))
+	}
+	if *namespace != "" {
+		opts = append(opts, client.WithNamespace(*namespace))
+	}
+
+	return cmd.run(&env{
+		client:    client.NewMessageQueueClient(*addr, false, opts...),
+		out:       printer{w: stdout, format: *output},
+		stdin:     stdin,
+		stderr:    stderr,
+		interrupt: interrupt,
+		usage:     cmd.usage,
+	}, fs.Args()[1:])
+}
+
+func usage(w io.Writer) {
+	fmt.Fprintf(w, "Usage: mqctl [--addr host:port] [--tls] [--ca f] [--cert f --key f] [--api-key k | --token t] [-n namespace] [-o table|json] [-v] <command> [arguments]\n\nCommands:\n")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-10s %s\n", name, commands[name].summary)
+		fmt.Fprintf(w, "  %-10s   mqctl %s\n", "", commands[name].usage)
+	}
+}
+
+// parseArgs parses the flags of a command, which may come before, after or
+// between its positional arguments, and checks the number of positional
+// arguments. Everything after -- is positional.
+func parseArgs(fs *flag.FlagSet, args []string, min int, max int) ([]string, error) {
+	var rest []string
+	for i, arg := range args {
+		if arg == "--" {
+			args, rest = args[:i], args[i+1:]
+			break
+		}
+	}
+
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			break
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+	positional = append(positional, rest...)
+
+	if len(positional) < min || (max >= 0 && len(positional) > max) {
+		fs.Usage()
+		return nil, fmt.Errorf("%s: wrong number of arguments", fs.Name())
+	}
+
+	return positional, nil
+}
+
+func newFlagSet(e *env, name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(e.stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(e.stderr, "Usage: mqctl %s\n", e.usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func envOr(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// parseInts reads a comma separated list of integers.
+func parseInts(s string) ([]int, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var ints []int
+	for _, field := range strings.Split(s, ",") {
+		var n int
+		if _, err := fmt.Sscanf(strings.TrimSpace(field), "%d", &n); err != nil {
+			return nil, fmt.Errorf("invalid number %q", field)
+		}
+		ints = append(ints, n)
+	}
+	return ints, nil
+}
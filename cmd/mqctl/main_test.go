@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mdkelley02/message-queue/server"
+	"github.com/mdkelley02/message-queue/storage"
+)
+
+const testAddr = "localhost:8086"
+
+// mqctl runs the command against the test broker and returns its output.
+func mqctl(t *testing.T, stdin string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	interrupt := make(chan struct{})
+	err := run(append([]string{"--addr", testAddr}, args...), strings.NewReader(stdin), &stdout, &stderr, interrupt)
+	return stdout.String(), err
+}
+
+func mustMqctl(t *testing.T, args ...string) string {
+	out, err := mqctl(t, "", args...)
+	if err != nil {
+		t.Fatalf("mqctl %s: %v", strings.Join(args, " "), err)
+	}
+	return out
+}
+
+func Test_mqctl(t *testing.T) {
+	s := server.NewServer(server.ServerConfig{
+		ServerAddr:      ":8086",
+		MakeStorageFunc: storage.NewStorage,
+	})
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- s.Start()
+	}()
+	defer func() {
+		http.DefaultClient.CloseIdleConnections()
+		s.Stop()
+		<-stopped
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", testAddr)
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("server did not start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Run("topics are created, configured and described", func(t *testing.T) {
+		out := mustMqctl(t, "create", "--partitions", "2", "--delivery-mode", "at-least-once", "orders")
+		assert.Contains(t, out, "orders")
+		assert.Contains(t, out, "at-least-once")
+
+		out = mustMqctl(t, "-o", "json", "config", "orders", "--retention", "1h", "--retry-max-attempts", "3")
+		var topic server.TopicResponse
+		if err := json.Unmarshal([]byte(out), &topic); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, server.Duration(time.Hour), topic.Config.Retention)
+		assert.Equal(t, 2, topic.Config.Partitions)
+		assert.Equal(t, server.DeliveryAtLeastOnce, topic.Config.DeliveryMode)
+		assert.Equal(t, 3, topic.Config.Retry.MaxAttempts)
+
+		out = mustMqctl(t, "topics")
+		assert.Contains(t, out, "orders")
+
+		out = mustMqctl(t, "describe", "orders")
+		assert.Contains(t, out, "Retention:")
+		assert.Contains(t, out, "1h0m0s")
+		assert.Contains(t, out, "PARTITION")
+
+		_, err := mqctl(t, "", "describe", "missing")
+		assert.ErrorContains(t, err, "404")
+	})
+
+	t.Run("messages are published from arguments and stdin and consumed", func(t *testing.T) {
+		mustMqctl(t, "publish", "--key", "k", "events", "one", "two")
+		if _, err := mqctl(t, "three\nfour\n", "publish", "events"); err != nil {
+			t.Fatal(err)
+		}
+
+		out := mustMqctl(t, "tail", "--from-beginning", "--count", "4", "events")
+		assert.Equal(t, 4, strings.Count(out, "events-0-"))
+
+		out = mustMqctl(t, "-o", "json", "consume", "--count", "4", "events")
+		values := make([]string, 0, 4)
+		decoder := json.NewDecoder(strings.NewReader(out))
+		for decoder.More() {
+			var d server.Delivery
+			if err := decoder.Decode(&d); err != nil {
+				t.Fatal(err)
+			}
+			values = append(values, d.Value)
+		}
+		assert.Equal(t, []string{"one", "two", "three", "four"}, values)
+	})
+
+	t.Run("consume stops reading at the count", func(t *testing.T) {
+		mustMqctl(t, "create", "--delivery-mode", "at-least-once", "stock")
+		mustMqctl(t, "publish", "stock", "s1", "s2")
+
+		for _, value := range []string{"s1", "s2"} {
+			out := mustMqctl(t, "-o", "json", "consume", "--count", "1", "stock")
+			var d server.Delivery
+			if err := json.Unmarshal([]byte(out), &d); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, value, d.Value)
+			// the second message was never handed back to the broker
+			assert.Equal(t, 1, d.Attempt)
+		}
+	})
+
+	t.Run("consume returns when the server ends the subscription", func(t *testing.T) {
+		mustMqctl(t, "create", "shortlived")
+
+		consumed := make(chan error, 1)
+		go func() {
+			_, err := mqctl(t, "", "consume", "shortlived")
+			consumed <- err
+		}()
+
+		assert.Eventually(t, func() bool {
+			out, err := mqctl(t, "", "-o", "json", "describe", "shortlived")
+			return err == nil && strings.Contains(out, `"subscribers": 1`)
+		}, time.Second, 10*time.Millisecond)
+		mustMqctl(t, "delete", "shortlived")
+
+		select {
+		case err := <-consumed:
+			assert.Error(t, err)
+		case <-time.After(time.Second):
+			t.Fatal("consume did not return")
+		}
+	})
+
+	t.Run("lag and redrive are reported", func(t *testing.T) {
+		mustMqctl(t, "create", "--delivery-mode", "at-least-once", "--retry-max-attempts", "1", "payments")
+		mustMqctl(t, "publish", "payments", "p1")
+		mustMqctl(t, "consume", "--nack", "--count", "1", "payments")
+
+		assert.Eventually(t, func() bool {
+			out, err := mqctl(t, "", "topics")
+			return err == nil && strings.Contains(out, server.DeadLetterTopic("payments"))
+		}, time.Second, 10*time.Millisecond)
+
+		out := mustMqctl(t, "lag", "payments")
+		assert.Contains(t, out, "GROUP")
+		assert.Contains(t, out, server.DefaultGroup)
+
+		out = mustMqctl(t, "-o", "json", "redrive", "payments")
+		var response server.RedriveResponse
+		if err := json.Unmarshal([]byte(out), &response); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 1, response.Moved)
+	})
+
+	t.Run("bad usage is rejected", func(t *testing.T) {
+		_, err := mqctl(t, "", "frobnicate")
+		assert.ErrorContains(t, err, "unknown command")
+
+		_, err = mqctl(t, "", "publish")
+		assert.ErrorContains(t, err, "wrong number of arguments")
+
+		_, err = mqctl(t, "", "-o", "xml", "topics")
+		assert.ErrorContains(t, err, "unknown output format")
+	})
+}
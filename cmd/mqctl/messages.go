@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/mdkelley02/message-queue/client"
+	"github.com/mdkelley02/message-queue/server"
+)
+
+func runPublish(e *env, args []string) error {
+	fs := newFlagSet(e, "publish")
+	key := fs.String("key", "", "message key")
+	partition := fs.Int("partition", -1, "publish to this partition instead of letting the broker pick")
+	file := fs.String("file", "", "publish every line of the file, - for stdin")
+	positional, err := parseArgs(fs, args, 1, -1)
+	if err != nil {
+		return err
+	}
+
+	topic, messages := positional[0], positional[1:]
+	if len(messages) > 0 && *file != "" {
+		return errors.New("publish: give messages or --file, not both")
+	}
+
+	publish := func(body string) error {
+		request := server.PublishRequest{Body: body, Key: *key}
+		if *partition >= 0 {
+			request.Partition = partition
+		}
+
+		response, err := e.client.PublishMessage(topic, request)
+		if err != nil {
+			return err
+		}
+
+		return e.out.stream(response, []string{response.MessageId, strconv.Itoa(response.Partition), strconv.Itoa(response.Offset)})
+	}
+
+	if len(messages) > 0 {
+		for _, message := range messages {
+			if err := publish(message); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// without messages, publish each line of the file or stdin
+	var r io.Reader = e.stdin
+	if *file != "" && *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if err := publish(scanner.Text()); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+func deliveryRow(d server.Delivery) []string {
+	return []string{
+		d.MessageId,
+		strconv.Itoa(d.Partition),
+		strconv.Itoa(d.Offset),
+		strconv.Itoa(d.Attempt),
+		d.Key,
+		d.Value,
+	}
+}
+
+func runConsume(e *env, args []string) error {
+	fs := newFlagSet(e, "consume")
+	group := fs.String("group", "", "consumer group, the default group if empty")
+	partitionList := fs.String("partitions", "", "comma separated partitions, all if empty")
+	count := fs.Int("count", 0, "stop after this many messages, 0 to run until interrupted")
+	nack := fs.Bool("nack", false, "reject every message instead of acknowledging it")
+	positional, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	partitions, err := parseInts(*partitionList)
+	if err != nil {
+		return err
+	}
+
+	var opts []client.SubscribeOption
+	if *group != "" {
+		opts = append(opts, client.WithGroup(*group))
+	}
+	if len(partitions) > 0 {
+		opts = append(opts, client.WithPartitions(partitions...))
+	}
+	// the subscription ends at the count, so no message past it is taken
+	// from the broker
+	done := make(chan error, 1)
+	opts = append(opts, client.WithLimit(*count), client.WithDone(done))
+
+	errRejected := errors.New("rejected by mqctl")
+
+	quit, err := e.client.Subscribe(positional[0], func(d server.Delivery) error {
+		if err := e.out.stream(d, deliveryRow(d)); err != nil {
+			fmt.Fprintln(e.stderr, "mqctl:", err)
+		}
+
+		if *nack {
+			return errRejected
+		}
+		return nil
+	}, opts...)
+	if err != nil {
+		return err
+	}
+	defer close(quit)
+
+	select {
+	case err := <-done:
+		return err
+	case <-e.interrupt:
+	}
+
+	return nil
+}
+
+func runTail(e *env, args []string) error {
+	fs := newFlagSet(e, "tail")
+	partition := fs.Int("partition", -1, "only follow this partition")
+	fromBeginning := fs.Bool("from-beginning", false, "start at the oldest stored message instead of the newest")
+	count := fs.Int("count", 0, "stop after this many messages, 0 to run until interrupted")
+	interval := fs.Duration("interval", 500*time.Millisecond, "how often to look for new messages")
+	positional, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	name := positional[0]
+	topic, err := e.client.GetTopic(name)
+	if err != nil {
+		return err
+	}
+
+	// next holds the offset to read from for every followed partition
+	next := make(map[int]int)
+	for _, p := range topic.Partitions {
+		if *partition >= 0 && p.Id != *partition {
+			continue
+		}
+		next[p.Id] = p.HighWatermark
+		if *fromBeginning {
+			next[p.Id] = p.LowWatermark
+		}
+	}
+	if len(next) == 0 {
+		return fmt.Errorf("tail: topic %s has no partition %d", name, *partition)
+	}
+
+	ids := make([]int, 0, len(next))
+	for id := range next {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+	printed := 0
+	for {
+		for _, id := range ids {
+			page, err := e.client.BrowseMessages(name, id, next[id], 100)
+			if err != nil {
+				return err
+			}
+
+			for _, msg := range page.Messages {
+				if err := e.out.stream(msg, []string{msg.Id, strconv.Itoa(msg.Partition), strconv.Itoa(msg.Offset), msg.Key, msg.Value}); err != nil {
+					return err
+				}
+
+				printed++
+				if *count > 0 && printed >= *count {
+					return nil
+				}
+			}
+			next[id] = page.NextOffset
+		}
+
+		select {
+		case <-ticker.C:
+		case <-e.interrupt:
+			return nil
+		}
+	}
+}
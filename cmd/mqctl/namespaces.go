@@ -0,0 +1,136 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+
+	"github.com/mdkelley02/message-queue/server"
+)
+
+var namespaceHeader = []string{"NAMESPACE", "TOPICS", "BYTES", "CONNECTIONS", "QUOTAS", "DEAD LETTER"}
+
+func namespaceRow(ns server.NamespaceResponse) []string {
+	q := ns.Config.Quotas
+	quotas := fmt.Sprintf("topics %s, bytes %s, rate %s/s, connections %s",
+		limitString(q.MaxTopics), limitString(q.MaxBytes), orNone(q.MaxPublishRate != 0, strconv.FormatFloat(q.MaxPublishRate, 'g', -1, 64)), limitString(q.MaxConnections))
+
+	return []string{
+		ns.Name,
+		strconv.Itoa(ns.Topics),
+		strconv.Itoa(ns.Bytes),
+		strconv.Itoa(ns.Connections),
+		quotas,
+		strconv.FormatBool(!ns.Config.DeadLetter.Disabled),
+	}
+}
+
+func limitString(n int) string {
+	return orNone(n != 0, strconv.Itoa(n))
+}
+
+// namespaceConfigFlags are the flags of ns-create and ns-config.
+type namespaceConfigFlags struct {
+	fs             *flag.FlagSet
+	maxTopics      int
+	maxBytes       int
+	maxPublishRate float64
+	maxConnections int
+	deadLetter     bool
+}
+
+func newNamespaceConfigFlags(fs *flag.FlagSet) *namespaceConfigFlags {
+	f := &namespaceConfigFlags{fs: fs}
+	fs.IntVar(&f.maxTopics, "max-topics", 0, "maximum number of topics, 0 for the broker default")
+	fs.IntVar(&f.maxBytes, "max-bytes", 0, "maximum size of the stored messages, 0 for no limit")
+	fs.Float64Var(&f.maxPublishRate, "max-publish-rate", 0, "messages per second, 0 for no limit")
+	fs.IntVar(&f.maxConnections, "max-connections", 0, "maximum number of subscriptions, 0 for no limit")
+	fs.BoolVar(&f.deadLetter, "dead-letter", true, "dead letter messages without attempts left instead of dropping them")
+	return f
+}
+
+// apply returns base with the flags that were given on the command line.
+func (f *namespaceConfigFlags) apply(base server.NamespaceConfig) server.NamespaceConfig {
+	cfg := base
+	f.fs.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "max-topics":
+			cfg.Quotas.MaxTopics = f.maxTopics
+		case "max-bytes":
+			cfg.Quotas.MaxBytes = f.maxBytes
+		case "max-publish-rate":
+			cfg.Quotas.MaxPublishRate = f.maxPublishRate
+		case "max-connections":
+			cfg.Quotas.MaxConnections = f.maxConnections
+		case "dead-letter":
+			cfg.DeadLetter.Disabled = !f.deadLetter
+		}
+	})
+	return cfg
+}
+
+func runNamespaces(e *env, args []string) error {
+	fs := newFlagSet(e, "namespaces")
+	if _, err := parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	namespaces, err := e.client.GetNamespaces()
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(namespaces))
+	for _, ns := range namespaces {
+		rows = append(rows, namespaceRow(ns))
+	}
+
+	return e.out.print(server.GetNamespacesResponse{Namespaces: namespaces}, namespaceHeader, rows)
+}
+
+func runNamespaceCreate(e *env, args []string) error {
+	fs := newFlagSet(e, "ns-create")
+	flags := newNamespaceConfigFlags(fs)
+	positional, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	ns, err := e.client.CreateNamespace(positional[0], flags.apply(server.NamespaceConfig{}))
+	if err != nil {
+		return err
+	}
+
+	return e.out.print(ns, namespaceHeader, [][]string{namespaceRow(ns)})
+}
+
+func runNamespaceConfig(e *env, args []string) error {
+	fs := newFlagSet(e, "ns-config")
+	flags := newNamespaceConfigFlags(fs)
+	positional, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	current, err := e.client.GetNamespace(positional[0])
+	if err != nil {
+		return err
+	}
+
+	ns, err := e.client.UpdateNamespaceConfig(positional[0], flags.apply(current.Config))
+	if err != nil {
+		return err
+	}
+
+	return e.out.print(ns, namespaceHeader, [][]string{namespaceRow(ns)})
+}
+
+func runNamespaceDelete(e *env, args []string) error {
+	fs := newFlagSet(e, "ns-delete")
+	positional, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	return e.client.DeleteNamespace(positional[0])
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+)
+
+// printer writes command results either as indented JSON or as a table.
+type printer struct {
+	w      io.Writer
+	format string
+}
+
+// print writes v as JSON, or the rows under header as a table.
+func (p printer) print(v any, header []string, rows [][]string) error {
+	if p.format == formatJSON {
+		encoder := json.NewEncoder(p.w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	}
+
+	tw := tabwriter.NewWriter(p.w, 0, 4, 2, ' ', 0)
+	if header != nil {
+		fmt.Fprintln(tw, strings.Join(header, "\t"))
+	}
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+// stream writes one record of a stream as a line of JSON or a tab separated
+// row.
+func (p printer) stream(v any, row []string) error {
+	if p.format == formatJSON {
+		return json.NewEncoder(p.w).Encode(v)
+	}
+
+	_, err := fmt.Fprintln(p.w, strings.Join(row, "\t"))
+	return err
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/mdkelley02/message-queue/server"
+)
+
+func runTopics(e *env, args []string) error {
+	fs := newFlagSet(e, "topics")
+	if _, err := parseArgs(fs, args, 0, 0); err != nil {
+		return err
+	}
+
+	topics, err := e.client.GetTopics()
+	if err != nil {
+		return err
+	}
+
+	rows := make([][]string, 0, len(topics))
+	for _, topic := range topics {
+		rows = append(rows, []string{topic})
+	}
+
+	return e.out.print(server.GetTopicsResponse{Topics: topics}, []string{"TOPIC"}, rows)
+}
+
+type describeResponse struct {
+	server.TopicResponse
+	Groups []server.GroupLagResponse `json:"groups"`
+}
+
+func runDescribe(e *env, args []string) error {
+	fs := newFlagSet(e, "describe")
+	positional, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	topic, err := e.client.GetTopic(positional[0])
+	if err != nil {
+		return err
+	}
+
+	lag, err := e.client.GetLag(positional[0])
+	if err != nil {
+		return err
+	}
+
+	if e.out.format == formatJSON {
+		return e.out.print(describeResponse{TopicResponse: topic, Groups: lag.Groups}, nil, nil)
+	}
+
+	cfg := topic.Config
+	if err := e.out.print(nil, nil, [][]string{
+		{"Name:", topic.Name},
+		{"Created:", topic.CreatedAt.Format(time.RFC3339)},
+		{"Storage:", cfg.Storage},
+		{"Delivery mode:", cfg.DeliveryMode},
+		{"Partitioner:", cfg.Partitioner},
+		{"Retention:", orNone(cfg.Retention != 0, time.Duration(cfg.Retention).String())},
+		{"Max size:", orNone(cfg.MaxSize != 0, strconv.Itoa(cfg.MaxSize))},
+		{"Retry:", retryString(cfg.Retry)},
+		{"Min in-sync replicas:", strconv.Itoa(cfg.MinInSyncReplicas)},
+		{"Depth:", strconv.Itoa(topic.Depth)},
+		{"Bytes:", strconv.Itoa(topic.Bytes)},
+		{"Subscribers:", strconv.Itoa(topic.Subscribers)},
+	}); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(e.out.w)
+	rows := make([][]string, 0, len(topic.Partitions))
+	for _, p := range topic.Partitions {
+		rows = append(rows, []string{
+			strconv.Itoa(p.Id),
+			strconv.Itoa(p.Depth),
+			strconv.Itoa(p.Bytes),
+			strconv.Itoa(p.LowWatermark),
+			strconv.Itoa(p.HighWatermark),
+		})
+	}
+	if err := e.out.print(nil, []string{"PARTITION", "DEPTH", "BYTES", "LOW", "HIGH"}, rows); err != nil {
+		return err
+	}
+
+	if len(lag.Groups) == 0 {
+		return nil
+	}
+
+	fmt.Fprintln(e.out.w)
+	return e.out.print(nil, lagHeader, groupRows(lag))
+}
+
+func orNone(set bool, value string) string {
+	if !set {
+		return "none"
+	}
+	return value
+}
+
+func retryString(p *server.RetryPolicy) string {
+	if p == nil {
+		return "immediate, unlimited"
+	}
+
+	attempts := "unlimited"
+	if p.MaxAttempts > 0 {
+		attempts = fmt.Sprintf("%d attempts", p.MaxAttempts)
+	}
+
+	return fmt.Sprintf("%s x%g up to %s, jitter %g, %s",
+		time.Duration(p.InitialDelay), p.Multiplier, orNone(p.MaxDelay != 0, time.Duration(p.MaxDelay).String()), p.Jitter, attempts)
+}
+
+// topicConfigFlags are the flags of create and config.
+type topicConfigFlags struct {
+	fs                *flag.FlagSet
+	storage           string
+	retention         time.Duration
+	maxSize           int
+	deliveryMode      string
+	partitions        int
+	partitioner       string
+	retryInitialDelay time.Duration
+	retryMultiplier   float64
+	retryMaxDelay     time.Duration
+	retryJitter       float64
+	retryMaxAttempts  int
+	minInSyncReplicas int
+}
+
+func newTopicConfigFlags(fs *flag.FlagSet) *topicConfigFlags {
+	f := &topicConfigFlags{fs: fs}
+	fs.StringVar(&f.storage, "storage", "", "memory or file")
+	fs.DurationVar(&f.retention, "retention", 0, "how long messages are kept, 0 until consumed")
+	fs.IntVar(&f.maxSize, "max-size", 0, "maximum number of messages, 0 for no limit")
+	fs.StringVar(&f.deliveryMode, "delivery-mode", "", "at-most-once or at-least-once")
+	fs.IntVar(&f.partitions, "partitions", 0, "number of partitions")
+	fs.StringVar(&f.partitioner, "partitioner", "", "hash or round-robin")
+	fs.DurationVar(&f.retryInitialDelay, "retry-initial-delay", 0, "delay before the first redelivery of a nacked message")
+	fs.Float64Var(&f.retryMultiplier, "retry-multiplier", 0, "factor the retry delay grows by per attempt")
+	fs.DurationVar(&f.retryMaxDelay, "retry-max-delay", 0, "upper bound of the retry delay")
+	fs.Float64Var(&f.retryJitter, "retry-jitter", 0, "fraction the retry delay is randomly spread by")
+	fs.IntVar(&f.retryMaxAttempts, "retry-max-attempts", 0, "deliveries before a message is dead lettered, 0 for no limit")
+	fs.IntVar(&f.minInSyncReplicas, "min-insync-replicas", 0, "in-sync followers a publish waits for, 0 to replicate asynchronously")
+	return f
+}
+
+// apply returns base with the flags that were given on the command line.
+func (f *topicConfigFlags) apply(base server.TopicConfig) server.TopicConfig {
+	cfg := base
+	if cfg.Retry != nil {
+		retry := *cfg.Retry
+		cfg.Retry = &retry
+	}
+
+	retry := func() *server.RetryPolicy {
+		if cfg.Retry == nil {
+			cfg.Retry = &server.RetryPolicy{}
+		}
+		return cfg.Retry
+	}
+
+	f.fs.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "storage":
+			cfg.Storage = f.storage
+		case "retention":
+			cfg.Retention = server.Duration(f.retention)
+		case "max-size":
+			cfg.MaxSize = f.maxSize
+		case "delivery-mode":
+			cfg.DeliveryMode = f.deliveryMode
+		case "partitions":
+			cfg.Partitions = f.partitions
+		case "partitioner":
+			cfg.Partitioner = f.partitioner
+		case "retry-initial-delay":
+			retry().InitialDelay = server.Duration(f.retryInitialDelay)
+		case "retry-multiplier":
+			retry().Multiplier = f.retryMultiplier
+		case "retry-max-delay":
+			retry().MaxDelay = server.Duration(f.retryMaxDelay)
+		case "retry-jitter":
+			retry().Jitter = f.retryJitter
+		case "retry-max-attempts":
+			retry().MaxAttempts = f.retryMaxAttempts
+		case "min-insync-replicas":
+			cfg.MinInSyncReplicas = f.minInSyncReplicas
+		}
+	})
+
+	return cfg
+}
+
+func runCreate(e *env, args []string) error {
+	fs := newFlagSet(e, "create")
+	flags := newTopicConfigFlags(fs)
+	positional, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	topic, err := e.client.CreateTopic(positional[0], flags.apply(server.TopicConfig{}))
+	if err != nil {
+		return err
+	}
+
+	return printTopic(e, topic)
+}
+
+func runConfig(e *env, args []string) error {
+	fs := newFlagSet(e, "config")
+	flags := newTopicConfigFlags(fs)
+	positional, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	current, err := e.client.GetTopic(positional[0])
+	if err != nil {
+		return err
+	}
+
+	topic, err := e.client.UpdateTopicConfig(positional[0], flags.apply(current.Config))
+	if err != nil {
+		return err
+	}
+
+	return printTopic(e, topic)
+}
+
+func printTopic(e *env, topic server.TopicResponse) error {
+	cfg := topic.Config
+	return e.out.print(topic, []string{"TOPIC", "STORAGE", "DELIVERY", "PARTITIONS", "RETENTION", "MAX SIZE", "RETRY"}, [][]string{{
+		topic.Name,
+		cfg.Storage,
+		cfg.DeliveryMode,
+		strconv.Itoa(cfg.Partitions),
+		orNone(cfg.Retention != 0, time.Duration(cfg.Retention).String()),
+		orNone(cfg.MaxSize != 0, strconv.Itoa(cfg.MaxSize)),
+		retryString(cfg.Retry),
+	}})
+}
+
+func runDelete(e *env, args []string) error {
+	fs := newFlagSet(e, "delete")
+	positional, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	if err := e.client.DeleteTopic(positional[0]); err != nil {
+		return err
+	}
+
+	return e.out.print(map[string]string{"deleted": positional[0]}, nil, [][]string{{"deleted", positional[0]}})
+}
+
+func runPurge(e *env, args []string) error {
+	fs := newFlagSet(e, "purge")
+	positional, err := parseArgs(fs, args, 1, 1)
+	if err != nil {
+		return err
+	}
+
+	purged, err := e.client.PurgeTopic(positional[0])
+	if err != nil {
+		return err
+	}
+
+	return e.out.print(server.PurgeTopicResponse{Purged: purged}, nil, [][]string{{"purged", strconv.Itoa(purged)}})
+}
@@ -0,0 +1,916 @@
+// Package config loads the broker configuration. Settings come from built-in
+// defaults, then an optional YAML file, then MQ_* environment variables and
+// finally command line flags, each overriding the one before.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/mdkelley02/message-queue/client"
+	"github.com/mdkelley02/message-queue/mirror"
+	"github.com/mdkelley02/message-queue/server"
+	"github.com/mdkelley02/message-queue/storage"
+)
+
+const envPrefix = "MQ_"
+
+type Config struct {
+	Server  ServerConfig  `yaml:"server"`
+	Storage StorageConfig `yaml:"storage"`
+	Topics  TopicConfig   `yaml:"topics"`
+	Limits  LimitsConfig  `yaml:"limits"`
+	Auth    AuthConfig    `yaml:"auth"`
+	ACL     ACLConfig     `yaml:"acl"`
+	Tracing TracingConfig `yaml:"tracing"`
+	Audit   AuditConfig   `yaml:"audit"`
+	// Replication is enabled by a node id.
+	Replication ReplicationConfig `yaml:"replication"`
+	// Cluster is enabled by its members, it needs replication.
+	Cluster ClusterConfig `yaml:"cluster"`
+	Mirrors MirrorsConfig `yaml:"mirrors"`
+}
+
+type ServerConfig struct {
+	Addr            string          `yaml:"addr"`
+	MetricsAddr     string          `yaml:"metricsAddr"`
+	BinaryAddr      string          `yaml:"binaryAddr"`
+	AckTimeout      time.Duration   `yaml:"ackTimeout"`
+	ShutdownTimeout time.Duration   `yaml:"shutdownTimeout"`
+	ShutdownDelay   time.Duration   `yaml:"shutdownDelay"`
+	Websocket       WebsocketConfig `yaml:"websocket"`
+	TLS             TLSConfig       `yaml:"tls"`
+}
+
+// TLSConfig serves the broker over TLS when a certificate is given.
+type TLSConfig struct {
+	CertFile     string `yaml:"certFile"`
+	KeyFile      string `yaml:"keyFile"`
+	ClientCAFile string `yaml:"clientCAFile"`
+	// ClientAuth is none, optional or require.
+	ClientAuth string `yaml:"clientAuth"`
+}
+
+func (c TLSConfig) enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+type WebsocketConfig struct {
+	ReadBufferSize  int `yaml:"readBufferSize"`
+	WriteBufferSize int `yaml:"writeBufferSize"`
+}
+
+type StorageConfig struct {
+	// Backend is the storage of topics that do not choose one.
+	Backend string `yaml:"backend"`
+	// DataDir keeps topic configs and file backed topics. Nothing is
+	// persisted when it is empty.
+	DataDir string `yaml:"dataDir"`
+}
+
+// TopicConfig holds the defaults of new topics.
+type TopicConfig struct {
+	Retention    time.Duration `yaml:"retention"`
+	MaxSize      int           `yaml:"maxSize"`
+	DeliveryMode string        `yaml:"deliveryMode"`
+	Partitions   int           `yaml:"partitions"`
+	Partitioner  string        `yaml:"partitioner"`
+	// MinInSyncReplicas is the number of in-sync followers a publish
+	// waits for.
+	MinInSyncReplicas int `yaml:"minInSyncReplicas"`
+}
+
+type LimitsConfig struct {
+	MaxTopics       int `yaml:"maxTopics"`
+	MaxMessageBytes int `yaml:"maxMessageBytes"`
+	// Publish rejects publishes over the rates, Consume slows down
+	// deliveries.
+	Publish RateLimitsConfig `yaml:"publish"`
+	Consume RateLimitsConfig `yaml:"consume"`
+}
+
+// RateLimitsConfig holds the rates each principal, client address and topic
+// is allowed on its own.
+type RateLimitsConfig struct {
+	Principal RateConfig `yaml:"principal"`
+	ClientIP  RateConfig `yaml:"clientIp"`
+	Topic     RateConfig `yaml:"topic"`
+}
+
+// RateConfig is a rate in messages and bytes per second, zero for no limit.
+type RateConfig struct {
+	Messages float64 `yaml:"messagesPerSecond"`
+	Bytes    float64 `yaml:"bytesPerSecond"`
+}
+
+func (c RateLimitsConfig) limits() server.RateLimits {
+	return server.RateLimits{
+		Principal: c.Principal.limit(),
+		ClientIP:  c.ClientIP.limit(),
+		Topic:     c.Topic.limit(),
+	}
+}
+
+func (c RateConfig) limit() server.RateLimit {
+	return server.RateLimit{MessagesPerSecond: c.Messages, BytesPerSecond: c.Bytes}
+}
+
+// TracingConfig records the spans of the broker. Trace context is passed on
+// to subscribers either way.
+type TracingConfig struct {
+	// SpanLog is a file every span is appended to as a line of JSON.
+	SpanLog string `yaml:"spanLog"`
+}
+
+// AuditConfig records administrative and security events in the $SYS.audit
+// topic and, when File is set, in a local file that is rotated by size.
+type AuditConfig struct {
+	Enabled      bool   `yaml:"enabled"`
+	File         string `yaml:"file"`
+	MaxFileBytes int64  `yaml:"maxFileBytes"`
+	MaxFiles     int    `yaml:"maxFiles"`
+}
+
+func (c AuditConfig) audit() *server.AuditConfig {
+	if !c.Enabled {
+		return nil
+	}
+	return &server.AuditConfig{File: c.File, MaxFileBytes: c.MaxFileBytes, MaxFiles: c.MaxFiles}
+}
+
+// ReplicationConfig replicates topics from a leader to its followers. The
+// broker follows Leader when it is set.
+type ReplicationConfig struct {
+	NodeId       string        `yaml:"nodeId"`
+	Leader       string        `yaml:"leader"`
+	APIKey       string        `yaml:"apiKey"`
+	LagTimeout   time.Duration `yaml:"lagTimeout"`
+	AckTimeout   time.Duration `yaml:"ackTimeout"`
+	SyncInterval time.Duration `yaml:"syncInterval"`
+}
+
+func (c ReplicationConfig) replication() *server.ReplicationConfig {
+	if c.NodeId == "" {
+		return nil
+	}
+	return &server.ReplicationConfig{
+		NodeId:       c.NodeId,
+		Leader:       c.Leader,
+		APIKey:       c.APIKey,
+		LagTimeout:   c.LagTimeout,
+		AckTimeout:   c.AckTimeout,
+		SyncInterval: c.SyncInterval,
+	}
+}
+
+// ClusterConfig makes the broker a member of a cluster that elects the
+// leader of the replicated topics.
+type ClusterConfig struct {
+	Members           []ClusterMemberConfig `yaml:"members,omitempty"`
+	HeartbeatInterval time.Duration         `yaml:"heartbeatInterval"`
+	ElectionTimeout   time.Duration         `yaml:"electionTimeout"`
+}
+
+type ClusterMemberConfig struct {
+	Id   string `yaml:"id"`
+	Addr string `yaml:"addr"`
+}
+
+func (c ClusterConfig) cluster() *server.ClusterConfig {
+	if len(c.Members) == 0 {
+		return nil
+	}
+
+	members := make([]server.ClusterMember, len(c.Members))
+	for i, m := range c.Members {
+		members[i] = server.ClusterMember{Id: m.Id, Addr: m.Addr}
+	}
+	return &server.ClusterConfig{
+		Members:           members,
+		HeartbeatInterval: c.HeartbeatInterval,
+		ElectionTimeout:   c.ElectionTimeout,
+	}
+}
+
+// MirrorsConfig copies topics of other brokers into this one, a mirror
+// runs for every source.
+type MirrorsConfig struct {
+	// Site names the broker in the path of mirrored messages.
+	Site string `yaml:"site"`
+	// APIKey authenticates the mirrors at this broker.
+	APIKey  string               `yaml:"apiKey"`
+	Sources []MirrorSourceConfig `yaml:"sources,omitempty"`
+}
+
+type MirrorSourceConfig struct {
+	Site string `yaml:"site"`
+	// Addr is the host:port of the source broker.
+	Addr string `yaml:"addr"`
+	// TLS connects to the source over TLS, trusting the CAs in CAFile or
+	// the system roots.
+	TLS       bool   `yaml:"tls"`
+	CAFile    string `yaml:"caFile"`
+	APIKey    string `yaml:"apiKey"`
+	Namespace string `yaml:"namespace"`
+	// Topics are names or patterns of source topics, copied into the same
+	// namespace of this broker.
+	Topics       []MirrorTopicConfig `yaml:"topics"`
+	PollInterval time.Duration       `yaml:"pollInterval"`
+	BatchSize    int                 `yaml:"batchSize"`
+}
+
+type MirrorTopicConfig struct {
+	Source      string `yaml:"source"`
+	Destination string `yaml:"destination,omitempty"`
+}
+
+// mirrorConfigs builds the settings of a mirror for every source, without
+// their clients.
+func (c Config) mirrorConfigs() []mirror.Config {
+	configs := make([]mirror.Config, 0, len(c.Mirrors.Sources))
+	for _, source := range c.Mirrors.Sources {
+		topics := make([]mirror.TopicMapping, len(source.Topics))
+		for j, t := range source.Topics {
+			topics[j] = mirror.TopicMapping{Source: t.Source, Destination: t.Destination}
+		}
+
+		checkpointFile := ""
+		if c.Storage.DataDir != "" {
+			checkpointFile = filepath.Join(c.Storage.DataDir, "mirrors", source.Site+".json")
+		}
+
+		configs = append(configs, mirror.Config{
+			Site:           c.Mirrors.Site,
+			SourceSite:     source.Site,
+			Topics:         topics,
+			CheckpointFile: checkpointFile,
+			PollInterval:   source.PollInterval,
+			BatchSize:      source.BatchSize,
+		})
+	}
+	return configs
+}
+
+// mirrors builds the config of a mirror for every source with its clients.
+// The mirrors publish to the broker at its own address.
+func (c Config) mirrors() ([]mirror.Config, error) {
+	if len(c.Mirrors.Sources) == 0 {
+		return nil, nil
+	}
+
+	host, port, err := net.SplitHostPort(c.Server.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("server.addr: %w", err)
+	}
+	if host == "" {
+		host = "localhost"
+	}
+
+	var localOpts []client.ClientOption
+	if c.Mirrors.APIKey != "" {
+		localOpts = append(localOpts, client.WithAPIKey(c.Mirrors.APIKey))
+	}
+	if c.Server.TLS.enabled() {
+		// the broker is trusted by its own certificate
+		tlsConfig, err := client.NewTLSConfig(c.Server.TLS.CertFile, "", "")
+		if err != nil {
+			return nil, fmt.Errorf("server.tls: %w", err)
+		}
+		localOpts = append(localOpts, client.WithTLS(tlsConfig))
+	}
+
+	configs := c.mirrorConfigs()
+	for i, source := range c.Mirrors.Sources {
+		var sourceOpts []client.ClientOption
+		if source.APIKey != "" {
+			sourceOpts = append(sourceOpts, client.WithAPIKey(source.APIKey))
+		}
+		if source.TLS {
+			tlsConfig, err := client.NewTLSConfig(source.CAFile, "", "")
+			if err != nil {
+				return nil, fmt.Errorf("mirrors.sources[%d]: %w", i, err)
+			}
+			sourceOpts = append(sourceOpts, client.WithTLS(tlsConfig))
+		}
+		if source.Namespace != "" {
+			sourceOpts = append(sourceOpts, client.WithNamespace(source.Namespace))
+		}
+
+		local := localOpts
+		if source.Namespace != "" {
+			local = append(append([]client.ClientOption{}, localOpts...), client.WithNamespace(source.Namespace))
+		}
+
+		configs[i].Source = client.NewMessageQueueClient(source.Addr, false, sourceOpts...)
+		configs[i].Local = client.NewMessageQueueClient(net.JoinHostPort(host, port), false, local...)
+	}
+
+	return configs, nil
+}
+
+// clusterMembersFlag reads the members of a cluster as id=url pairs
+// separated by commas.
+type clusterMembersFlag struct {
+	members *[]ClusterMemberConfig
+}
+
+func (f clusterMembersFlag) String() string {
+	if f.members == nil {
+		return ""
+	}
+
+	pairs := make([]string, len(*f.members))
+	for i, m := range *f.members {
+		pairs[i] = m.Id + "=" + m.Addr
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f clusterMembersFlag) Set(value string) error {
+	var members []ClusterMemberConfig
+	if value == "" {
+		*f.members = members
+		return nil
+	}
+	for _, pair := range strings.Split(value, ",") {
+		id, addr, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return fmt.Errorf("member %q is not id=url", pair)
+		}
+		members = append(members, ClusterMemberConfig{Id: id, Addr: addr})
+	}
+
+	*f.members = members
+	return nil
+}
+
+type AuthConfig struct {
+	// Required rejects requests without credentials.
+	Required bool           `yaml:"required"`
+	APIKeys  []APIKeyConfig `yaml:"apiKeys,omitempty"`
+	JWT      JWTConfig      `yaml:"jwt"`
+}
+
+type APIKeyConfig struct {
+	Name  string   `yaml:"name"`
+	Key   string   `yaml:"key"`
+	Roles []string `yaml:"roles,omitempty"`
+}
+
+// JWTConfig accepts HMAC signed bearer tokens when a secret is given, either
+// inline or in a file.
+type JWTConfig struct {
+	Secret     string        `yaml:"secret"`
+	SecretFile string        `yaml:"secretFile"`
+	Issuer     string        `yaml:"issuer"`
+	Audience   string        `yaml:"audience"`
+	Leeway     time.Duration `yaml:"leeway"`
+}
+
+func (c JWTConfig) enabled() bool {
+	return c.Secret != "" || c.SecretFile != ""
+}
+
+// ACLConfig enables authorization. The rules are static; rules added at
+// runtime are kept in the data directory.
+type ACLConfig struct {
+	Enabled bool            `yaml:"enabled"`
+	Rules   []ACLRuleConfig `yaml:"rules,omitempty"`
+}
+
+type ACLRuleConfig struct {
+	Principal string   `yaml:"principal,omitempty"`
+	Role      string   `yaml:"role,omitempty"`
+	Topic     string   `yaml:"topic"`
+	Actions   []string `yaml:"actions"`
+}
+
+func (c ACLRuleConfig) rule() server.ACLRule {
+	return server.ACLRule{Principal: c.Principal, Role: c.Role, Topic: c.Topic, Actions: c.Actions}
+}
+
+// minSecretBytes is the size of an HS256 hash; shorter secrets are easier to
+// brute force than the signature.
+const minSecretBytes = 32
+
+// redacted replaces secrets in the printed configuration.
+const redacted = "<redacted>"
+
+// Default returns the configuration used when nothing else is given.
+func Default() Config {
+	return Config{
+		Server: ServerConfig{
+			Addr:            ":8080",
+			MetricsAddr:     ":8081",
+			AckTimeout:      30 * time.Second,
+			ShutdownTimeout: 30 * time.Second,
+			Websocket: WebsocketConfig{
+				ReadBufferSize:  1024,
+				WriteBufferSize: 1024,
+			},
+			TLS: TLSConfig{
+				ClientAuth: server.ClientAuthNone,
+			},
+		},
+		Storage: StorageConfig{
+			Backend: server.StorageMemory,
+		},
+		Topics: TopicConfig{
+			DeliveryMode: server.DeliveryAtMostOnce,
+			Partitions:   1,
+			Partitioner:  server.PartitionerHash,
+		},
+	}
+}
+
+// Options are the command line settings that are not part of the
+// configuration itself.
+type Options struct {
+	Path        string
+	PrintConfig bool
+}
+
+// Load builds the configuration from args and the environment, looked up
+// with lookupEnv, and validates it. The YAML file is taken from --config or
+// MQ_CONFIG.
+func Load(args []string, lookupEnv func(string) (string, bool)) (Config, Options, error) {
+	// the flags are parsed twice: once to find the config file, and again
+	// after the file and environment are applied so that they win
+	var opts Options
+	scratch := Default()
+	fs := newFlagSet(&scratch, &opts, io.Discard)
+	if err := fs.Parse(args); err != nil {
+		return Config{}, opts, err
+	}
+
+	if opts.Path == "" {
+		opts.Path, _ = lookupEnv(envPrefix + "CONFIG")
+	}
+
+	cfg := Default()
+	if opts.Path != "" {
+		if err := cfg.readFile(opts.Path); err != nil {
+			return Config{}, opts, err
+		}
+	}
+
+	fs = newFlagSet(&cfg, &opts, io.Discard)
+	if err := applyEnv(fs, lookupEnv); err != nil {
+		return Config{}, opts, err
+	}
+	if err := fs.Parse(args); err != nil {
+		return Config{}, opts, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return Config{}, opts, err
+	}
+
+	return cfg, opts, nil
+}
+
+// Usage writes the flags and their environment variables to w.
+func Usage(w io.Writer) {
+	cfg := Default()
+	fs := newFlagSet(&cfg, &Options{}, w)
+	fmt.Fprintf(w, "Usage of message-queue:\n")
+	fs.PrintDefaults()
+	fmt.Fprintf(w, "\nEvery flag can also be set with an environment variable, e.g. --metrics-addr as %s.\n", envName("metrics-addr"))
+}
+
+func newFlagSet(cfg *Config, opts *Options, output io.Writer) *flag.FlagSet {
+	fs := flag.NewFlagSet("message-queue", flag.ContinueOnError)
+	fs.SetOutput(output)
+
+	fs.StringVar(&opts.Path, "config", opts.Path, "path of the YAML config file")
+	fs.BoolVar(&opts.PrintConfig, "print-config", opts.PrintConfig, "print the effective configuration and exit")
+
+	fs.StringVar(&cfg.Server.Addr, "addr", cfg.Server.Addr, "address of the message queue server")
+	fs.StringVar(&cfg.Server.MetricsAddr, "metrics-addr", cfg.Server.MetricsAddr, "address of the metrics server, empty to disable")
+	fs.StringVar(&cfg.Server.BinaryAddr, "binary-addr", cfg.Server.BinaryAddr, "address of the binary protocol server, empty to disable")
+	fs.DurationVar(&cfg.Server.AckTimeout, "ack-timeout", cfg.Server.AckTimeout, "how long subscribers have to acknowledge a delivery")
+	fs.DurationVar(&cfg.Server.ShutdownTimeout, "shutdown-timeout", cfg.Server.ShutdownTimeout, "how long shutdown waits for in-flight deliveries")
+	fs.DurationVar(&cfg.Server.ShutdownDelay, "shutdown-delay", cfg.Server.ShutdownDelay, "how long to keep serving with /readyz failing before shutting down")
+	fs.IntVar(&cfg.Server.Websocket.ReadBufferSize, "websocket-read-buffer-size", cfg.Server.Websocket.ReadBufferSize, "websocket read buffer size in bytes")
+	fs.IntVar(&cfg.Server.Websocket.WriteBufferSize, "websocket-write-buffer-size", cfg.Server.Websocket.WriteBufferSize, "websocket write buffer size in bytes")
+
+	fs.StringVar(&cfg.Server.TLS.CertFile, "tls-cert", cfg.Server.TLS.CertFile, "certificate file, enables TLS on every listener")
+	fs.StringVar(&cfg.Server.TLS.KeyFile, "tls-key", cfg.Server.TLS.KeyFile, "private key file of the certificate")
+	fs.StringVar(&cfg.Server.TLS.ClientCAFile, "tls-client-ca", cfg.Server.TLS.ClientCAFile, "CA bundle client certificates are verified against")
+	fs.StringVar(&cfg.Server.TLS.ClientAuth, "tls-client-auth", cfg.Server.TLS.ClientAuth, "client certificates, none, optional or require")
+
+	fs.BoolVar(&cfg.Auth.Required, "auth-required", cfg.Auth.Required, "reject requests without credentials")
+	fs.StringVar(&cfg.Auth.JWT.Secret, "auth-jwt-secret", cfg.Auth.JWT.Secret, "HMAC secret of bearer tokens, prefer the environment or a file")
+	fs.StringVar(&cfg.Auth.JWT.SecretFile, "auth-jwt-secret-file", cfg.Auth.JWT.SecretFile, "file holding the HMAC secret of bearer tokens")
+	fs.StringVar(&cfg.Auth.JWT.Issuer, "auth-jwt-issuer", cfg.Auth.JWT.Issuer, "required iss claim of bearer tokens")
+	fs.StringVar(&cfg.Auth.JWT.Audience, "auth-jwt-audience", cfg.Auth.JWT.Audience, "required aud claim of bearer tokens")
+	fs.DurationVar(&cfg.Auth.JWT.Leeway, "auth-jwt-leeway", cfg.Auth.JWT.Leeway, "clock skew tolerated when checking token expiry")
+
+	fs.BoolVar(&cfg.ACL.Enabled, "acl-enabled", cfg.ACL.Enabled, "deny requests that no acl rule allows")
+
+	fs.StringVar(&cfg.Tracing.SpanLog, "trace-span-log", cfg.Tracing.SpanLog, "file to append spans to as JSON lines, empty to disable")
+
+	fs.BoolVar(&cfg.Audit.Enabled, "audit-enabled", cfg.Audit.Enabled, "record administrative and security events in the $SYS.audit topic")
+	fs.StringVar(&cfg.Audit.File, "audit-file", cfg.Audit.File, "file to append audit events to as JSON lines, empty for the topic only")
+	fs.Int64Var(&cfg.Audit.MaxFileBytes, "audit-max-file-bytes", cfg.Audit.MaxFileBytes, "size at which the audit file is rotated, 0 for the default")
+	fs.IntVar(&cfg.Audit.MaxFiles, "audit-max-files", cfg.Audit.MaxFiles, "number of rotated audit files to keep, 0 for the default")
+
+	fs.StringVar(&cfg.Replication.NodeId, "node-id", cfg.Replication.NodeId, "name of the broker among its replicas, enables replication")
+	fs.StringVar(&cfg.Replication.Leader, "replicate-from", cfg.Replication.Leader, "url of the leader to follow, empty to lead")
+	fs.StringVar(&cfg.Replication.APIKey, "replication-api-key", cfg.Replication.APIKey, "api key a follower authenticates at the leader with")
+	fs.DurationVar(&cfg.Replication.LagTimeout, "replication-lag-timeout", cfg.Replication.LagTimeout, "how long a follower may lag before it is out of sync, 0 for the default")
+	fs.DurationVar(&cfg.Replication.AckTimeout, "replication-ack-timeout", cfg.Replication.AckTimeout, "how long a publish waits for in-sync followers, 0 for the default")
+	fs.DurationVar(&cfg.Replication.SyncInterval, "replication-sync-interval", cfg.Replication.SyncInterval, "how often followers copy the topics of the leader, 0 for the default")
+
+	fs.StringVar(&cfg.Mirrors.Site, "mirror-site", cfg.Mirrors.Site, "name of the broker in the path of mirrored messages")
+	fs.StringVar(&cfg.Mirrors.APIKey, "mirror-api-key", cfg.Mirrors.APIKey, "api key the mirrors authenticate at this broker with")
+
+	fs.Var(clusterMembersFlag{&cfg.Cluster.Members}, "cluster-members", "members of the cluster as id=url,..., enables clustering")
+	fs.DurationVar(&cfg.Cluster.HeartbeatInterval, "cluster-heartbeat-interval", cfg.Cluster.HeartbeatInterval, "how often the leader of the cluster contacts the members, 0 for the default")
+	fs.DurationVar(&cfg.Cluster.ElectionTimeout, "cluster-election-timeout", cfg.Cluster.ElectionTimeout, "how long members wait for the leader before electing another one, 0 for the default")
+
+	fs.StringVar(&cfg.Storage.Backend, "storage", cfg.Storage.Backend, "default topic storage, memory or file")
+	fs.StringVar(&cfg.Storage.DataDir, "data-dir", cfg.Storage.DataDir, "directory for topic configs and file backed topics")
+
+	fs.DurationVar(&cfg.Topics.Retention, "topic-retention", cfg.Topics.Retention, "default message retention, 0 keeps messages until consumed")
+	fs.IntVar(&cfg.Topics.MaxSize, "topic-max-size", cfg.Topics.MaxSize, "default maximum number of messages per topic, 0 for no limit")
+	fs.StringVar(&cfg.Topics.DeliveryMode, "topic-delivery-mode", cfg.Topics.DeliveryMode, "default delivery mode, at-most-once or at-least-once")
+	fs.IntVar(&cfg.Topics.Partitions, "topic-partitions", cfg.Topics.Partitions, "default number of partitions")
+	fs.StringVar(&cfg.Topics.Partitioner, "topic-partitioner", cfg.Topics.Partitioner, "default partitioner, hash or round-robin")
+	fs.IntVar(&cfg.Topics.MinInSyncReplicas, "topic-min-insync-replicas", cfg.Topics.MinInSyncReplicas, "default number of in-sync followers a publish waits for")
+
+	fs.IntVar(&cfg.Limits.MaxTopics, "max-topics", cfg.Limits.MaxTopics, "maximum number of topics, 0 for no limit")
+	fs.IntVar(&cfg.Limits.MaxMessageBytes, "max-message-bytes", cfg.Limits.MaxMessageBytes, "maximum size of a message body, 0 for no limit")
+
+	fs.Float64Var(&cfg.Limits.Publish.Principal.Messages, "publish-rate-per-principal", cfg.Limits.Publish.Principal.Messages, "messages per second published per principal, 0 for no limit")
+	fs.Float64Var(&cfg.Limits.Publish.Principal.Bytes, "publish-bytes-per-principal", cfg.Limits.Publish.Principal.Bytes, "bytes per second published per principal, 0 for no limit")
+	fs.Float64Var(&cfg.Limits.Publish.ClientIP.Messages, "publish-rate-per-ip", cfg.Limits.Publish.ClientIP.Messages, "messages per second published per client address, 0 for no limit")
+	fs.Float64Var(&cfg.Limits.Publish.ClientIP.Bytes, "publish-bytes-per-ip", cfg.Limits.Publish.ClientIP.Bytes, "bytes per second published per client address, 0 for no limit")
+	fs.Float64Var(&cfg.Limits.Publish.Topic.Messages, "publish-rate-per-topic", cfg.Limits.Publish.Topic.Messages, "messages per second published per topic, 0 for no limit")
+	fs.Float64Var(&cfg.Limits.Publish.Topic.Bytes, "publish-bytes-per-topic", cfg.Limits.Publish.Topic.Bytes, "bytes per second published per topic, 0 for no limit")
+	fs.Float64Var(&cfg.Limits.Consume.Principal.Messages, "consume-rate-per-principal", cfg.Limits.Consume.Principal.Messages, "messages per second delivered per principal, 0 for no limit")
+	fs.Float64Var(&cfg.Limits.Consume.Principal.Bytes, "consume-bytes-per-principal", cfg.Limits.Consume.Principal.Bytes, "bytes per second delivered per principal, 0 for no limit")
+	fs.Float64Var(&cfg.Limits.Consume.ClientIP.Messages, "consume-rate-per-ip", cfg.Limits.Consume.ClientIP.Messages, "messages per second delivered per client address, 0 for no limit")
+	fs.Float64Var(&cfg.Limits.Consume.ClientIP.Bytes, "consume-bytes-per-ip", cfg.Limits.Consume.ClientIP.Bytes, "bytes per second delivered per client address, 0 for no limit")
+	fs.Float64Var(&cfg.Limits.Consume.Topic.Messages, "consume-rate-per-topic", cfg.Limits.Consume.Topic.Messages, "messages per second delivered per topic, 0 for no limit")
+	fs.Float64Var(&cfg.Limits.Consume.Topic.Bytes, "consume-bytes-per-topic", cfg.Limits.Consume.Topic.Bytes, "bytes per second delivered per topic, 0 for no limit")
+
+	return fs
+}
+
+func (c *Config) readFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not read config file: %w", err)
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("could not parse config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// applyEnv sets every flag of fs that has an MQ_* variable in the
+// environment. An empty variable clears what the file set.
+func applyEnv(fs *flag.FlagSet, lookupEnv func(string) (string, bool)) error {
+	var errs []error
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+
+		name := envName(f.Name)
+		value, ok := lookupEnv(name)
+		if !ok {
+			return
+		}
+		if value == "" {
+			value = zeroValue(f)
+		}
+
+		if err := f.Value.Set(value); err != nil {
+			errs = append(errs, fmt.Errorf("invalid value %q for %s: %v", value, name, err))
+		}
+	})
+
+	return errors.Join(errs...)
+}
+
+// zeroValue is the value that sets f to the zero value of its type.
+func zeroValue(f *flag.Flag) string {
+	if getter, ok := f.Value.(flag.Getter); ok {
+		switch getter.Get().(type) {
+		case bool:
+			return "false"
+		case int, int64, float64:
+			return "0"
+		case time.Duration:
+			return "0s"
+		}
+	}
+	return ""
+}
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// Validate reports every problem with the configuration at once.
+func (c Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Server.Addr != "", "server.addr must not be empty")
+	check(c.Server.Addr != c.Server.MetricsAddr, "server.addr and server.metricsAddr must differ")
+	check(c.Server.BinaryAddr == "" || (c.Server.BinaryAddr != c.Server.Addr && c.Server.BinaryAddr != c.Server.MetricsAddr), "server.binaryAddr must differ from server.addr and server.metricsAddr")
+	check(c.Server.AckTimeout > 0, "server.ackTimeout must be positive")
+	check(c.Server.ShutdownTimeout > 0, "server.shutdownTimeout must be positive")
+	check(c.Server.ShutdownDelay >= 0, "server.shutdownDelay must not be negative")
+	check(c.Server.Websocket.ReadBufferSize > 0, "server.websocket.readBufferSize must be positive")
+	check(c.Server.Websocket.WriteBufferSize > 0, "server.websocket.writeBufferSize must be positive")
+
+	if tls := c.tlsConfig(); tls != nil {
+		if err := tls.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("server.tls: %w", err))
+		}
+	} else {
+		check(c.Server.TLS.ClientCAFile == "", "server.tls.clientCAFile needs a certificate")
+	}
+
+	keys := make(map[string]bool)
+	for i, k := range c.Auth.APIKeys {
+		check(k.Name != "", "auth.apiKeys[%d].name must not be empty", i)
+		check(k.Key != "", "auth.apiKeys[%d].key must not be empty", i)
+		check(!keys[k.Key], "auth.apiKeys[%d].key is used more than once", i)
+		keys[k.Key] = true
+	}
+	check(c.Auth.JWT.Secret == "" || c.Auth.JWT.SecretFile == "", "auth.jwt.secret and auth.jwt.secretFile are exclusive")
+	check(c.Auth.JWT.Secret == "" || len(c.Auth.JWT.Secret) >= minSecretBytes, "auth.jwt.secret must be at least %d bytes", minSecretBytes)
+	check(c.Auth.JWT.enabled() || (c.Auth.JWT.Issuer == "" && c.Auth.JWT.Audience == ""), "auth.jwt.issuer and auth.jwt.audience need a secret")
+	check(c.Auth.JWT.Leeway >= 0, "auth.jwt.leeway must not be negative")
+	check(!c.Auth.Required || len(c.Auth.APIKeys) > 0 || c.Auth.JWT.enabled() || c.Server.TLS.ClientAuth != server.ClientAuthNone,
+		"auth.required needs api keys, a jwt secret or client certificates")
+
+	for i, rule := range c.ACL.Rules {
+		if err := rule.rule().Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("acl.rules[%d]: %w", i, err))
+		}
+	}
+	check(c.ACL.Enabled || len(c.ACL.Rules) == 0, "acl.rules need acl.enabled")
+
+	check(c.Storage.Backend != server.StorageFile || c.Storage.DataDir != "", "storage.dataDir is required for the file backend")
+
+	check(c.Limits.MaxTopics >= 0, "limits.maxTopics must not be negative")
+	check(c.Limits.MaxMessageBytes >= 0, "limits.maxMessageBytes must not be negative")
+	if err := c.rateLimits().Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("limits: %w", err))
+	}
+
+	if err := c.topicDefaults().Validate(); err != nil {
+		errs = append(errs, fmt.Errorf("topics: %w", err))
+	}
+
+	if audit := c.Audit.audit(); audit != nil {
+		if err := audit.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("audit: %w", err))
+		}
+	} else {
+		check(c.Audit.File == "", "audit.file needs audit.enabled")
+	}
+
+	if replication := c.Replication.replication(); replication != nil {
+		if err := replication.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("replication: %w", err))
+		}
+	} else {
+		check(c.Replication.Leader == "", "replication.leader needs replication.nodeId")
+		check(c.Topics.MinInSyncReplicas == 0, "topics.minInSyncReplicas needs replication.nodeId")
+	}
+
+	if cluster := c.Cluster.cluster(); cluster != nil {
+		if err := cluster.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("cluster: %w", err))
+		}
+		check(c.Replication.NodeId != "", "cluster.members need replication.nodeId")
+		check(c.Replication.Leader == "", "cluster.members and replication.leader are exclusive")
+	}
+
+	if len(c.Mirrors.Sources) > 0 {
+		check(c.Storage.DataDir != "", "mirrors.sources need storage.dataDir for their checkpoints")
+		_, _, err := net.SplitHostPort(c.Server.Addr)
+		check(err == nil, "mirrors.sources need server.addr as host:port")
+		sites := make(map[string]bool)
+		for i, source := range c.Mirrors.Sources {
+			check(source.Addr != "", "mirrors.sources[%d].addr must not be empty", i)
+			check(!sites[source.Site], "mirrors.sources[%d].site is used more than once", i)
+			sites[source.Site] = true
+		}
+
+		for i, m := range c.mirrorConfigs() {
+			if err := m.Validate(); err != nil {
+				errs = append(errs, fmt.Errorf("mirrors.sources[%d]: %w", i, err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (c Config) topicDefaults() server.TopicConfig {
+	return server.TopicConfig{
+		Storage:           c.Storage.Backend,
+		Retention:         server.Duration(c.Topics.Retention),
+		MaxSize:           c.Topics.MaxSize,
+		DeliveryMode:      c.Topics.DeliveryMode,
+		Partitions:        c.Topics.Partitions,
+		Partitioner:       c.Topics.Partitioner,
+		MinInSyncReplicas: c.Topics.MinInSyncReplicas,
+	}
+}
+
+func (c Config) rateLimits() server.RateLimitConfig {
+	return server.RateLimitConfig{
+		Publish: c.Limits.Publish.limits(),
+		Consume: c.Limits.Consume.limits(),
+	}
+}
+
+func (c Config) tlsConfig() *server.TLSConfig {
+	if !c.Server.TLS.enabled() {
+		return nil
+	}
+	return &server.TLSConfig{
+		CertFile:     c.Server.TLS.CertFile,
+		KeyFile:      c.Server.TLS.KeyFile,
+		ClientCAFile: c.Server.TLS.ClientCAFile,
+		ClientAuth:   c.Server.TLS.ClientAuth,
+	}
+}
+
+func (c Config) authenticators() ([]server.IAuthenticator, error) {
+	var authenticators []server.IAuthenticator
+
+	if len(c.Auth.APIKeys) > 0 {
+		keys := make([]server.APIKey, 0, len(c.Auth.APIKeys))
+		for _, k := range c.Auth.APIKeys {
+			keys = append(keys, server.APIKey{Name: k.Name, Key: k.Key, Roles: k.Roles})
+		}
+		authenticators = append(authenticators, server.NewAPIKeyAuthenticator(keys))
+	}
+
+	if c.Auth.JWT.enabled() {
+		secret := []byte(c.Auth.JWT.Secret)
+		if c.Auth.JWT.SecretFile != "" {
+			data, err := os.ReadFile(c.Auth.JWT.SecretFile)
+			if err != nil {
+				return nil, fmt.Errorf("could not read jwt secret: %w", err)
+			}
+			secret = bytes.TrimSpace(data)
+			if len(secret) < minSecretBytes {
+				return nil, fmt.Errorf("jwt secret in %s must be at least %d bytes", c.Auth.JWT.SecretFile, minSecretBytes)
+			}
+		}
+
+		authenticators = append(authenticators, server.NewJWTAuthenticator(server.JWTConfig{
+			Secret:   secret,
+			Issuer:   c.Auth.JWT.Issuer,
+			Audience: c.Auth.JWT.Audience,
+			Leeway:   c.Auth.JWT.Leeway,
+		}))
+	}
+
+	return authenticators, nil
+}
+
+func (c Config) aclConfig() *server.ACLConfig {
+	if !c.ACL.Enabled {
+		return nil
+	}
+
+	acl := &server.ACLConfig{}
+	for _, rule := range c.ACL.Rules {
+		acl.Rules = append(acl.Rules, rule.rule())
+	}
+	return acl
+}
+
+// ServerConfig returns the configuration for server.NewServer. It fails when
+// a file it refers to cannot be read.
+func (c Config) ServerConfig() (server.ServerConfig, error) {
+	authenticators, err := c.authenticators()
+	if err != nil {
+		return server.ServerConfig{}, err
+	}
+
+	spanExporter, err := c.spanExporter()
+	if err != nil {
+		return server.ServerConfig{}, err
+	}
+
+	mirrorConfigs, err := c.mirrors()
+	if err != nil {
+		return server.ServerConfig{}, err
+	}
+	mirrors := make([]server.IMirror, 0, len(mirrorConfigs))
+	for _, cfg := range mirrorConfigs {
+		m, err := mirror.NewMirror(cfg)
+		if err != nil {
+			return server.ServerConfig{}, err
+		}
+		mirrors = append(mirrors, m)
+	}
+
+	return server.ServerConfig{
+		ServerAddr:               c.Server.Addr,
+		MetricsAddr:              c.Server.MetricsAddr,
+		BinaryAddr:               c.Server.BinaryAddr,
+		MakeStorageFunc:          storage.NewStorage,
+		WebsocketReadBufferSize:  c.Server.Websocket.ReadBufferSize,
+		WebsocketWriteBufferSize: c.Server.Websocket.WriteBufferSize,
+		DataDir:                  c.Storage.DataDir,
+		AckTimeout:               c.Server.AckTimeout,
+		ShutdownTimeout:          c.Server.ShutdownTimeout,
+		ShutdownDelay:            c.Server.ShutdownDelay,
+		TopicDefaults:            c.topicDefaults(),
+		MaxTopics:                c.Limits.MaxTopics,
+		MaxMessageBytes:          c.Limits.MaxMessageBytes,
+		TLS:                      c.tlsConfig(),
+		Authenticators:           authenticators,
+		RequireAuth:              c.Auth.Required,
+		ACL:                      c.aclConfig(),
+		RateLimits:               c.rateLimits(),
+		SpanExporter:             spanExporter,
+		Audit:                    c.Audit.audit(),
+		Replication:              c.Replication.replication(),
+		Cluster:                  c.Cluster.cluster(),
+		Mirrors:                  mirrors,
+	}, nil
+}
+
+func (c Config) spanExporter() (server.ISpanExporter, error) {
+	if c.Tracing.SpanLog == "" {
+		return nil, nil
+	}
+
+	f, err := os.OpenFile(c.Tracing.SpanLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open span log: %w", err)
+	}
+	return server.NewSpanLogExporter(f), nil
+}
+
+// Write prints the configuration as YAML, with secrets redacted.
+func (c Config) Write(w io.Writer) error {
+	if c.Auth.JWT.Secret != "" {
+		c.Auth.JWT.Secret = redacted
+	}
+	if len(c.Auth.APIKeys) > 0 {
+		keys := make([]APIKeyConfig, len(c.Auth.APIKeys))
+		for i, k := range c.Auth.APIKeys {
+			k.Key = redacted
+			keys[i] = k
+		}
+		c.Auth.APIKeys = keys
+	}
+	if c.Replication.APIKey != "" {
+		c.Replication.APIKey = redacted
+	}
+	if c.Mirrors.APIKey != "" {
+		c.Mirrors.APIKey = redacted
+	}
+	if len(c.Mirrors.Sources) > 0 {
+		sources := make([]MirrorSourceConfig, len(c.Mirrors.Sources))
+		for i, source := range c.Mirrors.Sources {
+			if source.APIKey != "" {
+				source.APIKey = redacted
+			}
+			sources[i] = source
+		}
+		c.Mirrors.Sources = sources
+	}
+
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(c); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
@@ -0,0 +1,455 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mdkelley02/message-queue/server"
+)
+
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := vars[name]
+		return value, ok
+	}
+}
+
+func writeFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func mustServerConfig(t *testing.T, cfg Config) server.ServerConfig {
+	serverConfig, err := cfg.ServerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serverConfig
+}
+
+func Test_config(t *testing.T) {
+	t.Run("defaults are used when nothing is configured", func(t *testing.T) {
+		cfg, opts, err := Load(nil, env(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, Default(), cfg)
+		assert.False(t, opts.PrintConfig)
+	})
+
+	t.Run("flags override the environment which overrides the file", func(t *testing.T) {
+		path := writeFile(t, `
+server:
+  addr: ":9000"
+  ackTimeout: 5s
+storage:
+  backend: file
+  dataDir: /var/lib/mq
+topics:
+  partitions: 2
+limits:
+  maxTopics: 10
+`)
+
+		cfg, _, err := Load([]string{"--config", path, "--topic-partitions", "8"}, env(map[string]string{
+			"MQ_ACK_TIMEOUT":      "10s",
+			"MQ_TOPIC_PARTITIONS": "4",
+			"MQ_MAX_TOPICS":       "20",
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, ":9000", cfg.Server.Addr)
+		assert.Equal(t, ":8081", cfg.Server.MetricsAddr)
+		assert.Equal(t, 10*time.Second, cfg.Server.AckTimeout)
+		assert.Equal(t, 8, cfg.Topics.Partitions)
+		assert.Equal(t, 20, cfg.Limits.MaxTopics)
+
+		serverConfig := mustServerConfig(t, cfg)
+		assert.Equal(t, "/var/lib/mq", serverConfig.DataDir)
+		assert.Equal(t, server.StorageFile, serverConfig.TopicDefaults.Storage)
+		assert.Equal(t, 8, serverConfig.TopicDefaults.Partitions)
+	})
+
+	t.Run("the config file can be given in the environment", func(t *testing.T) {
+		path := writeFile(t, "server:\n  metricsAddr: \"\"\n")
+
+		cfg, _, err := Load(nil, env(map[string]string{"MQ_CONFIG": path}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "", cfg.Server.MetricsAddr)
+	})
+
+	t.Run("an empty variable clears a setting of the file", func(t *testing.T) {
+		path := writeFile(t, `
+server:
+  metricsAddr: ":9090"
+storage:
+  dataDir: /var/lib/mq
+audit:
+  enabled: true
+`)
+
+		cfg, _, err := Load([]string{"--config", path}, env(map[string]string{
+			"MQ_METRICS_ADDR":  "",
+			"MQ_DATA_DIR":      "",
+			"MQ_AUDIT_ENABLED": "",
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "", cfg.Server.MetricsAddr)
+		assert.Equal(t, "", cfg.Storage.DataDir)
+		assert.False(t, cfg.Audit.Enabled)
+	})
+
+	t.Run("the binary protocol is served on its own address", func(t *testing.T) {
+		cfg, _, err := Load([]string{"--binary-addr", ":9092"}, env(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, ":9092", mustServerConfig(t, cfg).BinaryAddr)
+
+		_, _, err = Load(nil, env(map[string]string{"MQ_BINARY_ADDR": ":8080"}))
+		assert.ErrorContains(t, err, "server.binaryAddr must differ")
+	})
+
+	t.Run("invalid settings are all reported", func(t *testing.T) {
+		_, _, err := Load([]string{"--storage", "file", "--topic-delivery-mode", "sometimes"}, env(map[string]string{
+			"MQ_MAX_MESSAGE_BYTES": "-1",
+		}))
+
+		assert.ErrorContains(t, err, "storage.dataDir is required")
+		assert.ErrorContains(t, err, "limits.maxMessageBytes must not be negative")
+		assert.ErrorContains(t, err, `unknown delivery mode "sometimes"`)
+	})
+
+	t.Run("tls is enabled by a certificate", func(t *testing.T) {
+		cfg, _, err := Load(nil, env(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Nil(t, mustServerConfig(t, cfg).TLS)
+
+		cfg, _, err = Load([]string{"--tls-cert", "cert.pem", "--tls-key", "key.pem"}, env(map[string]string{
+			"MQ_TLS_CLIENT_CA":   "ca.pem",
+			"MQ_TLS_CLIENT_AUTH": server.ClientAuthRequire,
+		}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, &server.TLSConfig{
+			CertFile:     "cert.pem",
+			KeyFile:      "key.pem",
+			ClientCAFile: "ca.pem",
+			ClientAuth:   server.ClientAuthRequire,
+		}, mustServerConfig(t, cfg).TLS)
+
+		_, _, err = Load([]string{"--tls-cert", "cert.pem", "--tls-client-auth", server.ClientAuthRequire}, env(nil))
+		assert.ErrorContains(t, err, "tls needs both a certificate and a key file")
+
+		_, _, err = Load([]string{"--tls-client-ca", "ca.pem"}, env(nil))
+		assert.ErrorContains(t, err, "server.tls.clientCAFile needs a certificate")
+	})
+
+	t.Run("credentials are configured and redacted when printed", func(t *testing.T) {
+		secret := strings.Repeat("s", 32)
+		secretFile := writeFile(t, secret+"\n")
+		path := writeFile(t, `
+auth:
+  required: true
+  apiKeys:
+    - name: billing
+      key: k1
+      roles: [publisher]
+`)
+
+		cfg, _, err := Load([]string{"--config", path, "--auth-jwt-secret-file", secretFile}, env(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		serverConfig := mustServerConfig(t, cfg)
+		assert.True(t, serverConfig.RequireAuth)
+		assert.Len(t, serverConfig.Authenticators, 2)
+
+		var out bytes.Buffer
+		if err := cfg.Write(&out); err != nil {
+			t.Fatal(err)
+		}
+		assert.NotContains(t, out.String(), "k1")
+		assert.Contains(t, out.String(), "billing")
+		assert.Equal(t, "k1", cfg.Auth.APIKeys[0].Key)
+
+		_, _, err = Load([]string{"--auth-required", "--auth-jwt-secret", "short", "--auth-jwt-secret-file", secretFile}, env(nil))
+		assert.ErrorContains(t, err, "auth.jwt.secret and auth.jwt.secretFile are exclusive")
+		assert.ErrorContains(t, err, "auth.jwt.secret must be at least 32 bytes")
+
+		_, _, err = Load([]string{"--auth-required"}, env(nil))
+		assert.ErrorContains(t, err, "auth.required needs api keys")
+
+		cfg, _, err = Load([]string{"--auth-jwt-secret-file", filepath.Join(t.TempDir(), "missing")}, env(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = cfg.ServerConfig()
+		assert.ErrorContains(t, err, "could not read jwt secret")
+	})
+
+	t.Run("acl rules are validated", func(t *testing.T) {
+		path := writeFile(t, `
+acl:
+  enabled: true
+  rules:
+    - role: admin
+      topic: "*"
+      actions: [admin]
+`)
+
+		cfg, _, err := Load([]string{"--config", path}, env(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, &server.ACLConfig{Rules: []server.ACLRule{
+			{Role: "admin", Topic: "*", Actions: []string{server.ActionAdmin}},
+		}}, mustServerConfig(t, cfg).ACL)
+
+		_, _, err = Load([]string{"--config", writeFile(t, `
+acl:
+  rules:
+    - principal: alice
+      role: admin
+      topic: "["
+      actions: [read]
+`)}, env(nil))
+		assert.ErrorContains(t, err, "acl.rules[0]: invalid acl rule: exactly one of principal and role")
+		assert.ErrorContains(t, err, "acl.rules need acl.enabled")
+	})
+
+	t.Run("rate limits come from the file and flags", func(t *testing.T) {
+		path := writeFile(t, `
+limits:
+  publish:
+    principal:
+      messagesPerSecond: 100
+      bytesPerSecond: 1048576
+  consume:
+    topic:
+      messagesPerSecond: 50
+`)
+
+		cfg, _, err := Load([]string{"--config", path, "--publish-rate-per-ip", "20"}, env(map[string]string{"MQ_CONSUME_BYTES_PER_TOPIC": "4096"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, server.RateLimitConfig{
+			Publish: server.RateLimits{
+				Principal: server.RateLimit{MessagesPerSecond: 100, BytesPerSecond: 1048576},
+				ClientIP:  server.RateLimit{MessagesPerSecond: 20},
+			},
+			Consume: server.RateLimits{
+				Topic: server.RateLimit{MessagesPerSecond: 50, BytesPerSecond: 4096},
+			},
+		}, mustServerConfig(t, cfg).RateLimits)
+
+		_, _, err = Load([]string{"--consume-rate-per-principal", "-1"}, env(nil))
+		assert.ErrorContains(t, err, "limits: invalid rate limit")
+	})
+
+	t.Run("spans are logged to the configured file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "spans.jsonl")
+		cfg, _, err := Load(nil, env(map[string]string{"MQ_TRACE_SPAN_LOG": path}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		exporter := mustServerConfig(t, cfg).SpanExporter
+		if assert.NotNil(t, exporter) {
+			if err := exporter.ExportSpan(server.Span{Name: "publish orders"}); err != nil {
+				t.Fatal(err)
+			}
+			content, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Contains(t, string(content), `"name":"publish orders"`)
+		}
+
+		assert.Nil(t, mustServerConfig(t, Default()).SpanExporter)
+
+		cfg.Tracing.SpanLog = filepath.Join(t.TempDir(), "missing", "spans.jsonl")
+		_, err = cfg.ServerConfig()
+		assert.ErrorContains(t, err, "could not open span log")
+	})
+
+	t.Run("the audit log is enabled with its file", func(t *testing.T) {
+		cfg, _, err := Load([]string{"--audit-enabled", "--audit-file", "/var/log/mq/audit.jsonl"}, env(map[string]string{"MQ_AUDIT_MAX_FILES": "3"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, &server.AuditConfig{File: "/var/log/mq/audit.jsonl", MaxFiles: 3}, mustServerConfig(t, cfg).Audit)
+
+		assert.Nil(t, mustServerConfig(t, Default()).Audit)
+
+		_, _, err = Load([]string{"--audit-file", "audit.jsonl"}, env(nil))
+		assert.ErrorContains(t, err, "audit.file needs audit.enabled")
+
+		_, _, err = Load([]string{"--audit-enabled", "--audit-max-file-bytes", "-1"}, env(nil))
+		assert.ErrorContains(t, err, "audit: invalid audit config")
+	})
+
+	t.Run("replication is enabled by a node id", func(t *testing.T) {
+		cfg, _, err := Load([]string{"--node-id", "b", "--replicate-from", "http://leader:8080", "--topic-min-insync-replicas", "1"},
+			env(map[string]string{"MQ_REPLICATION_API_KEY": "follower-key"}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		serverConfig := mustServerConfig(t, cfg)
+		assert.Equal(t, &server.ReplicationConfig{NodeId: "b", Leader: "http://leader:8080", APIKey: "follower-key"}, serverConfig.Replication)
+		assert.Equal(t, 1, serverConfig.TopicDefaults.MinInSyncReplicas)
+
+		var out bytes.Buffer
+		if err := cfg.Write(&out); err != nil {
+			t.Fatal(err)
+		}
+		assert.NotContains(t, out.String(), "follower-key")
+
+		assert.Nil(t, mustServerConfig(t, Default()).Replication)
+
+		_, _, err = Load([]string{"--replicate-from", "http://leader:8080", "--topic-min-insync-replicas", "1"}, env(nil))
+		assert.ErrorContains(t, err, "replication.leader needs replication.nodeId")
+		assert.ErrorContains(t, err, "topics.minInSyncReplicas needs replication.nodeId")
+
+		_, _, err = Load([]string{"--node-id", "b", "--replicate-from", "leader:8080"}, env(nil))
+		assert.ErrorContains(t, err, "replication: invalid replication config")
+	})
+
+	t.Run("clustering is enabled by its members", func(t *testing.T) {
+		cfg, _, err := Load([]string{"--node-id", "a", "--cluster-members", "a=http://a:8080, b=http://b:8080", "--cluster-election-timeout", "2s"}, env(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, &server.ClusterConfig{
+			Members: []server.ClusterMember{
+				{Id: "a", Addr: "http://a:8080"},
+				{Id: "b", Addr: "http://b:8080"},
+			},
+			ElectionTimeout: 2 * time.Second,
+		}, mustServerConfig(t, cfg).Cluster)
+
+		cfg, _, err = Load([]string{"--config", writeFile(t, "replication:\n  nodeId: c\ncluster:\n  members:\n    - id: c\n      addr: http://c:8080\n  heartbeatInterval: 50ms\n")}, env(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, &server.ClusterConfig{
+			Members:           []server.ClusterMember{{Id: "c", Addr: "http://c:8080"}},
+			HeartbeatInterval: 50 * time.Millisecond,
+		}, mustServerConfig(t, cfg).Cluster)
+
+		assert.Nil(t, mustServerConfig(t, Default()).Cluster)
+
+		_, _, err = Load([]string{"--cluster-members", "a=http://a:8080"}, env(map[string]string{"MQ_REPLICATE_FROM": "http://a:8080"}))
+		assert.ErrorContains(t, err, "cluster.members need replication.nodeId")
+		assert.ErrorContains(t, err, "cluster.members and replication.leader are exclusive")
+
+		_, _, err = Load([]string{"--node-id", "a", "--cluster-members", "a=a:8080"}, env(nil))
+		assert.ErrorContains(t, err, "cluster: invalid cluster config")
+
+		_, _, err = Load([]string{"--cluster-members", "a"}, env(nil))
+		assert.ErrorContains(t, err, "is not id=url")
+	})
+
+	t.Run("mirrors copy topics of other brokers", func(t *testing.T) {
+		dataDir := t.TempDir()
+		cfg, _, err := Load([]string{"--data-dir", dataDir, "--config", writeFile(t, `
+mirrors:
+  site: us
+  apiKey: local-key
+  sources:
+    - site: eu
+      addr: eu.example.com:8080
+      apiKey: eu-key
+      topics:
+        - source: orders.*
+          destination: eu.{topic}
+`)}, env(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, mustServerConfig(t, cfg).Mirrors, 1)
+
+		var out bytes.Buffer
+		if err := cfg.Write(&out); err != nil {
+			t.Fatal(err)
+		}
+		assert.NotContains(t, out.String(), "local-key")
+		assert.NotContains(t, out.String(), "eu-key")
+
+		assert.Empty(t, mustServerConfig(t, Default()).Mirrors)
+
+		// the CA file is only read when the mirrors are built
+		cfg.Mirrors.Sources[0].TLS = true
+		cfg.Mirrors.Sources[0].CAFile = filepath.Join(dataDir, "missing.pem")
+		assert.NoError(t, cfg.Validate())
+		_, err = cfg.ServerConfig()
+		assert.ErrorContains(t, err, "mirrors.sources[0]")
+
+		_, _, err = Load([]string{"--config", writeFile(t, `
+mirrors:
+  sources:
+    - site: eu
+      topics:
+        - source: orders.*
+          destination: orders
+`)}, env(nil))
+		assert.ErrorContains(t, err, "mirrors.sources need storage.dataDir")
+		assert.ErrorContains(t, err, "mirrors.sources[0].addr must not be empty")
+		assert.ErrorContains(t, err, "mirrors.sources[0]: invalid mirror config")
+	})
+
+	t.Run("malformed input is rejected", func(t *testing.T) {
+		_, _, err := Load(nil, env(map[string]string{"MQ_ACK_TIMEOUT": "soon"}))
+		assert.ErrorContains(t, err, "MQ_ACK_TIMEOUT")
+
+		_, _, err = Load([]string{"--config", writeFile(t, "server:\n  adress: \":9000\"\n")}, env(nil))
+		assert.ErrorContains(t, err, "field adress not found")
+
+		_, _, err = Load([]string{"--config", filepath.Join(t.TempDir(), "missing.yaml")}, env(nil))
+		assert.ErrorContains(t, err, "could not read config file")
+
+		_, _, err = Load([]string{"--help"}, env(nil))
+		assert.ErrorIs(t, err, flag.ErrHelp)
+	})
+
+	t.Run("the printed config can be loaded again", func(t *testing.T) {
+		cfg, opts, err := Load([]string{"--print-config", "--topic-retention", "1h"}, env(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.True(t, opts.PrintConfig)
+
+		var out bytes.Buffer
+		if err := cfg.Write(&out); err != nil {
+			t.Fatal(err)
+		}
+
+		reloaded, _, err := Load([]string{"--config", writeFile(t, out.String())}, env(nil))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, cfg, reloaded)
+	})
+}
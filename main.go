@@ -1,22 +1,45 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"log/slog"
+	"os"
 
+	"github.com/mdkelley02/message-queue/config"
 	"github.com/mdkelley02/message-queue/server"
-	"github.com/mdkelley02/message-queue/storage"
 )
 
 func main() {
+	cfg, opts, err := config.Load(os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		config.Usage(os.Stdout)
+		return
+	}
+	if err != nil {
+		slog.Error("Invalid configuration", "err", err)
+		os.Exit(2)
+	}
+
+	if opts.PrintConfig {
+		if err := cfg.Write(os.Stdout); err != nil {
+			slog.Error("Could not print configuration", "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	serverConfig, err := cfg.ServerConfig()
+	if err != nil {
+		slog.Error("Invalid configuration", "err", err)
+		os.Exit(2)
+	}
+
 	slog.Info("Starting Message Queue")
 
-	s := server.NewServer(server.ServerConfig{
-		ServerAddr:      ":8080",
-		MetricsAddr:     ":8081",
-		MakeStorageFunc: storage.NewStorage,
-	})
+	s := server.NewServer(serverConfig)
 	if err := s.Start(); err != nil {
-		slog.Error("Could not start server: %v", err)
+		slog.Error("Could not start server", "err", err)
 	}
 
 	slog.Info("Stopping Message Queue")
@@ -0,0 +1,88 @@
+package mirror
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// checkpointFile is the content of the checkpoint file, the next offset of
+// every source partition by topic/partition.
+type checkpointFile struct {
+	Offsets map[string]int `json:"offsets"`
+}
+
+func loadCheckpoint(file string) (map[partitionKey]int, error) {
+	offsets := make(map[partitionKey]int)
+	if file == "" {
+		return offsets, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return offsets, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not read mirror checkpoint: %w", err)
+	}
+
+	var checkpoint checkpointFile
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return nil, fmt.Errorf("could not parse mirror checkpoint %s: %w", file, err)
+	}
+
+	for name, offset := range checkpoint.Offsets {
+		i := strings.LastIndex(name, "/")
+		if i < 0 {
+			return nil, fmt.Errorf("bad partition %q in mirror checkpoint %s", name, file)
+		}
+		partition, err := strconv.Atoi(name[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("bad partition %q in mirror checkpoint %s", name, file)
+		}
+		offsets[partitionKey{topic: name[:i], partition: partition}] = offset
+	}
+
+	return offsets, nil
+}
+
+// saveCheckpoint writes the offsets of every partition to the checkpoint
+// file.
+func (m *Mirror) saveCheckpoint() error {
+	if m.cfg.CheckpointFile == "" {
+		return nil
+	}
+
+	m.checkpointMu.Lock()
+	defer m.checkpointMu.Unlock()
+
+	m.mu.Lock()
+	for key, p := range m.partitions {
+		m.checkpoint[key] = p.offset
+	}
+	checkpoint := checkpointFile{Offsets: make(map[string]int, len(m.checkpoint))}
+	for key, offset := range m.checkpoint {
+		checkpoint.Offsets[key.String()] = offset
+	}
+	m.mu.Unlock()
+
+	data, err := json.MarshalIndent(checkpoint, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// write to a temporary file first so that a crash does not leave a
+	// torn checkpoint behind
+	if err := os.MkdirAll(filepath.Dir(m.cfg.CheckpointFile), 0o755); err != nil {
+		return err
+	}
+	tmp := m.cfg.CheckpointFile + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.cfg.CheckpointFile)
+}
@@ -0,0 +1,581 @@
+// Package mirror copies topics of a remote broker into the local one, e.g.
+// between the brokers of different sites. A mirror reads the stored
+// messages of every source partition by offset, the way mqctl tail does,
+// and publishes them locally with the client package. It checkpoints the
+// next offset of every source partition so that it resumes where it
+// stopped without copying a message twice.
+//
+// Mirrored messages carry the sites they were stored at in the HeaderPath
+// header. A mirror does not copy a message that was stored at its own site
+// before, so that brokers may mirror each other's topics without looping.
+//
+// The mirror is not a consumer group of the source, so messages that every
+// group of the source acknowledged before the mirror read them are not
+// copied.
+package mirror
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdkelley02/message-queue/client"
+	"github.com/mdkelley02/message-queue/server"
+)
+
+const (
+	// HeaderPath lists the sites a mirrored message was stored at, separated
+	// by commas, starting with the site it was published at.
+	HeaderPath = "mq-mirror-path"
+	// HeaderSource is where a mirrored message was copied from, as
+	// site/topic/partition/offset.
+	HeaderSource = "mq-mirror-source"
+
+	defaultPollInterval = time.Second
+	defaultBatchSize    = 100
+	maxBatchSize        = 1000
+)
+
+var errInvalidMirrorConfig = errors.New("invalid mirror config")
+
+// Config copies the topics of Source into Local.
+type Config struct {
+	// Site names the local broker and SourceSite the source broker in the
+	// path of mirrored messages.
+	Site       string
+	SourceSite string
+	Source     client.IMessageQueueClient
+	Local      client.IMessageQueueClient
+	Topics     []TopicMapping
+	// CheckpointFile keeps the next offset of every source partition. The
+	// mirror starts at the beginning of the source partitions without one,
+	// and on every start when it is empty.
+	CheckpointFile string
+	// PollInterval is how long the mirror waits for new messages of a
+	// partition it copied completely, and how often it looks for new
+	// topics of the source.
+	PollInterval time.Duration
+	// BatchSize is how many messages of a partition are read at once.
+	BatchSize int
+}
+
+// TopicMapping selects topics of the source by name, or by a path.Match
+// pattern, and names their copies. Destination may contain {topic}, which
+// stands for the name of the source topic. The copy has the name of the
+// source topic when Destination is empty.
+type TopicMapping struct {
+	Source      string
+	Destination string
+}
+
+// Validate checks the settings of the mirror. The clients are checked by
+// NewMirror.
+func (c Config) Validate() error {
+	if c.Site == "" || c.SourceSite == "" {
+		return fmt.Errorf("%w: site and source site must not be empty", errInvalidMirrorConfig)
+	}
+	if c.Site == c.SourceSite {
+		return fmt.Errorf("%w: site and source site must differ", errInvalidMirrorConfig)
+	}
+	if strings.ContainsAny(c.Site+c.SourceSite, ",/") {
+		return fmt.Errorf("%w: sites must not contain commas or slashes", errInvalidMirrorConfig)
+	}
+	if len(c.Topics) == 0 {
+		return fmt.Errorf("%w: topics must not be empty", errInvalidMirrorConfig)
+	}
+	for _, t := range c.Topics {
+		if err := t.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.PollInterval < 0 {
+		return fmt.Errorf("%w: poll interval must not be negative", errInvalidMirrorConfig)
+	}
+	if c.BatchSize < 0 || c.BatchSize > maxBatchSize {
+		return fmt.Errorf("%w: batch size must be between 0 and %d", errInvalidMirrorConfig, maxBatchSize)
+	}
+	return nil
+}
+
+func (c Config) withDefaults() Config {
+	if c.PollInterval == 0 {
+		c.PollInterval = defaultPollInterval
+	}
+	if c.BatchSize == 0 {
+		c.BatchSize = defaultBatchSize
+	}
+	return c
+}
+
+func (t TopicMapping) Validate() error {
+	if t.Source == "" {
+		return fmt.Errorf("%w: source topic must not be empty", errInvalidMirrorConfig)
+	}
+	if _, err := path.Match(t.Source, ""); err != nil {
+		return fmt.Errorf("%w: bad topic pattern %q", errInvalidMirrorConfig, t.Source)
+	}
+	// a pattern copied into one topic would mix the partitions of its
+	// topics
+	if t.pattern() && t.Destination != "" && !strings.Contains(t.Destination, "{topic}") {
+		return fmt.Errorf("%w: the destination of pattern %q must contain {topic}", errInvalidMirrorConfig, t.Source)
+	}
+	return nil
+}
+
+func (t TopicMapping) pattern() bool {
+	return strings.ContainsAny(t.Source, `*?[\`)
+}
+
+// destination returns the name of the copy of topic, ok is false if the
+// mapping does not select topic.
+func (t TopicMapping) destination(topic string) (string, bool) {
+	if ok, _ := path.Match(t.Source, topic); !ok {
+		return "", false
+	}
+	if t.Destination == "" {
+		return topic, true
+	}
+	return strings.ReplaceAll(t.Destination, "{topic}", topic), true
+}
+
+type partitionKey struct {
+	topic     string
+	partition int
+}
+
+func (k partitionKey) String() string {
+	return fmt.Sprintf("%s/%d", k.topic, k.partition)
+}
+
+// partitionState is how far a source partition is copied.
+type partitionState struct {
+	destination   string
+	offset        int
+	highWatermark int
+	mirrored      int64
+	skipped       int64
+	lastMirrored  time.Time
+	cancel        context.CancelFunc
+}
+
+// Mirror copies the topics of a source broker into the local broker. It
+// implements server.IMirror.
+type Mirror struct {
+	cfg Config
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu          sync.Mutex
+	running     bool
+	partitions  map[partitionKey]*partitionState
+	checkpoint  map[partitionKey]int
+	lastError   string
+	lastErrorAt time.Time
+
+	// checkpointMu serializes the writes of the checkpoint file
+	checkpointMu sync.Mutex
+}
+
+func NewMirror(cfg Config) (*Mirror, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if cfg.Source == nil || cfg.Local == nil {
+		return nil, fmt.Errorf("%w: source and local clients are required", errInvalidMirrorConfig)
+	}
+
+	checkpoint, err := loadCheckpoint(cfg.CheckpointFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Mirror{
+		cfg:        cfg.withDefaults(),
+		partitions: make(map[partitionKey]*partitionState),
+		checkpoint: checkpoint,
+	}, nil
+}
+
+func (m *Mirror) Start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+
+	m.mu.Lock()
+	m.running = true
+	m.partitions = make(map[partitionKey]*partitionState)
+	m.mu.Unlock()
+
+	m.wg.Add(1)
+	go m.run(ctx)
+}
+
+func (m *Mirror) Stop() {
+	m.cancel()
+	m.wg.Wait()
+
+	m.mu.Lock()
+	m.running = false
+	m.mu.Unlock()
+
+	if err := m.saveCheckpoint(); err != nil {
+		slog.Error("could not save mirror checkpoint", "source", m.cfg.SourceSite, "err", err)
+	}
+}
+
+// Status reports every source partition the mirror copies.
+func (m *Mirror) Status() server.MirrorStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	status := server.MirrorStatus{
+		Source:     m.cfg.SourceSite,
+		Running:    m.running,
+		Partitions: make([]server.MirroredPartition, 0, len(m.partitions)),
+		LastError:  m.lastError,
+	}
+	if !m.lastErrorAt.IsZero() {
+		lastErrorAt := m.lastErrorAt
+		status.LastErrorAt = &lastErrorAt
+	}
+
+	for key, p := range m.partitions {
+		partition := server.MirroredPartition{
+			SourceTopic:   key.topic,
+			Topic:         p.destination,
+			Partition:     key.partition,
+			Offset:        p.offset,
+			HighWatermark: p.highWatermark,
+			Lag:           max(p.highWatermark-p.offset, 0),
+			Mirrored:      p.mirrored,
+			Skipped:       p.skipped,
+		}
+		if !p.lastMirrored.IsZero() {
+			lastMirrored := p.lastMirrored
+			partition.LastMirrored = &lastMirrored
+		}
+		status.Partitions = append(status.Partitions, partition)
+	}
+
+	sort.Slice(status.Partitions, func(i, j int) bool {
+		a, b := status.Partitions[i], status.Partitions[j]
+		if a.SourceTopic != b.SourceTopic {
+			return a.SourceTopic < b.SourceTopic
+		}
+		return a.Partition < b.Partition
+	})
+
+	return status
+}
+
+func (m *Mirror) run(ctx context.Context) {
+	defer m.wg.Done()
+
+	for {
+		if err := m.discover(ctx); err != nil {
+			m.fail("could not list the topics of the source", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(m.cfg.PollInterval):
+		}
+	}
+}
+
+// discover starts copying the partitions of the source topics the mirror
+// selects, and stops copying the topics the source deleted.
+func (m *Mirror) discover(ctx context.Context) error {
+	topics, err := m.cfg.Source.GetTopics()
+	if err != nil {
+		return err
+	}
+
+	selected := make(map[string]bool)
+	for _, topic := range topics {
+		// system topics belong to their broker
+		if strings.HasPrefix(topic, "$") {
+			continue
+		}
+
+		destination, ok := m.destination(topic)
+		if !ok {
+			continue
+		}
+		selected[topic] = true
+
+		if err := m.mirrorTopic(ctx, topic, destination); err != nil {
+			m.fail(fmt.Sprintf("could not mirror topic %s", topic), err)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key, p := range m.partitions {
+		if !selected[key.topic] {
+			p.cancel()
+			delete(m.partitions, key)
+			// a topic created again starts over
+			delete(m.checkpoint, key)
+		}
+	}
+
+	return nil
+}
+
+func (m *Mirror) destination(topic string) (string, bool) {
+	for _, t := range m.cfg.Topics {
+		if destination, ok := t.destination(topic); ok {
+			return destination, true
+		}
+	}
+	return "", false
+}
+
+// mirrorTopic creates the copy of topic with as many partitions and copies
+// the partitions that are not copied yet.
+func (m *Mirror) mirrorTopic(ctx context.Context, topic string, destination string) error {
+	source, err := m.cfg.Source.GetTopic(topic)
+	if err != nil {
+		return err
+	}
+
+	local, err := m.cfg.Local.GetTopic(destination)
+	if isStatus(err, http.StatusNotFound) {
+		local, err = m.cfg.Local.CreateTopic(destination, server.TopicConfig{Partitions: len(source.Partitions)})
+	}
+	if err != nil {
+		return fmt.Errorf("could not create %s: %w", destination, err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, p := range source.Partitions {
+		key := partitionKey{topic: topic, partition: p.Id}
+		if state, ok := m.partitions[key]; ok {
+			state.highWatermark = p.HighWatermark
+			continue
+		}
+
+		ctx, cancel := context.WithCancel(ctx)
+		state := &partitionState{
+			destination:   destination,
+			offset:        m.checkpoint[key],
+			highWatermark: p.HighWatermark,
+			cancel:        cancel,
+		}
+		m.partitions[key] = state
+
+		m.wg.Add(1)
+		go m.copyPartition(ctx, key, destination, len(local.Partitions))
+	}
+
+	return nil
+}
+
+func (m *Mirror) copyPartition(ctx context.Context, key partitionKey, destination string, partitions int) {
+	defer m.wg.Done()
+
+	if err := m.recover(key, destination); err != nil {
+		m.fail(fmt.Sprintf("could not recover the offset of %s", key), err)
+	}
+
+	for {
+		copied, more, err := m.copyBatch(ctx, key, destination, partitions)
+		if err != nil {
+			m.fail(fmt.Sprintf("could not copy %s", key), err)
+		}
+		if copied {
+			if err := m.saveCheckpoint(); err != nil {
+				m.fail("could not save checkpoint", err)
+			}
+		}
+
+		if more && err == nil {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(m.cfg.PollInterval):
+		}
+	}
+}
+
+// recover moves the offset of the source partition past the messages that
+// were published after the checkpoint was last written, the latest
+// messages of the destination tell which ones.
+func (m *Mirror) recover(key partitionKey, destination string) error {
+	topic, err := m.cfg.Local.GetTopic(destination)
+	if err != nil {
+		return err
+	}
+
+	next := -1
+	for _, p := range topic.Partitions {
+		from := max(p.HighWatermark-m.cfg.BatchSize, p.LowWatermark)
+		response, err := m.cfg.Local.BrowseMessages(destination, p.Id, from, m.cfg.BatchSize)
+		if err != nil {
+			return err
+		}
+
+		for _, msg := range response.Messages {
+			site, source, offset, ok := parseSource(msg.Headers[HeaderSource])
+			if ok && site == m.cfg.SourceSite && source == key {
+				next = max(next, offset+1)
+			}
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if state, ok := m.partitions[key]; ok && next > state.offset {
+		slog.Info("recovered mirror offset", "source", m.cfg.SourceSite, "partition", key.String(), "checkpoint", state.offset, "offset", next)
+		state.offset = next
+	}
+	return nil
+}
+
+// copyBatch copies the next messages of the source partition. It reports
+// whether the offset of the partition moved and whether there are more
+// messages to copy.
+func (m *Mirror) copyBatch(ctx context.Context, key partitionKey, destination string, partitions int) (bool, bool, error) {
+	m.mu.Lock()
+	state, ok := m.partitions[key]
+	if !ok {
+		m.mu.Unlock()
+		return false, false, nil
+	}
+	offset := state.offset
+	m.mu.Unlock()
+
+	response, err := m.cfg.Source.BrowseMessages(key.topic, key.partition, offset, m.cfg.BatchSize)
+	if err != nil {
+		return false, false, err
+	}
+
+	for _, msg := range response.Messages {
+		if ctx.Err() != nil {
+			return true, false, nil
+		}
+
+		visited := m.visited(msg.Headers[HeaderPath])
+		if !visited {
+			if _, err := m.cfg.Local.PublishMessage(destination, m.publishRequest(key, msg, partitions)); err != nil {
+				return msg.Offset > offset, false, err
+			}
+		}
+
+		m.mu.Lock()
+		state.offset = msg.Offset + 1
+		if visited {
+			state.skipped++
+		} else {
+			state.mirrored++
+			state.lastMirrored = time.Now()
+		}
+		m.mu.Unlock()
+	}
+
+	more := len(response.Messages) == m.cfg.BatchSize
+
+	m.mu.Lock()
+	// skip the removed messages at the end of the batch
+	state.offset = max(state.offset, response.NextOffset)
+	if !more {
+		state.highWatermark = response.NextOffset
+	}
+	state.highWatermark = max(state.highWatermark, state.offset)
+	copied := state.offset > offset
+	m.mu.Unlock()
+
+	return copied, more, nil
+}
+
+// visited reports whether a message with the path was stored at the site
+// of the mirror before.
+func (m *Mirror) visited(path string) bool {
+	if path == "" {
+		return false
+	}
+	for _, site := range strings.Split(path, ",") {
+		if site == m.cfg.Site {
+			return true
+		}
+	}
+	return false
+}
+
+// publishRequest copies msg. It goes to the same partition when the copy
+// has enough partitions, and is partitioned by its key otherwise.
+func (m *Mirror) publishRequest(key partitionKey, msg server.MessageResponse, partitions int) server.PublishRequest {
+	headers := make(map[string]string, len(msg.Headers)+2)
+	for name, value := range msg.Headers {
+		headers[name] = value
+	}
+
+	path := msg.Headers[HeaderPath]
+	if path == "" {
+		path = m.cfg.SourceSite
+	}
+	headers[HeaderPath] = path + "," + m.cfg.Site
+	headers[HeaderSource] = fmt.Sprintf("%s/%s/%d", m.cfg.SourceSite, key, msg.Offset)
+
+	req := server.PublishRequest{
+		Body:    msg.Value,
+		Key:     msg.Key,
+		Headers: headers,
+		Trace:   msg.TraceContext,
+	}
+	if key.partition < partitions {
+		partition := key.partition
+		req.Partition = &partition
+	}
+	return req
+}
+
+// parseSource splits a HeaderSource value.
+func parseSource(value string) (string, partitionKey, int, bool) {
+	parts := strings.Split(value, "/")
+	if len(parts) != 4 {
+		return "", partitionKey{}, 0, false
+	}
+
+	partition, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return "", partitionKey{}, 0, false
+	}
+	offset, err := strconv.Atoi(parts[3])
+	if err != nil {
+		return "", partitionKey{}, 0, false
+	}
+
+	return parts[0], partitionKey{topic: parts[1], partition: partition}, offset, true
+}
+
+func (m *Mirror) fail(msg string, err error) {
+	slog.Warn(msg, "source", m.cfg.SourceSite, "err", err)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastError = fmt.Sprintf("%s: %v", msg, err)
+	m.lastErrorAt = time.Now()
+}
+
+func isStatus(err error, status int) bool {
+	var respErr *client.ResponseError
+	return errors.As(err, &respErr) && respErr.StatusCode == status
+}
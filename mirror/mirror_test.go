@@ -0,0 +1,251 @@
+package mirror
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mdkelley02/message-queue/client"
+	"github.com/mdkelley02/message-queue/server"
+	"github.com/mdkelley02/message-queue/storage"
+)
+
+func Test_mirror(t *testing.T) {
+	a := client.NewMessageQueueClient("localhost:8104", false)
+	b := client.NewMessageQueueClient("localhost:8105", false)
+
+	// a copies the events of b while it serves, b mirrors a with a mirror
+	// of its own so that the test can restart it
+	fromB, err := NewMirror(Config{
+		Site:         "a",
+		SourceSite:   "b",
+		Source:       b,
+		Local:        a,
+		Topics:       []TopicMapping{{Source: "events"}},
+		PollInterval: 20 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for addr, mirrors := range map[string][]server.IMirror{":8104": {fromB}, ":8105": nil} {
+		s := server.NewServer(server.ServerConfig{
+			ServerAddr:      addr,
+			MakeStorageFunc: storage.NewStorage,
+			Mirrors:         mirrors,
+		})
+		stopped := make(chan error, 1)
+		go func() {
+			stopped <- s.Start()
+		}()
+		waitForServer(t, "localhost"+addr)
+		defer stopServer(t, s, stopped)
+	}
+
+	checkpointFile := filepath.Join(t.TempDir(), "a.json")
+	fromA := Config{
+		Site:       "b",
+		SourceSite: "a",
+		Source:     a,
+		Local:      b,
+		Topics: []TopicMapping{
+			{Source: "events"},
+			{Source: "orders.*", Destination: "a.{topic}"},
+		},
+		CheckpointFile: checkpointFile,
+		PollInterval:   20 * time.Millisecond,
+		BatchSize:      2,
+	}
+	startMirror := func(t *testing.T) *Mirror {
+		m, err := NewMirror(fromA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Start()
+		return m
+	}
+	m := startMirror(t)
+	defer func() {
+		m.Stop()
+	}()
+
+	values := func(c client.IMessageQueueClient, topic string) []string {
+		response, err := c.GetTopic(topic)
+		if err != nil {
+			return nil
+		}
+
+		var values []string
+		for _, p := range response.Partitions {
+			browsed, err := c.BrowseMessages(topic, p.Id, 0, 100)
+			if err != nil {
+				return nil
+			}
+			for _, msg := range browsed.Messages {
+				values = append(values, msg.Value)
+			}
+		}
+		sort.Strings(values)
+		return values
+	}
+
+	t.Run("topics are copied with their headers under their new names", func(t *testing.T) {
+		if _, err := a.CreateTopic("orders.eu", server.TopicConfig{Partitions: 2}); err != nil {
+			t.Fatal(err)
+		}
+		for i, value := range []string{"o1", "o2", "o3"} {
+			partition := i % 2
+			if _, err := a.PublishMessage("orders.eu", server.PublishRequest{
+				Body:      value,
+				Key:       "k",
+				Partition: &partition,
+				Headers:   map[string]string{"origin": "test"},
+			}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		assert.Eventually(t, func() bool {
+			return assert.ObjectsAreEqual([]string{"o1", "o2", "o3"}, values(b, "a.orders.eu"))
+		}, 5*time.Second, 20*time.Millisecond)
+
+		topic, err := b.GetTopic("a.orders.eu")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Len(t, topic.Partitions, 2)
+
+		browsed, err := b.BrowseMessages("a.orders.eu", 1, 0, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, browsed.Messages, 1) {
+			msg := browsed.Messages[0]
+			assert.Equal(t, "o2", msg.Value)
+			assert.Equal(t, "k", msg.Key)
+			assert.Equal(t, map[string]string{
+				"origin":     "test",
+				HeaderPath:   "a,b",
+				HeaderSource: "a/orders.eu/1/0",
+			}, msg.Headers)
+		}
+	})
+
+	t.Run("messages do not loop between brokers mirroring each other", func(t *testing.T) {
+		for _, value := range []string{"a1", "a2"} {
+			if _, err := a.Publish("events", value); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := b.Publish("events", "b1"); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, c := range []client.IMessageQueueClient{a, b} {
+			assert.Eventually(t, func() bool {
+				return assert.ObjectsAreEqual([]string{"a1", "a2", "b1"}, values(c, "events"))
+			}, 5*time.Second, 20*time.Millisecond)
+		}
+		assert.Never(t, func() bool {
+			return len(values(a, "events")) > 3 || len(values(b, "events")) > 3
+		}, 200*time.Millisecond, 20*time.Millisecond)
+
+		mirrors, err := a.GetMirrors()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if assert.Len(t, mirrors, 1) && assert.Len(t, mirrors[0].Partitions, 1) {
+			assert.Equal(t, "b", mirrors[0].Source)
+			assert.True(t, mirrors[0].Running)
+
+			p := mirrors[0].Partitions[0]
+			assert.Equal(t, "events", p.SourceTopic)
+			assert.Equal(t, 3, p.Offset)
+			assert.Equal(t, 0, p.Lag)
+			assert.Equal(t, int64(1), p.Mirrored)
+			assert.Equal(t, int64(2), p.Skipped)
+		}
+	})
+
+	t.Run("the mirror resumes without copying messages twice", func(t *testing.T) {
+		m.Stop()
+		if _, err := a.Publish("orders.eu", "o4"); err != nil {
+			t.Fatal(err)
+		}
+
+		m = startMirror(t)
+		assert.Eventually(t, func() bool {
+			return assert.ObjectsAreEqual([]string{"o1", "o2", "o3", "o4"}, values(b, "a.orders.eu"))
+		}, 5*time.Second, 20*time.Millisecond)
+
+		// the latest messages of the copies tell where the mirror was when
+		// its checkpoint is lost
+		m.Stop()
+		if err := os.Remove(checkpointFile); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := a.Publish("orders.eu", "o5"); err != nil {
+			t.Fatal(err)
+		}
+
+		m = startMirror(t)
+		assert.Eventually(t, func() bool {
+			return assert.ObjectsAreEqual([]string{"o1", "o2", "o3", "o4", "o5"}, values(b, "a.orders.eu"))
+		}, 5*time.Second, 20*time.Millisecond)
+		assert.Never(t, func() bool {
+			return len(values(b, "a.orders.eu")) > 5 || len(values(b, "events")) > 3
+		}, 200*time.Millisecond, 20*time.Millisecond)
+	})
+}
+
+func Test_config(t *testing.T) {
+	c := client.NewMessageQueueClient("localhost:8080", false)
+	valid := Config{Site: "a", SourceSite: "b", Source: c, Local: c, Topics: []TopicMapping{{Source: "orders.*", Destination: "b.{topic}"}}}
+	assert.NoError(t, valid.Validate())
+
+	for name, change := range map[string]func(*Config){
+		"same sites":           func(c *Config) { c.SourceSite = "a" },
+		"site with a comma":    func(c *Config) { c.Site = "a,c" },
+		"no topics":            func(c *Config) { c.Topics = nil },
+		"pattern into a topic": func(c *Config) { c.Topics = []TopicMapping{{Source: "orders.*", Destination: "orders"}} },
+		"bad pattern":          func(c *Config) { c.Topics = []TopicMapping{{Source: "orders.["}} },
+		"batch too large":      func(c *Config) { c.BatchSize = maxBatchSize + 1 },
+	} {
+		cfg := valid
+		change(&cfg)
+		assert.ErrorIs(t, cfg.Validate(), errInvalidMirrorConfig, name)
+	}
+
+	destination, ok := valid.Topics[0].destination("orders.eu")
+	assert.True(t, ok)
+	assert.Equal(t, "b.orders.eu", destination)
+	_, ok = valid.Topics[0].destination("payments")
+	assert.False(t, ok)
+}
+
+func stopServer(t *testing.T, s *server.Server, stopped <-chan error) {
+	http.DefaultClient.CloseIdleConnections()
+	s.Stop()
+	if err := <-stopped; err != nil {
+		t.Error(err)
+	}
+}
+
+func waitForServer(t *testing.T, addr string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("server at %s did not start", addr)
+}
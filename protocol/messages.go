@@ -0,0 +1,212 @@
+package protocol
+
+import "time"
+
+// AnyPartition lets the broker choose the partition of a message, by its
+// key when it has one.
+const AnyPartition = -1
+
+// AuthRequest carries credentials the way the HTTP API takes them from
+// headers, e.g. X-Api-Key or Authorization.
+type AuthRequest struct {
+	Credentials map[string]string
+}
+
+func (r *AuthRequest) Encode(enc *Encoder) {
+	enc.Headers(r.Credentials)
+}
+
+func (r *AuthRequest) Decode(dec *Decoder) {
+	r.Credentials = dec.Headers()
+}
+
+// Empty is the body of requests and responses that carry nothing else.
+type Empty struct{}
+
+func (*Empty) Encode(*Encoder) {}
+
+func (*Empty) Decode(*Decoder) {}
+
+// ProduceRequest publishes a batch of messages to one topic. The messages
+// are stored in order, each one is answered on its own.
+type ProduceRequest struct {
+	Namespace string
+	Topic     string
+	Messages  []Message
+}
+
+// Message is a message to publish. TraceParent and TraceState propagate
+// the trace of the producer like the headers of the same name do over
+// HTTP.
+type Message struct {
+	Key         string
+	Partition   int32
+	Value       string
+	Headers     map[string]string
+	TraceParent string
+	TraceState  string
+}
+
+func (r *ProduceRequest) Encode(enc *Encoder) {
+	enc.String(r.Namespace)
+	enc.String(r.Topic)
+	enc.Uint32(uint32(len(r.Messages)))
+	for _, m := range r.Messages {
+		enc.String(m.Key)
+		enc.Int32(m.Partition)
+		enc.String(m.Value)
+		enc.Headers(m.Headers)
+		enc.String(m.TraceParent)
+		enc.String(m.TraceState)
+	}
+}
+
+func (r *ProduceRequest) Decode(dec *Decoder) {
+	r.Namespace = dec.String()
+	r.Topic = dec.String()
+	r.Messages = make([]Message, dec.count(24))
+	for i := range r.Messages {
+		r.Messages[i] = Message{
+			Key:         dec.String(),
+			Partition:   dec.Int32(),
+			Value:       dec.String(),
+			Headers:     dec.Headers(),
+			TraceParent: dec.String(),
+			TraceState:  dec.String(),
+		}
+	}
+}
+
+// ProduceResponse has a result for every message of the request, in the
+// same order.
+type ProduceResponse struct {
+	Results []ProduceResult
+}
+
+// ProduceResult is where a message was stored, or why it was not when
+// Status is not StatusOK.
+type ProduceResult struct {
+	Status    uint16
+	Error     string
+	Partition int32
+	Offset    int64
+}
+
+func (r *ProduceResponse) Encode(enc *Encoder) {
+	enc.Uint32(uint32(len(r.Results)))
+	for _, result := range r.Results {
+		enc.Uint16(result.Status)
+		enc.String(result.Error)
+		enc.Int32(result.Partition)
+		enc.Int64(result.Offset)
+	}
+}
+
+func (r *ProduceResponse) Decode(dec *Decoder) {
+	r.Results = make([]ProduceResult, dec.count(18))
+	for i := range r.Results {
+		r.Results[i] = ProduceResult{
+			Status:    dec.Uint16(),
+			Error:     dec.String(),
+			Partition: dec.Int32(),
+			Offset:    dec.Int64(),
+		}
+	}
+}
+
+// FetchRequest reads up to MaxMessages messages of a partition from Offset
+// on.
+type FetchRequest struct {
+	Namespace   string
+	Topic       string
+	Partition   int32
+	Offset      int64
+	MaxMessages int32
+}
+
+func (r *FetchRequest) Encode(enc *Encoder) {
+	enc.String(r.Namespace)
+	enc.String(r.Topic)
+	enc.Int32(r.Partition)
+	enc.Int64(r.Offset)
+	enc.Int32(r.MaxMessages)
+}
+
+func (r *FetchRequest) Decode(dec *Decoder) {
+	r.Namespace = dec.String()
+	r.Topic = dec.String()
+	r.Partition = dec.Int32()
+	r.Offset = dec.Int64()
+	r.MaxMessages = dec.Int32()
+}
+
+// FetchResponse holds the messages read and the offset to fetch the next
+// ones from.
+type FetchResponse struct {
+	NextOffset    int64
+	HighWatermark int64
+	Records       []Record
+}
+
+// Record is a stored message.
+type Record struct {
+	Offset    int64
+	Timestamp time.Time
+	Key       string
+	Value     string
+	Headers   map[string]string
+}
+
+func (r *FetchResponse) Encode(enc *Encoder) {
+	enc.Int64(r.NextOffset)
+	enc.Int64(r.HighWatermark)
+	enc.Uint32(uint32(len(r.Records)))
+	for _, record := range r.Records {
+		enc.Int64(record.Offset)
+		enc.Int64(record.Timestamp.UnixNano())
+		enc.String(record.Key)
+		enc.String(record.Value)
+		enc.Headers(record.Headers)
+	}
+}
+
+func (r *FetchResponse) Decode(dec *Decoder) {
+	r.NextOffset = dec.Int64()
+	r.HighWatermark = dec.Int64()
+	r.Records = make([]Record, dec.count(28))
+	for i := range r.Records {
+		r.Records[i] = Record{
+			Offset:    dec.Int64(),
+			Timestamp: time.Unix(0, dec.Int64()),
+			Key:       dec.String(),
+			Value:     dec.String(),
+			Headers:   dec.Headers(),
+		}
+	}
+}
+
+// OffsetRequest acknowledges or commits an offset of a partition for a
+// consumer group, the default group when Group is empty.
+type OffsetRequest struct {
+	Namespace string
+	Topic     string
+	Group     string
+	Partition int32
+	Offset    int64
+}
+
+func (r *OffsetRequest) Encode(enc *Encoder) {
+	enc.String(r.Namespace)
+	enc.String(r.Topic)
+	enc.String(r.Group)
+	enc.Int32(r.Partition)
+	enc.Int64(r.Offset)
+}
+
+func (r *OffsetRequest) Decode(dec *Decoder) {
+	r.Namespace = dec.String()
+	r.Topic = dec.String()
+	r.Group = dec.String()
+	r.Partition = dec.Int32()
+	r.Offset = dec.Int64()
+}
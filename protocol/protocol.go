@@ -0,0 +1,347 @@
+// Package protocol is the binary protocol of the broker, a leaner
+// alternative to its HTTP API for clients that produce and fetch many
+// messages.
+//
+// Every frame starts with its length as a big endian uint32, not counting
+// the prefix itself. A request frame continues with the operation as a
+// uint8, a correlation id as a uint32 and the body of the operation. A
+// response frame repeats the operation and the correlation id of its
+// request, followed by a status as a uint16 and either the body of the
+// response or, for any status but StatusOK, an Error.
+//
+// A client may send any number of requests without waiting for their
+// responses. The broker serves the requests of a connection in the order
+// they arrive and answers them in that order, the correlation id lets the
+// client match them all the same.
+//
+// Integers are big endian. Strings are a uint32 length followed by their
+// bytes, headers are a uint32 count followed by that many key and value
+// strings.
+package protocol
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// Op is the operation of a request.
+type Op uint8
+
+const (
+	// OpAuth authenticates the connection with an AuthRequest. Until it
+	// does, the connection is anonymous or identified by its client
+	// certificate.
+	OpAuth Op = iota + 1
+	// OpProduce publishes a ProduceRequest, answered with a
+	// ProduceResponse.
+	OpProduce
+	// OpFetch reads the messages of a partition from an offset on without
+	// claiming them, a FetchRequest answered with a FetchResponse.
+	OpFetch
+	// OpAck acknowledges one offset for a consumer group, an OffsetRequest.
+	OpAck
+	// OpCommit acknowledges every offset below the given one for a
+	// consumer group, an OffsetRequest.
+	OpCommit
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpAuth:
+		return "auth"
+	case OpProduce:
+		return "produce"
+	case OpFetch:
+		return "fetch"
+	case OpAck:
+		return "ack"
+	case OpCommit:
+		return "commit"
+	}
+	return fmt.Sprintf("op(%d)", uint8(op))
+}
+
+// Statuses are those of the HTTP API, so that a failure means the same
+// whichever way the broker is asked.
+const StatusOK = http.StatusOK
+
+const (
+	// MaxFrameSize bounds the length of a frame.
+	MaxFrameSize = 64 << 20
+
+	lengthSize  = 4
+	requestSize = 1 + 4
+)
+
+var (
+	ErrFrameTooLarge = errors.New("frame is too large")
+	ErrMalformed     = errors.New("malformed frame")
+)
+
+// Error is the body of a response whose status is not StatusOK. Leader is
+// set when a broker that does not lead refused a request only its leader
+// serves, RetryAfter when a rate limit was hit.
+type Error struct {
+	Status     uint16
+	Message    string
+	Leader     string
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d: %s", e.Status, e.Message)
+}
+
+func (e *Error) Encode(enc *Encoder) {
+	enc.String(e.Message)
+	enc.String(e.Leader)
+	enc.Uint32(uint32(e.RetryAfter / time.Millisecond))
+}
+
+func (e *Error) Decode(dec *Decoder) {
+	e.Message = dec.String()
+	e.Leader = dec.String()
+	e.RetryAfter = time.Duration(dec.Uint32()) * time.Millisecond
+}
+
+// Body is the body of a request or a response.
+type Body interface {
+	Encode(enc *Encoder)
+	Decode(dec *Decoder)
+}
+
+// Header identifies a request and its response.
+type Header struct {
+	Op            Op
+	CorrelationId uint32
+}
+
+// AppendRequest appends the frame of a request to buf.
+func AppendRequest(buf []byte, h Header, body Body) []byte {
+	enc := newFrame(buf, h)
+	body.Encode(enc)
+	return enc.frame(len(buf))
+}
+
+// AppendResponse appends the frame of a response to buf. The body is an
+// Error unless status is StatusOK.
+func AppendResponse(buf []byte, h Header, status uint16, body Body) []byte {
+	enc := newFrame(buf, h)
+	enc.Uint16(status)
+	if body != nil {
+		body.Encode(enc)
+	}
+	return enc.frame(len(buf))
+}
+
+// AppendError appends the frame of a failed response to buf.
+func AppendError(buf []byte, h Header, e *Error) []byte {
+	return AppendResponse(buf, h, e.Status, e)
+}
+
+func newFrame(buf []byte, h Header) *Encoder {
+	enc := &Encoder{buf: buf}
+	enc.Uint32(0)
+	enc.Uint8(uint8(h.Op))
+	enc.Uint32(h.CorrelationId)
+	return enc
+}
+
+// ReadFrame reads the next frame from r and returns it without its length
+// prefix.
+func ReadFrame(r *bufio.Reader) ([]byte, error) {
+	var prefix [lengthSize]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(prefix[:])
+	if size > MaxFrameSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, size)
+	}
+	if size < requestSize {
+		return nil, ErrMalformed
+	}
+
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return frame, nil
+}
+
+// ParseRequest splits a request frame into its header and a decoder of its
+// body.
+func ParseRequest(frame []byte) (Header, *Decoder) {
+	dec := &Decoder{buf: frame}
+	h := Header{Op: Op(dec.Uint8()), CorrelationId: dec.Uint32()}
+	return h, dec
+}
+
+// ParseResponse splits a response frame into its header, its status and a
+// decoder of its body. The body of a failed response is returned as an
+// *Error.
+func ParseResponse(frame []byte) (Header, *Decoder, error) {
+	dec := &Decoder{buf: frame}
+	h := Header{Op: Op(dec.Uint8()), CorrelationId: dec.Uint32()}
+	status := dec.Uint16()
+	if err := dec.Err(); err != nil {
+		return h, nil, err
+	}
+
+	if status != StatusOK {
+		e := &Error{Status: status}
+		e.Decode(dec)
+		if err := dec.Err(); err != nil {
+			return h, nil, err
+		}
+		return h, nil, e
+	}
+	return h, dec, nil
+}
+
+// Encoder appends the fields of a frame to a buffer.
+type Encoder struct {
+	buf []byte
+}
+
+func (e *Encoder) Uint8(v uint8) {
+	e.buf = append(e.buf, v)
+}
+
+func (e *Encoder) Uint16(v uint16) {
+	e.buf = binary.BigEndian.AppendUint16(e.buf, v)
+}
+
+func (e *Encoder) Uint32(v uint32) {
+	e.buf = binary.BigEndian.AppendUint32(e.buf, v)
+}
+
+func (e *Encoder) Int32(v int32) {
+	e.Uint32(uint32(v))
+}
+
+func (e *Encoder) Int64(v int64) {
+	e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(v))
+}
+
+func (e *Encoder) String(v string) {
+	e.Uint32(uint32(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+func (e *Encoder) Headers(headers map[string]string) {
+	e.Uint32(uint32(len(headers)))
+	for k, v := range headers {
+		e.String(k)
+		e.String(v)
+	}
+}
+
+// frame fills in the length prefix of the frame that starts at start.
+func (e *Encoder) frame(start int) []byte {
+	binary.BigEndian.PutUint32(e.buf[start:], uint32(len(e.buf)-start-lengthSize))
+	return e.buf
+}
+
+// Decoder reads the fields of a frame. The first field that does not fit
+// into what is left of the frame fails the decoder, the fields read after
+// it are zero.
+type Decoder struct {
+	buf []byte
+	err error
+}
+
+// Err returns ErrMalformed if a field did not fit into the frame.
+func (d *Decoder) Err() error {
+	return d.err
+}
+
+func (d *Decoder) take(n int) []byte {
+	if d.err != nil || n < 0 || n > len(d.buf) {
+		d.err = ErrMalformed
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *Decoder) Uint8() uint8 {
+	b := d.take(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *Decoder) Uint16() uint16 {
+	b := d.take(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (d *Decoder) Uint32() uint32 {
+	b := d.take(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (d *Decoder) Int32() int32 {
+	return int32(d.Uint32())
+}
+
+func (d *Decoder) Int64() int64 {
+	b := d.take(8)
+	if b == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+func (d *Decoder) String() string {
+	return string(d.take(int(d.Uint32())))
+}
+
+func (d *Decoder) Headers() map[string]string {
+	n := d.Uint32()
+	// every header takes at least the two lengths, which bounds n by what
+	// is left of the frame
+	if d.err != nil || uint64(n) > uint64(len(d.buf)/8) {
+		d.err = ErrMalformed
+		return nil
+	}
+	if n == 0 {
+		return nil
+	}
+
+	headers := make(map[string]string, n)
+	for i := uint32(0); i < n && d.err == nil; i++ {
+		k := d.String()
+		headers[k] = d.String()
+	}
+	return headers
+}
+
+// count reads the number of entries of a list whose entries take at least
+// minSize bytes each.
+func (d *Decoder) count(minSize int) int {
+	n := d.Uint32()
+	if d.err != nil || uint64(n) > uint64(len(d.buf)/minSize) {
+		d.err = ErrMalformed
+		return 0
+	}
+	return int(n)
+}
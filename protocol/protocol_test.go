@@ -0,0 +1,93 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_protocol(t *testing.T) {
+	t.Run("requests and responses survive their frames", func(t *testing.T) {
+		request := &ProduceRequest{
+			Namespace: "billing",
+			Topic:     "orders",
+			Messages: []Message{
+				{Key: "k", Partition: AnyPartition, Value: "v1", Headers: map[string]string{"a": "b"}},
+				{Partition: 3, Value: "v2", TraceParent: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"},
+			},
+		}
+		fetched := &FetchResponse{
+			NextOffset:    7,
+			HighWatermark: 9,
+			Records:       []Record{{Offset: 6, Timestamp: time.Unix(0, 42), Key: "k", Value: "v", Headers: map[string]string{"a": "b"}}},
+		}
+
+		var buf []byte
+		buf = AppendRequest(buf, Header{Op: OpProduce, CorrelationId: 1}, request)
+		buf = AppendResponse(buf, Header{Op: OpFetch, CorrelationId: 2}, StatusOK, fetched)
+		buf = AppendError(buf, Header{Op: OpAck, CorrelationId: 3}, &Error{Status: http.StatusMisdirectedRequest, Message: "not the leader", Leader: "http://b", RetryAfter: time.Second})
+
+		r := bufio.NewReader(bytes.NewReader(buf))
+
+		frame, err := ReadFrame(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, dec := ParseRequest(frame)
+		assert.Equal(t, Header{Op: OpProduce, CorrelationId: 1}, h)
+		var decodedRequest ProduceRequest
+		decodedRequest.Decode(dec)
+		assert.NoError(t, dec.Err())
+		assert.Equal(t, request, &decodedRequest)
+
+		frame, err = ReadFrame(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, dec, err = ParseResponse(frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, Header{Op: OpFetch, CorrelationId: 2}, h)
+		var decodedResponse FetchResponse
+		decodedResponse.Decode(dec)
+		assert.NoError(t, dec.Err())
+		assert.Equal(t, fetched, &decodedResponse)
+
+		frame, err = ReadFrame(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h, _, err = ParseResponse(frame)
+		assert.Equal(t, uint32(3), h.CorrelationId)
+		assert.Equal(t, &Error{Status: http.StatusMisdirectedRequest, Message: "not the leader", Leader: "http://b", RetryAfter: time.Second}, err)
+	})
+
+	t.Run("malformed frames are rejected", func(t *testing.T) {
+		frame := AppendRequest(nil, Header{Op: OpFetch, CorrelationId: 1}, &FetchRequest{Topic: "orders"})
+
+		// a body cut short does not decode
+		_, dec := ParseRequest(frame[4 : len(frame)-1])
+		var request FetchRequest
+		request.Decode(dec)
+		assert.ErrorIs(t, dec.Err(), ErrMalformed)
+
+		// a count larger than the frame is not allocated
+		huge := AppendRequest(nil, Header{Op: OpProduce}, &ProduceRequest{})[4:]
+		binary.BigEndian.PutUint32(huge[len(huge)-4:], 1<<30)
+		_, dec = ParseRequest(huge)
+		var produce ProduceRequest
+		produce.Decode(dec)
+		assert.ErrorIs(t, dec.Err(), ErrMalformed)
+
+		tooLarge := binary.BigEndian.AppendUint32(nil, MaxFrameSize+1)
+		_, err := ReadFrame(bufio.NewReader(bytes.NewReader(tooLarge)))
+		assert.True(t, errors.Is(err, ErrFrameTooLarge))
+	})
+}
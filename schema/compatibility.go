@@ -0,0 +1,202 @@
+package schema
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+)
+
+type Compatibility string
+
+const (
+	CompatibilityNone     Compatibility = "none"
+	CompatibilityBackward Compatibility = "backward"
+	CompatibilityForward  Compatibility = "forward"
+	CompatibilityFull     Compatibility = "full"
+)
+
+func (c Compatibility) Valid() bool {
+	switch c {
+	case CompatibilityNone, CompatibilityBackward, CompatibilityForward, CompatibilityFull:
+		return true
+	}
+	return false
+}
+
+// checkCompatibility returns the reasons why next cannot replace prev under
+// the given mode. Backward means consumers using next can read data written
+// with prev, forward means consumers still on prev can read data written with
+// next, and full requires both.
+func checkCompatibility(mode Compatibility, prev, next *node) []string {
+	var reasons []string
+
+	if mode == CompatibilityBackward || mode == CompatibilityFull {
+		for _, reason := range canRead(next, prev, "$") {
+			reasons = append(reasons, "backward: "+reason)
+		}
+	}
+
+	if mode == CompatibilityForward || mode == CompatibilityFull {
+		for _, reason := range canRead(prev, next, "$") {
+			reasons = append(reasons, "forward: "+reason)
+		}
+	}
+
+	return reasons
+}
+
+// canRead reports the ways in which a document accepted by writer could be
+// rejected by reader. It is conservative: an empty result means every
+// document valid under writer is valid under reader for the supported
+// keywords. The one exception are properties the reader names and the
+// writer does not, which are taken to be absent from what the writer wrote,
+// so that adding an optional property stays compatible.
+func canRead(reader, writer *node, path string) []string {
+	if writer.reject {
+		return nil
+	}
+	if reader.reject {
+		return []string{fmt.Sprintf("%s: reader rejects all values", path)}
+	}
+
+	var reasons []string
+
+	if len(reader.Types) > 0 {
+		if len(writer.Types) == 0 {
+			reasons = append(reasons, fmt.Sprintf("%s: type restricted to %v", path, reader.Types))
+		} else {
+			for _, t := range writer.Types {
+				if !typeAccepted(reader.Types, t) {
+					reasons = append(reasons, fmt.Sprintf("%s: type %s is no longer accepted", path, t))
+				}
+			}
+		}
+	}
+
+	if len(reader.Enum) > 0 {
+		if len(writer.Enum) == 0 {
+			reasons = append(reasons, fmt.Sprintf("%s: values restricted to %v", path, reader.Enum))
+		} else {
+			for _, v := range writer.Enum {
+				if !containsValue(reader.Enum, v) {
+					reasons = append(reasons, fmt.Sprintf("%s: enum value %v is no longer accepted", path, v))
+				}
+			}
+		}
+	}
+
+	if reader.Const != nil && (writer.Const == nil || !reflect.DeepEqual(*reader.Const, *writer.Const)) {
+		reasons = append(reasons, fmt.Sprintf("%s: value restricted to %v", path, *reader.Const))
+	}
+
+	reasons = append(reasons, lowerBound(path, "minimum", reader.Minimum, writer.Minimum)...)
+	reasons = append(reasons, upperBound(path, "maximum", reader.Maximum, writer.Maximum)...)
+	reasons = append(reasons, lowerBound(path, "exclusiveMinimum", reader.ExclusiveMinimum, writer.ExclusiveMinimum)...)
+	reasons = append(reasons, upperBound(path, "exclusiveMaximum", reader.ExclusiveMaximum, writer.ExclusiveMaximum)...)
+	reasons = append(reasons, lowerBound(path, "minLength", intPtr(reader.MinLength), intPtr(writer.MinLength))...)
+	reasons = append(reasons, upperBound(path, "maxLength", intPtr(reader.MaxLength), intPtr(writer.MaxLength))...)
+	reasons = append(reasons, lowerBound(path, "minItems", intPtr(reader.MinItems), intPtr(writer.MinItems))...)
+	reasons = append(reasons, upperBound(path, "maxItems", intPtr(reader.MaxItems), intPtr(writer.MaxItems))...)
+
+	if reader.Pattern != nil && (writer.Pattern == nil || reader.Pattern.String() != writer.Pattern.String()) {
+		reasons = append(reasons, fmt.Sprintf("%s: pattern changed to %q", path, reader.Pattern.String()))
+	}
+
+	for _, name := range reader.Required {
+		if !contains(writer.Required, name) {
+			reasons = append(reasons, fmt.Sprintf("%s: property %q is now required", path, name))
+		}
+	}
+
+	names := make([]string, 0, len(reader.Properties))
+	for name := range reader.Properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if writerProp, ok := writer.Properties[name]; ok {
+			reasons = append(reasons, canRead(reader.Properties[name], writerProp, fmt.Sprintf("%s.%s", path, name))...)
+		}
+	}
+
+	// the additional properties of the reader are the properties of the
+	// writer it does not name, and whatever more the writer allows
+	if additional := reader.AdditionalProperties; additional != nil {
+		names := make([]string, 0, len(writer.Properties))
+		for name := range writer.Properties {
+			if _, ok := reader.Properties[name]; !ok {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			if additional.reject {
+				reasons = append(reasons, fmt.Sprintf("%s: property %q is no longer allowed", path, name))
+			} else {
+				reasons = append(reasons, canRead(additional, writer.Properties[name], fmt.Sprintf("%s.%s", path, name))...)
+			}
+		}
+
+		switch {
+		case writer.AdditionalProperties != nil:
+			reasons = append(reasons, canRead(additional, writer.AdditionalProperties, path+".*")...)
+		case additional.reject:
+			reasons = append(reasons, fmt.Sprintf("%s: additional properties are no longer allowed", path))
+		default:
+			reasons = append(reasons, canRead(additional, &node{}, path+".*")...)
+		}
+	}
+
+	// a writer without items allows any
+	if reader.Items != nil {
+		writerItems := writer.Items
+		if writerItems == nil {
+			writerItems = &node{}
+		}
+		reasons = append(reasons, canRead(reader.Items, writerItems, path+"[]")...)
+	}
+
+	return reasons
+}
+
+func typeAccepted(types []string, t string) bool {
+	for _, candidate := range types {
+		if candidate == t || (candidate == "number" && t == "integer") {
+			return true
+		}
+	}
+	return false
+}
+
+func lowerBound(path, keyword string, reader, writer *float64) []string {
+	if reader == nil || (writer != nil && *writer >= *reader) {
+		return nil
+	}
+	return []string{fmt.Sprintf("%s: %s tightened to %v", path, keyword, *reader)}
+}
+
+func upperBound(path, keyword string, reader, writer *float64) []string {
+	if reader == nil || (writer != nil && *writer <= *reader) {
+		return nil
+	}
+	return []string{fmt.Sprintf("%s: %s tightened to %v", path, keyword, *reader)}
+}
+
+func intPtr(v *int) *float64 {
+	if v == nil {
+		return nil
+	}
+	f := float64(*v)
+	return &f
+}
+
+func contains(values []string, v string) bool {
+	for _, candidate := range values {
+		if candidate == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,146 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+)
+
+// node is the subset of JSON Schema understood by the registry. Unknown
+// keywords are ignored so that schemas written for richer validators still
+// load.
+type node struct {
+	Types                []string
+	Properties           map[string]*node
+	Required             []string
+	AdditionalProperties *node
+	Items                *node
+	Enum                 []any
+	Const                *any
+	Minimum              *float64
+	Maximum              *float64
+	ExclusiveMinimum     *float64
+	ExclusiveMaximum     *float64
+	MinLength            *int
+	MaxLength            *int
+	MinItems             *int
+	MaxItems             *int
+	Pattern              *regexp.Regexp
+
+	// reject is set for the boolean schema `false`
+	reject bool
+}
+
+type rawNode struct {
+	Type                 json.RawMessage            `json:"type"`
+	Properties           map[string]json.RawMessage `json:"properties"`
+	Required             []string                   `json:"required"`
+	AdditionalProperties json.RawMessage            `json:"additionalProperties"`
+	Items                json.RawMessage            `json:"items"`
+	Enum                 []any                      `json:"enum"`
+	Const                json.RawMessage            `json:"const"`
+	Minimum              *float64                   `json:"minimum"`
+	Maximum              *float64                   `json:"maximum"`
+	ExclusiveMinimum     *float64                   `json:"exclusiveMinimum"`
+	ExclusiveMaximum     *float64                   `json:"exclusiveMaximum"`
+	MinLength            *int                       `json:"minLength"`
+	MaxLength            *int                       `json:"maxLength"`
+	MinItems             *int                       `json:"minItems"`
+	MaxItems             *int                       `json:"maxItems"`
+	Pattern              *string                    `json:"pattern"`
+}
+
+var knownTypes = map[string]bool{
+	"null":    true,
+	"boolean": true,
+	"object":  true,
+	"array":   true,
+	"number":  true,
+	"integer": true,
+	"string":  true,
+}
+
+func parse(definition []byte) (*node, error) {
+	var b bool
+	if err := json.Unmarshal(definition, &b); err == nil {
+		return &node{reject: !b}, nil
+	}
+
+	var raw rawNode
+	if err := json.Unmarshal(definition, &raw); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSchema, err)
+	}
+
+	n := &node{
+		Required:         raw.Required,
+		Enum:             raw.Enum,
+		Minimum:          raw.Minimum,
+		Maximum:          raw.Maximum,
+		ExclusiveMinimum: raw.ExclusiveMinimum,
+		ExclusiveMaximum: raw.ExclusiveMaximum,
+		MinLength:        raw.MinLength,
+		MaxLength:        raw.MaxLength,
+		MinItems:         raw.MinItems,
+		MaxItems:         raw.MaxItems,
+	}
+
+	if len(raw.Type) > 0 {
+		var single string
+		if err := json.Unmarshal(raw.Type, &single); err == nil {
+			n.Types = []string{single}
+		} else if err := json.Unmarshal(raw.Type, &n.Types); err != nil {
+			return nil, fmt.Errorf("%w: type must be a string or an array of strings", ErrInvalidSchema)
+		}
+
+		for _, t := range n.Types {
+			if !knownTypes[t] {
+				return nil, fmt.Errorf("%w: unknown type %q", ErrInvalidSchema, t)
+			}
+		}
+	}
+
+	if len(raw.Properties) > 0 {
+		n.Properties = make(map[string]*node, len(raw.Properties))
+		for name, def := range raw.Properties {
+			child, err := parse(def)
+			if err != nil {
+				return nil, err
+			}
+			n.Properties[name] = child
+		}
+	}
+
+	if len(raw.AdditionalProperties) > 0 {
+		child, err := parse(raw.AdditionalProperties)
+		if err != nil {
+			return nil, err
+		}
+		n.AdditionalProperties = child
+	}
+
+	if len(raw.Items) > 0 {
+		child, err := parse(raw.Items)
+		if err != nil {
+			return nil, err
+		}
+		n.Items = child
+	}
+
+	if len(raw.Const) > 0 {
+		var c any
+		if err := json.Unmarshal(raw.Const, &c); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidSchema, err)
+		}
+		n.Const = &c
+	}
+
+	if raw.Pattern != nil {
+		re, err := regexp.Compile(*raw.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid pattern: %v", ErrInvalidSchema, err)
+		}
+		n.Pattern = re
+	}
+
+	return n, nil
+}
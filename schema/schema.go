@@ -0,0 +1,251 @@
+package schema
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrNotFound      = errors.New("schema not found")
+	ErrInvalidSchema = errors.New("invalid schema")
+	ErrIncompatible  = errors.New("schema is incompatible")
+)
+
+type Schema struct {
+	Id         int             `json:"id"`
+	Topic      string          `json:"topic"`
+	Version    int             `json:"version"`
+	Definition json.RawMessage `json:"schema"`
+
+	compiled *node
+}
+
+// IncompatibleError is returned by Register when the new version breaks the
+// topic's compatibility mode.
+type IncompatibleError struct {
+	Mode    Compatibility
+	Reasons []string
+}
+
+func (e *IncompatibleError) Error() string {
+	return fmt.Sprintf("%s (%s): %s", ErrIncompatible, e.Mode, strings.Join(e.Reasons, "; "))
+}
+
+func (e *IncompatibleError) Unwrap() error {
+	return ErrIncompatible
+}
+
+// ValidationError is returned by Validate when a message does not match the
+// latest schema registered for its topic.
+type ValidationError struct {
+	SchemaId int
+	Errors   []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("message does not match schema %d: %s", e.SchemaId, strings.Join(e.Errors, "; "))
+}
+
+// Snapshot is the content of a registry: every registered schema and the
+// compatibility modes set for topics.
+type Snapshot struct {
+	Schemas       []Schema                 `json:"schemas,omitempty"`
+	Compatibility map[string]Compatibility `json:"compatibility,omitempty"`
+}
+
+type IRegistry interface {
+	Register(topic string, definition json.RawMessage) (Schema, error)
+	Get(topic string, version int) (Schema, error)
+	Latest(topic string) (Schema, error)
+	List(topic string) []Schema
+	Compatibility(topic string) Compatibility
+	SetCompatibility(topic string, mode Compatibility) error
+	Validate(topic string, value string) (int, error)
+	Snapshot() Snapshot
+	Restore(snapshot Snapshot) error
+}
+
+type Registry struct {
+	rwLock        *sync.RWMutex
+	nextId        int
+	schemas       map[string][]Schema
+	compatibility map[string]Compatibility
+	defaultMode   Compatibility
+}
+
+func NewRegistry() IRegistry {
+	return &Registry{
+		rwLock:        &sync.RWMutex{},
+		nextId:        1,
+		schemas:       make(map[string][]Schema),
+		compatibility: make(map[string]Compatibility),
+		defaultMode:   CompatibilityBackward,
+	}
+}
+
+func (r *Registry) Register(topic string, definition json.RawMessage) (Schema, error) {
+	compiled, err := parse(definition)
+	if err != nil {
+		return Schema{}, err
+	}
+
+	r.rwLock.Lock()
+	defer r.rwLock.Unlock()
+
+	versions := r.schemas[topic]
+	if len(versions) > 0 {
+		latest := versions[len(versions)-1]
+		mode := r.compatibilityLocked(topic)
+		if reasons := checkCompatibility(mode, latest.compiled, compiled); len(reasons) > 0 {
+			return Schema{}, &IncompatibleError{Mode: mode, Reasons: reasons}
+		}
+	}
+
+	s := Schema{
+		Id:         r.nextId,
+		Topic:      topic,
+		Version:    len(versions) + 1,
+		Definition: definition,
+		compiled:   compiled,
+	}
+	r.nextId++
+	r.schemas[topic] = append(versions, s)
+
+	return s, nil
+}
+
+func (r *Registry) Get(topic string, version int) (Schema, error) {
+	r.rwLock.RLock()
+	defer r.rwLock.RUnlock()
+
+	versions := r.schemas[topic]
+	if version < 1 || version > len(versions) {
+		return Schema{}, ErrNotFound
+	}
+
+	return versions[version-1], nil
+}
+
+func (r *Registry) Latest(topic string) (Schema, error) {
+	r.rwLock.RLock()
+	defer r.rwLock.RUnlock()
+
+	versions := r.schemas[topic]
+	if len(versions) == 0 {
+		return Schema{}, ErrNotFound
+	}
+
+	return versions[len(versions)-1], nil
+}
+
+func (r *Registry) List(topic string) []Schema {
+	r.rwLock.RLock()
+	defer r.rwLock.RUnlock()
+
+	versions := make([]Schema, len(r.schemas[topic]))
+	copy(versions, r.schemas[topic])
+	return versions
+}
+
+func (r *Registry) Compatibility(topic string) Compatibility {
+	r.rwLock.RLock()
+	defer r.rwLock.RUnlock()
+
+	return r.compatibilityLocked(topic)
+}
+
+func (r *Registry) SetCompatibility(topic string, mode Compatibility) error {
+	if !mode.Valid() {
+		return fmt.Errorf("unknown compatibility mode %q", mode)
+	}
+
+	r.rwLock.Lock()
+	defer r.rwLock.Unlock()
+
+	r.compatibility[topic] = mode
+	return nil
+}
+
+// Validate checks value against the latest schema for topic and returns the
+// id of that schema. A topic without schemas accepts anything and yields id 0.
+func (r *Registry) Validate(topic string, value string) (int, error) {
+	latest, err := r.Latest(topic)
+	if errors.Is(err, ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if errs := validateDocument(latest.compiled, value); len(errs) > 0 {
+		return latest.Id, &ValidationError{SchemaId: latest.Id, Errors: errs}
+	}
+
+	return latest.Id, nil
+}
+
+// Snapshot returns the schemas of every topic, ordered by id, and the
+// compatibility modes set for topics.
+func (r *Registry) Snapshot() Snapshot {
+	r.rwLock.RLock()
+	defer r.rwLock.RUnlock()
+
+	snapshot := Snapshot{Compatibility: make(map[string]Compatibility, len(r.compatibility))}
+	for _, versions := range r.schemas {
+		snapshot.Schemas = append(snapshot.Schemas, versions...)
+	}
+	sort.Slice(snapshot.Schemas, func(i, j int) bool {
+		return snapshot.Schemas[i].Id < snapshot.Schemas[j].Id
+	})
+	for topic, mode := range r.compatibility {
+		snapshot.Compatibility[topic] = mode
+	}
+
+	return snapshot
+}
+
+// Restore replaces the content of the registry with snapshot. The schemas
+// keep their ids and versions, and new ones are numbered after them.
+func (r *Registry) Restore(snapshot Snapshot) error {
+	schemas := make(map[string][]Schema)
+	nextId := 1
+	for _, s := range snapshot.Schemas {
+		compiled, err := parse(s.Definition)
+		if err != nil {
+			return err
+		}
+		if s.Version != len(schemas[s.Topic])+1 {
+			return fmt.Errorf("%w: version %d of topic %s follows version %d", ErrInvalidSchema, s.Version, s.Topic, len(schemas[s.Topic]))
+		}
+		s.compiled = compiled
+		schemas[s.Topic] = append(schemas[s.Topic], s)
+		nextId = max(nextId, s.Id+1)
+	}
+
+	compatibility := make(map[string]Compatibility, len(snapshot.Compatibility))
+	for topic, mode := range snapshot.Compatibility {
+		if !mode.Valid() {
+			return fmt.Errorf("unknown compatibility mode %q", mode)
+		}
+		compatibility[topic] = mode
+	}
+
+	r.rwLock.Lock()
+	defer r.rwLock.Unlock()
+
+	r.nextId = nextId
+	r.schemas = schemas
+	r.compatibility = compatibility
+	return nil
+}
+
+func (r *Registry) compatibilityLocked(topic string) Compatibility {
+	if mode, ok := r.compatibility[topic]; ok {
+		return mode
+	}
+	return r.defaultMode
+}
@@ -0,0 +1,238 @@
+package schema
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const orderV1 = `{
+	"type": "object",
+	"properties": {
+		"id": {"type": "integer", "minimum": 1},
+		"sku": {"type": "string", "pattern": "^[A-Z]{3}-[0-9]+$"},
+		"tags": {"type": "array", "items": {"type": "string"}}
+	},
+	"required": ["id", "sku"]
+}`
+
+func Test_validate(t *testing.T) {
+	registry := NewRegistry()
+	topic := "orders"
+
+	t.Run("topic without schema accepts anything", func(t *testing.T) {
+		id, err := registry.Validate(topic, "not json at all")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 0, id)
+	})
+
+	s, err := registry.Register(topic, json.RawMessage(orderV1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 1, s.Version)
+
+	t.Run("valid message is stamped with schema id", func(t *testing.T) {
+		id, err := registry.Validate(topic, `{"id": 3, "sku": "ABC-12", "tags": ["a"]}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, s.Id, id)
+	})
+
+	t.Run("invalid message reports every violation", func(t *testing.T) {
+		_, err := registry.Validate(topic, `{"id": 0.5, "tags": [1]}`)
+
+		var validationErr *ValidationError
+		if !errors.As(err, &validationErr) {
+			t.Fatalf("expected validation error, got %v", err)
+		}
+
+		assert.Equal(t, []string{
+			`$: missing required property "sku"`,
+			`$.id: expected integer, got number`,
+			`$.tags[0]: expected string, got number`,
+		}, validationErr.Errors)
+	})
+
+	t.Run("non json message is rejected", func(t *testing.T) {
+		_, err := registry.Validate(topic, `{`)
+
+		var validationErr *ValidationError
+		assert.True(t, errors.As(err, &validationErr))
+	})
+}
+
+func Test_compatibility(t *testing.T) {
+	t.Run("backward allows adding an optional property", func(t *testing.T) {
+		registry := NewRegistry()
+		if _, err := registry.Register("orders", json.RawMessage(orderV1)); err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := registry.Register("orders", json.RawMessage(`{
+			"type": "object",
+			"properties": {
+				"id": {"type": "number"},
+				"sku": {"type": "string", "pattern": "^[A-Z]{3}-[0-9]+$"},
+				"note": {"type": "string"}
+			},
+			"required": ["id", "sku"]
+		}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 2, s.Version)
+	})
+
+	t.Run("backward rejects a new required property", func(t *testing.T) {
+		registry := NewRegistry()
+		if _, err := registry.Register("orders", json.RawMessage(orderV1)); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := registry.Register("orders", json.RawMessage(`{
+			"type": "object",
+			"properties": {"id": {"type": "integer"}, "sku": {"type": "string"}},
+			"required": ["id", "sku", "customer"]
+		}`))
+		assert.True(t, errors.Is(err, ErrIncompatible))
+	})
+
+	t.Run("backward rejects closing an object to additional properties", func(t *testing.T) {
+		registry := NewRegistry()
+		if _, err := registry.Register("orders", json.RawMessage(`{
+			"type": "object",
+			"properties": {"id": {"type": "integer"}}
+		}`)); err != nil {
+			t.Fatal(err)
+		}
+
+		closed := json.RawMessage(`{
+			"type": "object",
+			"properties": {"id": {"type": "integer"}},
+			"additionalProperties": false
+		}`)
+		_, err := registry.Register("orders", closed)
+		assert.True(t, errors.Is(err, ErrIncompatible))
+
+		_, err = registry.Register("orders", json.RawMessage(`{
+			"type": "object",
+			"properties": {"id": {"type": "integer"}},
+			"additionalProperties": {"type": "string"}
+		}`))
+		assert.True(t, errors.Is(err, ErrIncompatible))
+
+		// a closed object stays readable while it is closed
+		registry = NewRegistry()
+		if _, err := registry.Register("orders", closed); err != nil {
+			t.Fatal(err)
+		}
+		_, err = registry.Register("orders", closed)
+		assert.NoError(t, err)
+	})
+
+	t.Run("backward rejects constraining items the writer did not", func(t *testing.T) {
+		registry := NewRegistry()
+		if _, err := registry.Register("orders", json.RawMessage(`{"type": "array"}`)); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := registry.Register("orders", json.RawMessage(`{"type": "array", "items": {"type": "string"}}`))
+		assert.True(t, errors.Is(err, ErrIncompatible))
+
+		_, err = registry.Register("orders", json.RawMessage(`{"type": "array", "items": {}}`))
+		assert.NoError(t, err)
+	})
+
+	t.Run("forward rejects widening a type", func(t *testing.T) {
+		registry := NewRegistry()
+		if err := registry.SetCompatibility("orders", CompatibilityForward); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := registry.Register("orders", json.RawMessage(`{"type": "integer"}`)); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := registry.Register("orders", json.RawMessage(`{"type": "number"}`))
+
+		var incompatible *IncompatibleError
+		if !errors.As(err, &incompatible) {
+			t.Fatalf("expected incompatible error, got %v", err)
+		}
+		assert.Equal(t, CompatibilityForward, incompatible.Mode)
+	})
+
+	t.Run("full requires both directions", func(t *testing.T) {
+		registry := NewRegistry()
+		if err := registry.SetCompatibility("orders", CompatibilityFull); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := registry.Register("orders", json.RawMessage(`{"type": "string", "enum": ["a", "b"]}`)); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := registry.Register("orders", json.RawMessage(`{"type": "string", "enum": ["a", "b", "c"]}`))
+		assert.True(t, errors.Is(err, ErrIncompatible))
+
+		_, err = registry.Register("orders", json.RawMessage(`{"type": "string", "enum": ["b", "a"]}`))
+		assert.NoError(t, err)
+	})
+
+	t.Run("none skips the check", func(t *testing.T) {
+		registry := NewRegistry()
+		if err := registry.SetCompatibility("orders", CompatibilityNone); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := registry.Register("orders", json.RawMessage(`{"type": "string"}`)); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := registry.Register("orders", json.RawMessage(`{"type": "object"}`))
+		assert.NoError(t, err)
+	})
+
+	t.Run("invalid schema is rejected", func(t *testing.T) {
+		_, err := NewRegistry().Register("orders", json.RawMessage(`{"type": "bogus"}`))
+		assert.True(t, errors.Is(err, ErrInvalidSchema))
+	})
+}
+
+func Test_snapshot(t *testing.T) {
+	t.Run("a restored registry keeps ids, versions and compatibility modes", func(t *testing.T) {
+		registry := NewRegistry()
+		if _, err := registry.Register("payments", json.RawMessage(`{"type": "object"}`)); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := registry.Register("orders", json.RawMessage(orderV1)); err != nil {
+			t.Fatal(err)
+		}
+		if err := registry.SetCompatibility("orders", CompatibilityNone); err != nil {
+			t.Fatal(err)
+		}
+
+		restored := NewRegistry()
+		if err := restored.Restore(registry.Snapshot()); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, registry.Snapshot(), restored.Snapshot())
+		assert.Equal(t, CompatibilityNone, restored.Compatibility("orders"))
+
+		id, err := restored.Validate("orders", `{"id": 3, "sku": "ABC-12"}`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 2, id)
+
+		next, err := restored.Register("payments", json.RawMessage(`{"type": "object"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 3, next.Id)
+		assert.Equal(t, 2, next.Version)
+	})
+}
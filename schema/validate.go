@@ -0,0 +1,179 @@
+package schema
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"unicode/utf8"
+)
+
+func validateDocument(n *node, value string) []string {
+	var v any
+	if err := json.Unmarshal([]byte(value), &v); err != nil {
+		return []string{fmt.Sprintf("$: invalid json: %v", err)}
+	}
+
+	return validate(n, v, "$")
+}
+
+func validate(n *node, v any, path string) []string {
+	if n.reject {
+		return []string{fmt.Sprintf("%s: no value is allowed", path)}
+	}
+
+	var errs []string
+
+	if len(n.Types) > 0 && !matchesAnyType(n.Types, v) {
+		errs = append(errs, fmt.Sprintf("%s: expected %s, got %s", path, typeList(n.Types), typeOf(v)))
+		return errs
+	}
+
+	if n.Const != nil && !reflect.DeepEqual(*n.Const, v) {
+		errs = append(errs, fmt.Sprintf("%s: must be equal to %v", path, *n.Const))
+	}
+
+	if len(n.Enum) > 0 && !containsValue(n.Enum, v) {
+		errs = append(errs, fmt.Sprintf("%s: must be one of %v", path, n.Enum))
+	}
+
+	switch value := v.(type) {
+	case float64:
+		if n.Minimum != nil && value < *n.Minimum {
+			errs = append(errs, fmt.Sprintf("%s: must be >= %v", path, *n.Minimum))
+		}
+		if n.Maximum != nil && value > *n.Maximum {
+			errs = append(errs, fmt.Sprintf("%s: must be <= %v", path, *n.Maximum))
+		}
+		if n.ExclusiveMinimum != nil && value <= *n.ExclusiveMinimum {
+			errs = append(errs, fmt.Sprintf("%s: must be > %v", path, *n.ExclusiveMinimum))
+		}
+		if n.ExclusiveMaximum != nil && value >= *n.ExclusiveMaximum {
+			errs = append(errs, fmt.Sprintf("%s: must be < %v", path, *n.ExclusiveMaximum))
+		}
+
+	case string:
+		length := utf8.RuneCountInString(value)
+		if n.MinLength != nil && length < *n.MinLength {
+			errs = append(errs, fmt.Sprintf("%s: length must be >= %d", path, *n.MinLength))
+		}
+		if n.MaxLength != nil && length > *n.MaxLength {
+			errs = append(errs, fmt.Sprintf("%s: length must be <= %d", path, *n.MaxLength))
+		}
+		if n.Pattern != nil && !n.Pattern.MatchString(value) {
+			errs = append(errs, fmt.Sprintf("%s: must match pattern %q", path, n.Pattern.String()))
+		}
+
+	case []any:
+		if n.MinItems != nil && len(value) < *n.MinItems {
+			errs = append(errs, fmt.Sprintf("%s: must have at least %d items", path, *n.MinItems))
+		}
+		if n.MaxItems != nil && len(value) > *n.MaxItems {
+			errs = append(errs, fmt.Sprintf("%s: must have at most %d items", path, *n.MaxItems))
+		}
+		if n.Items != nil {
+			for i, item := range value {
+				errs = append(errs, validate(n.Items, item, fmt.Sprintf("%s[%d]", path, i))...)
+			}
+		}
+
+	case map[string]any:
+		for _, name := range n.Required {
+			if _, ok := value[name]; !ok {
+				errs = append(errs, fmt.Sprintf("%s: missing required property %q", path, name))
+			}
+		}
+
+		// iterate in a stable order so the errors are deterministic
+		names := make([]string, 0, len(value))
+		for name := range value {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			childPath := fmt.Sprintf("%s.%s", path, name)
+			if child, ok := n.Properties[name]; ok {
+				errs = append(errs, validate(child, value[name], childPath)...)
+			} else if n.AdditionalProperties != nil {
+				if n.AdditionalProperties.reject {
+					errs = append(errs, fmt.Sprintf("%s: additional property is not allowed", childPath))
+				} else {
+					errs = append(errs, validate(n.AdditionalProperties, value[name], childPath)...)
+				}
+			}
+		}
+	}
+
+	return errs
+}
+
+func matchesAnyType(types []string, v any) bool {
+	for _, t := range types {
+		if matchesType(t, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesType(t string, v any) bool {
+	switch t {
+	case "null":
+		return v == nil
+	case "boolean":
+		_, ok := v.(bool)
+		return ok
+	case "object":
+		_, ok := v.(map[string]any)
+		return ok
+	case "array":
+		_, ok := v.([]any)
+		return ok
+	case "number":
+		_, ok := v.(float64)
+		return ok
+	case "integer":
+		f, ok := v.(float64)
+		return ok && f == math.Trunc(f)
+	case "string":
+		_, ok := v.(string)
+		return ok
+	}
+	return false
+}
+
+func typeOf(v any) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]any:
+		return "object"
+	case []any:
+		return "array"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	}
+	return fmt.Sprintf("%T", v)
+}
+
+func typeList(types []string) string {
+	if len(types) == 1 {
+		return types[0]
+	}
+	return fmt.Sprintf("one of %v", types)
+}
+
+func containsValue(values []any, v any) bool {
+	for _, candidate := range values {
+		if reflect.DeepEqual(candidate, v) {
+			return true
+		}
+	}
+	return false
+}
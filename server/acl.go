@@ -0,0 +1,415 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+const aclsFileName = "acls.json"
+
+// ACLConfig enables authorization. Every request is denied unless a rule
+// allows it.
+type ACLConfig struct {
+	Rules []ACLRule
+}
+
+var (
+	errInvalidACLRule = errors.New("invalid acl rule")
+	errACLNotFound    = errors.New("acl rule not found")
+	errACLStatic      = errors.New("acl rule is static")
+)
+
+// aclStore holds the static rules of the configuration and the rules added
+// at runtime, which are persisted in the data directory.
+type aclStore struct {
+	mu      sync.RWMutex
+	static  []ACLRule
+	rules   []ACLRule
+	dataDir string
+}
+
+func newACLStore(cfg ACLConfig, dataDir string) (*aclStore, error) {
+	a := &aclStore{dataDir: dataDir}
+	for i, rule := range cfg.Rules {
+		if err := rule.Validate(); err != nil {
+			return nil, fmt.Errorf("acl rule %d: %w", i, err)
+		}
+		rule.Id = fmt.Sprintf("static-%d", i)
+		rule.Static = true
+		a.static = append(a.static, rule)
+	}
+	return a, nil
+}
+
+// Validate checks that the rule names a principal or role, a topic pattern
+// and known actions.
+func (r ACLRule) Validate() error {
+	if (r.Principal == "") == (r.Role == "") {
+		return fmt.Errorf("%w: exactly one of principal and role must be set", errInvalidACLRule)
+	}
+	if r.Topic == "" {
+		return fmt.Errorf("%w: topic must not be empty", errInvalidACLRule)
+	}
+	if _, err := path.Match(r.Topic, ""); err != nil {
+		return fmt.Errorf("%w: bad topic pattern %q", errInvalidACLRule, r.Topic)
+	}
+	if len(r.Actions) == 0 {
+		return fmt.Errorf("%w: no actions", errInvalidACLRule)
+	}
+	for _, action := range r.Actions {
+		switch action {
+		case ActionPublish, ActionSubscribe, ActionAdmin:
+		default:
+			return fmt.Errorf("%w: unknown action %q", errInvalidACLRule, action)
+		}
+	}
+	return nil
+}
+
+func (r ACLRule) appliesTo(p Principal) bool {
+	if r.Principal != "" {
+		return r.Principal == "*" || (p.Method != AuthMethodNone && r.Principal == p.Name)
+	}
+	for _, role := range p.Roles {
+		if role == r.Role {
+			return true
+		}
+	}
+	return false
+}
+
+func (r ACLRule) grants(action string) bool {
+	for _, a := range r.Actions {
+		if a == action || a == ActionAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed reports whether p may perform action on topic. Rights on a topic
+// extend to its dead letter topic.
+func (a *aclStore) allowed(p Principal, action string, topic string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	names := []string{topic}
+	if base, ok := strings.CutSuffix(topic, deadLetterSuffix); ok {
+		names = append(names, base)
+	}
+
+	for _, rules := range [][]ACLRule{a.static, a.rules} {
+		for _, rule := range rules {
+			if !rule.appliesTo(p) || !rule.grants(action) {
+				continue
+			}
+			for _, name := range names {
+				if ok, _ := path.Match(rule.Topic, name); ok {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// grantsEveryTopic reports whether a rule for every topic grants p action.
+// That takes the pattern "*" itself, patterns like "?" match the name "*"
+// but not every topic.
+func (a *aclStore) grantsEveryTopic(p Principal, action string) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	for _, rules := range [][]ACLRule{a.static, a.rules} {
+		for _, rule := range rules {
+			if rule.Topic == aclTopic && rule.appliesTo(p) && rule.grants(action) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (a *aclStore) list() []ACLRule {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	rules := make([]ACLRule, 0, len(a.static)+len(a.rules))
+	rules = append(rules, a.static...)
+	return append(rules, a.rules...)
+}
+
+func (a *aclStore) add(rule ACLRule) (ACLRule, error) {
+	if err := rule.Validate(); err != nil {
+		return ACLRule{}, err
+	}
+
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return ACLRule{}, err
+	}
+	rule.Id = hex.EncodeToString(id)
+	rule.Static = false
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.rules = append(a.rules, rule)
+	if err := a.saveLocked(); err != nil {
+		a.rules = a.rules[:len(a.rules)-1]
+		return ACLRule{}, err
+	}
+	return rule, nil
+}
+
+func (a *aclStore) remove(id string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, rule := range a.static {
+		if rule.Id == id {
+			return errACLStatic
+		}
+	}
+
+	for i, rule := range a.rules {
+		if rule.Id != id {
+			continue
+		}
+
+		rules := append(append([]ACLRule{}, a.rules[:i]...), a.rules[i+1:]...)
+		previous := a.rules
+		a.rules = rules
+		if err := a.saveLocked(); err != nil {
+			a.rules = previous
+			return err
+		}
+		return nil
+	}
+
+	return errACLNotFound
+}
+
+// dynamic returns the rules added at runtime.
+func (a *aclStore) dynamic() []ACLRule {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return append([]ACLRule{}, a.rules...)
+}
+
+// replace makes rules the rules added at runtime, e.g. those of the leader.
+func (a *aclStore) replace(rules []ACLRule) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	previous := a.rules
+	a.rules = append([]ACLRule{}, rules...)
+	if err := a.saveLocked(); err != nil {
+		a.rules = previous
+		return err
+	}
+	return nil
+}
+
+type aclsFile struct {
+	Rules []ACLRule `json:"rules"`
+}
+
+func (a *aclStore) saveLocked() error {
+	if a.dataDir == "" {
+		return nil
+	}
+
+	return writeFileAtomic(filepath.Join(a.dataDir, aclsFileName), aclsFile{Rules: a.rules}, 0o600)
+}
+
+// load restores the rules added at runtime by a previous run.
+func (a *aclStore) load() error {
+	if a.dataDir == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(a.dataDir, aclsFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var file aclsFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("could not parse %s: %w", aclsFileName, err)
+	}
+
+	for _, rule := range file.Rules {
+		if err := rule.Validate(); err != nil {
+			return fmt.Errorf("could not recover acl rule %s: %w", rule.Id, err)
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rules = file.Rules
+
+	return nil
+}
+
+// allowed reports whether the principal of r may perform action on topic in
+// the namespace of r. Everything is allowed when authorization is not
+// enabled, and broker admins are allowed everything in every namespace.
+// System topics are written by the broker alone.
+func (s *Server) allowed(r *http.Request, action string, topic string) bool {
+	if isSystemTopic(topic) {
+		return action == ActionSubscribe && (s.aclConfig == nil || s.brokerAdmin(principalFromContext(r.Context())))
+	}
+	if s.aclConfig == nil {
+		return true
+	}
+	p := principalFromContext(r.Context())
+	return s.namespace(r).acl.allowed(p, action, topic) || s.brokerAdmin(p)
+}
+
+// brokerAdmin reports whether p has admin rights on every topic of the
+// default namespace, which makes it an admin of the whole broker.
+func (s *Server) brokerAdmin(p Principal) bool {
+	return s.defaultNamespace.acl.grantsEveryTopic(p, ActionAdmin)
+}
+
+// requireBrokerAdmin wraps the routes that manage the broker as a whole.
+func (s *Server) requireBrokerAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.aclConfig != nil && !s.brokerAdmin(principalFromContext(r.Context())) {
+			s.writeForbidden(w, r, ActionAdmin, aclTopic)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// visible reports whether the principal of r has any right on topic.
+func (s *Server) visible(r *http.Request, topic string) bool {
+	return s.allowed(r, ActionPublish, topic) || s.allowed(r, ActionSubscribe, topic)
+}
+
+// authorize wraps a handler of a topic route so that it only runs when the
+// principal may perform one of actions on the topic.
+func (s *Server) authorize(next http.HandlerFunc, actions ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		topic := getTopicFromUrl(r)
+		for _, action := range actions {
+			if s.allowed(r, action, topic) {
+				next(w, r)
+				return
+			}
+		}
+
+		s.writeForbidden(w, r, actions[0], topic)
+	}
+}
+
+func (s *Server) writeForbidden(w http.ResponseWriter, r *http.Request, action string, topic string) {
+	http.Error(w, s.denied(r, action, topic).Error(), http.StatusForbidden)
+}
+
+// denied logs and audits that the principal of r may not perform action on
+// topic, and returns the error it is refused with.
+func (s *Server) denied(r *http.Request, action string, topic string) error {
+	p := principalFromContext(r.Context())
+	slog.Warn("access denied", "principal", p.Name, "method", p.Method, "action", action, "topic", topic)
+	s.auditWithReason(r, AuditPermissionDenied, topic, nil, nil, action+" is not allowed")
+	return fmt.Errorf("forbidden: %s on %s is not allowed", action, topic)
+}
+
+// aclTopic is the topic pattern of the rules for every topic, the only
+// rules that grant access to the rules themselves.
+const aclTopic = "*"
+
+func (s *Server) GetACLsHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, ACLRulesResponse{Rules: s.namespace(r).acl.list()})
+}
+
+func (s *Server) AddACLHandler(w http.ResponseWriter, r *http.Request) {
+	var rule ACLRule
+	if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+		slog.Error("could not read request body", "err", err)
+		http.Error(w, "could not read request body", http.StatusBadRequest)
+		return
+	}
+
+	rule, err := s.namespace(r).acl.add(rule)
+	if err != nil {
+		writeACLError(w, err)
+		return
+	}
+
+	slog.Info("added acl rule", "namespace", s.namespace(r).name, "id", rule.Id, "principal", rule.Principal, "role", rule.Role, "topic", rule.Topic, "actions", rule.Actions)
+	s.audit(r, AuditACLAdd, rule.Id, nil, rule)
+
+	writeJSON(w, http.StatusCreated, rule)
+}
+
+func (s *Server) DeleteACLHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var before *ACLRule
+	for _, rule := range s.namespace(r).acl.list() {
+		if rule.Id == id {
+			before = &rule
+		}
+	}
+
+	if err := s.namespace(r).acl.remove(id); err != nil {
+		writeACLError(w, err)
+		return
+	}
+
+	slog.Info("removed acl rule", "namespace", s.namespace(r).name, "id", id)
+	s.audit(r, AuditACLDelete, id, before, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requireACLs wraps the acl routes, which need authorization to be enabled
+// and admin rights on every topic of the namespace.
+func (s *Server) requireACLs(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.aclConfig == nil {
+			http.Error(w, "access control is not enabled", http.StatusNotFound)
+			return
+		}
+		p := principalFromContext(r.Context())
+		if !s.namespace(r).acl.grantsEveryTopic(p, ActionAdmin) && !s.brokerAdmin(p) {
+			s.writeForbidden(w, r, ActionAdmin, aclTopic)
+			return
+		}
+		next(w, r)
+	}
+}
+
+func writeACLError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errInvalidACLRule):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, errACLNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errACLStatic):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		slog.Error("acl operation failed", "err", err)
+		http.Error(w, "acl operation failed", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,250 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// systemTopicPrefix marks the topics the broker writes itself. Nobody may
+// publish to or manage them, and only broker admins may read them.
+const systemTopicPrefix = "$SYS."
+
+// AuditTopic receives every audit event of the broker.
+const AuditTopic = systemTopicPrefix + "audit"
+
+func isSystemTopic(name string) bool {
+	return strings.HasPrefix(name, systemTopicPrefix)
+}
+
+const (
+	defaultAuditMaxFileBytes = 100 << 20
+	defaultAuditMaxFiles     = 10
+)
+
+// AuditConfig enables the audit log. Events are published to AuditTopic and,
+// when File is set, appended to it as lines of JSON. The file is rotated once
+// it grows beyond MaxFileBytes, keeping MaxFiles old files.
+type AuditConfig struct {
+	File         string
+	MaxFileBytes int64
+	MaxFiles     int
+}
+
+var errInvalidAuditConfig = errors.New("invalid audit config")
+
+func (c AuditConfig) Validate() error {
+	if c.MaxFileBytes < 0 {
+		return fmt.Errorf("%w: max file bytes must not be negative", errInvalidAuditConfig)
+	}
+	if c.MaxFiles < 0 {
+		return fmt.Errorf("%w: max files must not be negative", errInvalidAuditConfig)
+	}
+	return nil
+}
+
+func (c AuditConfig) withDefaults() AuditConfig {
+	if c.MaxFileBytes == 0 {
+		c.MaxFileBytes = defaultAuditMaxFileBytes
+	}
+	if c.MaxFiles == 0 {
+		c.MaxFiles = defaultAuditMaxFiles
+	}
+	return c
+}
+
+// rotatingFile appends to a file and moves it aside to path.1, path.2 and so
+// on once it gets too large. The oldest file is removed.
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxBytes int64
+	maxFiles int
+	f        *os.File
+	size     int64
+}
+
+func openRotatingFile(path string, maxBytes int64, maxFiles int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxBytes: maxBytes, maxFiles: maxFiles}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	rf.f, rf.size = f, info.Size()
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.size > 0 && rf.size+int64(len(p)) > rf.maxBytes {
+		if err := rf.rotate(); err != nil {
+			return 0, fmt.Errorf("could not rotate %s: %w", rf.path, err)
+		}
+	}
+
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		return err
+	}
+
+	for i := rf.maxFiles - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.%d", rf.path, i), fmt.Sprintf("%s.%d", rf.path, i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Rename(rf.path, rf.path+".1"); err != nil {
+		return err
+	}
+
+	return rf.open()
+}
+
+func (rf *rotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	return rf.f.Close()
+}
+
+// RequestIdHeader identifies a request in the audit log. It is taken from
+// the request when the client sent one, and returned with every response.
+const RequestIdHeader = "X-Request-Id"
+
+const maxRequestIdLength = 128
+
+type requestIdKey struct{}
+
+// withRequestId attaches the id of the request to its context.
+func withRequestId(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the dashboard api passes requests through the router twice
+		if _, ok := r.Context().Value(requestIdKey{}).(string); ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		id := r.Header.Get(RequestIdHeader)
+		if !validRequestId(id) {
+			id = randomHex(16)
+		}
+		w.Header().Set(RequestIdHeader, id)
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIdKey{}, id)))
+	})
+}
+
+func validRequestId(id string) bool {
+	if id == "" || len(id) > maxRequestIdLength {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func requestIdFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+// openAuditLog creates the audit topic, kept on disk when the broker has a
+// data directory, and opens the audit file if there is one.
+func (s *Server) openAuditLog() error {
+	if s.auditConfig == nil {
+		return nil
+	}
+
+	var cfg TopicConfig
+	if s.dataDir != "" {
+		cfg.Storage = StorageFile
+	}
+	if _, err := s.upsertTopicWithConfig(s.defaultNamespace, AuditTopic, cfg); err != nil {
+		return fmt.Errorf("could not create audit topic: %w", err)
+	}
+
+	if s.auditConfig.File == "" {
+		return nil
+	}
+
+	auditConfig := s.auditConfig.withDefaults()
+	f, err := openRotatingFile(auditConfig.File, auditConfig.MaxFileBytes, auditConfig.MaxFiles)
+	if err != nil {
+		return fmt.Errorf("could not open audit log: %w", err)
+	}
+	s.auditFile = f
+	return nil
+}
+
+// audit records that the principal of r performed action on resource,
+// changing it from before to after. It does nothing unless the audit log is
+// enabled.
+func (s *Server) audit(r *http.Request, action string, resource string, before any, after any) {
+	s.auditWithReason(r, action, resource, before, after, "")
+}
+
+func (s *Server) auditWithReason(r *http.Request, action string, resource string, before any, after any, reason string) {
+	if s.auditConfig == nil {
+		return
+	}
+
+	p := principalFromContext(r.Context())
+	event := AuditEvent{
+		Time:       time.Now().UTC(),
+		Action:     action,
+		Principal:  p.Name,
+		AuthMethod: p.Method,
+		SourceIP:   clientIP(r),
+		RequestId:  requestIdFromContext(r.Context()),
+		Namespace:  s.namespace(r).name,
+		Resource:   resource,
+		Before:     before,
+		After:      after,
+		Reason:     reason,
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("could not encode audit event", "action", action, "err", err)
+		return
+	}
+
+	if s.auditFile != nil {
+		if _, err := s.auditFile.Write(append(line, '\n')); err != nil {
+			slog.Error("could not write audit event", "action", action, "err", err)
+		}
+	}
+
+	if _, err := s.publishMessage(s.defaultNamespace, AuditTopic, PublishRequest{Body: string(line), Key: action}); err != nil {
+		slog.Error("could not publish audit event", "action", action, "err", err)
+	}
+}
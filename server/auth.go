@@ -0,0 +1,161 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// IAuthenticator identifies the principal of a request. ok is false when the
+// request carries no credentials the authenticator understands, and err is
+// set when it does but they are not valid.
+type IAuthenticator interface {
+	Authenticate(r *http.Request) (p Principal, ok bool, err error)
+}
+
+var errUnauthorized = errors.New("unauthorized")
+
+// authenticate attaches the principal of the request to its context. The
+// configured authenticators are asked in order, then the client certificate
+// is used. Invalid credentials are rejected with 401, and so are requests
+// without any when authentication is required.
+func (s *Server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, ok, err := s.principalOf(r)
+		if err != nil {
+			writeUnauthorized(w, err)
+			return
+		}
+		if ok {
+			next.ServeHTTP(w, r.WithContext(withPrincipal(r.Context(), p)))
+			return
+		}
+
+		if s.requireAuth {
+			err := errors.New("credentials required")
+			s.auditWithReason(r, AuditAuthFailure, "", nil, nil, err.Error())
+			writeUnauthorized(w, err)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// principalOf asks the authenticators for the principal of r. Invalid
+// credentials are logged and audited.
+func (s *Server) principalOf(r *http.Request) (Principal, bool, error) {
+	for _, a := range s.authenticators {
+		p, ok, err := a.Authenticate(r)
+		if err != nil {
+			slog.Warn("authentication failed", "remote", r.RemoteAddr, "err", err)
+			s.auditWithReason(r, AuditAuthFailure, "", nil, nil, err.Error())
+			return Principal{}, false, err
+		}
+		if ok {
+			return p, true, nil
+		}
+	}
+	return Principal{}, false, nil
+}
+
+func writeUnauthorized(w http.ResponseWriter, err error) {
+	w.Header().Set("WWW-Authenticate", `Bearer realm="message-queue"`)
+	// browsers only prompt for credentials on a basic challenge
+	w.Header().Add("WWW-Authenticate", `Basic realm="message-queue"`)
+	http.Error(w, errUnauthorized.Error()+": "+err.Error(), http.StatusUnauthorized)
+}
+
+// tlsAuthenticator maps a verified client certificate to its subject common
+// name, or the whole subject when it has none.
+type tlsAuthenticator struct{}
+
+func (tlsAuthenticator) Authenticate(r *http.Request) (Principal, bool, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return Principal{}, false, nil
+	}
+
+	subject := r.TLS.VerifiedChains[0][0].Subject
+	name := subject.CommonName
+	if name == "" {
+		name = subject.String()
+	}
+	return Principal{Name: name, Method: AuthMethodTLS}, true, nil
+}
+
+// APIKeyHeader carries an API key.
+const APIKeyHeader = "X-Api-Key"
+
+// APIKey is a static credential of a principal.
+type APIKey struct {
+	Name  string
+	Key   string
+	Roles []string
+}
+
+type apiKeyAuthenticator struct {
+	// keys are compared by their hash, so every key is compared in the
+	// same time
+	keys []hashedKey
+}
+
+type hashedKey struct {
+	sum       [sha256.Size]byte
+	principal Principal
+}
+
+// NewAPIKeyAuthenticator accepts the keys in the X-Api-Key header, or as the
+// password of basic authentication so that browsers can log in with them.
+func NewAPIKeyAuthenticator(keys []APIKey) IAuthenticator {
+	a := &apiKeyAuthenticator{}
+	for _, k := range keys {
+		a.keys = append(a.keys, hashedKey{
+			sum:       sha256.Sum256([]byte(k.Key)),
+			principal: Principal{Name: k.Name, Method: AuthMethodAPIKey, Roles: k.Roles},
+		})
+	}
+	return a
+}
+
+func (a *apiKeyAuthenticator) Authenticate(r *http.Request) (Principal, bool, error) {
+	key := r.Header.Get(APIKeyHeader)
+	if key == "" {
+		if _, password, ok := r.BasicAuth(); ok {
+			key = password
+		}
+	}
+	if key == "" {
+		return Principal{}, false, nil
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	var found *Principal
+	for i := range a.keys {
+		if subtle.ConstantTimeCompare(sum[:], a.keys[i].sum[:]) == 1 {
+			found = &a.keys[i].principal
+		}
+	}
+	if found == nil {
+		return Principal{}, false, errors.New("unknown api key")
+	}
+
+	return *found, true, nil
+}
+
+// bearerToken returns the token of the Authorization header. Browsers
+// cannot set headers on a websocket upgrade, so it is also taken from the
+// access_token query parameter there.
+func bearerToken(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return strings.TrimSpace(token)
+	}
+	if websocket.IsWebSocketUpgrade(r) {
+		return r.URL.Query().Get("access_token")
+	}
+	return ""
+}
@@ -0,0 +1,515 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/mdkelley02/message-queue/protocol"
+	"github.com/mdkelley02/message-queue/storage"
+)
+
+const (
+	// maxFetchMessages and maxFetchBytes bound what one fetch returns. A
+	// message larger than maxFetchBytes is still returned on its own.
+	maxFetchMessages = 10000
+	maxFetchBytes    = 16 << 20
+
+	binaryBufferSize       = 64 << 10
+	binaryHandshakeTimeout = 10 * time.Second
+	// binaryPipelineDepth is how many responses a connection holds before
+	// it stops reading requests.
+	binaryPipelineDepth = 256
+)
+
+// serveBinary accepts connections of the binary protocol, see the protocol
+// package, until the listener is closed.
+func (s *Server) serveBinary(listener net.Listener) {
+	slog.Info("starting binary protocol server", "addr", listener.Addr().String())
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			slog.Warn("could not accept binary protocol connection", "err", err)
+			time.Sleep(50 * time.Millisecond)
+			continue
+		}
+
+		if !s.trackBinaryConn(conn) {
+			conn.Close()
+			continue
+		}
+		go s.serveBinaryConn(conn)
+	}
+}
+
+func (s *Server) trackBinaryConn(conn net.Conn) bool {
+	s.binaryMu.Lock()
+	defer s.binaryMu.Unlock()
+
+	// the connections are gone once the server stopped serving them
+	if s.binaryConns == nil {
+		return false
+	}
+	s.binaryConns[conn] = struct{}{}
+	s.binaryServing.Add(1)
+	return true
+}
+
+func (s *Server) untrackBinaryConn(conn net.Conn) {
+	s.binaryMu.Lock()
+	defer s.binaryMu.Unlock()
+
+	delete(s.binaryConns, conn)
+}
+
+// stopBinary stops accepting connections and reading requests. The requests
+// read so far are answered before the connections are closed, as long as
+// the clients read their responses before ctx expires.
+func (s *Server) stopBinary(ctx context.Context) {
+	if s.binaryListener == nil {
+		return
+	}
+	s.binaryListener.Close()
+
+	deadline, _ := ctx.Deadline()
+	s.binaryMu.Lock()
+	for conn := range s.binaryConns {
+		conn.SetReadDeadline(time.Now())
+		conn.SetWriteDeadline(deadline)
+	}
+	s.binaryConns = nil
+	s.binaryMu.Unlock()
+
+	s.binaryServing.Wait()
+}
+
+// binaryConn is a connection of the binary protocol. Its requests stand in
+// for HTTP requests towards the code shared with the HTTP API, which finds
+// the principal, address and namespace of a request there.
+type binaryConn struct {
+	s    *Server
+	conn net.Conn
+	// base is the request of the connection before it authenticated, r the
+	// request of its principal
+	base          *http.Request
+	r             *http.Request
+	authenticated bool
+	// namespaces are those the connection counts against the connection
+	// quota of, from its first request in them until it is closed
+	namespaces map[*namespace]struct{}
+}
+
+func (s *Server) serveBinaryConn(conn net.Conn) {
+	defer s.binaryServing.Done()
+	defer s.untrackBinaryConn(conn)
+	defer conn.Close()
+
+	ctx := context.WithValue(context.Background(), requestIdKey{}, randomHex(16))
+	base := (&http.Request{
+		Header:     http.Header{},
+		URL:        &url.URL{},
+		RemoteAddr: conn.RemoteAddr().String(),
+	}).WithContext(ctx)
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		tlsConn.SetDeadline(time.Now().Add(binaryHandshakeTimeout))
+		if err := tlsConn.Handshake(); err != nil {
+			slog.Warn("tls handshake failed", "remote", base.RemoteAddr, "err", err)
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+		state := tlsConn.ConnectionState()
+		base.TLS = &state
+	}
+
+	// stopBinary may have set the deadline the handshake cleared
+	if s.isClosing() {
+		return
+	}
+
+	c := &binaryConn{s: s, conn: conn, base: base, r: base, authenticated: !s.requireAuth, namespaces: make(map[*namespace]struct{})}
+	defer c.releaseConnections()
+
+	// a verified client certificate identifies the connection right away
+	if p, ok, _ := s.principalOf(base); ok {
+		c.r = base.WithContext(withPrincipal(ctx, p))
+		c.authenticated = true
+	}
+
+	responses := make(chan []byte, binaryPipelineDepth)
+	written := make(chan struct{})
+	go c.writeResponses(responses, written)
+
+	reader := bufio.NewReaderSize(conn, binaryBufferSize)
+	for {
+		frame, err := protocol.ReadFrame(reader)
+		if err != nil {
+			var netErr net.Error
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) && !(errors.As(err, &netErr) && netErr.Timeout()) {
+				slog.Warn("could not read binary request", "remote", base.RemoteAddr, "err", err)
+			}
+			break
+		}
+
+		responses <- c.handle(frame)
+	}
+
+	close(responses)
+	<-written
+}
+
+// writeResponses writes the responses in the order of their requests. They
+// are flushed once no more are waiting, so that pipelined requests are
+// answered with few writes.
+func (c *binaryConn) writeResponses(responses <-chan []byte, written chan<- struct{}) {
+	defer close(written)
+
+	w := bufio.NewWriterSize(c.conn, binaryBufferSize)
+	var err error
+	for frame := range responses {
+		if err != nil {
+			continue
+		}
+
+		if _, err = w.Write(frame); err == nil && len(responses) == 0 {
+			err = w.Flush()
+		}
+		if err != nil {
+			slog.Warn("could not write binary response", "remote", c.base.RemoteAddr, "err", err)
+			c.conn.Close()
+		}
+	}
+}
+
+func (c *binaryConn) handle(frame []byte) []byte {
+	h, dec := protocol.ParseRequest(frame)
+
+	body, err := c.serve(h.Op, dec)
+	if err != nil {
+		return protocol.AppendError(nil, h, err)
+	}
+	return protocol.AppendResponse(nil, h, protocol.StatusOK, body)
+}
+
+func (c *binaryConn) serve(op protocol.Op, dec *protocol.Decoder) (protocol.Body, *protocol.Error) {
+	var req protocol.Body
+	switch op {
+	case protocol.OpAuth:
+		req = &protocol.AuthRequest{}
+	case protocol.OpProduce:
+		req = &protocol.ProduceRequest{}
+	case protocol.OpFetch:
+		req = &protocol.FetchRequest{}
+	case protocol.OpAck, protocol.OpCommit:
+		req = &protocol.OffsetRequest{}
+	default:
+		return nil, binaryError(http.StatusBadRequest, "unknown operation %v", op)
+	}
+
+	req.Decode(dec)
+	if err := dec.Err(); err != nil {
+		return nil, binaryError(http.StatusBadRequest, "could not read %v request", op)
+	}
+
+	if op == protocol.OpAuth {
+		return c.auth(req.(*protocol.AuthRequest))
+	}
+
+	if !c.authenticated {
+		err := errors.New("credentials required")
+		c.s.auditWithReason(c.r, AuditAuthFailure, "", nil, nil, err.Error())
+		return nil, binaryError(http.StatusUnauthorized, "%v: %v", errUnauthorized, err)
+	}
+
+	switch req := req.(type) {
+	case *protocol.ProduceRequest:
+		return c.produce(req)
+	case *protocol.FetchRequest:
+		return c.fetch(req)
+	default:
+		return c.offset(op, req.(*protocol.OffsetRequest))
+	}
+}
+
+// auth identifies the principal of the connection by the credentials of
+// req, which replace whatever the connection authenticated with before.
+func (c *binaryConn) auth(req *protocol.AuthRequest) (protocol.Body, *protocol.Error) {
+	r := c.base.Clone(c.base.Context())
+	for k, v := range req.Credentials {
+		r.Header.Set(k, v)
+	}
+
+	c.r, c.authenticated = c.base, false
+
+	p, ok, err := c.s.principalOf(r)
+	if err != nil {
+		return nil, binaryError(http.StatusUnauthorized, "%v: %v", errUnauthorized, err)
+	}
+	if ok {
+		c.r, c.authenticated = c.base.WithContext(withPrincipal(c.base.Context(), p)), true
+		return &protocol.Empty{}, nil
+	}
+
+	if c.s.requireAuth {
+		err := errors.New("credentials required")
+		c.s.auditWithReason(r, AuditAuthFailure, "", nil, nil, err.Error())
+		return nil, binaryError(http.StatusUnauthorized, "%v: %v", errUnauthorized, err)
+	}
+
+	c.authenticated = true
+	return &protocol.Empty{}, nil
+}
+
+// request returns the request of the connection in the named namespace,
+// the default namespace when name is empty. The first request in a
+// namespace counts the connection against its connection quota, the way a
+// subscription counts.
+func (c *binaryConn) request(name string) (*http.Request, *namespace, *protocol.Error) {
+	if name == "" {
+		name = DefaultNamespace
+	}
+
+	ns, err := c.s.getNamespace(name)
+	if err != nil {
+		return nil, nil, binaryError(http.StatusNotFound, "%v", err)
+	}
+	if _, ok := c.namespaces[ns]; !ok {
+		if !ns.acquireConnection() {
+			return nil, nil, binaryError(http.StatusTooManyRequests, "%v: namespace %s has too many connections", errRateLimited, ns.name)
+		}
+		c.namespaces[ns] = struct{}{}
+	}
+	return c.r.WithContext(context.WithValue(c.r.Context(), namespaceKey{}, ns)), ns, nil
+}
+
+func (c *binaryConn) releaseConnections() {
+	for ns := range c.namespaces {
+		ns.releaseConnection()
+	}
+}
+
+// requireLeader refuses what only the leader serves, like leaderOnly. The
+// leader is given by the address of its HTTP API.
+func (c *binaryConn) requireLeader(topic string) *protocol.Error {
+	if isSystemTopic(topic) {
+		return nil
+	}
+
+	leader, ok := c.s.leads()
+	if ok {
+		return nil
+	}
+	if leader == "" {
+		return binaryError(http.StatusServiceUnavailable, "%v", errNoLeader)
+	}
+
+	err := binaryError(http.StatusMisdirectedRequest, "%v, the leader is %s", errNotLeader, leader)
+	err.Leader = leader
+	return err
+}
+
+func (c *binaryConn) authorize(r *http.Request, action string, topic string) *protocol.Error {
+	if c.s.allowed(r, action, topic) {
+		return nil
+	}
+	return binaryError(http.StatusForbidden, "%v", c.s.denied(r, action, topic))
+}
+
+// produce publishes the messages of req one after the other, so that a
+// message that fails does not keep the others from being stored.
+func (c *binaryConn) produce(req *protocol.ProduceRequest) (protocol.Body, *protocol.Error) {
+	if req.Topic == "" {
+		return nil, binaryError(http.StatusBadRequest, "missing topic")
+	}
+	if err := c.requireLeader(req.Topic); err != nil {
+		return nil, err
+	}
+
+	r, ns, err := c.request(req.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.authorize(r, ActionPublish, req.Topic); err != nil {
+		return nil, err
+	}
+
+	keys := rateLimitKeysOf(r, ns, req.Topic)
+	response := &protocol.ProduceResponse{Results: make([]protocol.ProduceResult, len(req.Messages))}
+	for i, m := range req.Messages {
+		response.Results[i] = c.s.produceMessage(ns, req.Topic, keys, m)
+	}
+
+	return response, nil
+}
+
+func (s *Server) produceMessage(ns *namespace, topic string, keys rateLimitKeys, m protocol.Message) protocol.ProduceResult {
+	if s.isClosing() {
+		return protocol.ProduceResult{Status: http.StatusServiceUnavailable, Error: errShuttingDown.Error()}
+	}
+
+	// limited the way the PublishHandler limits
+	now := time.Now()
+	if !ns.publishes.allow(now) {
+		return protocol.ProduceResult{Status: http.StatusTooManyRequests, Error: fmt.Sprintf("%v: namespace %s", errRateLimited, ns.name)}
+	}
+	if wait := s.publishLimits.tryTake(keys, len(m.Value), now); wait > 0 {
+		ns.publishes.refund()
+		return protocol.ProduceResult{Status: http.StatusTooManyRequests, Error: errRateLimited.Error()}
+	}
+
+	req := PublishRequest{Body: m.Value, Key: m.Key, Headers: m.Headers}
+	if m.Partition != protocol.AnyPartition {
+		partition := int(m.Partition)
+		req.Partition = &partition
+	}
+	// a trace state without a valid parent is meaningless, as over HTTP
+	if trace := (TraceContext{TraceParent: m.TraceParent, TraceState: m.TraceState}); trace.TraceParent != "" {
+		if _, _, _, ok := trace.parse(); ok {
+			req.Trace = trace
+		}
+	}
+
+	response, err := s.publishMessage(ns, topic, req)
+	if err != nil {
+		status, msg := publishErrorStatus(err)
+		if status >= http.StatusInternalServerError {
+			slog.Error("could not publish message", "namespace", ns.name, "topic", topic, "err", err)
+		}
+		return protocol.ProduceResult{Status: uint16(status), Error: msg}
+	}
+
+	return protocol.ProduceResult{Status: protocol.StatusOK, Partition: int32(response.Partition), Offset: int64(response.Offset)}
+}
+
+// fetch reads messages without claiming them, like BrowseMessagesHandler,
+// so it is served by followers as well.
+func (c *binaryConn) fetch(req *protocol.FetchRequest) (protocol.Body, *protocol.Error) {
+	r, ns, perr := c.request(req.Namespace)
+	if perr != nil {
+		return nil, perr
+	}
+	if err := c.authorize(r, ActionSubscribe, req.Topic); err != nil {
+		return nil, err
+	}
+
+	t, err := c.s.getTopic(ns, req.Topic)
+	if err != nil {
+		return nil, binaryError(http.StatusNotFound, "%v", err)
+	}
+	if req.Partition < 0 || int(req.Partition) >= len(t.partitions) {
+		return nil, binaryError(http.StatusBadRequest, "invalid partition")
+	}
+	if req.Offset < 0 {
+		return nil, binaryError(http.StatusBadRequest, "invalid offset")
+	}
+	if req.MaxMessages < 1 || req.MaxMessages > maxFetchMessages {
+		return nil, binaryError(http.StatusBadRequest, "max messages must be between 1 and %d", maxFetchMessages)
+	}
+
+	keys := rateLimitKeysOf(r, ns, t.name)
+	if wait := c.s.consumeLimits.wait(keys, time.Now()); wait > 0 {
+		err := binaryError(http.StatusTooManyRequests, "%v", errRateLimited)
+		err.RetryAfter = wait
+		return nil, err
+	}
+
+	p := t.partitions[req.Partition]
+	response := &protocol.FetchResponse{HighWatermark: int64(p.storage.Stats().HighWatermark)}
+
+	size := 0
+	next, err := p.read(int(req.Offset), int(req.MaxMessages), func(offset int, record storage.Record) bool {
+		if len(response.Records) > 0 && size+len(record.Value) > maxFetchBytes {
+			return false
+		}
+		size += len(record.Value)
+
+		response.Records = append(response.Records, protocol.Record{
+			Offset:    int64(offset),
+			Timestamp: record.Timestamp,
+			Key:       record.Key,
+			Value:     record.Value,
+			Headers:   record.Headers,
+		})
+		return true
+	})
+	if err != nil {
+		slog.Error("could not read message from storage", "err", err)
+		return nil, binaryError(http.StatusInternalServerError, "could not read message from storage")
+	}
+	response.NextOffset = int64(next)
+
+	now := time.Now()
+	for _, record := range response.Records {
+		c.s.consumeLimits.take(keys, len(record.Value), now)
+	}
+
+	return response, nil
+}
+
+// offset acknowledges a single offset of a consumer group for OpAck, and
+// every offset below it for OpCommit.
+func (c *binaryConn) offset(op protocol.Op, req *protocol.OffsetRequest) (protocol.Body, *protocol.Error) {
+	if err := c.requireLeader(req.Topic); err != nil {
+		return nil, err
+	}
+
+	r, ns, perr := c.request(req.Namespace)
+	if perr != nil {
+		return nil, perr
+	}
+	if err := c.authorize(r, ActionSubscribe, req.Topic); err != nil {
+		return nil, err
+	}
+
+	t, err := c.s.getTopic(ns, req.Topic)
+	if err != nil {
+		return nil, binaryError(http.StatusNotFound, "%v", err)
+	}
+	if req.Partition < 0 || int(req.Partition) >= len(t.partitions) {
+		return nil, binaryError(http.StatusBadRequest, "invalid partition")
+	}
+
+	group := req.Group
+	if group == "" {
+		group = DefaultGroup
+	}
+	if !groupNamePattern.MatchString(group) {
+		return nil, binaryError(http.StatusBadRequest, "invalid group")
+	}
+
+	p := t.partitions[req.Partition]
+	high := int64(p.storage.Stats().HighWatermark)
+
+	if op == protocol.OpAck {
+		if req.Offset < 0 || req.Offset >= high {
+			return nil, binaryError(http.StatusBadRequest, "invalid offset")
+		}
+		err = p.ack(group, int(req.Offset))
+	} else {
+		if req.Offset < 0 || req.Offset > high {
+			return nil, binaryError(http.StatusBadRequest, "invalid offset")
+		}
+		err = p.commit(group, int(req.Offset))
+	}
+	if err != nil {
+		slog.Error("could not commit message", "topic", t.name, "group", group, "err", err)
+		return nil, binaryError(http.StatusInternalServerError, "could not commit message")
+	}
+
+	return &protocol.Empty{}, nil
+}
+
+func binaryError(status int, format string, args ...any) *protocol.Error {
+	return &protocol.Error{Status: uint16(status), Message: fmt.Sprintf(format, args...)}
+}
@@ -0,0 +1,185 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/mdkelley02/message-queue/storage"
+)
+
+const (
+	defaultBrowseLimit = 100
+	maxBrowseLimit     = 1000
+)
+
+var errMessageNotFound = errors.New("message not found")
+
+// BrowseMessagesHandler pages through the stored messages of one partition
+// without claiming them, so it never changes what subscribers receive.
+func (s *Server) BrowseMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	t, err := s.getTopic(s.namespace(r), getTopicFromUrl(r))
+	if err != nil {
+		writeTopicError(w, err)
+		return
+	}
+
+	query := r.URL.Query()
+
+	partitionId, err := queryInt(query.Get("partition"), 0)
+	if err != nil || partitionId < 0 || partitionId >= len(t.partitions) {
+		http.Error(w, "invalid partition", http.StatusBadRequest)
+		return
+	}
+
+	p := t.partitions[partitionId]
+
+	from, err := queryInt(query.Get("from"), p.stats().LowWatermark)
+	if err != nil || from < 0 {
+		http.Error(w, "invalid from offset", http.StatusBadRequest)
+		return
+	}
+
+	limit, err := queryInt(query.Get("limit"), defaultBrowseLimit)
+	if err != nil || limit < 1 || limit > maxBrowseLimit {
+		http.Error(w, fmt.Sprintf("limit must be between 1 and %d", maxBrowseLimit), http.StatusBadRequest)
+		return
+	}
+
+	response := BrowseMessagesResponse{
+		Topic:     t.name,
+		Partition: p.id,
+		Messages:  make([]MessageResponse, 0),
+	}
+
+	response.NextOffset, err = p.read(from, limit, func(offset int, record storage.Record) bool {
+		response.Messages = append(response.Messages, t.messageResponse(p, offset, record))
+		return true
+	})
+	if err != nil {
+		slog.Error("could not read message from storage", "err", err)
+		http.Error(w, "could not read message from storage", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// read passes up to limit stored messages from offset from on to fn,
+// skipping the ones that are gone, and returns the offset to continue from.
+// fn returns false to stop before the message it was passed.
+func (p *partition) read(from int, limit int, fn func(offset int, record storage.Record) bool) (int, error) {
+	stats := p.stats()
+	offset := max(from, stats.LowWatermark)
+
+	for read := 0; offset < stats.HighWatermark && read < limit; offset++ {
+		record, err := p.storage.Get(offset)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return offset, err
+		}
+
+		if !fn(offset, record) {
+			break
+		}
+		read++
+	}
+
+	return offset, nil
+}
+
+// get returns the message at offset, storage.ErrNotFound when it is gone or
+// every group committed it.
+func (p *partition) get(offset int) (storage.Record, error) {
+	if offset < p.stats().LowWatermark {
+		return storage.Record{}, storage.ErrNotFound
+	}
+	return p.storage.Get(offset)
+}
+
+func (s *Server) GetMessageHandler(w http.ResponseWriter, r *http.Request) {
+	t, err := s.getTopic(s.namespace(r), getTopicFromUrl(r))
+	if err != nil {
+		writeTopicError(w, err)
+		return
+	}
+
+	partitionId, offset, err := parseMessageId(t.name, mux.Vars(r)["messageId"])
+	if err != nil || partitionId >= len(t.partitions) {
+		http.Error(w, "invalid message id", http.StatusBadRequest)
+		return
+	}
+
+	p := t.partitions[partitionId]
+
+	record, err := p.get(offset)
+	if errors.Is(err, storage.ErrNotFound) {
+		http.Error(w, errMessageNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("could not read message from storage", "err", err)
+		http.Error(w, "could not read message from storage", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, t.messageResponse(p, offset, record))
+}
+
+func (t *topic) messageResponse(p *partition, offset int, record storage.Record) MessageResponse {
+	msg := newMessage(t.name, p.id, offset)
+
+	return MessageResponse{
+		Id:        msg.Id,
+		Topic:     t.name,
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Key:       record.Key,
+		Value:     record.Value,
+		SchemaId:  record.SchemaId,
+		Timestamp: record.Timestamp,
+		Headers:   record.Headers,
+		Delivery:  p.deliveryState(offset),
+
+		TraceContext: traceContextOf(record),
+	}
+}
+
+// parseMessageId splits an id built by newMessage back into its partition
+// and offset.
+func parseMessageId(topic string, id string) (int, int, error) {
+	rest, ok := strings.CutPrefix(id, topic+"-")
+	if !ok {
+		return 0, 0, fmt.Errorf("message id %q does not belong to topic %s", id, topic)
+	}
+
+	partitionPart, offsetPart, ok := strings.Cut(rest, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("malformed message id %q", id)
+	}
+
+	partition, err := strconv.Atoi(partitionPart)
+	if err != nil || partition < 0 {
+		return 0, 0, fmt.Errorf("malformed message id %q", id)
+	}
+
+	offset, err := strconv.Atoi(offsetPart)
+	if err != nil || offset < 0 {
+		return 0, 0, fmt.Errorf("malformed message id %q", id)
+	}
+
+	return partition, offset, nil
+}
+
+func queryInt(value string, fallback int) (int, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	return strconv.Atoi(value)
+}
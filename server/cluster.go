@@ -0,0 +1,731 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Clustering runs brokers as one. The members of a cluster agree with Raft,
+// see raft.go, on who they are, who leads them and on the metadata of the
+// broker: its namespaces, topic configs, acl rules and schemas, and the
+// committed offsets of the consumer groups.
+//
+// Partitions are not assigned to members one by one. The leader of the Raft
+// group leads every partition and the other members follow it with
+// replication, see replication.go. When the leader fails the others elect
+// another one, which takes over every partition, and the others redirect
+// clients to it. Failover moves the whole broker, the load of the
+// partitions is not spread over the members.
+
+const (
+	defaultHeartbeatInterval = 100 * time.Millisecond
+	defaultElectionTimeout   = time.Second
+	raftFileName             = "raft.json"
+)
+
+var (
+	errInvalidClusterConfig = errors.New("invalid cluster config")
+	errInvalidClusterMember = errors.New("invalid cluster member")
+	errMemberNotFound       = errors.New("cluster member not found")
+	errNoLeader             = errors.New("the cluster has no leader")
+	errClusterManaged       = errors.New("leadership is managed by the cluster")
+)
+
+// ClusterConfig makes the broker a member of a cluster. It needs
+// replication with a node id and without a leader, the cluster elects one.
+type ClusterConfig struct {
+	// Members are the brokers the cluster starts with, every one of them is
+	// started with the same members. A broker that is not among them waits
+	// until the leader adds it.
+	Members []ClusterMember
+	// HeartbeatInterval is how often the leader contacts the members.
+	HeartbeatInterval time.Duration
+	// ElectionTimeout is how long members wait for the leader before they
+	// elect another one, randomized up to twice as long.
+	ElectionTimeout time.Duration
+}
+
+func (c ClusterConfig) Validate() error {
+	if len(c.Members) == 0 {
+		return fmt.Errorf("%w: members must not be empty", errInvalidClusterConfig)
+	}
+
+	seen := make(map[string]bool)
+	for _, m := range c.Members {
+		if err := m.Validate(); err != nil {
+			return fmt.Errorf("%w: %v", errInvalidClusterConfig, err)
+		}
+		if seen[m.Id] {
+			return fmt.Errorf("%w: member %s is listed twice", errInvalidClusterConfig, m.Id)
+		}
+		seen[m.Id] = true
+	}
+
+	if c.HeartbeatInterval < 0 || c.ElectionTimeout < 0 {
+		return fmt.Errorf("%w: timeouts must not be negative", errInvalidClusterConfig)
+	}
+	if d := c.withDefaults(); d.HeartbeatInterval >= d.ElectionTimeout {
+		return fmt.Errorf("%w: the heartbeat interval must be shorter than the election timeout", errInvalidClusterConfig)
+	}
+	return nil
+}
+
+func (c ClusterConfig) withDefaults() ClusterConfig {
+	if c.HeartbeatInterval == 0 {
+		c.HeartbeatInterval = defaultHeartbeatInterval
+	}
+	if c.ElectionTimeout == 0 {
+		c.ElectionTimeout = defaultElectionTimeout
+	}
+	return c
+}
+
+func (m ClusterMember) Validate() error {
+	if m.Id == "" {
+		return fmt.Errorf("%w: id must not be empty", errInvalidClusterMember)
+	}
+	u, err := url.Parse(m.Addr)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: addr of %s must be an http or https url, got %q", errInvalidClusterMember, m.Id, m.Addr)
+	}
+	return nil
+}
+
+// clusterState is what the members agree on besides themselves.
+type clusterState struct {
+	// Leader leads every partition since Epoch, there is no assignment of
+	// single partitions
+	Leader   string                      `json:"leader,omitempty"`
+	Epoch    int                         `json:"epoch"`
+	Metadata *ReplicatedTopicsResponse   `json:"metadata,omitempty"`
+	Offsets  map[string]ReplicatedOffset `json:"offsets"`
+}
+
+const (
+	commandLeader   = "leader"
+	commandMetadata = "metadata"
+	commandOffsets  = "offsets"
+)
+
+// clusterCommand is a change of the state, the command of an entry of the
+// log.
+type clusterCommand struct {
+	Type     string                    `json:"type"`
+	Leader   string                    `json:"leader,omitempty"`
+	Metadata *ReplicatedTopicsResponse `json:"metadata,omitempty"`
+	Offsets  []ReplicatedOffset        `json:"offsets,omitempty"`
+}
+
+func offsetKey(o ReplicatedOffset) string {
+	return fmt.Sprintf("%s/%s/%d/%s", o.Namespace, o.Topic, o.Partition, o.Group)
+}
+
+// cluster is the membership of the broker in a cluster. It is the state
+// machine and the transport of its Raft node.
+type cluster struct {
+	s      *Server
+	id     string
+	node   *raftNode
+	client *http.Client
+	// ledTerm is the term in which the broker took over the partitions, it
+	// only serves writes while it leads in that term
+	ledTerm atomic.Int64
+	cancel  context.CancelFunc
+	done    chan struct{}
+
+	// proposeMu serializes the changes the broker proposes
+	proposeMu sync.Mutex
+
+	mu    sync.Mutex
+	state clusterState
+}
+
+func (s *Server) newCluster(cfg ClusterConfig) (*cluster, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	if s.replication == nil || s.replication.Leader != "" {
+		return nil, fmt.Errorf("%w: clustering needs replication with a node id and without a leader", errInvalidClusterConfig)
+	}
+
+	members := make(map[string]string, len(cfg.Members))
+	for _, m := range cfg.Members {
+		members[m.Id] = strings.TrimSuffix(m.Addr, "/")
+	}
+
+	path := ""
+	if s.dataDir != "" {
+		path = filepath.Join(s.dataDir, raftFileName)
+	}
+
+	c := &cluster{
+		s:      s,
+		id:     s.replication.NodeId,
+		client: &http.Client{},
+		done:   make(chan struct{}),
+		state:  clusterState{Offsets: make(map[string]ReplicatedOffset)},
+	}
+
+	node, err := newRaftNode(c.id, members, c, c, cfg.HeartbeatInterval, cfg.ElectionTimeout, path)
+	if err != nil {
+		return nil, err
+	}
+	c.node = node
+
+	return c, nil
+}
+
+func (c *cluster) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.cancel = cancel
+
+	c.node.start()
+	go c.run(ctx)
+}
+
+func (c *cluster) stop() {
+	c.cancel()
+	<-c.done
+	c.node.stop()
+}
+
+func (c *cluster) run(ctx context.Context) {
+	defer close(c.done)
+
+	ticker := time.NewTicker(c.node.heartbeat)
+	defer ticker.Stop()
+
+	for {
+		status := c.node.status()
+		c.reconcile(ctx, status)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-status.changed:
+		case <-ticker.C:
+		}
+	}
+}
+
+// reconcile makes the broker lead the partitions while it leads the cluster
+// and follow the leader otherwise. The leader has the cluster commit the
+// changes of the metadata and offsets of the broker.
+func (c *cluster) reconcile(ctx context.Context, status raftStatus) {
+	if status.role != RoleLeader {
+		c.ledTerm.Store(0)
+		if status.leaderAddr == "" {
+			return
+		}
+		if f := c.s.follower.Load(); f == nil || f.leader != status.leaderAddr {
+			slog.Info("following the leader of the cluster", "node", c.id, "leader", status.leaderId)
+			c.s.follow(status.leaderAddr)
+		}
+
+		// the topics of offsets applied before the broker copied them
+		// exist by now
+		c.s.restoreOffsets(c.offsets())
+		return
+	}
+
+	if c.ledTerm.Load() != int64(status.term) {
+		// the partitions are taken over once the entries of the previous
+		// leaders are applied
+		if !status.ready {
+			return
+		}
+		if err := c.takeOver(ctx, status.term); err != nil {
+			slog.Warn("could not take over the partitions", "node", c.id, "err", err)
+			return
+		}
+	}
+
+	if err := c.commitMetadata(ctx); err != nil && ctx.Err() == nil {
+		slog.Warn("could not commit metadata", "node", c.id, "err", err)
+	}
+	if err := c.commitOffsets(ctx); err != nil && ctx.Err() == nil {
+		slog.Warn("could not commit offsets", "node", c.id, "err", err)
+	}
+}
+
+// takeOver makes the broker the leader of every partition, with the
+// metadata and offsets the cluster committed.
+func (c *cluster) takeOver(ctx context.Context, term int) error {
+	c.s.promote()
+
+	if metadata, ok, _ := c.metadata(); ok {
+		c.s.applyReplicatedTopics(metadata, func(*topic) {})
+	}
+	c.s.restoreOffsets(c.offsets())
+
+	if err := c.propose(ctx, clusterCommand{Type: commandLeader, Leader: c.id}); err != nil {
+		return err
+	}
+
+	c.ledTerm.Store(int64(term))
+	slog.Info("took over the partitions", "node", c.id, "term", term)
+	return nil
+}
+
+// leader returns whether the broker serves the requests only the leader
+// serves, and otherwise the address of the leader if there is one.
+func (c *cluster) leader() (string, bool) {
+	role, term, leaderAddr := c.node.leadership()
+	if role == RoleLeader {
+		return "", c.ledTerm.Load() == int64(term)
+	}
+	return leaderAddr, false
+}
+
+func (c *cluster) propose(ctx context.Context, command clusterCommand) error {
+	data, err := json.Marshal(command)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.node.electionTimeout)
+	defer cancel()
+
+	return c.node.propose(ctx, data)
+}
+
+// changeMembers has the cluster commit the members change returns.
+func (c *cluster) changeMembers(ctx context.Context, change func(members map[string]string) error) error {
+	ctx, cancel := context.WithTimeout(ctx, c.node.electionTimeout)
+	defer cancel()
+
+	return c.node.changeMembers(ctx, change)
+}
+
+// commitMetadata has the cluster commit the metadata of the broker when it
+// changed.
+func (c *cluster) commitMetadata(ctx context.Context) error {
+	c.proposeMu.Lock()
+	defer c.proposeMu.Unlock()
+
+	metadata := c.s.replicatedTopics()
+	if current, ok, _ := c.metadata(); ok && sameJSON(current, metadata) {
+		return nil
+	}
+
+	return c.propose(ctx, clusterCommand{Type: commandMetadata, Metadata: &metadata})
+}
+
+// commitOffsets has the cluster commit the offsets the consumer groups
+// committed on the broker since.
+func (c *cluster) commitOffsets(ctx context.Context) error {
+	c.proposeMu.Lock()
+	defer c.proposeMu.Unlock()
+
+	var changed []ReplicatedOffset
+	c.mu.Lock()
+	for _, o := range c.s.committedOffsets() {
+		if current, ok := c.state.Offsets[offsetKey(o)]; !ok || o.Offset > current.Offset {
+			changed = append(changed, o)
+		}
+	}
+	c.mu.Unlock()
+
+	if len(changed) == 0 {
+		return nil
+	}
+
+	return c.propose(ctx, clusterCommand{Type: commandOffsets, Offsets: changed})
+}
+
+func sameJSON(a any, b any) bool {
+	x, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	y, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(x, y)
+}
+
+// metadata returns the metadata the cluster agreed on, ok is false until
+// the first leader committed its metadata.
+func (c *cluster) metadata() (ReplicatedTopicsResponse, bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.state.Metadata == nil {
+		return ReplicatedTopicsResponse{}, false, nil
+	}
+	return *c.state.Metadata, true, nil
+}
+
+func (c *cluster) offsets() []ReplicatedOffset {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	offsets := make([]ReplicatedOffset, 0, len(c.state.Offsets))
+	for _, o := range c.state.Offsets {
+		offsets = append(offsets, o)
+	}
+	return offsets
+}
+
+func (c *cluster) apply(command json.RawMessage) error {
+	var cmd clusterCommand
+	if err := json.Unmarshal(command, &cmd); err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	switch cmd.Type {
+	case commandLeader:
+		c.state.Leader = cmd.Leader
+		c.state.Epoch++
+	case commandMetadata:
+		c.state.Metadata = cmd.Metadata
+
+		// forget the offsets of deleted topics
+		topics := make(map[string]bool)
+		for _, t := range cmd.Metadata.Topics {
+			topics[t.Namespace+"/"+t.Name] = true
+		}
+		for key, o := range c.state.Offsets {
+			if !topics[o.Namespace+"/"+o.Topic] {
+				delete(c.state.Offsets, key)
+			}
+		}
+	case commandOffsets:
+		for _, o := range cmd.Offsets {
+			c.state.Offsets[offsetKey(o)] = o
+		}
+	default:
+		c.mu.Unlock()
+		return fmt.Errorf("unknown cluster command %q", cmd.Type)
+	}
+	c.mu.Unlock()
+
+	// followers keep the offsets up to date, so that a consumer lag is
+	// reported everywhere and the next leader resumes where the groups are
+	if cmd.Type == commandOffsets && c.ledTerm.Load() == 0 {
+		c.s.restoreOffsets(cmd.Offsets)
+	}
+
+	return nil
+}
+
+func (c *cluster) snapshot() (json.RawMessage, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return json.Marshal(c.state)
+}
+
+func (c *cluster) restore(data json.RawMessage) error {
+	var state clusterState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return err
+	}
+	if state.Offsets == nil {
+		state.Offsets = make(map[string]ReplicatedOffset)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.state = state
+	return nil
+}
+
+func (c *cluster) requestVote(ctx context.Context, addr string, req RaftVoteRequest) (RaftVoteResponse, error) {
+	var response RaftVoteResponse
+	err := c.post(ctx, addr+"/cluster/raft/vote", req, &response)
+	return response, err
+}
+
+func (c *cluster) appendEntries(ctx context.Context, addr string, req RaftAppendRequest) (RaftAppendResponse, error) {
+	var response RaftAppendResponse
+	err := c.post(ctx, addr+"/cluster/raft/append", req, &response)
+	return response, err
+}
+
+func (c *cluster) post(ctx context.Context, url string, in any, out any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(ReplicaIdHeader, c.id)
+	if c.s.replication.APIKey != "" {
+		req.Header.Set(APIKeyHeader, c.s.replication.APIKey)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("member answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *cluster) response() ClusterResponse {
+	status := c.node.status()
+
+	c.mu.Lock()
+	state := c.state
+	c.mu.Unlock()
+
+	response := ClusterResponse{
+		NodeId:      c.id,
+		Role:        status.role,
+		Term:        status.term,
+		Leader:      status.leaderId,
+		LeaderAddr:  status.leaderAddr,
+		CommitIndex: status.commitIndex,
+		Applied:     status.lastApplied,
+		Members:     make([]ClusterMemberResponse, 0, len(status.members)),
+		Partitions:  make([]PartitionAssignment, 0),
+	}
+
+	replicas := make([]string, 0, len(status.members))
+	for _, m := range status.members {
+		member := ClusterMemberResponse{
+			ClusterMember: ClusterMember{Id: m.id, Addr: m.addr},
+			Leader:        m.id == status.leaderId,
+			MatchIndex:    m.matchIndex,
+		}
+		if !m.lastContact.IsZero() {
+			member.LastContact = &m.lastContact
+		}
+		response.Members = append(response.Members, member)
+		replicas = append(replicas, m.id)
+	}
+
+	if state.Metadata != nil {
+		for _, t := range state.Metadata.Topics {
+			for id := 0; id < t.Config.Partitions; id++ {
+				response.Partitions = append(response.Partitions, PartitionAssignment{
+					Namespace: t.Namespace,
+					Topic:     t.Name,
+					Partition: id,
+					Leader:    state.Leader,
+					Replicas:  replicas,
+					Epoch:     state.Epoch,
+				})
+			}
+		}
+	}
+
+	return response
+}
+
+// committedOffsets returns the committed offsets of every consumer group of
+// every topic.
+func (s *Server) committedOffsets() []ReplicatedOffset {
+	var offsets []ReplicatedOffset
+	for _, t := range s.allTopics() {
+		if isSystemTopic(t.name) {
+			continue
+		}
+		for _, p := range t.partitions {
+			for group, offset := range p.committedOffsets() {
+				offsets = append(offsets, ReplicatedOffset{
+					Namespace: t.ns.name,
+					Topic:     t.name,
+					Partition: p.id,
+					Group:     group,
+					Offset:    offset,
+				})
+			}
+		}
+	}
+
+	sort.Slice(offsets, func(i, j int) bool {
+		return offsetKey(offsets[i]) < offsetKey(offsets[j])
+	})
+	return offsets
+}
+
+// restoreOffsets moves the consumer groups forward to the given offsets.
+func (s *Server) restoreOffsets(offsets []ReplicatedOffset) {
+	for _, o := range offsets {
+		ns, ok := s.namespaces.get(o.Namespace)
+		if !ok {
+			continue
+		}
+		t, ok := ns.topics.get(o.Topic)
+		if !ok || o.Partition >= len(t.partitions) {
+			continue
+		}
+		t.partitions[o.Partition].restoreCommitted(o.Group, o.Offset)
+	}
+}
+
+// replicated wraps the routes that change the state of the broker. In a
+// cluster their response is held back until the cluster committed the
+// metadata of the broker with the change. The records purges and redrives
+// change reach the other members with replication.
+func (s *Server) replicated(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if s.cluster == nil {
+			next(w, r)
+			return
+		}
+
+		buffered := &bufferedResponse{ResponseWriter: w, status: http.StatusOK}
+		next(buffered, r)
+
+		if buffered.status < http.StatusMultipleChoices {
+			if err := s.cluster.commitMetadata(r.Context()); err != nil {
+				slog.Error("could not commit metadata", "err", err)
+				http.Error(w, fmt.Sprintf("the change is not committed by the cluster yet: %v", err), http.StatusServiceUnavailable)
+				return
+			}
+		}
+
+		buffered.flush()
+	}
+}
+
+// bufferedResponse holds back a response until it is flushed.
+type bufferedResponse struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	b.status = status
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
+
+func (b *bufferedResponse) flush() {
+	b.ResponseWriter.WriteHeader(b.status)
+	b.ResponseWriter.Write(b.body.Bytes())
+}
+
+func (s *Server) GetClusterHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.cluster.response())
+}
+
+func (s *Server) AddClusterMemberHandler(w http.ResponseWriter, r *http.Request) {
+	var member ClusterMember
+	if err := json.NewDecoder(r.Body).Decode(&member); err != nil {
+		slog.Error("could not read request body", "err", err)
+		http.Error(w, "could not read request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := member.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	member.Addr = strings.TrimSuffix(member.Addr, "/")
+
+	var before *ClusterMember
+	err := s.cluster.changeMembers(r.Context(), func(members map[string]string) error {
+		if addr, ok := members[member.Id]; ok {
+			before = &ClusterMember{Id: member.Id, Addr: addr}
+		}
+		members[member.Id] = member.Addr
+		return nil
+	})
+	if err != nil {
+		writeClusterError(w, err)
+		return
+	}
+
+	slog.Info("added cluster member", "id", member.Id, "addr", member.Addr)
+	s.audit(r, AuditClusterJoin, member.Id, before, member)
+
+	writeJSON(w, http.StatusOK, s.cluster.response())
+}
+
+func (s *Server) RemoveClusterMemberHandler(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	var before ClusterMember
+	err := s.cluster.changeMembers(r.Context(), func(members map[string]string) error {
+		addr, ok := members[id]
+		if !ok {
+			return fmt.Errorf("%w: %s", errMemberNotFound, id)
+		}
+		if len(members) == 1 {
+			return fmt.Errorf("%w: the last member cannot be removed", errInvalidClusterMember)
+		}
+		before = ClusterMember{Id: id, Addr: addr}
+		delete(members, id)
+		return nil
+	})
+	if err != nil {
+		writeClusterError(w, err)
+		return
+	}
+
+	slog.Info("removed cluster member", "id", id)
+	s.audit(r, AuditClusterLeave, id, before, nil)
+
+	writeJSON(w, http.StatusOK, s.cluster.response())
+}
+
+func (s *Server) RaftVoteHandler(w http.ResponseWriter, r *http.Request) {
+	var request RaftVoteRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "could not read request body", http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.cluster.node.handleVote(request))
+}
+
+func (s *Server) RaftAppendHandler(w http.ResponseWriter, r *http.Request) {
+	var request RaftAppendRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "could not read request body", http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.cluster.node.handleAppend(request))
+}
+
+func writeClusterError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errInvalidClusterMember):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, errMemberNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errMembershipChanging):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, errNotLeader), errors.Is(err, errEntryLost), errors.Is(err, context.DeadlineExceeded), errors.Is(err, errShuttingDown):
+		http.Error(w, fmt.Sprintf("the change is not committed: %v", err), http.StatusServiceUnavailable)
+	default:
+		slog.Error("cluster operation failed", "err", err)
+		http.Error(w, "cluster operation failed", http.StatusInternalServerError)
+	}
+}
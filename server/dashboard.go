@@ -0,0 +1,64 @@
+package server
+
+import (
+	"embed"
+	"errors"
+	"io/fs"
+	"net/http"
+)
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+const (
+	// dashboardPath is where the dashboard is served.
+	dashboardPath = "/dashboard/"
+	// dashboardAPIPath serves the API to the dashboard. Browsers only send
+	// the credentials of a basic login along to paths below the page.
+	dashboardAPIPath = dashboardPath + "api"
+	// DashboardHeader has to be set on requests to the dashboard API. Other
+	// sites cannot set it without a CORS preflight, so they cannot make use
+	// of a login to the dashboard.
+	DashboardHeader = "X-Requested-With"
+)
+
+// dashboardHandler serves the dashboard. The page is shown to the same
+// principals the admin API is open to.
+func (s *Server) dashboardHandler() http.Handler {
+	files, err := fs.Sub(dashboardFiles, "dashboard")
+	if err != nil {
+		panic(err)
+	}
+	fileServer := http.StripPrefix(dashboardPath, http.FileServer(http.FS(files)))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := principalFromContext(r.Context())
+		if s.aclConfig != nil && !s.brokerAdmin(p) {
+			// let a browser that has not logged in yet ask for credentials
+			if p.Method == AuthMethodNone {
+				writeUnauthorized(w, errors.New("credentials required"))
+				return
+			}
+			s.writeForbidden(w, r, ActionAdmin, aclTopic)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("X-Frame-Options", "DENY")
+		fileServer.ServeHTTP(w, r)
+	})
+}
+
+// dashboardAPIHandler serves the API below the dashboard. Requests are
+// authorized like any other API request.
+func (s *Server) dashboardAPIHandler() http.Handler {
+	api := http.StripPrefix(dashboardAPIPath, s.router)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(DashboardHeader) == "" {
+			http.Error(w, DashboardHeader+" header required", http.StatusForbidden)
+			return
+		}
+		api.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,252 @@
+"use strict";
+
+// The dashboard polls the admin API and derives publish and deliver rates
+// from the counters of consecutive polls.
+
+const refreshInterval = 2000;
+
+const state = {
+  namespace: "default",
+  topic: null,
+  // counters of the previous poll by topic, to compute rates from
+  previous: new Map(),
+};
+
+const $ = (selector) => document.querySelector(selector);
+
+function apiPath(path) {
+  if (state.namespace === "default") {
+    return "api" + path;
+  }
+  return "api/ns/" + encodeURIComponent(state.namespace) + path;
+}
+
+function topicPath(topic, suffix = "") {
+  return apiPath("/topics/" + encodeURIComponent(topic) + suffix);
+}
+
+async function api(path, options = {}) {
+  const response = await fetch(path, {
+    ...options,
+    headers: { "X-Requested-With": "dashboard", "Content-Type": "application/json" },
+  });
+  if (!response.ok) {
+    const error = new Error((await response.text()).trim() || response.statusText);
+    error.status = response.status;
+    throw error;
+  }
+  return response.json();
+}
+
+function setStatus(message, error = false) {
+  const status = $("#status");
+  status.textContent = message;
+  status.classList.toggle("error", error);
+}
+
+function cell(row, value, className) {
+  const td = row.insertCell();
+  td.textContent = value;
+  if (className) {
+    td.className = className;
+  }
+  return td;
+}
+
+function fillTable(selector, items, render) {
+  const body = $(selector + " tbody");
+  body.replaceChildren();
+  for (const item of items) {
+    render(body.insertRow(), item);
+  }
+}
+
+function rate(current, previous, seconds) {
+  if (previous === undefined || seconds <= 0) {
+    return "";
+  }
+  return ((current - previous) / seconds).toFixed(1);
+}
+
+async function loadNamespaces() {
+  const select = $("#namespace");
+  let names = ["default"];
+  try {
+    const response = await api("api/namespaces");
+    names = response.namespaces.map((ns) => ns.name);
+  } catch (error) {
+    // only broker admins may list namespaces
+    select.disabled = true;
+  }
+
+  select.replaceChildren(...names.map((name) => new Option(name, name)));
+  select.value = state.namespace;
+}
+
+async function loadPrincipal() {
+  const principal = await api("api/whoami");
+  $("#principal").textContent = principal.name ? principal.name + " (" + principal.method + ")" : "anonymous";
+}
+
+async function refresh() {
+  const now = Date.now();
+  const [{ topics: names }, { topics: lags }] = await Promise.all([
+    api(apiPath("/topics")),
+    api(apiPath("/lag")),
+  ]);
+  const topics = await Promise.all(names.map((name) => api(topicPath(name))));
+
+  const lagByTopic = new Map(lags.map((lag) => [lag.topic, lag]));
+  const previous = state.previous;
+  state.previous = new Map(topics.map((topic) => [topic.name, { at: now, published: topic.published, delivered: topic.delivered }]));
+
+  fillTable("#topics", topics, (row, topic) => {
+    const before = previous.get(topic.name) || {};
+    const seconds = (now - before.at) / 1000;
+    const lag = (lagByTopic.get(topic.name) || { groups: [] }).groups.reduce((sum, group) => sum + group.lag, 0);
+
+    row.classList.toggle("selected", topic.name === state.topic);
+    row.addEventListener("click", () => selectTopic(topic.name));
+    cell(row, topic.name);
+    cell(row, topic.partitions.length, "number");
+    cell(row, topic.depth, "number");
+    cell(row, topic.bytes, "number");
+    cell(row, rate(topic.published, before.published, seconds), "number");
+    cell(row, rate(topic.delivered, before.delivered, seconds), "number");
+    cell(row, topic.subscribers, "number");
+    cell(row, lag, "number");
+  });
+
+  if (state.topic) {
+    const topic = topics.find((topic) => topic.name === state.topic);
+    if (!topic) {
+      selectTopic(null);
+      return;
+    }
+    renderTopic(topic, lagByTopic.get(topic.name));
+    await loadDeadLetters(names);
+  }
+}
+
+function renderTopic(topic, lag) {
+  fillTable("#partitions", topic.partitions, (row, partition) => {
+    cell(row, partition.id, "number");
+    cell(row, partition.depth, "number");
+    cell(row, partition.bytes, "number");
+    cell(row, partition.lowWatermark, "number");
+    cell(row, partition.highWatermark, "number");
+  });
+
+  fillTable("#groups", lag ? lag.groups : [], (row, group) => {
+    cell(row, group.group);
+    cell(row, group.lag, "number");
+    cell(row, group.inFlight, "number");
+    cell(row, group.oldestUnackedAgeSeconds ? group.oldestUnackedAgeSeconds.toFixed(1) + "s" : "", "number");
+  });
+}
+
+function renderMessages(selector, messages) {
+  fillTable(selector, messages, (row, message) => {
+    cell(row, message.partition + "/" + message.offset, "number");
+    cell(row, message.key || "");
+    cell(row, message.value, "value");
+    cell(row, new Date(message.timestamp).toLocaleString());
+    cell(row, (message.delivery || []).map((d) => d.group + ": " + d.state).join(", "));
+  });
+}
+
+async function browse(topic, partition, from, limit) {
+  const query = new URLSearchParams({ partition, limit });
+  if (from !== "") {
+    query.set("from", from);
+  }
+  const page = await api(topicPath(topic, "/messages?" + query));
+  return page.messages;
+}
+
+async function loadDeadLetters(names) {
+  const deadLetterTopic = state.topic + ".deadletter";
+  if (!names.includes(deadLetterTopic)) {
+    renderMessages("#deadletters", []);
+    return;
+  }
+  renderMessages("#deadletters", await browse(deadLetterTopic, 0, "", 100));
+}
+
+function selectTopic(name) {
+  state.topic = name;
+  $("#topic").hidden = name === null;
+  $("#topic-name").textContent = name || "";
+  renderMessages("#messages", []);
+  refresh().catch(showError);
+}
+
+function showError(error) {
+  setStatus(error.message, true);
+}
+
+function onSubmit(selector, handler) {
+  $(selector).addEventListener("submit", async (event) => {
+    event.preventDefault();
+    try {
+      await handler(event.target, event.submitter);
+      await refresh();
+    } catch (error) {
+      showError(error);
+    }
+  });
+}
+
+onSubmit("#publish", async (form) => {
+  const request = { body: form.body.value };
+  if (form.key.value) {
+    request.key = form.key.value;
+  }
+  if (form.partition.value !== "") {
+    request.partition = Number(form.partition.value);
+  }
+  const response = await api(topicPath(state.topic), { method: "POST", body: JSON.stringify(request) });
+  setStatus("published " + response.messageId);
+});
+
+onSubmit("#browse", async (form) => {
+  const messages = await browse(state.topic, form.partition.value, form.from.value, form.limit.value);
+  renderMessages("#messages", messages);
+  setStatus("showing " + messages.length + " messages");
+});
+
+onSubmit("#admin", async (form, button) => {
+  if (button.name === "purge") {
+    if (!confirm("Purge every message of " + state.topic + "?")) {
+      return;
+    }
+    const response = await api(topicPath(state.topic, "/purge"), { method: "POST" });
+    setStatus("purged " + response.purged + " messages");
+    return;
+  }
+
+  const request = {};
+  if (form.filter.value) {
+    request.filter = form.filter.value;
+  }
+  const response = await api(topicPath(state.topic, "/redrive"), { method: "POST", body: JSON.stringify(request) });
+  setStatus("redrove " + response.moved + " messages, " + response.failed + " failed");
+});
+
+$("#namespace").addEventListener("change", (event) => {
+  state.namespace = event.target.value;
+  state.previous = new Map();
+  selectTopic(null);
+});
+
+async function poll() {
+  try {
+    await refresh();
+    setStatus("updated " + new Date().toLocaleTimeString());
+  } catch (error) {
+    showError(error);
+  }
+  setTimeout(poll, refreshInterval);
+}
+
+Promise.all([loadNamespaces(), loadPrincipal()]).catch(showError).then(poll);
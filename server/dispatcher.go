@@ -0,0 +1,137 @@
+package server
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// dispatcher wakes up the subscribers of a topic. It runs for as long as the
+// topic exists: publishes and nacks only hand it a notification, so they
+// never block on subscribers, and retries scheduled for later share a single
+// timer instead of one per message.
+type dispatcher struct {
+	kick     chan struct{}
+	schedule chan time.Time
+	quit     chan struct{}
+	quitOnce sync.Once
+
+	mu   sync.Mutex
+	wake chan struct{}
+}
+
+func newDispatcher() *dispatcher {
+	return &dispatcher{
+		kick:     make(chan struct{}, 1),
+		schedule: make(chan time.Time),
+		quit:     make(chan struct{}),
+		wake:     make(chan struct{}),
+	}
+}
+
+func (d *dispatcher) run() {
+	var due dueTimes
+	timer := time.NewTimer(0)
+	if !timer.Stop() {
+		<-timer.C
+	}
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-d.kick:
+			d.broadcast()
+
+		case at := <-d.schedule:
+			if len(due) > 0 && !at.Before(due[0]) {
+				heap.Push(&due, at)
+				continue
+			}
+
+			heap.Push(&due, at)
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(time.Until(at))
+
+		case now := <-timer.C:
+			for len(due) > 0 && !due[0].After(now) {
+				heap.Pop(&due)
+			}
+			if len(due) > 0 {
+				timer.Reset(due[0].Sub(now))
+			}
+			d.broadcast()
+
+		case <-d.quit:
+			return
+		}
+	}
+}
+
+// wait returns a channel that is closed the next time subscribers are woken
+// up. Callers must get it before looking for messages so that a wakeup is
+// not missed.
+func (d *dispatcher) wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.wake
+}
+
+// signal asks for the subscribers to be woken up. Signals that arrive while
+// one is pending are coalesced.
+func (d *dispatcher) signal() {
+	select {
+	case d.kick <- struct{}{}:
+	default:
+	}
+}
+
+// signalAt asks for the subscribers to be woken up at the given time.
+func (d *dispatcher) signalAt(at time.Time) {
+	if !at.After(time.Now()) {
+		d.signal()
+		return
+	}
+
+	select {
+	case d.schedule <- at:
+	case <-d.quit:
+	}
+}
+
+func (d *dispatcher) stop() {
+	d.quitOnce.Do(func() {
+		close(d.quit)
+	})
+}
+
+func (d *dispatcher) broadcast() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	close(d.wake)
+	d.wake = make(chan struct{})
+}
+
+// dueTimes is a min-heap of scheduled wakeups.
+type dueTimes []time.Time
+
+func (h dueTimes) Len() int           { return len(h) }
+func (h dueTimes) Less(i, j int) bool { return h[i].Before(h[j]) }
+func (h dueTimes) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *dueTimes) Push(x any) {
+	*h = append(*h, x.(time.Time))
+}
+
+func (h *dueTimes) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,456 @@
+package server
+
+import (
+	"errors"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/mdkelley02/message-queue/storage"
+)
+
+const DefaultGroup = "default"
+
+var groupNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+// groupOffsets is the position of one consumer group in one partition.
+// Every offset below committed has been acknowledged; offsets between
+// committed and cursor are either in flight, waiting to be retried or
+// acknowledged out of order.
+type groupOffsets struct {
+	cursor    int
+	committed int
+	retries   []retry
+	inflight  map[int]time.Time
+	acked     map[int]bool
+	attempts  map[int]int
+}
+
+// retry is a nacked offset that may be claimed again once it is due.
+type retry struct {
+	offset int
+	due    time.Time
+}
+
+// groupLocked returns the offsets of the named group, creating them at the
+// start of the partition the first time the group is seen.
+func (p *partition) groupLocked(name string) *groupOffsets {
+	g, ok := p.groups[name]
+	if !ok {
+		low := p.statsLocked().LowWatermark
+		g = &groupOffsets{
+			cursor:    low,
+			committed: low,
+			inflight:  make(map[int]time.Time),
+			acked:     make(map[int]bool),
+			attempts:  make(map[int]int),
+		}
+		p.groups[name] = g
+	}
+
+	// forget whatever was truncated since the group was last used
+	if low := p.storage.Stats().LowWatermark; g.committed < low {
+		g.committed = low
+		if g.cursor < low {
+			g.cursor = low
+		}
+		g.forgetBelow(low)
+	}
+
+	return g
+}
+
+// forgetBelow drops what the group tracks of the offsets below offset.
+func (g *groupOffsets) forgetBelow(offset int) {
+	for o := range g.inflight {
+		if o < offset {
+			delete(g.inflight, o)
+		}
+	}
+	for o := range g.acked {
+		if o < offset {
+			delete(g.acked, o)
+		}
+	}
+	for o := range g.attempts {
+		if o < offset {
+			delete(g.attempts, o)
+		}
+	}
+	retries := g.retries[:0]
+	for _, r := range g.retries {
+		if r.offset >= offset {
+			retries = append(retries, r)
+		}
+	}
+	g.retries = retries
+}
+
+// claim returns the next message for the group together with its delivery
+// attempt. Retries that are due come before newer messages. Offsets whose
+// message is gone are acknowledged on the way so they do not hold back the
+// committed offset.
+func (p *partition) claim(group string, now time.Time) (int, int, storage.Record, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	g := p.groupLocked(group)
+
+	for i := 0; i < len(g.retries); i++ {
+		r := g.retries[i]
+		if r.due.After(now) {
+			continue
+		}
+		g.retries = append(g.retries[:i], g.retries[i+1:]...)
+		i--
+
+		record, ok, err := p.fetchLocked(g, r.offset, now)
+		if err != nil {
+			return 0, 0, storage.Record{}, false
+		}
+		if ok {
+			return r.offset, g.attempts[r.offset], record, true
+		}
+	}
+
+	for g.cursor < p.storage.Len() {
+		offset := g.cursor
+		g.cursor++
+
+		record, ok, err := p.fetchLocked(g, offset, now)
+		if err != nil {
+			return 0, 0, storage.Record{}, false
+		}
+		if ok {
+			return offset, g.attempts[offset], record, true
+		}
+	}
+
+	return 0, 0, storage.Record{}, false
+}
+
+// fetchLocked reads the message at offset, marks it in flight and counts the
+// attempt. A message that is gone is committed, one that cannot be read is
+// retried right away.
+func (p *partition) fetchLocked(g *groupOffsets, offset int, now time.Time) (storage.Record, bool, error) {
+	record, err := p.storage.Get(offset)
+	if errors.Is(err, storage.ErrNotFound) {
+		p.commitLocked(g, offset)
+		return storage.Record{}, false, nil
+	}
+	if err != nil {
+		g.retries = append(g.retries, retry{offset: offset, due: now})
+		return storage.Record{}, false, err
+	}
+
+	g.inflight[offset] = now
+	g.attempts[offset]++
+	return record, true, nil
+}
+
+// ack commits offset for the group and removes the messages that every
+// group has committed.
+func (p *partition) ack(group string, offset int) error {
+	p.mu.Lock()
+	g := p.groupLocked(group)
+	p.commitLocked(g, offset)
+	removable := p.minCommittedLocked()
+	p.mu.Unlock()
+
+	return p.truncateCommitted(removable)
+}
+
+// commit acknowledges every offset of the group below offset, as if the
+// group had acknowledged them one by one. Offsets below the committed
+// offset of the group are committed already.
+func (p *partition) commit(group string, offset int) error {
+	p.mu.Lock()
+	g := p.groupLocked(group)
+	p.moveCommittedLocked(g, offset)
+	g.forgetBelow(offset)
+	removable := p.minCommittedLocked()
+	p.mu.Unlock()
+
+	return p.truncateCommitted(removable)
+}
+
+// truncateBatch is how many committed messages a partition keeps before it
+// removes them, so that acknowledging a message does not truncate the
+// storage, and append to its log, every time.
+const truncateBatch = 256
+
+// committedRecords counts the messages from the low watermark of the
+// storage up to to that every group committed. They are only counted
+// while the low watermark is still from, a truncation of its own, e.g. by
+// retention, makes them recounted.
+type committedRecords struct {
+	from, to     int
+	count, bytes int
+}
+
+// truncateCommitted removes the messages below removable, the offset every
+// group has committed, once there are truncateBatch of them or every
+// message of the partition is committed. Until then they are left out of
+// the stats of the partition and of what it reads.
+func (p *partition) truncateCommitted(removable int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := p.storage.Stats()
+	if p.committed.from != stats.LowWatermark || removable < p.committed.to {
+		p.committed = committedRecords{from: stats.LowWatermark, to: stats.LowWatermark}
+	}
+	for ; p.committed.to < removable; p.committed.to++ {
+		record, err := p.storage.Get(p.committed.to)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		p.committed.count++
+		p.committed.bytes += len(record.Value)
+	}
+
+	if removable-stats.LowWatermark >= truncateBatch ||
+		removable > stats.LowWatermark && removable >= stats.HighWatermark {
+		if _, err := p.storage.Truncate(removable); err != nil {
+			return err
+		}
+		p.committed = committedRecords{from: removable, to: removable}
+	}
+	return nil
+}
+
+// delete removes the message at offset, from the committed messages too
+// when it is one of them.
+func (p *partition) delete(offset int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.committed.from == p.storage.Stats().LowWatermark && offset < p.committed.to {
+		if record, err := p.storage.Get(offset); err == nil {
+			p.committed.count--
+			p.committed.bytes -= len(record.Value)
+		}
+	}
+	return p.storage.Delete(offset)
+}
+
+// attempt returns how often offset has been delivered to the group. ok is
+// false if the offset is not in flight.
+func (p *partition) attempt(group string, offset int) (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	g := p.groupLocked(group)
+	if _, ok := g.inflight[offset]; !ok {
+		return 0, false
+	}
+	return g.attempts[offset], true
+}
+
+// retry makes an in flight offset available to the group again once delay
+// has passed.
+func (p *partition) retry(group string, offset int, delay time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	g := p.groupLocked(group)
+	if _, ok := g.inflight[offset]; !ok {
+		return
+	}
+
+	delete(g.inflight, offset)
+	g.retries = append(g.retries, retry{offset: offset, due: time.Now().Add(delay)})
+}
+
+func (p *partition) commitLocked(g *groupOffsets, offset int) {
+	delete(g.inflight, offset)
+	delete(g.attempts, offset)
+	if offset < g.committed {
+		return
+	}
+
+	g.acked[offset] = true
+	for g.acked[g.committed] {
+		delete(g.acked, g.committed)
+		g.committed++
+	}
+}
+
+// committedOffsets returns the committed offset of every group.
+func (p *partition) committedOffsets() map[string]int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	offsets := make(map[string]int, len(p.groups))
+	for name, g := range p.groups {
+		offsets[name] = g.committed
+	}
+	return offsets
+}
+
+// restoreCommitted moves the committed offset of the group forward to
+// offset, e.g. to where the group was on the previous leader.
+func (p *partition) restoreCommitted(group string, offset int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.moveCommittedLocked(p.groupLocked(group), offset)
+}
+
+func (p *partition) moveCommittedLocked(g *groupOffsets, offset int) {
+	if offset <= g.committed {
+		return
+	}
+
+	g.committed = offset
+	g.cursor = max(g.cursor, offset)
+	for acked := range g.acked {
+		if acked < offset {
+			delete(g.acked, acked)
+		}
+	}
+	for g.acked[g.committed] {
+		delete(g.acked, g.committed)
+		g.committed++
+	}
+}
+
+func (p *partition) minCommittedLocked() int {
+	min := -1
+	for _, g := range p.groups {
+		if min == -1 || g.committed < min {
+			min = g.committed
+		}
+	}
+	return min
+}
+
+func (p *partition) groupNames() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	names := make([]string, 0, len(p.groups))
+	for name := range p.groups {
+		names = append(names, name)
+	}
+	return names
+}
+
+// lag reports how far the group is behind on this partition. ok is false if
+// the group never consumed from it.
+func (p *partition) lag(group string, now time.Time) (PartitionLagResponse, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, ok := p.groups[group]; !ok {
+		return PartitionLagResponse{}, false
+	}
+
+	g := p.groupLocked(group)
+	high := p.storage.Len()
+
+	response := PartitionLagResponse{
+		Partition:       p.id,
+		HighWatermark:   high,
+		CommittedOffset: g.committed,
+		Lag:             high - g.committed,
+		InFlight:        len(g.inflight),
+	}
+
+	// the oldest unacked message is the first one at or above the committed
+	// offset that has not been acknowledged out of order
+	for offset := g.committed; offset < high; offset++ {
+		if g.acked[offset] {
+			continue
+		}
+
+		record, err := p.storage.Get(offset)
+		if err != nil {
+			continue
+		}
+
+		response.OldestUnackedAge = now.Sub(record.Timestamp).Seconds()
+		break
+	}
+
+	return response, true
+}
+
+func (t *topic) groupNames() []string {
+	seen := make(map[string]bool)
+	for _, p := range t.partitions {
+		for _, name := range p.groupNames() {
+			seen[name] = true
+		}
+	}
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (t *topic) lag(now time.Time) TopicLagResponse {
+	response := TopicLagResponse{
+		Topic:  t.name,
+		Groups: make([]GroupLagResponse, 0),
+	}
+
+	for _, name := range t.groupNames() {
+		group := GroupLagResponse{
+			Group:      name,
+			Partitions: make([]PartitionLagResponse, 0, len(t.partitions)),
+		}
+
+		for _, p := range t.partitions {
+			partitionLag, ok := p.lag(name, now)
+			if !ok {
+				continue
+			}
+
+			group.Partitions = append(group.Partitions, partitionLag)
+			group.Lag += partitionLag.Lag
+			group.InFlight += partitionLag.InFlight
+			if partitionLag.OldestUnackedAge > group.OldestUnackedAge {
+				group.OldestUnackedAge = partitionLag.OldestUnackedAge
+			}
+		}
+
+		response.Groups = append(response.Groups, group)
+	}
+
+	return response
+}
+
+// deliveryState reports where offset stands for every group that has read
+// from the partition.
+func (p *partition) deliveryState(offset int) []MessageDeliveryState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	states := make([]MessageDeliveryState, 0, len(p.groups))
+	for name := range p.groups {
+		g := p.groupLocked(name)
+		state := MessageDeliveryState{Group: name, State: DeliveryStatePending}
+
+		if deliveredAt, ok := g.inflight[offset]; ok {
+			state.State = DeliveryStateInFlight
+			state.DeliveredAt = &deliveredAt
+		} else if offset < g.committed || g.acked[offset] {
+			state.State = DeliveryStateAcked
+		}
+
+		states = append(states, state)
+	}
+
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Group < states[j].Group
+	})
+
+	return states
+}
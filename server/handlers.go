@@ -2,18 +2,28 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/mdkelley02/message-queue/schema"
 )
 
 func (s *Server) GetTopicsHandler(w http.ResponseWriter, r *http.Request) {
+	topics := s.namespace(r).topics.list()
 	response := GetTopicsResponse{
-		Topics: make([]string, 0, len(s.messages)),
+		Topics: make([]string, 0, len(topics)),
 	}
 
-	for topic := range s.messages {
-		response.Topics = append(response.Topics, topic)
+	for _, t := range topics {
+		if s.visible(r, t.name) {
+			response.Topics = append(response.Topics, t.name)
+		}
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -32,18 +42,54 @@ func (s *Server) PublishHandler(w http.ResponseWriter, r *http.Request) {
 	// read request body
 	var request PublishRequest
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		slog.Error("could not read request body: %v", err)
+		slog.Error("could not read request body", "err", err)
 		http.Error(w, "could not read request body", http.StatusBadRequest)
 		return
 	}
 
 	slog.Info(fmt.Sprintf("request: %v", request))
 
+	request.Trace = TraceContextFromHeader(r.Header)
+
+	if s.isClosing() {
+		http.Error(w, errShuttingDown.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	// the namespace is asked first so that a publish it refuses does not
+	// spend the tokens of the other limits, which it refunds when they refuse
+	ns := s.namespace(r)
+	now := time.Now()
+	if !ns.publishes.allow(now) {
+		writeRateLimited(w, ns.publishes.delay(now, 1), fmt.Sprintf("%v: namespace %s", errRateLimited, ns.name))
+		return
+	}
+	if wait := s.publishLimits.tryTake(rateLimitKeysOf(r, ns, topic), len(request.Body), now); wait > 0 {
+		ns.publishes.refund()
+		writeRateLimited(w, wait, errRateLimited.Error())
+		return
+	}
+
 	// publish message to topic
-	publishResp, err := s.publishMessage(topic, request)
+	publishResp, err := s.publishMessage(ns, topic, request)
+
+	var validationErr *schema.ValidationError
+	if errors.As(err, &validationErr) {
+		slog.Error("message rejected by schema", "topic", topic, "schemaId", validationErr.SchemaId)
+		writeJSON(w, http.StatusUnprocessableEntity, ErrorResponse{
+			Error:    "message does not match schema",
+			SchemaId: validationErr.SchemaId,
+			Errors:   validationErr.Errors,
+		})
+		return
+	}
+
 	if err != nil {
-		slog.Error("could not publish message: %v", err)
-		http.Error(w, "could not publish message", http.StatusInternalServerError)
+		status, msg := publishErrorStatus(err)
+		if status >= http.StatusInternalServerError {
+			slog.Error("could not publish message", "namespace", ns.name, "topic", topic, "err", err)
+		}
+		http.Error(w, msg, status)
 		return
 	}
 
@@ -51,7 +97,36 @@ func (s *Server) PublishHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(publishResp)
 }
 
+// publishErrorStatus returns the status and message a failed publish is
+// answered with, over HTTP and the binary protocol alike. Over HTTP a
+// message that does not match its schema is answered with an ErrorResponse
+// instead, which lists the violations on their own.
+func publishErrorStatus(err error) (int, string) {
+	var validationErr *schema.ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		return http.StatusUnprocessableEntity, "message does not match schema: " + strings.Join(validationErr.Errors, ", ")
+	case errors.Is(err, errInvalidPartition), errors.Is(err, errInvalidTopicConfig):
+		return http.StatusBadRequest, err.Error()
+	case errors.Is(err, errTopicFull), errors.Is(err, errTooManyTopics), errors.Is(err, errQuotaExceeded):
+		return http.StatusInsufficientStorage, err.Error()
+	case errors.Is(err, errMessageTooLarge):
+		return http.StatusRequestEntityTooLarge, err.Error()
+	case errors.Is(err, errNotEnoughReplicas), errors.Is(err, errShuttingDown):
+		return http.StatusServiceUnavailable, err.Error()
+	}
+	return http.StatusInternalServerError, "could not publish message"
+}
+
 func (s *Server) SubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	// count the subscription before the connection is hijacked so shutdown
+	// can wait for it
+	if !s.addSubscription() {
+		http.Error(w, errShuttingDown.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer s.subscriptions.Done()
+
 	// get topic identifier from url
 	topic := getTopicFromUrl(r)
 	if topic == "" {
@@ -60,51 +135,246 @@ func (s *Server) SubscribeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ns := s.namespace(r)
+	if !ns.acquireConnection() {
+		http.Error(w, fmt.Sprintf("%v: namespace %s has too many connections", errRateLimited, ns.name), http.StatusTooManyRequests)
+		return
+	}
+	defer ns.releaseConnection()
+
+	// create topic if it does not exist
+	t, err := s.upsertTopic(ns, topic)
+	if errors.Is(err, errInvalidTopicConfig) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		slog.Error("could not create topic", "err", err)
+		http.Error(w, "could not create topic", http.StatusInternalServerError)
+		return
+	}
+
+	partitions, err := parsePartitions(r, t)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	group := r.URL.Query().Get("group")
+	if group == "" {
+		group = DefaultGroup
+	}
+	if !groupNamePattern.MatchString(group) {
+		http.Error(w, "invalid group", http.StatusBadRequest)
+		return
+	}
+
+	// a limited subscription ends once it was sent that many messages, so
+	// none past the limit is taken from the topic
+	limit := 0
+	if param := r.URL.Query().Get("limit"); param != "" {
+		limit, err = strconv.Atoi(param)
+		if err != nil || limit < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
 	// upgrade connection to websocket
 	conn, err := s.upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		slog.Error("could not upgrade connection: %v", err)
-		http.Error(w, "could not upgrade connection", http.StatusInternalServerError)
+		slog.Error("could not upgrade connection", "err", err)
 		return
 	}
+	defer conn.Close()
 
-	// create topic if it does not exist
-	s.upsertTopic(topic)
+	t.subscribers.Add(1)
+	defer t.subscribers.Add(-1)
 
-	topicStorage := s.storage[topic]
+	stop := make(chan struct{})
+	defer close(stop)
+
+	// send a close frame if the topic is deleted while subscribed
+	go func() {
+		select {
+		case <-t.done:
+			closeConn(conn, websocket.CloseNormalClosure, "topic deleted")
+		case <-stop:
+		}
+	}()
+
+	// read acknowledgements until the subscriber goes away
+	acks := make(chan DeliveryResponse)
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		for {
+			var response DeliveryResponse
+			if err := conn.ReadJSON(&response); err != nil {
+				return
+			}
+			select {
+			case acks <- response:
+			case <-stop:
+				return
+			}
+		}
+	}()
 
 	// subscribe to topic
+	keys := rateLimitKeysOf(r, ns, topic)
+	next := 0
+	sent := 0
 	for {
-		// read message from topic
-		message, ok := <-s.messages[topic]
-		if !ok {
-			slog.Error("could not read message from topic")
-			http.Error(w, "could not read message from topic", http.StatusInternalServerError)
+		// stop claiming once the server shuts down, the message in flight has
+		// been settled by now
+		if s.isClosing() {
+			closeConn(conn, websocket.CloseGoingAway, "server shutting down")
+			return
+		}
+		if limit > 0 && sent >= limit {
+			closeConn(conn, websocket.CloseNormalClosure, "limit reached")
 			return
 		}
 
-		value, err := topicStorage.Get(message.Offset)
-		if err != nil {
-			slog.Error("could not read message from storage: %v", err)
-			http.Error(w, "could not read message from storage", http.StatusInternalServerError)
+		// hold deliveries back while the subscriber is over its rate
+		if wait := s.consumeLimits.wait(keys, time.Now()); wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-gone:
+				timer.Stop()
+				return
+			case <-t.done:
+				timer.Stop()
+				return
+			case <-s.closing:
+				timer.Stop()
+			}
+			continue
 		}
 
-		// delete message from storage
-		if err := topicStorage.Delete(message.Offset); err != nil {
-			slog.Error("could not delete message from storage: %v", err)
-			http.Error(w, "could not delete message from storage", http.StatusInternalServerError)
-			return
+		wake := t.wait()
+
+		message, value, ok := t.claim(group, partitions, &next)
+		if !ok {
+			select {
+			case <-wake:
+				continue
+			case <-gone:
+				return
+			case <-t.done:
+				return
+			case <-s.closing:
+				continue
+			}
+		}
+
+		s.consumeLimits.take(keys, len(value.Value), time.Now())
+
+		ackRequired := t.cfg().DeliveryMode == DeliveryAtLeastOnce
+
+		// commit message before delivery unless the subscriber has to
+		// acknowledge it
+		if !ackRequired {
+			if err := t.ack(group, message); err != nil {
+				slog.Error("could not commit message", "err", err)
+				return
+			}
 		}
 
+		sp := s.startSpan("deliver "+topic, SpanKindConsumer, traceContextOf(value))
+		sp.setAttribute("namespace", t.ns.name)
+		sp.setAttribute("topic", topic)
+		sp.setAttribute("group", group)
+		sp.setAttribute("messageId", message.Id)
+		sp.setAttribute("attempt", message.Attempt)
+
 		// write message to connection
 		if err := conn.WriteJSON(Delivery{
-			Topic:     topic,
-			MessageId: message.Id,
-			Value:     value,
+			Topic:       topic,
+			Group:       group,
+			MessageId:   message.Id,
+			Partition:   message.Partition,
+			Offset:      message.Offset,
+			Key:         value.Key,
+			Value:       value.Value,
+			SchemaId:    value.SchemaId,
+			AckRequired: ackRequired,
+			Attempt:     message.Attempt,
+			Headers:     value.Headers,
+
+			TraceContext: traceContextOf(value),
 		}); err != nil {
-			slog.Error("could not write message to connection: %v", err)
-			http.Error(w, "could not write message to connection", http.StatusInternalServerError)
+			slog.Error("could not write message to connection", "err", err)
+			sp.end(err)
+			if ackRequired {
+				s.nack(t, group, message)
+			}
 			return
 		}
+		sent++
+		t.delivered.Add(1)
+		s.metrics.delivered.WithLabelValues(t.ns.name, t.name).Inc()
+		s.metrics.deliverLatency.WithLabelValues(t.ns.name, t.name).Observe(time.Since(value.Timestamp).Seconds())
+		if message.Attempt > 1 {
+			s.metrics.redelivered.WithLabelValues(t.ns.name, t.name).Inc()
+		}
+
+		if ackRequired {
+			if err := s.awaitAck(t, group, message, acks, gone); err != nil {
+				slog.Error("could not read acknowledgement", "err", err)
+				sp.end(err)
+				return
+			}
+		}
+		sp.end(nil)
 	}
 }
+
+// awaitAck waits for the subscriber to acknowledge message. Acked messages
+// are committed for the group, anything else makes the message available to
+// the group again.
+func (s *Server) awaitAck(t *topic, group string, message Message, acks <-chan DeliveryResponse, gone <-chan struct{}) error {
+	delivered := time.Now()
+	timeout := time.NewTimer(s.ackTimeout)
+	defer timeout.Stop()
+
+	var response DeliveryResponse
+	select {
+	case response = <-acks:
+	case <-timeout.C:
+		s.nack(t, group, message)
+		return fmt.Errorf("timed out waiting for acknowledgement of %s", message.Id)
+	case <-gone:
+		s.nack(t, group, message)
+		return fmt.Errorf("subscriber went away before acknowledging %s", message.Id)
+	case <-t.done:
+		return nil
+	case <-s.abort:
+		// the subscriber is sent a close frame on the next iteration
+		slog.Info("requeueing unacknowledged message on shutdown", "messageId", message.Id)
+		s.nack(t, group, message)
+		return nil
+	}
+
+	if response.MessageId != message.Id {
+		s.nack(t, group, message)
+		return fmt.Errorf("expected acknowledgement for %s, got %s", message.Id, response.MessageId)
+	}
+
+	if !response.Ack {
+		slog.Info("message was not acknowledged", "messageId", message.Id, "err", response.Err)
+		s.nack(t, group, message)
+		return nil
+	}
+
+	s.metrics.acked.WithLabelValues(t.ns.name, t.name).Inc()
+	s.metrics.ackLatency.WithLabelValues(t.ns.name, t.name).Observe(time.Since(delivered).Seconds())
+
+	if err := t.ack(group, message); err != nil {
+		slog.Error("could not commit message", "err", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/mdkelley02/message-queue/storage"
+)
+
+// withProbes serves the health probes ahead of next so that they need no
+// credentials and do not show up in the request metrics.
+func (s *Server) withProbes(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/healthz":
+			s.HealthzHandler(w, r)
+		case "/readyz":
+			s.ReadyzHandler(w, r)
+		default:
+			next.ServeHTTP(w, r)
+		}
+	})
+}
+
+// HealthzHandler reports that the process is alive.
+func (s *Server) HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, HealthResponse{Status: HealthOK})
+}
+
+// ReadyzHandler reports whether the broker should get traffic: storage has
+// been recovered, the listeners are bound, it is not shutting down and the
+// storage of every topic is healthy.
+func (s *Server) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	response := HealthResponse{Status: HealthOK, Topics: s.topicHealth()}
+
+	unhealthy := 0
+	for _, t := range response.Topics {
+		if t.Status != HealthOK {
+			unhealthy++
+		}
+	}
+
+	switch {
+	case !s.ready.Load():
+		response.Reason = "starting"
+	case s.draining.Load():
+		response.Reason = "shutting down"
+	case unhealthy > 0:
+		response.Reason = fmt.Sprintf("storage of %d topics is unhealthy", unhealthy)
+	}
+
+	if response.Reason != "" {
+		response.Status = HealthUnavailable
+		writeJSON(w, http.StatusServiceUnavailable, response)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// topicHealth asks the storage of every partition that can tell whether it
+// works.
+func (s *Server) topicHealth() []TopicHealth {
+	topics := s.allTopics()
+	health := make([]TopicHealth, 0, len(topics))
+	for _, t := range topics {
+		h := TopicHealth{Namespace: t.ns.name, Topic: t.name, Status: HealthOK}
+		for _, p := range t.partitions {
+			checker, ok := p.storage.(storage.IHealthChecker)
+			if !ok {
+				continue
+			}
+			if err := checker.Health(); err != nil {
+				h.Status = HealthUnavailable
+				h.Errors = append(h.Errors, fmt.Sprintf("partition %d: %v", p.id, err))
+			}
+		}
+		health = append(health, h)
+	}
+	return health
+}
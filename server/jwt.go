@@ -0,0 +1,181 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// JWTConfig verifies HMAC signed JSON web tokens. Issuer and Audience are
+// only checked when they are set.
+type JWTConfig struct {
+	Secret   []byte
+	Issuer   string
+	Audience string
+	// Leeway tolerates clock skew when checking exp and nbf.
+	Leeway time.Duration
+}
+
+// TokenClaims are the claims the broker reads from a token. The subject
+// names the principal.
+type TokenClaims struct {
+	Subject   string   `json:"sub"`
+	Issuer    string   `json:"iss,omitempty"`
+	Audience  audience `json:"aud,omitempty"`
+	ExpiresAt int64    `json:"exp,omitempty"`
+	NotBefore int64    `json:"nbf,omitempty"`
+	IssuedAt  int64    `json:"iat,omitempty"`
+	Roles     []string `json:"roles,omitempty"`
+}
+
+// audience is a single string or a list of them.
+type audience []string
+
+func (a audience) MarshalJSON() ([]byte, error) {
+	if len(a) == 1 {
+		return json.Marshal(a[0])
+	}
+	return json.Marshal([]string(a))
+}
+
+func (a *audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(a))
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+}
+
+var algorithms = map[string]func() hash.Hash{
+	"HS256": sha256.New,
+	"HS384": sha512.New384,
+	"HS512": sha512.New,
+}
+
+var errInvalidToken = errors.New("invalid token")
+
+type jwtAuthenticator struct {
+	cfg JWTConfig
+	now func() time.Time
+}
+
+// NewJWTAuthenticator accepts bearer tokens signed with the secret of cfg.
+func NewJWTAuthenticator(cfg JWTConfig) IAuthenticator {
+	return &jwtAuthenticator{cfg: cfg, now: time.Now}
+}
+
+func (a *jwtAuthenticator) Authenticate(r *http.Request) (Principal, bool, error) {
+	token := bearerToken(r)
+	if token == "" {
+		return Principal{}, false, nil
+	}
+
+	claims, err := a.verify(token)
+	if err != nil {
+		return Principal{}, false, err
+	}
+
+	return Principal{Name: claims.Subject, Method: AuthMethodJWT, Roles: claims.Roles}, true, nil
+}
+
+func (a *jwtAuthenticator) verify(token string) (TokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return TokenClaims{}, fmt.Errorf("%w: malformed", errInvalidToken)
+	}
+
+	var header tokenHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return TokenClaims{}, err
+	}
+
+	newHash, ok := algorithms[header.Alg]
+	if !ok {
+		return TokenClaims{}, fmt.Errorf("%w: unsupported algorithm %q", errInvalidToken, header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return TokenClaims{}, fmt.Errorf("%w: malformed signature", errInvalidToken)
+	}
+	if !hmac.Equal(signature, sign(newHash, a.cfg.Secret, parts[0]+"."+parts[1])) {
+		return TokenClaims{}, fmt.Errorf("%w: bad signature", errInvalidToken)
+	}
+
+	var claims TokenClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return TokenClaims{}, err
+	}
+
+	now := a.now()
+	switch {
+	case claims.Subject == "":
+		return TokenClaims{}, fmt.Errorf("%w: no subject", errInvalidToken)
+	case claims.ExpiresAt != 0 && now.After(time.Unix(claims.ExpiresAt, 0).Add(a.cfg.Leeway)):
+		return TokenClaims{}, fmt.Errorf("%w: expired", errInvalidToken)
+	case claims.NotBefore != 0 && now.Before(time.Unix(claims.NotBefore, 0).Add(-a.cfg.Leeway)):
+		return TokenClaims{}, fmt.Errorf("%w: not valid yet", errInvalidToken)
+	case a.cfg.Issuer != "" && claims.Issuer != a.cfg.Issuer:
+		return TokenClaims{}, fmt.Errorf("%w: wrong issuer", errInvalidToken)
+	case a.cfg.Audience != "" && !claims.Audience.contains(a.cfg.Audience):
+		return TokenClaims{}, fmt.Errorf("%w: wrong audience", errInvalidToken)
+	}
+
+	return claims, nil
+}
+
+func (a audience) contains(s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeSegment(segment string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return fmt.Errorf("%w: malformed", errInvalidToken)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%w: malformed", errInvalidToken)
+	}
+	return nil
+}
+
+func sign(newHash func() hash.Hash, secret []byte, signingInput string) []byte {
+	mac := hmac.New(newHash, secret)
+	mac.Write([]byte(signingInput))
+	return mac.Sum(nil)
+}
+
+// SignToken issues an HS256 token for claims that the broker accepts when it
+// is configured with the same secret.
+func SignToken(secret []byte, claims TokenClaims) (string, error) {
+	header, err := json.Marshal(tokenHeader{Alg: "HS256", Typ: "JWT"})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sign(sha256.New, secret, signingInput)), nil
+}
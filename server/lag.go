@@ -0,0 +1,120 @@
+package server
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func (s *Server) GetTopicLagHandler(w http.ResponseWriter, r *http.Request) {
+	t, err := s.getTopic(s.namespace(r), getTopicFromUrl(r))
+	if err != nil {
+		writeTopicError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, t.lag(time.Now()))
+}
+
+func (s *Server) GetLagHandler(w http.ResponseWriter, r *http.Request) {
+	response := s.lag(s.namespace(r), time.Now())
+
+	// only report the topics the principal may see
+	visible := response.Topics[:0]
+	for _, t := range response.Topics {
+		if s.visible(r, t.Topic) {
+			visible = append(visible, t)
+		}
+	}
+	response.Topics = visible
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) lag(ns *namespace, now time.Time) GetLagResponse {
+	topics := ns.topics.list()
+	response := GetLagResponse{
+		Topics: make([]TopicLagResponse, 0, len(topics)),
+	}
+
+	for _, t := range topics {
+		response.Topics = append(response.Topics, t.lag(now))
+	}
+
+	return response
+}
+
+var (
+	lagLabels = []string{"namespace", "topic", "group", "partition"}
+
+	highWatermarkDesc = prometheus.NewDesc(
+		"mq_consumer_group_high_watermark",
+		"Offset the next message published to the partition will get.",
+		lagLabels, nil,
+	)
+	committedOffsetDesc = prometheus.NewDesc(
+		"mq_consumer_group_committed_offset",
+		"Offset below which the consumer group has acknowledged every message.",
+		lagLabels, nil,
+	)
+	lagDesc = prometheus.NewDesc(
+		"mq_consumer_group_lag_messages",
+		"Number of messages the consumer group has not acknowledged yet.",
+		lagLabels, nil,
+	)
+	oldestUnackedAgeDesc = prometheus.NewDesc(
+		"mq_consumer_group_oldest_unacked_age_seconds",
+		"Age of the oldest message the consumer group has not acknowledged.",
+		lagLabels, nil,
+	)
+	inFlightDesc = prometheus.NewDesc(
+		"mq_consumer_group_in_flight_messages",
+		"Number of messages delivered to the consumer group and waiting for an acknowledgement.",
+		lagLabels, nil,
+	)
+)
+
+// lagCollector exposes consumer lag as gauges computed at scrape time.
+type lagCollector struct {
+	server *Server
+}
+
+func (c lagCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- highWatermarkDesc
+	ch <- committedOffsetDesc
+	ch <- lagDesc
+	ch <- oldestUnackedAgeDesc
+	ch <- inFlightDesc
+}
+
+func (c lagCollector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	for _, ns := range c.server.namespaces.list() {
+		for _, topic := range c.server.lag(ns, now).Topics {
+			c.collect(ch, ns.name, topic)
+		}
+	}
+}
+
+func (c lagCollector) collect(ch chan<- prometheus.Metric, ns string, topic TopicLagResponse) {
+	for _, group := range topic.Groups {
+		for _, p := range group.Partitions {
+			labels := []string{ns, topic.Topic, group.Group, strconv.Itoa(p.Partition)}
+
+			ch <- prometheus.MustNewConstMetric(highWatermarkDesc, prometheus.GaugeValue, float64(p.HighWatermark), labels...)
+			ch <- prometheus.MustNewConstMetric(committedOffsetDesc, prometheus.GaugeValue, float64(p.CommittedOffset), labels...)
+			ch <- prometheus.MustNewConstMetric(lagDesc, prometheus.GaugeValue, float64(p.Lag), labels...)
+			ch <- prometheus.MustNewConstMetric(oldestUnackedAgeDesc, prometheus.GaugeValue, p.OldestUnackedAge, labels...)
+			ch <- prometheus.MustNewConstMetric(inFlightDesc, prometheus.GaugeValue, float64(p.InFlight), labels...)
+		}
+	}
+}
+
+func (s *Server) registerLagMetrics() {
+	if err := s.registry.Register(lagCollector{server: s}); err != nil {
+		slog.Error("could not register lag metrics", "err", err)
+	}
+}
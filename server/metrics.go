@@ -0,0 +1,202 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/slok/go-http-metrics/metrics"
+	prommetrics "github.com/slok/go-http-metrics/metrics/prometheus"
+)
+
+// namespaceRecorder labels the HTTP metrics with the namespace a request
+// addressed.
+type namespaceRecorder struct {
+	metrics.Recorder
+}
+
+func newNamespaceRecorder(registry prometheus.Registerer) metrics.Recorder {
+	return namespaceRecorder{prommetrics.NewRecorder(prommetrics.Config{Registry: registry, ServiceLabel: "namespace"})}
+}
+
+func (r namespaceRecorder) ObserveHTTPRequestDuration(ctx context.Context, props metrics.HTTPReqProperties, duration time.Duration) {
+	props.Service = namespaceOfPath(props.ID)
+	r.Recorder.ObserveHTTPRequestDuration(ctx, props, duration)
+}
+
+func (r namespaceRecorder) ObserveHTTPResponseSize(ctx context.Context, props metrics.HTTPReqProperties, sizeBytes int64) {
+	props.Service = namespaceOfPath(props.ID)
+	r.Recorder.ObserveHTTPResponseSize(ctx, props, sizeBytes)
+}
+
+func (r namespaceRecorder) AddInflightRequests(ctx context.Context, props metrics.HTTPProperties, quantity int) {
+	props.Service = namespaceOfPath(props.ID)
+	r.Recorder.AddInflightRequests(ctx, props, quantity)
+}
+
+var (
+	topicLabels     = []string{"namespace", "topic"}
+	partitionLabels = []string{"namespace", "topic", "partition"}
+
+	depthDesc = prometheus.NewDesc(
+		"mq_topic_depth_messages",
+		"Number of messages stored in the topic.",
+		topicLabels, nil,
+	)
+	bytesDesc = prometheus.NewDesc(
+		"mq_topic_bytes",
+		"Size of the messages stored in the topic.",
+		topicLabels, nil,
+	)
+	topicInFlightDesc = prometheus.NewDesc(
+		"mq_topic_in_flight_messages",
+		"Number of messages of the topic delivered and waiting for an acknowledgement.",
+		topicLabels, nil,
+	)
+	subscribersDesc = prometheus.NewDesc(
+		"mq_topic_subscribers",
+		"Number of subscribers connected to the topic.",
+		topicLabels, nil,
+	)
+	replicationLagDesc = prometheus.NewDesc(
+		"mq_replication_lag_messages",
+		"Number of messages a follower is behind the leader on the partition.",
+		partitionLabels, nil,
+	)
+	inSyncReplicasDesc = prometheus.NewDesc(
+		"mq_replication_in_sync_replicas",
+		"Number of followers of the partition that are in sync with the leader.",
+		partitionLabels, nil,
+	)
+)
+
+// topicMetrics count what happens to the messages of each topic. The
+// gauges are computed at scrape time.
+type topicMetrics struct {
+	server *Server
+
+	published    *prometheus.CounterVec
+	delivered    *prometheus.CounterVec
+	acked        *prometheus.CounterVec
+	nacked       *prometheus.CounterVec
+	redelivered  *prometheus.CounterVec
+	expired      *prometheus.CounterVec
+	deadLettered *prometheus.CounterVec
+
+	deliverLatency *prometheus.HistogramVec
+	ackLatency     *prometheus.HistogramVec
+	payloadSize    *prometheus.HistogramVec
+}
+
+func newTopicMetrics(s *Server) *topicMetrics {
+	counter := func(name string, help string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, topicLabels)
+	}
+	histogram := func(name string, help string, buckets []float64) *prometheus.HistogramVec {
+		return prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: buckets}, topicLabels)
+	}
+
+	return &topicMetrics{
+		server:       s,
+		published:    counter("mq_messages_published_total", "Number of messages published to the topic."),
+		delivered:    counter("mq_messages_delivered_total", "Number of messages delivered to subscribers of the topic."),
+		acked:        counter("mq_messages_acked_total", "Number of deliveries subscribers acknowledged."),
+		nacked:       counter("mq_messages_nacked_total", "Number of deliveries that failed and were handed back to their group."),
+		redelivered:  counter("mq_messages_redelivered_total", "Number of deliveries of messages that were delivered before."),
+		expired:      counter("mq_messages_expired_total", "Number of messages removed by the retention of the topic."),
+		deadLettered: counter("mq_messages_dead_lettered_total", "Number of messages moved to the dead letter topic."),
+		deliverLatency: histogram("mq_publish_to_deliver_latency_seconds",
+			"Time from publishing a message to delivering it.", prometheus.ExponentialBuckets(0.001, 4, 10)),
+		ackLatency: histogram("mq_ack_latency_seconds",
+			"Time from delivering a message to its acknowledgement.", prometheus.ExponentialBuckets(0.001, 4, 10)),
+		payloadSize: histogram("mq_message_payload_bytes",
+			"Size of published messages.", prometheus.ExponentialBuckets(64, 4, 10)),
+	}
+}
+
+// vec is what the counter and histogram vectors have in common.
+type vec interface {
+	prometheus.Collector
+	DeleteLabelValues(lvs ...string) bool
+}
+
+func (m *topicMetrics) vecs() []vec {
+	return []vec{
+		m.published, m.delivered, m.acked, m.nacked, m.redelivered, m.expired, m.deadLettered,
+		m.deliverLatency, m.ackLatency, m.payloadSize,
+	}
+}
+
+func (m *topicMetrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, vec := range m.vecs() {
+		vec.Describe(ch)
+	}
+	ch <- depthDesc
+	ch <- bytesDesc
+	ch <- topicInFlightDesc
+	ch <- subscribersDesc
+	ch <- replicationLagDesc
+	ch <- inSyncReplicasDesc
+}
+
+func (m *topicMetrics) Collect(ch chan<- prometheus.Metric) {
+	for _, vec := range m.vecs() {
+		vec.Collect(ch)
+	}
+
+	now := time.Now()
+	for _, ns := range m.server.namespaces.list() {
+		inFlight := make(map[string]int)
+		for _, topic := range m.server.lag(ns, now).Topics {
+			for _, group := range topic.Groups {
+				inFlight[topic.Topic] += group.InFlight
+			}
+		}
+
+		for _, t := range ns.topics.list() {
+			labels := []string{ns.name, t.name}
+			stats := t.stats()
+
+			ch <- prometheus.MustNewConstMetric(depthDesc, prometheus.GaugeValue, float64(stats.Count), labels...)
+			ch <- prometheus.MustNewConstMetric(bytesDesc, prometheus.GaugeValue, float64(stats.Bytes), labels...)
+			ch <- prometheus.MustNewConstMetric(topicInFlightDesc, prometheus.GaugeValue, float64(inFlight[t.name]), labels...)
+			ch <- prometheus.MustNewConstMetric(subscribersDesc, prometheus.GaugeValue, float64(t.subscribers.Load()), labels...)
+
+			if m.server.replication != nil && !isSystemTopic(t.name) {
+				m.collectReplication(ch, t, now)
+			}
+		}
+	}
+}
+
+// collectReplication reports the lag of a follower, or the in-sync
+// followers of a leader, for every partition of t.
+func (m *topicMetrics) collectReplication(ch chan<- prometheus.Metric, t *topic, now time.Time) {
+	following := m.server.follower.Load() != nil
+	for _, p := range t.partitions {
+		labels := []string{t.ns.name, t.name, strconv.Itoa(p.id)}
+		if following {
+			leaderHighWatermark, _ := p.replicas.following()
+			lag := max(leaderHighWatermark-p.storage.Stats().HighWatermark, 0)
+			ch <- prometheus.MustNewConstMetric(replicationLagDesc, prometheus.GaugeValue, float64(lag), labels...)
+		} else {
+			inSync := p.replicas.inSync(0, m.server.replicaLagTimeout(), now)
+			ch <- prometheus.MustNewConstMetric(inSyncReplicasDesc, prometheus.GaugeValue, float64(inSync), labels...)
+		}
+	}
+}
+
+// forget drops the series of a deleted topic.
+func (m *topicMetrics) forget(t *topic) {
+	for _, vec := range m.vecs() {
+		vec.DeleteLabelValues(t.ns.name, t.name)
+	}
+}
+
+func (s *Server) registerTopicMetrics() {
+	if err := s.registry.Register(s.metrics); err != nil {
+		slog.Error("could not register topic metrics", "err", err)
+	}
+}
@@ -0,0 +1,35 @@
+package server
+
+import (
+	"net/http"
+)
+
+// IMirror copies messages of another broker into this one, see the mirror
+// package. The broker runs its mirrors while it serves and reports their
+// status.
+type IMirror interface {
+	Start()
+	Stop()
+	Status() MirrorStatus
+}
+
+func (s *Server) startMirrors() {
+	for _, m := range s.mirrors {
+		m.Start()
+	}
+}
+
+func (s *Server) stopMirrors() {
+	for _, m := range s.mirrors {
+		m.Stop()
+	}
+}
+
+func (s *Server) GetMirrorsHandler(w http.ResponseWriter, r *http.Request) {
+	response := MirrorsResponse{Mirrors: make([]MirrorStatus, 0, len(s.mirrors))}
+	for _, m := range s.mirrors {
+		response.Mirrors = append(response.Mirrors, m.Status())
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
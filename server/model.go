@@ -1,14 +1,34 @@
 package server
 
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/mdkelley02/message-queue/schema"
+	"github.com/mdkelley02/message-queue/storage"
+)
+
 type Message struct {
-	Id     string
-	Offset int
+	Id        string
+	Partition int
+	Offset    int
+	Attempt   int
 }
 
 type Delivery struct {
-	Topic     string `json:"topic"`
-	MessageId string `json:"messageId"`
-	Value     string `json:"value"`
+	Topic       string            `json:"topic"`
+	Group       string            `json:"group"`
+	MessageId   string            `json:"messageId"`
+	Partition   int               `json:"partition"`
+	Offset      int               `json:"offset"`
+	Key         string            `json:"key,omitempty"`
+	Value       string            `json:"value"`
+	SchemaId    int               `json:"schemaId,omitempty"`
+	AckRequired bool              `json:"ackRequired,omitempty"`
+	Attempt     int               `json:"attempt"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	TraceContext
 }
 
 type DeliveryResponse struct {
@@ -18,10 +38,18 @@ type DeliveryResponse struct {
 }
 
 type PublishRequest struct {
-	Body string `json:"body"`
+	Body      string `json:"body"`
+	Key       string `json:"key,omitempty"`
+	Partition *int   `json:"partition,omitempty"`
+	// Headers are stored with the message and delivered with it.
+	Headers map[string]string `json:"headers,omitempty"`
+	// Trace is sent in the traceparent and tracestate headers rather than
+	// the body.
+	Trace TraceContext `json:"-"`
 }
 
 type PublishResponse struct {
+	Partition int    `json:"partition"`
 	Offset    int    `json:"offset"`
 	MessageId string `json:"messageId"`
 }
@@ -29,3 +57,568 @@ type PublishResponse struct {
 type GetTopicsResponse struct {
 	Topics []string `json:"topics"`
 }
+
+type RegisterSchemaRequest struct {
+	Schema json.RawMessage `json:"schema"`
+}
+
+type SchemaResponse struct {
+	Id      int             `json:"id"`
+	Topic   string          `json:"topic"`
+	Version int             `json:"version"`
+	Schema  json.RawMessage `json:"schema"`
+}
+
+type GetSchemasResponse struct {
+	Compatibility string           `json:"compatibility"`
+	Schemas       []SchemaResponse `json:"schemas"`
+}
+
+type SchemaCompatibilityRequest struct {
+	Compatibility string `json:"compatibility"`
+}
+
+type SchemaCompatibilityResponse struct {
+	Topic         string `json:"topic"`
+	Compatibility string `json:"compatibility"`
+}
+
+type ErrorResponse struct {
+	Error    string   `json:"error"`
+	SchemaId int      `json:"schemaId,omitempty"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+type RedriveRequest struct {
+	Destination string  `json:"destination,omitempty"`
+	Filter      string  `json:"filter,omitempty"`
+	FromOffset  int     `json:"fromOffset,omitempty"`
+	ToOffset    *int    `json:"toOffset,omitempty"`
+	RateLimit   float64 `json:"rateLimit,omitempty"`
+}
+
+type RedriveResponse struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	Moved       int    `json:"moved"`
+	Failed      int    `json:"failed"`
+}
+
+const (
+	StorageMemory = "memory"
+	StorageFile   = "file"
+
+	DeliveryAtMostOnce  = "at-most-once"
+	DeliveryAtLeastOnce = "at-least-once"
+)
+
+type TopicConfig struct {
+	Storage      string       `json:"storage,omitempty"`
+	Retention    Duration     `json:"retention,omitempty"`
+	MaxSize      int          `json:"maxSize,omitempty"`
+	DeliveryMode string       `json:"deliveryMode,omitempty"`
+	Partitions   int          `json:"partitions,omitempty"`
+	Partitioner  string       `json:"partitioner,omitempty"`
+	Retry        *RetryPolicy `json:"retry,omitempty"`
+	// MinInSyncReplicas is the number of in-sync followers a publish waits
+	// for before it is acknowledged. Zero replicates asynchronously.
+	MinInSyncReplicas int `json:"minInSyncReplicas,omitempty"`
+}
+
+// RetryPolicy controls when nacked messages of an at-least-once topic are
+// delivered again. The delay after attempt n is InitialDelay *
+// Multiplier^(n-1), capped at MaxDelay and spread by up to Jitter (a fraction
+// of the delay) in either direction. Once MaxAttempts deliveries have failed
+// the message is moved to the dead letter topic; zero retries forever.
+type RetryPolicy struct {
+	InitialDelay Duration `json:"initialDelay,omitempty"`
+	Multiplier   float64  `json:"multiplier,omitempty"`
+	MaxDelay     Duration `json:"maxDelay,omitempty"`
+	Jitter       float64  `json:"jitter,omitempty"`
+	MaxAttempts  int      `json:"maxAttempts,omitempty"`
+}
+
+const (
+	HealthOK          = "ok"
+	HealthUnavailable = "unavailable"
+)
+
+// HealthResponse answers the liveness and readiness probes. Reason says why
+// the broker is not ready.
+type HealthResponse struct {
+	Status string        `json:"status"`
+	Reason string        `json:"reason,omitempty"`
+	Topics []TopicHealth `json:"topics,omitempty"`
+}
+
+// TopicHealth is the storage health of a topic. Errors lists the partitions
+// whose storage reported a problem.
+type TopicHealth struct {
+	Namespace string   `json:"namespace"`
+	Topic     string   `json:"topic"`
+	Status    string   `json:"status"`
+	Errors    []string `json:"errors,omitempty"`
+}
+
+// DefaultNamespace holds the topics addressed without a namespace.
+const DefaultNamespace = "default"
+
+const (
+	DirectionPublish = "publish"
+	DirectionConsume = "consume"
+
+	RateLimitPrincipal = "principal"
+	RateLimitClientIP  = "clientIp"
+	RateLimitTopic     = "topic"
+	RateLimitNamespace = "namespace"
+)
+
+// RateLimiterResponse is the state of the bucket of one key. The tokens are
+// what may pass right now; they are negative while the key is in debt and
+// only set for the rates that are limited.
+type RateLimiterResponse struct {
+	Direction     string    `json:"direction"`
+	Kind          string    `json:"kind"`
+	Key           string    `json:"key"`
+	Limit         RateLimit `json:"limit"`
+	MessageTokens float64   `json:"messageTokens"`
+	ByteTokens    float64   `json:"byteTokens"`
+}
+
+type RateLimitsResponse struct {
+	Limiters []RateLimiterResponse `json:"limiters"`
+}
+
+// NamespaceConfig holds the settings of a namespace.
+type NamespaceConfig struct {
+	Quotas     NamespaceQuotas  `json:"quotas"`
+	DeadLetter DeadLetterConfig `json:"deadLetter"`
+}
+
+// NamespaceQuotas limit what the topics of a namespace may use: the number
+// of topics, the bytes they store, the messages published per second and
+// the open subscriptions. Zero means no limit, except for MaxTopics which
+// falls back to the limit of the broker.
+type NamespaceQuotas struct {
+	MaxTopics      int     `json:"maxTopics,omitempty"`
+	MaxBytes       int     `json:"maxBytes,omitempty"`
+	MaxPublishRate float64 `json:"maxPublishRate,omitempty"`
+	MaxConnections int     `json:"maxConnections,omitempty"`
+}
+
+// DeadLetterConfig decides what happens to messages that ran out of
+// delivery attempts. They are moved to a dead letter topic, created with
+// Topic when it does not exist, or dropped when Disabled is set.
+type DeadLetterConfig struct {
+	Disabled bool        `json:"disabled,omitempty"`
+	Topic    TopicConfig `json:"topic"`
+}
+
+type CreateNamespaceRequest struct {
+	Name   string          `json:"name"`
+	Config NamespaceConfig `json:"config"`
+}
+
+type NamespaceResponse struct {
+	Name        string          `json:"name"`
+	Config      NamespaceConfig `json:"config"`
+	CreatedAt   time.Time       `json:"createdAt"`
+	Topics      int             `json:"topics"`
+	Bytes       int             `json:"bytes"`
+	Connections int             `json:"connections"`
+}
+
+type GetNamespacesResponse struct {
+	Namespaces []NamespaceResponse `json:"namespaces"`
+}
+
+const (
+	ActionPublish   = "publish"
+	ActionSubscribe = "subscribe"
+	ActionAdmin     = "admin"
+)
+
+// ACLRule grants actions on the topics matching Topic, a pattern such as
+// "orders.*", to a principal or to every principal with a role. Principal
+// "*" matches everyone, including anonymous requests. Admin implies the
+// other actions. Static rules come from the configuration and cannot be
+// removed at runtime.
+type ACLRule struct {
+	Id        string   `json:"id,omitempty"`
+	Principal string   `json:"principal,omitempty"`
+	Role      string   `json:"role,omitempty"`
+	Topic     string   `json:"topic"`
+	Actions   []string `json:"actions"`
+	Static    bool     `json:"static,omitempty"`
+}
+
+type ACLRulesResponse struct {
+	Rules []ACLRule `json:"rules"`
+}
+
+type CreateTopicRequest struct {
+	Name   string      `json:"name"`
+	Config TopicConfig `json:"config"`
+}
+
+type TopicResponse struct {
+	Name        string              `json:"name"`
+	Config      TopicConfig         `json:"config"`
+	CreatedAt   time.Time           `json:"createdAt"`
+	Depth       int                 `json:"depth"`
+	Bytes       int                 `json:"bytes"`
+	Subscribers int                 `json:"subscribers"`
+	Published   int64               `json:"published"`
+	Delivered   int64               `json:"delivered"`
+	Partitions  []PartitionResponse `json:"partitions"`
+}
+
+type PartitionResponse struct {
+	Id            int `json:"id"`
+	Depth         int `json:"depth"`
+	Bytes         int `json:"bytes"`
+	LowWatermark  int `json:"lowWatermark"`
+	HighWatermark int `json:"highWatermark"`
+}
+
+type PurgeTopicResponse struct {
+	Purged int `json:"purged"`
+}
+
+// Duration is a time.Duration that is written as a string such as "1h30m"
+// in JSON.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"1h\": %w", err)
+	}
+
+	if s == "" {
+		*d = 0
+		return nil
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(parsed)
+	return nil
+}
+
+type PartitionLagResponse struct {
+	Partition        int     `json:"partition"`
+	HighWatermark    int     `json:"highWatermark"`
+	CommittedOffset  int     `json:"committedOffset"`
+	Lag              int     `json:"lag"`
+	OldestUnackedAge float64 `json:"oldestUnackedAgeSeconds"`
+	InFlight         int     `json:"inFlight"`
+}
+
+type GroupLagResponse struct {
+	Group            string                 `json:"group"`
+	Lag              int                    `json:"lag"`
+	OldestUnackedAge float64                `json:"oldestUnackedAgeSeconds"`
+	InFlight         int                    `json:"inFlight"`
+	Partitions       []PartitionLagResponse `json:"partitions"`
+}
+
+type TopicLagResponse struct {
+	Topic  string             `json:"topic"`
+	Groups []GroupLagResponse `json:"groups"`
+}
+
+type GetLagResponse struct {
+	Topics []TopicLagResponse `json:"topics"`
+}
+
+const (
+	DeliveryStatePending  = "pending"
+	DeliveryStateInFlight = "in-flight"
+	DeliveryStateAcked    = "acked"
+)
+
+type MessageDeliveryState struct {
+	Group       string     `json:"group"`
+	State       string     `json:"state"`
+	DeliveredAt *time.Time `json:"deliveredAt,omitempty"`
+}
+
+type MessageResponse struct {
+	Id        string                 `json:"id"`
+	Topic     string                 `json:"topic"`
+	Partition int                    `json:"partition"`
+	Offset    int                    `json:"offset"`
+	Key       string                 `json:"key,omitempty"`
+	Value     string                 `json:"value"`
+	SchemaId  int                    `json:"schemaId,omitempty"`
+	Timestamp time.Time              `json:"timestamp"`
+	Headers   map[string]string      `json:"headers,omitempty"`
+	Delivery  []MessageDeliveryState `json:"delivery"`
+	TraceContext
+}
+
+type BrowseMessagesResponse struct {
+	Topic      string            `json:"topic"`
+	Partition  int               `json:"partition"`
+	Messages   []MessageResponse `json:"messages"`
+	NextOffset int               `json:"nextOffset"`
+}
+
+const (
+	AuditTopicCreate      = "topic.create"
+	AuditTopicDelete      = "topic.delete"
+	AuditTopicPurge       = "topic.purge"
+	AuditTopicConfig      = "topic.config"
+	AuditTopicRedrive     = "topic.redrive"
+	AuditNamespaceCreate  = "namespace.create"
+	AuditNamespaceConfig  = "namespace.config"
+	AuditNamespaceDelete  = "namespace.delete"
+	AuditACLAdd           = "acl.add"
+	AuditACLDelete        = "acl.delete"
+	AuditPromote          = "replication.promote"
+	AuditFollow           = "replication.follow"
+	AuditClusterJoin      = "cluster.join"
+	AuditClusterLeave     = "cluster.leave"
+	AuditAuthFailure      = "auth.failure"
+	AuditPermissionDenied = "auth.denied"
+)
+
+// AuditEvent is an entry of the audit log. Before and After hold the state
+// of the resource around a change.
+type AuditEvent struct {
+	Time       time.Time `json:"time"`
+	Action     string    `json:"action"`
+	Principal  string    `json:"principal,omitempty"`
+	AuthMethod string    `json:"authMethod"`
+	SourceIP   string    `json:"sourceIp"`
+	RequestId  string    `json:"requestId"`
+	Namespace  string    `json:"namespace"`
+	Resource   string    `json:"resource,omitempty"`
+	Before     any       `json:"before,omitempty"`
+	After      any       `json:"after,omitempty"`
+	Reason     string    `json:"reason,omitempty"`
+}
+
+const (
+	RoleLeader   = "leader"
+	RoleFollower = "follower"
+)
+
+// ReplicationResponse is the replication state of a broker. Leaders list
+// the followers of each partition, followers how far they are behind.
+type ReplicationResponse struct {
+	NodeId     string                         `json:"nodeId"`
+	Role       string                         `json:"role"`
+	Leader     string                         `json:"leader,omitempty"`
+	Partitions []PartitionReplicationResponse `json:"partitions"`
+}
+
+type PartitionReplicationResponse struct {
+	Namespace     string `json:"namespace"`
+	Topic         string `json:"topic"`
+	Partition     int    `json:"partition"`
+	HighWatermark int    `json:"highWatermark"`
+	// LeaderHighWatermark and Lag are reported by followers as of their
+	// last fetch
+	LeaderHighWatermark int               `json:"leaderHighWatermark,omitempty"`
+	Lag                 int               `json:"lag"`
+	LastFetch           *time.Time        `json:"lastFetch,omitempty"`
+	Replicas            []ReplicaResponse `json:"replicas,omitempty"`
+}
+
+// ReplicaResponse is a follower of a partition as the leader sees it.
+// Offset is the offset the follower fetches next, every message below it is
+// replicated.
+type ReplicaResponse struct {
+	Id        string    `json:"id"`
+	Offset    int       `json:"offset"`
+	Lag       int       `json:"lag"`
+	InSync    bool      `json:"inSync"`
+	LastFetch time.Time `json:"lastFetch"`
+}
+
+type FollowRequest struct {
+	Leader string `json:"leader"`
+}
+
+// ReplicatedTopicsResponse is the metadata followers copy from the leader.
+type ReplicatedTopicsResponse struct {
+	Namespaces []ReplicatedNamespace `json:"namespaces"`
+	Topics     []ReplicatedTopic     `json:"topics"`
+}
+
+// ReplicatedNamespace is a namespace with the acl rules added to it at
+// runtime and the schemas registered in it.
+type ReplicatedNamespace struct {
+	Name      string          `json:"name"`
+	Config    NamespaceConfig `json:"config"`
+	CreatedAt time.Time       `json:"createdAt"`
+	ACLRules  []ACLRule       `json:"aclRules,omitempty"`
+	Schemas   schema.Snapshot `json:"schemas"`
+}
+
+type ReplicatedTopic struct {
+	Namespace string      `json:"namespace"`
+	Name      string      `json:"name"`
+	Config    TopicConfig `json:"config"`
+	CreatedAt time.Time   `json:"createdAt"`
+}
+
+// ReplicaFetchResponse holds the records of a partition from the requested
+// offset on. Offsets below NextOffset that are not in Records were deleted.
+// Deleted lists the offsets below the requested one that were deleted after
+// the follower copied them.
+type ReplicaFetchResponse struct {
+	LowWatermark  int             `json:"lowWatermark"`
+	HighWatermark int             `json:"highWatermark"`
+	NextOffset    int             `json:"nextOffset"`
+	Records       []ReplicaRecord `json:"records"`
+	Deleted       []int           `json:"deleted,omitempty"`
+}
+
+type ReplicaRecord struct {
+	Offset int `json:"offset"`
+	storage.Record
+}
+
+const RoleCandidate = "candidate"
+
+// ClusterMember is a broker of a cluster and the URL it serves at.
+type ClusterMember struct {
+	Id   string `json:"id"`
+	Addr string `json:"addr"`
+}
+
+// ClusterResponse is the state of the cluster as a member sees it.
+// Partitions lists which member leads each partition and in which epoch,
+// the epoch grows every time leadership moves. The leader of the cluster
+// leads every partition.
+type ClusterResponse struct {
+	NodeId      string                  `json:"nodeId"`
+	Role        string                  `json:"role"`
+	Term        int                     `json:"term"`
+	Leader      string                  `json:"leader,omitempty"`
+	LeaderAddr  string                  `json:"leaderAddr,omitempty"`
+	CommitIndex int                     `json:"commitIndex"`
+	Applied     int                     `json:"applied"`
+	Members     []ClusterMemberResponse `json:"members"`
+	Partitions  []PartitionAssignment   `json:"partitions"`
+}
+
+// ClusterMemberResponse is a member of the cluster. The leader reports how
+// much of its log the other members have and when it last heard of them.
+type ClusterMemberResponse struct {
+	ClusterMember
+	Leader      bool       `json:"leader"`
+	MatchIndex  int        `json:"matchIndex"`
+	LastContact *time.Time `json:"lastContact,omitempty"`
+}
+
+type PartitionAssignment struct {
+	Namespace string   `json:"namespace"`
+	Topic     string   `json:"topic"`
+	Partition int      `json:"partition"`
+	Leader    string   `json:"leader"`
+	Replicas  []string `json:"replicas"`
+	Epoch     int      `json:"epoch"`
+}
+
+// ReplicatedOffset is the committed offset of a consumer group in a
+// partition.
+type ReplicatedOffset struct {
+	Namespace string `json:"namespace"`
+	Topic     string `json:"topic"`
+	Partition int    `json:"partition"`
+	Group     string `json:"group"`
+	Offset    int    `json:"offset"`
+}
+
+// RaftEntry is an entry of the log of the cluster. It holds either a
+// command or the members of the cluster from then on, an entry with neither
+// starts the term of a leader.
+type RaftEntry struct {
+	Index   int               `json:"index"`
+	Term    int               `json:"term"`
+	Command json.RawMessage   `json:"command,omitempty"`
+	Members map[string]string `json:"members,omitempty"`
+}
+
+// RaftSnapshot replaces the entries of the log up to Index.
+type RaftSnapshot struct {
+	Index   int               `json:"index"`
+	Term    int               `json:"term"`
+	Members map[string]string `json:"members"`
+	State   json.RawMessage   `json:"state,omitempty"`
+}
+
+type RaftVoteRequest struct {
+	Term         int    `json:"term"`
+	CandidateId  string `json:"candidateId"`
+	LastLogIndex int    `json:"lastLogIndex"`
+	LastLogTerm  int    `json:"lastLogTerm"`
+}
+
+type RaftVoteResponse struct {
+	Term    int  `json:"term"`
+	Granted bool `json:"granted"`
+}
+
+// RaftAppendRequest carries the entries of the leader after PrevLogIndex,
+// none for a heartbeat. Snapshot is set when the member needs entries the
+// leader compacted.
+type RaftAppendRequest struct {
+	Term         int           `json:"term"`
+	LeaderId     string        `json:"leaderId"`
+	LeaderAddr   string        `json:"leaderAddr"`
+	PrevLogIndex int           `json:"prevLogIndex"`
+	PrevLogTerm  int           `json:"prevLogTerm"`
+	Entries      []RaftEntry   `json:"entries"`
+	LeaderCommit int           `json:"leaderCommit"`
+	Snapshot     *RaftSnapshot `json:"snapshot,omitempty"`
+}
+
+type RaftAppendResponse struct {
+	Term         int  `json:"term"`
+	Success      bool `json:"success"`
+	LastLogIndex int  `json:"lastLogIndex"`
+}
+
+// MirrorStatus reports how far a mirror copied the topics of its source
+// broker.
+type MirrorStatus struct {
+	// Source is the site of the source broker
+	Source      string              `json:"source"`
+	Running     bool                `json:"running"`
+	Partitions  []MirroredPartition `json:"partitions"`
+	LastError   string              `json:"lastError,omitempty"`
+	LastErrorAt *time.Time          `json:"lastErrorAt,omitempty"`
+}
+
+// MirroredPartition is a partition of a source topic and where its
+// messages are copied to.
+type MirroredPartition struct {
+	SourceTopic string `json:"sourceTopic"`
+	Topic       string `json:"topic"`
+	Partition   int    `json:"partition"`
+	// Offset is the next offset of the source partition to copy, it is
+	// checkpointed by the mirror
+	Offset        int   `json:"offset"`
+	HighWatermark int   `json:"highWatermark"`
+	Lag           int   `json:"lag"`
+	Mirrored      int64 `json:"mirrored"`
+	// Skipped counts the messages that were copied from this broker before
+	Skipped      int64      `json:"skipped"`
+	LastMirrored *time.Time `json:"lastMirrored,omitempty"`
+}
+
+type MirrorsResponse struct {
+	Mirrors []MirrorStatus `json:"mirrors"`
+}
@@ -0,0 +1,558 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/mdkelley02/message-queue/schema"
+)
+
+const namespacesFileName = "namespaces.json"
+
+var (
+	errNamespaceNotFound      = errors.New("namespace not found")
+	errNamespaceExists        = errors.New("namespace already exists")
+	errInvalidNamespaceConfig = errors.New("invalid namespace config")
+	errDefaultNamespace       = errors.New("the default namespace cannot be deleted")
+	errQuotaExceeded          = errors.New("quota exceeded")
+	errRateLimited            = errors.New("rate limit exceeded")
+)
+
+// namespace is an isolated set of topics with its own schemas, access
+// control rules, dead letter settings and quotas.
+type namespace struct {
+	name      string
+	createdAt time.Time
+	config    atomic.Pointer[NamespaceConfig]
+	// dir keeps the files of the namespace, it is empty when nothing is
+	// persisted
+	dir         string
+	topics      *topicRegistry
+	schemas     schema.IRegistry
+	acl         *aclStore
+	publishes   *rateLimiter
+	connections atomic.Int32
+}
+
+// cfg returns the current config of the namespace.
+func (ns *namespace) cfg() NamespaceConfig {
+	return *ns.config.Load()
+}
+
+// storedBytes is the size of the messages kept by the topics of the
+// namespace.
+func (ns *namespace) storedBytes() int {
+	total := 0
+	for _, t := range ns.topics.list() {
+		total += t.stats().Bytes
+	}
+	return total
+}
+
+// acquireConnection counts a new subscription against the connection quota.
+// It reports false when the quota is used up.
+func (ns *namespace) acquireConnection() bool {
+	max := ns.cfg().Quotas.MaxConnections
+	for {
+		n := ns.connections.Load()
+		if max > 0 && int(n) >= max {
+			return false
+		}
+		if ns.connections.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+func (ns *namespace) releaseConnection() {
+	ns.connections.Add(-1)
+}
+
+func (ns *namespace) response() NamespaceResponse {
+	return NamespaceResponse{
+		Name:        ns.name,
+		Config:      ns.cfg(),
+		CreatedAt:   ns.createdAt,
+		Topics:      len(ns.topics.list()),
+		Bytes:       ns.storedBytes(),
+		Connections: int(ns.connections.Load()),
+	}
+}
+
+func (c NamespaceConfig) validate(topicDefaults TopicConfig) error {
+	q := c.Quotas
+	if q.MaxTopics < 0 || q.MaxBytes < 0 || q.MaxPublishRate < 0 || q.MaxConnections < 0 {
+		return fmt.Errorf("%w: quotas must not be negative", errInvalidNamespaceConfig)
+	}
+
+	if err := c.DeadLetter.Topic.inherit(topicDefaults).withDefaults().validate(); err != nil {
+		return fmt.Errorf("%w: dead letter topic: %v", errInvalidNamespaceConfig, err)
+	}
+
+	return nil
+}
+
+// namespaceRegistry is the set of namespaces known to the server. It is safe
+// for concurrent use.
+type namespaceRegistry struct {
+	mu         sync.RWMutex
+	namespaces map[string]*namespace
+}
+
+func newNamespaceRegistry() *namespaceRegistry {
+	return &namespaceRegistry{namespaces: make(map[string]*namespace)}
+}
+
+func (r *namespaceRegistry) get(name string) (*namespace, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ns, ok := r.namespaces[name]
+	return ns, ok
+}
+
+// create adds the namespace made by create, failing with errNamespaceExists
+// if the name is taken.
+func (r *namespaceRegistry) create(name string, create func() (*namespace, error)) (*namespace, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.namespaces[name]; ok {
+		return nil, errNamespaceExists
+	}
+
+	ns, err := create()
+	if err != nil {
+		return nil, err
+	}
+
+	r.namespaces[name] = ns
+	return ns, nil
+}
+
+func (r *namespaceRegistry) remove(name string) (*namespace, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	ns, ok := r.namespaces[name]
+	if ok {
+		delete(r.namespaces, name)
+	}
+	return ns, ok
+}
+
+// list returns a snapshot of the namespaces sorted by name.
+func (r *namespaceRegistry) list() []*namespace {
+	r.mu.RLock()
+	namespaces := make([]*namespace, 0, len(r.namespaces))
+	for _, ns := range r.namespaces {
+		namespaces = append(namespaces, ns)
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(namespaces, func(i, j int) bool {
+		return namespaces[i].name < namespaces[j].name
+	})
+
+	return namespaces
+}
+
+// allTopics returns the topics of every namespace.
+func (s *Server) allTopics() []*topic {
+	var topics []*topic
+	for _, ns := range s.namespaces.list() {
+		topics = append(topics, ns.topics.list()...)
+	}
+	return topics
+}
+
+func (s *Server) namespaceDir(name string) string {
+	if s.dataDir == "" {
+		return ""
+	}
+	// the default namespace keeps the layout of brokers without namespaces
+	if name == DefaultNamespace {
+		return s.dataDir
+	}
+	return filepath.Join(s.dataDir, "namespaces", url.PathEscape(name))
+}
+
+func (s *Server) maxTopics(cfg NamespaceConfig) int {
+	if cfg.Quotas.MaxTopics > 0 {
+		return cfg.Quotas.MaxTopics
+	}
+	return s.maxTopicsPerNamespace
+}
+
+// newNamespace makes a namespace without access control rules, see
+// enableACL.
+func (s *Server) newNamespace(name string, cfg NamespaceConfig, createdAt time.Time) *namespace {
+	ns := &namespace{
+		name:      name,
+		createdAt: createdAt,
+		dir:       s.namespaceDir(name),
+		topics:    newTopicRegistry(s.maxTopics(cfg)),
+		schemas:   schema.NewRegistry(),
+		publishes: newRateLimiter(cfg.Quotas.MaxPublishRate),
+	}
+	ns.config.Store(&cfg)
+	return ns
+}
+
+// enableACL gives the namespace its access control rules when authorization
+// is enabled. The static rules of the configuration belong to the default
+// namespace.
+func (s *Server) enableACL(ns *namespace) error {
+	if s.aclConfig == nil {
+		return nil
+	}
+
+	var static ACLConfig
+	if ns.name == DefaultNamespace {
+		static = *s.aclConfig
+	}
+
+	acl, err := newACLStore(static, ns.dir)
+	if err != nil {
+		return err
+	}
+	if err := acl.load(); err != nil {
+		return err
+	}
+
+	ns.acl = acl
+	return nil
+}
+
+func (s *Server) getNamespace(name string) (*namespace, error) {
+	ns, ok := s.namespaces.get(name)
+	if !ok {
+		return nil, errNamespaceNotFound
+	}
+	return ns, nil
+}
+
+func (s *Server) createNamespace(name string, cfg NamespaceConfig) (*namespace, error) {
+	if !topicNamePattern.MatchString(name) || name == "." || name == ".." {
+		return nil, fmt.Errorf("%w: invalid namespace name %q", errInvalidNamespaceConfig, name)
+	}
+
+	if err := cfg.validate(s.topicDefaults); err != nil {
+		return nil, err
+	}
+
+	ns, err := s.namespaces.create(name, func() (*namespace, error) {
+		ns := s.newNamespace(name, cfg, time.Now())
+		if err := s.enableACL(ns); err != nil {
+			return nil, err
+		}
+		return ns, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.persistNamespaces()
+
+	return ns, nil
+}
+
+func (s *Server) updateNamespaceConfig(name string, cfg NamespaceConfig) (*namespace, error) {
+	ns, err := s.getNamespace(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := cfg.validate(s.topicDefaults); err != nil {
+		return nil, err
+	}
+
+	ns.config.Store(&cfg)
+	ns.topics.setMax(s.maxTopics(cfg))
+	ns.publishes.setRate(cfg.Quotas.MaxPublishRate)
+
+	s.persistNamespaces()
+
+	return ns, nil
+}
+
+// deleteNamespace removes the namespace with its topics, messages and access
+// control rules.
+func (s *Server) deleteNamespace(name string) error {
+	if name == DefaultNamespace {
+		return errDefaultNamespace
+	}
+
+	ns, ok := s.namespaces.remove(name)
+	if !ok {
+		return errNamespaceNotFound
+	}
+
+	for _, t := range ns.topics.list() {
+		ns.topics.remove(t.name)
+		close(t.done)
+		t.close()
+		s.metrics.forget(t)
+	}
+
+	if ns.dir != "" {
+		if err := os.RemoveAll(ns.dir); err != nil {
+			slog.Error("could not remove namespace data", "namespace", name, "err", err)
+		}
+	}
+
+	s.persistNamespaces()
+	s.persistTopics()
+
+	return nil
+}
+
+type persistedNamespace struct {
+	Name      string          `json:"name"`
+	Config    NamespaceConfig `json:"config"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+type namespacesFile struct {
+	Namespaces []persistedNamespace `json:"namespaces"`
+}
+
+func (s *Server) persistNamespaces() {
+	if s.dataDir == "" {
+		return
+	}
+
+	s.persistMu.Lock()
+	defer s.persistMu.Unlock()
+
+	namespaces := s.namespaces.list()
+	file := namespacesFile{Namespaces: make([]persistedNamespace, 0, len(namespaces))}
+	for _, ns := range namespaces {
+		file.Namespaces = append(file.Namespaces, persistedNamespace{
+			Name:      ns.name,
+			Config:    ns.cfg(),
+			CreatedAt: ns.createdAt,
+		})
+	}
+
+	if err := writeFileAtomic(filepath.Join(s.dataDir, namespacesFileName), file, 0o644); err != nil {
+		slog.Error("could not persist namespaces", "err", err)
+	}
+}
+
+// loadNamespaces recreates the namespaces saved in the data directory and
+// restores the config of the default namespace.
+func (s *Server) loadNamespaces() error {
+	if s.dataDir == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(s.dataDir, namespacesFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var file namespacesFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("could not parse %s: %w", namespacesFileName, err)
+	}
+
+	for _, persisted := range file.Namespaces {
+		if persisted.Name == DefaultNamespace {
+			cfg := persisted.Config
+			s.defaultNamespace.config.Store(&cfg)
+			s.defaultNamespace.topics.setMax(s.maxTopics(cfg))
+			s.defaultNamespace.publishes.setRate(cfg.Quotas.MaxPublishRate)
+			continue
+		}
+
+		if _, err := s.namespaces.create(persisted.Name, func() (*namespace, error) {
+			ns := s.newNamespace(persisted.Name, persisted.Config, persisted.CreatedAt)
+			if err := s.enableACL(ns); err != nil {
+				return nil, err
+			}
+			return ns, nil
+		}); err != nil {
+			return fmt.Errorf("could not recover namespace %s: %w", persisted.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// writeFileAtomic writes v as JSON to a temporary file first so a crash
+// never leaves a partial file.
+func writeFileAtomic(path string, v any, perm os.FileMode) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(path+".tmp", data, perm); err != nil {
+		return err
+	}
+
+	return os.Rename(path+".tmp", path)
+}
+
+type namespaceKey struct{}
+
+// resolveNamespace attaches the namespace addressed by the URL to the
+// request, the default namespace for routes outside /ns/{ns}.
+func (s *Server) resolveNamespace(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := mux.Vars(r)["ns"]
+		if name == "" {
+			name = DefaultNamespace
+		}
+
+		ns, err := s.getNamespace(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), namespaceKey{}, ns)))
+	})
+}
+
+// namespace returns the namespace of the request.
+func (s *Server) namespace(r *http.Request) *namespace {
+	if ns, ok := r.Context().Value(namespaceKey{}).(*namespace); ok {
+		return ns
+	}
+	return s.defaultNamespace
+}
+
+// namespaceOfPath returns the namespace addressed by a request path.
+func namespaceOfPath(path string) string {
+	if rest, ok := strings.CutPrefix(path, "/ns/"); ok {
+		name, _, _ := strings.Cut(rest, "/")
+		if name, err := url.PathUnescape(name); err == nil {
+			return name
+		}
+	}
+	return DefaultNamespace
+}
+
+func (s *Server) GetNamespacesHandler(w http.ResponseWriter, r *http.Request) {
+	namespaces := s.namespaces.list()
+	response := GetNamespacesResponse{Namespaces: make([]NamespaceResponse, 0, len(namespaces))}
+	for _, ns := range namespaces {
+		response.Namespaces = append(response.Namespaces, ns.response())
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) CreateNamespaceHandler(w http.ResponseWriter, r *http.Request) {
+	var request CreateNamespaceRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		slog.Error("could not read request body", "err", err)
+		http.Error(w, "could not read request body", http.StatusBadRequest)
+		return
+	}
+
+	ns, err := s.createNamespace(request.Name, request.Config)
+	if err != nil {
+		writeNamespaceError(w, err)
+		return
+	}
+
+	slog.Info("created namespace", "namespace", ns.name)
+	s.audit(r, AuditNamespaceCreate, ns.name, nil, ns.cfg())
+
+	writeJSON(w, http.StatusCreated, ns.response())
+}
+
+func (s *Server) GetNamespaceHandler(w http.ResponseWriter, r *http.Request) {
+	ns, err := s.getNamespace(mux.Vars(r)["name"])
+	if err != nil {
+		writeNamespaceError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, ns.response())
+}
+
+func (s *Server) UpdateNamespaceConfigHandler(w http.ResponseWriter, r *http.Request) {
+	var config NamespaceConfig
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		slog.Error("could not read request body", "err", err)
+		http.Error(w, "could not read request body", http.StatusBadRequest)
+		return
+	}
+
+	before, err := s.getNamespace(mux.Vars(r)["name"])
+	if err != nil {
+		writeNamespaceError(w, err)
+		return
+	}
+	beforeConfig := before.cfg()
+
+	ns, err := s.updateNamespaceConfig(mux.Vars(r)["name"], config)
+	if err != nil {
+		writeNamespaceError(w, err)
+		return
+	}
+
+	slog.Info("updated namespace config", "namespace", ns.name)
+	s.audit(r, AuditNamespaceConfig, ns.name, beforeConfig, ns.cfg())
+
+	writeJSON(w, http.StatusOK, ns.response())
+}
+
+func (s *Server) DeleteNamespaceHandler(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+
+	ns, err := s.getNamespace(name)
+	if err != nil {
+		writeNamespaceError(w, err)
+		return
+	}
+	before := ns.response()
+
+	if err := s.deleteNamespace(name); err != nil {
+		writeNamespaceError(w, err)
+		return
+	}
+
+	slog.Info("deleted namespace", "namespace", name)
+	s.audit(r, AuditNamespaceDelete, name, before, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeNamespaceError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errNamespaceNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errNamespaceExists), errors.Is(err, errDefaultNamespace):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, errInvalidNamespaceConfig):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	default:
+		slog.Error("namespace operation failed", "err", err)
+		http.Error(w, "namespace operation failed", http.StatusInternalServerError)
+	}
+}
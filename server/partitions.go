@@ -0,0 +1,162 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdkelley02/message-queue/storage"
+)
+
+const (
+	PartitionerHash       = "hash"
+	PartitionerRoundRobin = "round-robin"
+)
+
+var errInvalidPartition = errors.New("invalid partition")
+
+// partition is an independent log within a topic. Each consumer group keeps
+// its own offsets into it, and messages are removed once every group has
+// committed them.
+type partition struct {
+	id       int
+	storage  storage.IStorage
+	replicas *replicaSet
+
+	mu     sync.Mutex
+	groups map[string]*groupOffsets
+	// committed are the messages every group committed that are still
+	// stored, see truncateCommitted
+	committed committedRecords
+}
+
+func newPartition(id int, partitionStorage storage.IStorage) *partition {
+	return &partition{
+		id:       id,
+		storage:  partitionStorage,
+		replicas: newReplicaSet(),
+		groups:   make(map[string]*groupOffsets),
+	}
+}
+
+// stats are the stats of the storage of the partition, without the
+// messages every group committed that are not truncated yet.
+func (p *partition) stats() storage.Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.statsLocked()
+}
+
+func (p *partition) statsLocked() storage.Stats {
+	stats := p.storage.Stats()
+	if p.committed.from == stats.LowWatermark && p.committed.to > stats.LowWatermark {
+		stats.LowWatermark = p.committed.to
+		stats.Count -= p.committed.count
+		stats.Bytes -= p.committed.bytes
+	}
+	return stats
+}
+
+func (p *partition) response() PartitionResponse {
+	stats := p.stats()
+
+	return PartitionResponse{
+		Id:            p.id,
+		Depth:         stats.Count,
+		Bytes:         stats.Bytes,
+		LowWatermark:  stats.LowWatermark,
+		HighWatermark: stats.HighWatermark,
+	}
+}
+
+func (s *Server) newPartitionStorage(ns *namespace, topicName string, cfg TopicConfig, id int) (storage.IStorage, error) {
+	if cfg.Storage != StorageFile {
+		return s.makeStorageFunc(), nil
+	}
+
+	if ns.dir == "" {
+		return nil, fmt.Errorf("%w: file storage requires a data directory", errInvalidTopicConfig)
+	}
+
+	return storage.NewFileStorage(filepath.Join(ns.topicDir(topicName), fmt.Sprintf("partition-%d.log", id)))
+}
+
+// selectPartition picks the partition for a published message. An explicit
+// partition wins, then the key hash for hash partitioned topics, and
+// round-robin otherwise.
+func (t *topic) selectPartition(req PublishRequest) (*partition, error) {
+	if req.Partition != nil {
+		if *req.Partition < 0 || *req.Partition >= len(t.partitions) {
+			return nil, fmt.Errorf("%w: %d", errInvalidPartition, *req.Partition)
+		}
+		return t.partitions[*req.Partition], nil
+	}
+
+	if t.cfg().Partitioner == PartitionerHash && req.Key != "" {
+		h := fnv.New32a()
+		h.Write([]byte(req.Key))
+		return t.partitions[int(h.Sum32()%uint32(len(t.partitions)))], nil
+	}
+
+	next := t.nextPartition.Add(1) - 1
+	return t.partitions[int(next%uint32(len(t.partitions)))], nil
+}
+
+// parsePartitions reads the comma separated partitions query parameter. All
+// partitions are returned when it is missing.
+func parsePartitions(r *http.Request, t *topic) ([]int, error) {
+	param := r.URL.Query().Get("partitions")
+	if param == "" {
+		ids := make([]int, len(t.partitions))
+		for i := range ids {
+			ids[i] = i
+		}
+		return ids, nil
+	}
+
+	seen := make(map[int]bool)
+	ids := make([]int, 0)
+	for _, field := range strings.Split(param, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || id < 0 || id >= len(t.partitions) {
+			return nil, fmt.Errorf("%w: %q", errInvalidPartition, field)
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+
+	return ids, nil
+}
+
+// claim returns the next message of the given partitions for the group,
+// starting at the partition after the one that was last delivered from so
+// that a busy partition cannot starve the others.
+func (t *topic) claim(group string, ids []int, next *int) (Message, storage.Record, bool) {
+	now := time.Now()
+	for i := 0; i < len(ids); i++ {
+		id := ids[(*next+i)%len(ids)]
+
+		if offset, attempt, record, ok := t.partitions[id].claim(group, now); ok {
+			*next = (*next + i + 1) % len(ids)
+			msg := newMessage(t.name, id, offset)
+			msg.Attempt = attempt
+			return msg, record, true
+		}
+	}
+
+	return Message{}, storage.Record{}, false
+}
+
+// ack commits msg for the group.
+func (t *topic) ack(group string, msg Message) error {
+	return t.partitions[msg.Partition].ack(group, msg.Offset)
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"context"
+	"net/http"
+)
+
+const (
+	AuthMethodNone   = "none"
+	AuthMethodTLS    = "tls"
+	AuthMethodAPIKey = "apikey"
+	AuthMethodJWT    = "jwt"
+)
+
+// Principal is the identity a request was made with.
+type Principal struct {
+	Name   string   `json:"name"`
+	Method string   `json:"method"`
+	Roles  []string `json:"roles,omitempty"`
+}
+
+var anonymous = Principal{Method: AuthMethodNone}
+
+type principalKey struct{}
+
+func withPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// principalFromContext returns the principal of a request, which is
+// anonymous unless the request authenticated.
+func principalFromContext(ctx context.Context) Principal {
+	if p, ok := ctx.Value(principalKey{}).(Principal); ok {
+		return p
+	}
+	return anonymous
+}
+
+// WhoAmIHandler reports the principal of the request.
+func (s *Server) WhoAmIHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, principalFromContext(r.Context()))
+}
@@ -0,0 +1,868 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// raftNode is a small implementation of the Raft consensus algorithm. The
+// members of a cluster elect a leader among them, which appends commands to
+// a log, replicates it to the other members and commits an entry once a
+// majority has it. Every member applies the committed entries in order to
+// its raftFSM, so they all end up in the same state.
+//
+// Membership changes are log entries as well. They take effect as soon as
+// they are in the log, and only one may be in progress at a time. When the
+// log grows too long the applied entries are replaced by a snapshot of the
+// state machine, which is sent to members that are too far behind.
+
+const (
+	maxRaftLogEntries    = 1024
+	maxRaftAppendEntries = 256
+)
+
+var (
+	errMembershipChanging = errors.New("a membership change is in progress")
+	errEntryLost          = errors.New("the entry was replaced by another leader")
+)
+
+// raftFSM is the state machine the log is applied to.
+type raftFSM interface {
+	apply(command json.RawMessage) error
+	snapshot() (json.RawMessage, error)
+	restore(state json.RawMessage) error
+}
+
+// raftTransport sends the messages of a node to the node at addr.
+type raftTransport interface {
+	requestVote(ctx context.Context, addr string, req RaftVoteRequest) (RaftVoteResponse, error)
+	appendEntries(ctx context.Context, addr string, req RaftAppendRequest) (RaftAppendResponse, error)
+}
+
+type raftNode struct {
+	id              string
+	fsm             raftFSM
+	transport       raftTransport
+	heartbeat       time.Duration
+	electionTimeout time.Duration
+	maxLogEntries   int
+	// path is the file the state is kept in, it is only kept in memory when
+	// empty
+	path string
+
+	// applyMu serializes the calls into the state machine
+	applyMu sync.Mutex
+
+	mu               sync.Mutex
+	members          map[string]string
+	role             string
+	term             int
+	votedFor         string
+	leaderId         string
+	leaderAddr       string
+	snapshot         RaftSnapshot
+	log              []RaftEntry
+	commitIndex      int
+	lastApplied      int
+	electionDeadline time.Time
+	// leadIndex is the first entry of the term the node leads
+	leadIndex int
+	peers     map[string]*raftPeer
+	waiters   map[int]raftWaiter
+	// changed is closed and replaced whenever the role or leader changes
+	changed chan struct{}
+
+	kick    chan struct{}
+	applyCh chan struct{}
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+}
+
+// raftPeer is what the leader knows about another member.
+type raftPeer struct {
+	nextIndex   int
+	matchIndex  int
+	inflight    bool
+	lastContact time.Time
+}
+
+type raftWaiter struct {
+	term int
+	done chan error
+}
+
+type raftFile struct {
+	Term     int          `json:"term"`
+	VotedFor string       `json:"votedFor,omitempty"`
+	Snapshot RaftSnapshot `json:"snapshot"`
+	Log      []RaftEntry  `json:"log"`
+}
+
+// newRaftNode makes a node that starts with members unless path holds the
+// state of a previous run. A node that is not one of the members waits
+// until a leader adds it.
+func newRaftNode(id string, members map[string]string, fsm raftFSM, transport raftTransport, heartbeat time.Duration, electionTimeout time.Duration, path string) (*raftNode, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &raftNode{
+		id:              id,
+		fsm:             fsm,
+		transport:       transport,
+		heartbeat:       heartbeat,
+		electionTimeout: electionTimeout,
+		maxLogEntries:   maxRaftLogEntries,
+		path:            path,
+		role:            RoleFollower,
+		snapshot:        RaftSnapshot{Members: members},
+		waiters:         make(map[int]raftWaiter),
+		changed:         make(chan struct{}),
+		kick:            make(chan struct{}, 1),
+		applyCh:         make(chan struct{}, 1),
+		ctx:             ctx,
+		cancel:          cancel,
+	}
+
+	if err := n.load(); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	n.members = n.latestMembersLocked()
+	n.resetElectionLocked()
+
+	return n, nil
+}
+
+func (n *raftNode) load() error {
+	if n.path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(n.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var file raftFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("could not parse %s: %w", n.path, err)
+	}
+
+	if file.Snapshot.Index > 0 {
+		if err := n.fsm.restore(file.Snapshot.State); err != nil {
+			return fmt.Errorf("could not restore raft snapshot: %w", err)
+		}
+	}
+
+	n.term = file.Term
+	n.votedFor = file.VotedFor
+	n.snapshot = file.Snapshot
+	n.log = file.Log
+	n.commitIndex = file.Snapshot.Index
+	n.lastApplied = file.Snapshot.Index
+	return nil
+}
+
+// latestMembersLocked returns the latest membership in the log, which is
+// in effect whether it is committed or not.
+func (n *raftNode) latestMembersLocked() map[string]string {
+	members := n.snapshot.Members
+	for _, e := range n.log {
+		if e.Members != nil {
+			members = e.Members
+		}
+	}
+	return members
+}
+
+func (n *raftNode) persistLocked() {
+	if n.path == "" {
+		return
+	}
+
+	file := raftFile{Term: n.term, VotedFor: n.votedFor, Snapshot: n.snapshot, Log: n.log}
+	if err := writeFileAtomic(n.path, file, 0o600); err != nil {
+		slog.Error("could not save raft state", "err", err)
+	}
+}
+
+func (n *raftNode) start() {
+	n.wg.Add(2)
+	go func() {
+		defer n.wg.Done()
+		n.run()
+	}()
+	go func() {
+		defer n.wg.Done()
+		n.applyLoop()
+	}()
+}
+
+func (n *raftNode) stop() {
+	n.cancel()
+	n.wg.Wait()
+}
+
+func (n *raftNode) run() {
+	ticker := time.NewTicker(n.heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-ticker.C:
+			n.tick()
+		case <-n.kick:
+			n.replicate()
+		}
+	}
+}
+
+// tick sends heartbeats as the leader and starts an election as anybody
+// else when the leader was not heard of for too long.
+func (n *raftNode) tick() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	now := time.Now()
+	switch {
+	case n.role == RoleLeader && !n.quorumContactLocked(now):
+		slog.Warn("lost contact with a majority of the cluster, stepping down", "node", n.id, "term", n.term)
+		n.becomeFollowerLocked(n.term, "", "")
+	case n.role == RoleLeader:
+		n.replicateLocked()
+	case now.After(n.electionDeadline) && n.members[n.id] != "":
+		n.startElectionLocked()
+	}
+}
+
+func (n *raftNode) resetElectionLocked() {
+	jitter := time.Duration(rand.Int63n(int64(n.electionTimeout)))
+	n.electionDeadline = time.Now().Add(n.electionTimeout + jitter)
+}
+
+// notifyLocked wakes up whoever waits for the role or leader to change.
+func (n *raftNode) notifyLocked() {
+	close(n.changed)
+	n.changed = make(chan struct{})
+}
+
+func (n *raftNode) lastIndexLocked() int {
+	return n.snapshot.Index + len(n.log)
+}
+
+// termAtLocked returns the term of the entry at index, -1 when the node
+// does not have it.
+func (n *raftNode) termAtLocked(index int) int {
+	switch {
+	case index == n.snapshot.Index:
+		return n.snapshot.Term
+	case index < n.snapshot.Index || index > n.lastIndexLocked():
+		return -1
+	default:
+		return n.log[index-n.snapshot.Index-1].Term
+	}
+}
+
+func (n *raftNode) lastTermLocked() int {
+	return n.termAtLocked(n.lastIndexLocked())
+}
+
+func (n *raftNode) quorumLocked(votes int) bool {
+	return votes > len(n.members)/2
+}
+
+func (n *raftNode) quorumContactLocked(now time.Time) bool {
+	contacts := 0
+	for id := range n.members {
+		if id == n.id {
+			contacts++
+		} else if p, ok := n.peers[id]; ok && now.Sub(p.lastContact) <= n.electionTimeout {
+			contacts++
+		}
+	}
+	return n.quorumLocked(contacts)
+}
+
+func (n *raftNode) becomeFollowerLocked(term int, leaderId string, leaderAddr string) {
+	if term > n.term {
+		n.term = term
+		n.votedFor = ""
+		n.persistLocked()
+	}
+
+	changed := n.role != RoleFollower || n.leaderId != leaderId
+	n.role = RoleFollower
+	n.leaderId = leaderId
+	n.leaderAddr = leaderAddr
+	n.peers = nil
+
+	// entries that were proposed here may still be committed by the next
+	// leader, but nobody waits for them anymore
+	for index, w := range n.waiters {
+		w.done <- errNotLeader
+		delete(n.waiters, index)
+	}
+
+	if changed {
+		n.notifyLocked()
+	}
+}
+
+func (n *raftNode) startElectionLocked() {
+	n.term++
+	n.role = RoleCandidate
+	n.votedFor = n.id
+	n.leaderId = ""
+	n.leaderAddr = ""
+	n.persistLocked()
+	n.resetElectionLocked()
+	n.notifyLocked()
+
+	slog.Info("starting election", "node", n.id, "term", n.term)
+
+	votes := 1
+	if n.quorumLocked(votes) {
+		n.becomeLeaderLocked()
+		return
+	}
+
+	req := RaftVoteRequest{
+		Term:         n.term,
+		CandidateId:  n.id,
+		LastLogIndex: n.lastIndexLocked(),
+		LastLogTerm:  n.lastTermLocked(),
+	}
+
+	for id, addr := range n.members {
+		if id == n.id {
+			continue
+		}
+
+		go func(addr string) {
+			ctx, cancel := context.WithTimeout(n.ctx, n.electionTimeout)
+			defer cancel()
+
+			resp, err := n.transport.requestVote(ctx, addr, req)
+			if err != nil {
+				return
+			}
+
+			n.mu.Lock()
+			defer n.mu.Unlock()
+
+			if resp.Term > n.term {
+				n.becomeFollowerLocked(resp.Term, "", "")
+				return
+			}
+			if n.role != RoleCandidate || n.term != req.Term || !resp.Granted {
+				return
+			}
+
+			votes++
+			if n.quorumLocked(votes) {
+				n.becomeLeaderLocked()
+			}
+		}(addr)
+	}
+}
+
+func (n *raftNode) becomeLeaderLocked() {
+	slog.Info("elected leader", "node", n.id, "term", n.term)
+
+	n.role = RoleLeader
+	n.leaderId = n.id
+	n.leaderAddr = n.members[n.id]
+
+	// entries of earlier terms are only committed with one of this term,
+	// which an empty entry provides right away
+	n.log = append(n.log, RaftEntry{Index: n.lastIndexLocked() + 1, Term: n.term})
+	n.leadIndex = n.lastIndexLocked()
+	n.persistLocked()
+
+	n.peers = make(map[string]*raftPeer)
+	n.updatePeersLocked()
+	n.advanceCommitLocked()
+	n.notifyLocked()
+	n.replicateLocked()
+}
+
+// updatePeersLocked tracks the members the leader replicates to.
+func (n *raftNode) updatePeersLocked() {
+	now := time.Now()
+	for id := range n.members {
+		if _, ok := n.peers[id]; !ok && id != n.id {
+			n.peers[id] = &raftPeer{nextIndex: n.lastIndexLocked() + 1, lastContact: now}
+		}
+	}
+	for id := range n.peers {
+		if _, ok := n.members[id]; !ok {
+			delete(n.peers, id)
+		}
+	}
+}
+
+func (n *raftNode) replicate() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.role == RoleLeader {
+		n.replicateLocked()
+	}
+}
+
+// replicateLocked sends every member without a request in flight the
+// entries it is missing, or a heartbeat when it has them all.
+func (n *raftNode) replicateLocked() {
+	for id, p := range n.peers {
+		if p.inflight {
+			continue
+		}
+		p.inflight = true
+		go n.sendAppend(id)
+	}
+}
+
+func (n *raftNode) triggerReplication() {
+	select {
+	case n.kick <- struct{}{}:
+	default:
+	}
+}
+
+func (n *raftNode) sendAppend(id string) {
+	n.mu.Lock()
+	p, ok := n.peers[id]
+	if !ok || n.role != RoleLeader {
+		n.mu.Unlock()
+		return
+	}
+
+	req := RaftAppendRequest{
+		Term:         n.term,
+		LeaderId:     n.id,
+		LeaderAddr:   n.members[n.id],
+		LeaderCommit: n.commitIndex,
+	}
+	from := p.nextIndex
+	if from <= n.snapshot.Index {
+		// the entries the member needs are gone, it gets the snapshot
+		// they were compacted into
+		snapshot := n.snapshot
+		req.Snapshot = &snapshot
+		from = n.snapshot.Index + 1
+	}
+	req.PrevLogIndex = from - 1
+	req.PrevLogTerm = n.termAtLocked(from - 1)
+	entries := n.log[from-n.snapshot.Index-1:]
+	if len(entries) > maxRaftAppendEntries {
+		entries = entries[:maxRaftAppendEntries]
+	}
+	req.Entries = append([]RaftEntry{}, entries...)
+	addr := n.members[id]
+	n.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(n.ctx, n.electionTimeout)
+	resp, err := n.transport.appendEntries(ctx, addr, req)
+	cancel()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	p, ok = n.peers[id]
+	if !ok {
+		return
+	}
+	p.inflight = false
+
+	if err != nil {
+		return
+	}
+	if resp.Term > n.term {
+		n.becomeFollowerLocked(resp.Term, "", "")
+		return
+	}
+	if n.role != RoleLeader || n.term != req.Term {
+		return
+	}
+
+	p.lastContact = time.Now()
+	if resp.Success {
+		p.matchIndex = max(p.matchIndex, req.PrevLogIndex+len(req.Entries))
+		p.nextIndex = p.matchIndex + 1
+		n.advanceCommitLocked()
+	} else {
+		p.nextIndex = max(1, min(p.nextIndex-1, resp.LastLogIndex+1))
+	}
+
+	if p.nextIndex <= n.lastIndexLocked() {
+		n.triggerReplication()
+	}
+}
+
+// advanceCommitLocked commits the entries of the current term a majority
+// of the members has.
+func (n *raftNode) advanceCommitLocked() {
+	for index := n.lastIndexLocked(); index > n.commitIndex; index-- {
+		if n.termAtLocked(index) != n.term {
+			break
+		}
+
+		count := 0
+		for id := range n.members {
+			if id == n.id {
+				count++
+			} else if p, ok := n.peers[id]; ok && p.matchIndex >= index {
+				count++
+			}
+		}
+
+		if n.quorumLocked(count) {
+			n.commitIndex = index
+			n.triggerApply()
+			return
+		}
+	}
+}
+
+func (n *raftNode) triggerApply() {
+	select {
+	case n.applyCh <- struct{}{}:
+	default:
+	}
+}
+
+func (n *raftNode) handleVote(req RaftVoteRequest) RaftVoteResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if req.Term > n.term {
+		n.becomeFollowerLocked(req.Term, "", "")
+	}
+
+	upToDate := req.LastLogTerm > n.lastTermLocked() ||
+		(req.LastLogTerm == n.lastTermLocked() && req.LastLogIndex >= n.lastIndexLocked())
+	granted := req.Term == n.term && (n.votedFor == "" || n.votedFor == req.CandidateId) && upToDate
+	if granted {
+		n.votedFor = req.CandidateId
+		n.persistLocked()
+		n.resetElectionLocked()
+	}
+
+	return RaftVoteResponse{Term: n.term, Granted: granted}
+}
+
+func (n *raftNode) handleAppend(req RaftAppendRequest) RaftAppendResponse {
+	if req.Snapshot != nil {
+		n.applyMu.Lock()
+		defer n.applyMu.Unlock()
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if req.Term < n.term {
+		return RaftAppendResponse{Term: n.term, LastLogIndex: n.lastIndexLocked()}
+	}
+	if req.Term > n.term || n.role != RoleFollower || n.leaderId != req.LeaderId {
+		n.becomeFollowerLocked(req.Term, req.LeaderId, req.LeaderAddr)
+	}
+	n.resetElectionLocked()
+
+	if req.Snapshot != nil && req.Snapshot.Index > n.lastApplied {
+		if err := n.fsm.restore(req.Snapshot.State); err != nil {
+			slog.Error("could not restore raft snapshot", "err", err)
+			return RaftAppendResponse{Term: n.term, LastLogIndex: n.lastIndexLocked()}
+		}
+		n.snapshot = *req.Snapshot
+		n.log = nil
+		n.members = n.snapshot.Members
+		n.commitIndex = max(n.commitIndex, n.snapshot.Index)
+		n.lastApplied = n.snapshot.Index
+		n.persistLocked()
+	}
+
+	entries := req.Entries
+	prevIndex, prevTerm := req.PrevLogIndex, req.PrevLogTerm
+	if prevIndex < n.snapshot.Index {
+		// the node compacted some of the entries already
+		for len(entries) > 0 && entries[0].Index <= n.snapshot.Index {
+			entries = entries[1:]
+		}
+		prevIndex, prevTerm = n.snapshot.Index, n.snapshot.Term
+	}
+	if n.termAtLocked(prevIndex) != prevTerm {
+		return RaftAppendResponse{Term: n.term, LastLogIndex: min(n.lastIndexLocked(), prevIndex-1)}
+	}
+
+	changed := false
+	for _, e := range entries {
+		if e.Index <= n.lastIndexLocked() {
+			if n.termAtLocked(e.Index) == e.Term {
+				continue
+			}
+			// a conflicting entry and everything after it were never
+			// committed
+			n.log = n.log[:e.Index-n.snapshot.Index-1]
+		}
+		n.log = append(n.log, e)
+		changed = true
+	}
+	if changed {
+		n.members = n.latestMembersLocked()
+		n.persistLocked()
+	}
+
+	if last := prevIndex + len(entries); req.LeaderCommit > n.commitIndex && last > n.commitIndex {
+		n.commitIndex = min(req.LeaderCommit, last)
+		n.triggerApply()
+	}
+
+	return RaftAppendResponse{Term: n.term, Success: true, LastLogIndex: n.lastIndexLocked()}
+}
+
+func (n *raftNode) applyLoop() {
+	for {
+		select {
+		case <-n.ctx.Done():
+			return
+		case <-n.applyCh:
+			n.applyCommitted()
+		}
+	}
+}
+
+// applyCommitted applies the committed entries to the state machine and
+// compacts the log when it grew too long.
+func (n *raftNode) applyCommitted() {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+
+	for {
+		n.mu.Lock()
+		if n.lastApplied >= n.commitIndex {
+			n.mu.Unlock()
+			break
+		}
+		e := n.log[n.lastApplied-n.snapshot.Index]
+		n.mu.Unlock()
+
+		var err error
+		if e.Command != nil {
+			err = n.fsm.apply(e.Command)
+		}
+
+		n.mu.Lock()
+		n.lastApplied = e.Index
+		if e.Members != nil {
+			n.applyMembersLocked(e.Members)
+		}
+		if w, ok := n.waiters[e.Index]; ok {
+			if w.term != e.Term {
+				err = errEntryLost
+			}
+			w.done <- err
+			delete(n.waiters, e.Index)
+		}
+		n.mu.Unlock()
+	}
+
+	n.mu.Lock()
+	compact := len(n.log) > n.maxLogEntries && n.lastApplied > n.snapshot.Index
+	n.mu.Unlock()
+	if !compact {
+		return
+	}
+
+	state, err := n.fsm.snapshot()
+	if err != nil {
+		slog.Error("could not snapshot raft state", "err", err)
+		return
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// the members in effect at the last applied entry, later ones are
+	// still in the log
+	members := n.snapshot.Members
+	for _, e := range n.log[:n.lastApplied-n.snapshot.Index] {
+		if e.Members != nil {
+			members = e.Members
+		}
+	}
+
+	index := n.lastApplied
+	term := n.termAtLocked(index)
+	n.log = append([]RaftEntry{}, n.log[index-n.snapshot.Index:]...)
+	n.snapshot = RaftSnapshot{Index: index, Term: term, Members: members, State: state}
+	n.persistLocked()
+}
+
+// applyMembersLocked makes a committed membership change take effect on
+// the leader, which stops leading when it was removed.
+func (n *raftNode) applyMembersLocked(members map[string]string) {
+	if n.role != RoleLeader {
+		return
+	}
+	if _, ok := members[n.id]; !ok {
+		slog.Info("removed from the cluster, stepping down", "node", n.id)
+		n.becomeFollowerLocked(n.term, "", "")
+		return
+	}
+	n.updatePeersLocked()
+}
+
+// propose appends command to the log and waits until it is applied.
+func (n *raftNode) propose(ctx context.Context, command json.RawMessage) error {
+	return n.append(ctx, RaftEntry{Command: command})
+}
+
+// changeMembers proposes the members change returns.
+func (n *raftNode) changeMembers(ctx context.Context, change func(members map[string]string) error) error {
+	n.mu.Lock()
+	for _, e := range n.log[n.commitIndex-n.snapshot.Index:] {
+		if e.Members != nil {
+			n.mu.Unlock()
+			return errMembershipChanging
+		}
+	}
+
+	members := make(map[string]string, len(n.members)+1)
+	for id, addr := range n.members {
+		members[id] = addr
+	}
+	n.mu.Unlock()
+
+	if err := change(members); err != nil {
+		return err
+	}
+
+	return n.append(ctx, RaftEntry{Members: members})
+}
+
+func (n *raftNode) append(ctx context.Context, e RaftEntry) error {
+	n.mu.Lock()
+	if n.role != RoleLeader {
+		n.mu.Unlock()
+		return errNotLeader
+	}
+
+	e.Index = n.lastIndexLocked() + 1
+	e.Term = n.term
+	n.log = append(n.log, e)
+	n.persistLocked()
+
+	// the leader counts with the new members as soon as they are in the
+	// log, like every other member
+	if e.Members != nil {
+		n.members = e.Members
+		n.updatePeersLocked()
+	}
+
+	done := make(chan error, 1)
+	n.waiters[e.Index] = raftWaiter{term: e.Term, done: done}
+	n.advanceCommitLocked()
+	n.mu.Unlock()
+
+	n.triggerReplication()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		n.mu.Lock()
+		delete(n.waiters, e.Index)
+		n.mu.Unlock()
+		return ctx.Err()
+	case <-n.ctx.Done():
+		return errShuttingDown
+	}
+}
+
+// leadership returns the role and term of the node and the address of the
+// leader it knows of.
+func (n *raftNode) leadership() (string, int, string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.role, n.term, n.leaderAddr
+}
+
+func (n *raftNode) snapshotIndex() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.snapshot.Index
+}
+
+// raftStatus is the state of a node as of a moment.
+type raftStatus struct {
+	id          string
+	role        string
+	term        int
+	leaderId    string
+	leaderAddr  string
+	commitIndex int
+	lastApplied int
+	lastIndex   int
+	// ready is set on a leader once it applied every entry of earlier
+	// terms
+	ready   bool
+	members []raftMemberStatus
+	changed <-chan struct{}
+}
+
+type raftMemberStatus struct {
+	id          string
+	addr        string
+	matchIndex  int
+	lastContact time.Time
+}
+
+func (n *raftNode) status() raftStatus {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	status := raftStatus{
+		id:          n.id,
+		role:        n.role,
+		term:        n.term,
+		leaderId:    n.leaderId,
+		leaderAddr:  n.leaderAddr,
+		commitIndex: n.commitIndex,
+		lastApplied: n.lastApplied,
+		lastIndex:   n.lastIndexLocked(),
+		ready:       n.role == RoleLeader && n.lastApplied >= n.leadIndex,
+		members:     make([]raftMemberStatus, 0, len(n.members)),
+		changed:     n.changed,
+	}
+
+	for id, addr := range n.members {
+		member := raftMemberStatus{id: id, addr: addr}
+		if id == n.id {
+			member.matchIndex = n.lastIndexLocked()
+		} else if p, ok := n.peers[id]; ok {
+			member.matchIndex = p.matchIndex
+			member.lastContact = p.lastContact
+		}
+		status.members = append(status.members, member)
+	}
+	sort.Slice(status.members, func(i, j int) bool {
+		return status.members[i].id < status.members[j].id
+	})
+
+	return status
+}
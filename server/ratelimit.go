@@ -0,0 +1,392 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket that allows rate events per second on
+// average and bursts of up to a second's worth. A zero rate allows
+// everything.
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64) *rateLimiter {
+	return &rateLimiter{rate: rate, tokens: burst(rate)}
+}
+
+func burst(rate float64) float64 {
+	if rate < 1 {
+		return 1
+	}
+	return rate
+}
+
+func (l *rateLimiter) refillLocked(now time.Time) {
+	if now.Before(l.last) {
+		return
+	}
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if max := burst(l.rate); l.tokens > max {
+			l.tokens = max
+		}
+	}
+	l.last = now
+}
+
+// delayLocked is how long it takes until n tokens are available. Costs above
+// the burst only wait for a full bucket so that they can pass at all.
+func (l *rateLimiter) delayLocked(n float64) time.Duration {
+	need := math.Min(n, burst(l.rate))
+	if l.rate <= 0 || l.tokens >= need {
+		return 0
+	}
+	return time.Duration((need - l.tokens) / l.rate * float64(time.Second))
+}
+
+// allow takes a token if one is available.
+func (l *rateLimiter) allow(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate <= 0 {
+		return true
+	}
+
+	l.refillLocked(now)
+	if l.delayLocked(1) > 0 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// refund gives back a token allow took for an event that did not happen.
+func (l *rateLimiter) refund() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate <= 0 {
+		return
+	}
+	l.tokens = min(l.tokens+1, burst(l.rate))
+}
+
+// delay returns how long it takes until n tokens are available.
+func (l *rateLimiter) delay(now time.Time, n float64) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refillLocked(now)
+	return l.delayLocked(n)
+}
+
+// take spends n tokens, going into debt when there are not enough. The debt
+// delays whoever comes next.
+func (l *rateLimiter) take(now time.Time, n float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate <= 0 {
+		return
+	}
+	l.refillLocked(now)
+	l.tokens -= n
+}
+
+// available returns the tokens left, negative when in debt.
+func (l *rateLimiter) available(now time.Time) float64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refillLocked(now)
+	return l.tokens
+}
+
+// setRate changes the rate, keeping the tokens that are left.
+func (l *rateLimiter) setRate(rate float64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate <= 0 || l.tokens > burst(rate) {
+		l.tokens = burst(rate)
+	}
+	l.rate = rate
+}
+
+// RateLimit bounds throughput in messages and bytes per second. Zero means no
+// limit.
+type RateLimit struct {
+	MessagesPerSecond float64 `json:"messagesPerSecond,omitempty"`
+	BytesPerSecond    float64 `json:"bytesPerSecond,omitempty"`
+}
+
+func (l RateLimit) enabled() bool {
+	return l.MessagesPerSecond > 0 || l.BytesPerSecond > 0
+}
+
+// RateLimits are the limits of one direction. Every principal, client
+// address and topic gets a bucket of its own. Anonymous requests are only
+// limited by address and topic.
+type RateLimits struct {
+	Principal RateLimit
+	ClientIP  RateLimit
+	Topic     RateLimit
+}
+
+// RateLimitConfig limits how fast messages are published and delivered.
+// Publishes over a limit are rejected, deliveries over a limit are slowed
+// down.
+type RateLimitConfig struct {
+	Publish RateLimits
+	Consume RateLimits
+}
+
+var errInvalidRateLimit = errors.New("invalid rate limit")
+
+func (c RateLimitConfig) Validate() error {
+	for _, limits := range []RateLimits{c.Publish, c.Consume} {
+		for _, limit := range []RateLimit{limits.Principal, limits.ClientIP, limits.Topic} {
+			if limit.MessagesPerSecond < 0 || limit.BytesPerSecond < 0 {
+				return fmt.Errorf("%w: rates must not be negative", errInvalidRateLimit)
+			}
+		}
+	}
+	return nil
+}
+
+// idleBucketTimeout is how long a full bucket is kept after its last use.
+const idleBucketTimeout = time.Minute
+
+// bucket limits a single principal, client address or topic.
+type bucket struct {
+	messages *rateLimiter
+	bytes    *rateLimiter
+	used     time.Time
+}
+
+func (b *bucket) delay(now time.Time, messages int, bytes int) time.Duration {
+	return max(b.messages.delay(now, float64(messages)), b.bytes.delay(now, float64(bytes)))
+}
+
+func (b *bucket) take(now time.Time, messages int, bytes int) {
+	b.messages.take(now, float64(messages))
+	b.bytes.take(now, float64(bytes))
+}
+
+// full reports whether the bucket is as good as a new one.
+func (b *bucket) full(now time.Time) bool {
+	return b.delay(now, math.MaxInt, math.MaxInt) == 0
+}
+
+// limiterSet holds the buckets of one kind of key.
+type limiterSet struct {
+	kind      string
+	limit     RateLimit
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// get returns the bucket of key, or nil when the set does not limit
+// anything.
+func (s *limiterSet) get(key string, now time.Time) *bucket {
+	if key == "" || !s.limit.enabled() {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// drop the buckets of clients that went away so the set does not grow
+	// without bound
+	if now.Sub(s.lastSweep) > idleBucketTimeout {
+		for k, b := range s.buckets {
+			if now.Sub(b.used) > idleBucketTimeout && b.full(now) {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &bucket{
+			messages: newRateLimiter(s.limit.MessagesPerSecond),
+			bytes:    newRateLimiter(s.limit.BytesPerSecond),
+		}
+		s.buckets[key] = b
+	}
+	b.used = now
+	return b
+}
+
+func (s *limiterSet) list(direction string, now time.Time) []RateLimiterResponse {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	limiters := make([]RateLimiterResponse, 0, len(s.buckets))
+	for key, b := range s.buckets {
+		limiter := RateLimiterResponse{Direction: direction, Kind: s.kind, Key: key, Limit: s.limit}
+		if s.limit.MessagesPerSecond > 0 {
+			limiter.MessageTokens = b.messages.available(now)
+		}
+		if s.limit.BytesPerSecond > 0 {
+			limiter.ByteTokens = b.bytes.available(now)
+		}
+		limiters = append(limiters, limiter)
+	}
+	return limiters
+}
+
+// rateLimitKeys are what a publish or delivery is counted against.
+type rateLimitKeys struct {
+	principal string
+	clientIP  string
+	topic     string
+}
+
+func rateLimitKeysOf(r *http.Request, ns *namespace, topic string) rateLimitKeys {
+	return rateLimitKeys{
+		principal: principalFromContext(r.Context()).Name,
+		clientIP:  clientIP(r),
+		topic:     ns.name + "/" + topic,
+	}
+}
+
+// clientIP returns the address the request came from, without the port.
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// rateLimits are the limits of one direction.
+type rateLimits struct {
+	direction string
+	principal *limiterSet
+	clientIP  *limiterSet
+	topic     *limiterSet
+}
+
+func newRateLimits(direction string, cfg RateLimits) *rateLimits {
+	set := func(kind string, limit RateLimit) *limiterSet {
+		return &limiterSet{kind: kind, limit: limit, buckets: make(map[string]*bucket)}
+	}
+	return &rateLimits{
+		direction: direction,
+		principal: set(RateLimitPrincipal, cfg.Principal),
+		clientIP:  set(RateLimitClientIP, cfg.ClientIP),
+		topic:     set(RateLimitTopic, cfg.Topic),
+	}
+}
+
+func (l *rateLimits) buckets(keys rateLimitKeys, now time.Time) []*bucket {
+	var buckets []*bucket
+	for _, b := range []*bucket{
+		l.principal.get(keys.principal, now),
+		l.clientIP.get(keys.clientIP, now),
+		l.topic.get(keys.topic, now),
+	} {
+		if b != nil {
+			buckets = append(buckets, b)
+		}
+	}
+	return buckets
+}
+
+// tryTake counts a message of size bytes when every bucket has room for it,
+// and otherwise returns how long to wait before trying again.
+func (l *rateLimits) tryTake(keys rateLimitKeys, size int, now time.Time) time.Duration {
+	buckets := l.buckets(keys, now)
+
+	var wait time.Duration
+	for _, b := range buckets {
+		wait = max(wait, b.delay(now, 1, size))
+	}
+	if wait > 0 {
+		return wait
+	}
+
+	for _, b := range buckets {
+		b.take(now, 1, size)
+	}
+	return 0
+}
+
+// wait returns how long to hold back the next delivery until no bucket is
+// in debt.
+func (l *rateLimits) wait(keys rateLimitKeys, now time.Time) time.Duration {
+	var wait time.Duration
+	for _, b := range l.buckets(keys, now) {
+		wait = max(wait, b.delay(now, 1, 0))
+	}
+	return wait
+}
+
+// take counts a delivered message of size bytes.
+func (l *rateLimits) take(keys rateLimitKeys, size int, now time.Time) {
+	for _, b := range l.buckets(keys, now) {
+		b.take(now, 1, size)
+	}
+}
+
+func (l *rateLimits) list(now time.Time) []RateLimiterResponse {
+	var limiters []RateLimiterResponse
+	for _, set := range []*limiterSet{l.principal, l.clientIP, l.topic} {
+		limiters = append(limiters, set.list(l.direction, now)...)
+	}
+	return limiters
+}
+
+// writeRateLimited rejects a request that may be retried after wait.
+func writeRateLimited(w http.ResponseWriter, wait time.Duration, msg string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(max(wait, time.Second).Seconds()))))
+	http.Error(w, msg, http.StatusTooManyRequests)
+}
+
+func (s *Server) GetRateLimitsHandler(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	limiters := append(s.publishLimits.list(now), s.consumeLimits.list(now)...)
+
+	for _, ns := range s.namespaces.list() {
+		rate := ns.cfg().Quotas.MaxPublishRate
+		if rate <= 0 {
+			continue
+		}
+		limiters = append(limiters, RateLimiterResponse{
+			Direction:     DirectionPublish,
+			Kind:          RateLimitNamespace,
+			Key:           ns.name,
+			Limit:         RateLimit{MessagesPerSecond: rate},
+			MessageTokens: ns.publishes.available(now),
+		})
+	}
+
+	sort.Slice(limiters, func(i, j int) bool {
+		a, b := limiters[i], limiters[j]
+		if a.Direction != b.Direction {
+			return a.Direction > b.Direction
+		}
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		return a.Key < b.Key
+	})
+
+	writeJSON(w, http.StatusOK, RateLimitsResponse{Limiters: limiters})
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/mdkelley02/message-queue/storage"
+)
+
+const deadLetterSuffix = ".deadletter"
+
+func DeadLetterTopic(topic string) string {
+	return topic + deadLetterSuffix
+}
+
+// maxRedriveRate is the highest rate limit of a redrive, one message per
+// nanosecond, which is the shortest interval the throttle can wait.
+const maxRedriveRate = float64(time.Second)
+
+func (s *Server) RedriveHandler(w http.ResponseWriter, r *http.Request) {
+	// get topic identifier from url
+	topic := getTopicFromUrl(r)
+	if topic == "" {
+		slog.Error("missing topic")
+		http.Error(w, "missing topic", http.StatusBadRequest)
+		return
+	}
+
+	var request RedriveRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		slog.Error("could not read request body", "err", err)
+		http.Error(w, "could not read request body", http.StatusBadRequest)
+		return
+	}
+
+	if request.FromOffset < 0 || (request.ToOffset != nil && *request.ToOffset < request.FromOffset) {
+		http.Error(w, "invalid offset range", http.StatusBadRequest)
+		return
+	}
+
+	if request.RateLimit < 0 || request.RateLimit > maxRedriveRate {
+		http.Error(w, fmt.Sprintf("rate limit must be between 0 and %g", float64(maxRedriveRate)), http.StatusBadRequest)
+		return
+	}
+
+	var filter *regexp.Regexp
+	if request.Filter != "" {
+		var err error
+		if filter, err = regexp.Compile(request.Filter); err != nil {
+			http.Error(w, fmt.Sprintf("invalid filter: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	source, err := s.getTopic(s.namespace(r), DeadLetterTopic(topic))
+	if err != nil {
+		http.Error(w, "dead letter topic not found", http.StatusNotFound)
+		return
+	}
+
+	if request.Destination == "" {
+		request.Destination = topic
+	}
+
+	if !s.allowed(r, ActionPublish, request.Destination) {
+		s.writeForbidden(w, r, ActionPublish, request.Destination)
+		return
+	}
+
+	response, err := s.redrive(r.Context(), source, request, filter)
+	if err != nil {
+		slog.Error("redrive interrupted", "source", source.name, "err", err)
+	}
+
+	slog.Info("redrive finished", "source", source.name, "destination", response.Destination, "moved", response.Moved, "failed", response.Failed)
+	s.audit(r, AuditTopicRedrive, topic, request, response)
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// redrive republishes the messages of source within the requested offset
+// range to the destination topic and removes them from source. Messages that
+// cannot be republished are left in place and counted as failed.
+func (s *Server) redrive(ctx context.Context, source *topic, req RedriveRequest, filter *regexp.Regexp) (RedriveResponse, error) {
+	response := RedriveResponse{
+		Source:      source.name,
+		Destination: req.Destination,
+	}
+
+	var throttle <-chan time.Time
+	if req.RateLimit > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / req.RateLimit))
+		defer ticker.Stop()
+		throttle = ticker.C
+	}
+
+	// the offset range applies to every partition of the dead letter topic
+	for _, p := range source.partitions {
+		end := p.storage.Len()
+		if req.ToOffset != nil && *req.ToOffset+1 < end {
+			end = *req.ToOffset + 1
+		}
+
+		start := req.FromOffset
+		if low := p.stats().LowWatermark; start < low {
+			start = low
+		}
+
+		for offset := start; offset < end; offset++ {
+			record, err := p.storage.Get(offset)
+			if errors.Is(err, storage.ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				slog.Error("could not read dead lettered message", "partition", p.id, "offset", offset, "err", err)
+				response.Failed++
+				continue
+			}
+
+			if filter != nil && !filter.MatchString(record.Value) {
+				continue
+			}
+
+			if throttle != nil {
+				select {
+				case <-throttle:
+				case <-ctx.Done():
+					return response, ctx.Err()
+				}
+			} else if err := ctx.Err(); err != nil {
+				return response, err
+			}
+
+			if _, err := s.publishMessage(source.ns, req.Destination, PublishRequest{
+				Body:    record.Value,
+				Key:     record.Key,
+				Headers: record.Headers,
+				Trace:   traceContextOf(record),
+			}); err != nil {
+				slog.Error("could not redrive message", "partition", p.id, "offset", offset, "err", err)
+				response.Failed++
+				continue
+			}
+
+			if err := p.delete(offset); err != nil {
+				slog.Error("could not delete redriven message", "partition", p.id, "offset", offset, "err", err)
+			}
+			response.Moved++
+		}
+	}
+
+	return response, nil
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"sort"
+	"sync"
+)
+
+// topicRegistry is the set of topics known to the server. It is safe for
+// concurrent use. Topics are created under the write lock so that requests
+// racing to create the same topic all end up with the same one.
+type topicRegistry struct {
+	mu     sync.RWMutex
+	topics map[string]*topic
+	max    int
+}
+
+func newTopicRegistry(max int) *topicRegistry {
+	return &topicRegistry{
+		topics: make(map[string]*topic),
+		max:    max,
+	}
+}
+
+func (r *topicRegistry) get(name string) (*topic, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	t, ok := r.topics[name]
+	return t, ok
+}
+
+// getOrCreate returns the named topic, calling create to make it if it does
+// not exist yet. created reports whether create was called.
+func (r *topicRegistry) getOrCreate(name string, create func() (*topic, error)) (t *topic, created bool, err error) {
+	if t, ok := r.get(name); ok {
+		return t, false, nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// another request may have created it in the meantime
+	if t, ok := r.topics[name]; ok {
+		return t, false, nil
+	}
+
+	if r.fullLocked() {
+		return nil, false, errTooManyTopics
+	}
+
+	if t, err = create(); err != nil {
+		return nil, false, err
+	}
+
+	r.topics[name] = t
+	return t, true, nil
+}
+
+// create adds the topic made by create, failing with errTopicExists if the
+// name is taken.
+func (r *topicRegistry) create(name string, create func() (*topic, error)) (*topic, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.topics[name]; ok {
+		return nil, errTopicExists
+	}
+
+	if r.fullLocked() {
+		return nil, errTooManyTopics
+	}
+
+	t, err := create()
+	if err != nil {
+		return nil, err
+	}
+
+	r.topics[name] = t
+	return t, nil
+}
+
+// setMax changes the maximum number of topics. Existing topics are kept
+// when there are more.
+func (r *topicRegistry) setMax(max int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.max = max
+}
+
+func (r *topicRegistry) fullLocked() bool {
+	return r.max > 0 && len(r.topics) >= r.max
+}
+
+func (r *topicRegistry) remove(name string) (*topic, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, ok := r.topics[name]
+	if ok {
+		delete(r.topics, name)
+	}
+	return t, ok
+}
+
+// list returns a snapshot of the topics sorted by name.
+func (r *topicRegistry) list() []*topic {
+	r.mu.RLock()
+	topics := make([]*topic, 0, len(r.topics))
+	for _, t := range r.topics {
+		topics = append(topics, t)
+	}
+	r.mu.RUnlock()
+
+	sort.Slice(topics, func(i, j int) bool {
+		return topics[i].name < topics[j].name
+	})
+
+	return topics
+}
@@ -0,0 +1,1060 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdkelley02/message-queue/storage"
+)
+
+// Replication copies the topics of a leader broker to its followers.
+// Followers pull: they copy the namespaces and topics of the leader and
+// fetch the records of every partition with long polls, which tells the
+// leader how far each of them got. A publish to a topic with
+// MinInSyncReplicas waits until that many followers in sync have its
+// message.
+
+const (
+	// ReplicaIdHeader names the follower fetching from the leader.
+	ReplicaIdHeader = "X-Replica-Id"
+	// LeaderHeader is the URL of the leader, returned by followers with the
+	// requests only the leader serves.
+	LeaderHeader = "X-Leader"
+)
+
+const (
+	defaultReplicaLagTimeout   = 10 * time.Second
+	defaultReplicaAckTimeout   = 5 * time.Second
+	defaultReplicaSyncInterval = time.Second
+	maxReplicaFetchRecords     = 1000
+	replicaRetryDelay          = time.Second
+)
+
+var (
+	errNotLeader                = errors.New("not the leader")
+	errNotEnoughReplicas        = errors.New("not enough in-sync replicas")
+	errInvalidReplicationConfig = errors.New("invalid replication config")
+	errDiverged                 = errors.New("log diverged from the leader")
+)
+
+// ReplicationConfig enables replication. The broker follows Leader when it
+// is set and is the leader otherwise.
+type ReplicationConfig struct {
+	// NodeId names the broker, followers send it with every fetch.
+	NodeId string
+	// Leader is the URL of the broker to follow, e.g. http://host:8080.
+	Leader string
+	// APIKey authenticates a follower at the leader, which only serves
+	// broker admins when ACLs are enabled.
+	APIKey string
+	// LagTimeout is how long a follower may take to catch up with the
+	// leader before it is out of sync.
+	LagTimeout time.Duration
+	// AckTimeout bounds how long a publish waits for in-sync followers.
+	AckTimeout time.Duration
+	// SyncInterval is how often followers copy the topics of the leader.
+	SyncInterval time.Duration
+}
+
+func (c ReplicationConfig) Validate() error {
+	if c.NodeId == "" {
+		return fmt.Errorf("%w: node id must not be empty", errInvalidReplicationConfig)
+	}
+	if c.Leader != "" {
+		if err := validateLeaderURL(c.Leader); err != nil {
+			return err
+		}
+	}
+	if c.LagTimeout < 0 || c.AckTimeout < 0 || c.SyncInterval < 0 {
+		return fmt.Errorf("%w: timeouts must not be negative", errInvalidReplicationConfig)
+	}
+	return nil
+}
+
+func (c ReplicationConfig) withDefaults() ReplicationConfig {
+	if c.LagTimeout == 0 {
+		c.LagTimeout = defaultReplicaLagTimeout
+	}
+	if c.AckTimeout == 0 {
+		c.AckTimeout = defaultReplicaAckTimeout
+	}
+	if c.SyncInterval == 0 {
+		c.SyncInterval = defaultReplicaSyncInterval
+	}
+	return c
+}
+
+func validateLeaderURL(leader string) error {
+	u, err := url.Parse(leader)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%w: leader must be an http or https url, got %q", errInvalidReplicationConfig, leader)
+	}
+	return nil
+}
+
+// replicaSet is the replication state of a partition. The leader tracks
+// its followers in it, a follower the leader.
+type replicaSet struct {
+	mu       sync.Mutex
+	replicas map[string]*replicaState
+	// changed is closed and replaced whenever a follower makes progress
+	changed chan struct{}
+
+	leaderHighWatermark int
+	lastFetch           time.Time
+}
+
+type replicaState struct {
+	// offset is the offset the follower fetches next
+	offset     int
+	fetchedAt  time.Time
+	caughtUpAt time.Time
+}
+
+func newReplicaSet() *replicaSet {
+	return &replicaSet{
+		replicas: make(map[string]*replicaState),
+		changed:  make(chan struct{}),
+	}
+}
+
+// fetched records that the follower id has every record below offset.
+func (rs *replicaSet) fetched(id string, offset int, highWatermark int, now time.Time) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	r, ok := rs.replicas[id]
+	if !ok {
+		r = &replicaState{}
+		rs.replicas[id] = r
+	}
+	r.offset = offset
+	r.fetchedAt = now
+	if offset == highWatermark {
+		r.caughtUpAt = now
+	}
+
+	close(rs.changed)
+	rs.changed = make(chan struct{})
+}
+
+// inSyncLocked counts the followers that caught up with the leader within
+// lagTimeout and have every record below offset.
+func (rs *replicaSet) inSyncLocked(offset int, lagTimeout time.Duration, now time.Time) int {
+	n := 0
+	for _, r := range rs.replicas {
+		if now.Sub(r.caughtUpAt) <= lagTimeout && r.offset >= offset {
+			n++
+		}
+	}
+	return n
+}
+
+func (rs *replicaSet) inSync(offset int, lagTimeout time.Duration, now time.Time) int {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	return rs.inSyncLocked(offset, lagTimeout, now)
+}
+
+// await waits until n in-sync followers have every record below offset.
+func (rs *replicaSet) await(offset int, n int, lagTimeout time.Duration, timeout time.Duration, cancel <-chan struct{}) error {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		rs.mu.Lock()
+		count := rs.inSyncLocked(offset, lagTimeout, time.Now())
+		changed := rs.changed
+		rs.mu.Unlock()
+
+		if count >= n {
+			return nil
+		}
+
+		select {
+		case <-changed:
+		case <-deadline.C:
+			return fmt.Errorf("%w: %d of %d followers have the message", errNotEnoughReplicas, count, n)
+		case <-cancel:
+			return errShuttingDown
+		}
+	}
+}
+
+func (rs *replicaSet) response(highWatermark int, lagTimeout time.Duration, now time.Time) []ReplicaResponse {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	replicas := make([]ReplicaResponse, 0, len(rs.replicas))
+	for id, r := range rs.replicas {
+		replicas = append(replicas, ReplicaResponse{
+			Id:        id,
+			Offset:    r.offset,
+			Lag:       max(highWatermark-r.offset, 0),
+			InSync:    now.Sub(r.caughtUpAt) <= lagTimeout,
+			LastFetch: r.fetchedAt,
+		})
+	}
+	sort.Slice(replicas, func(i, j int) bool {
+		return replicas[i].Id < replicas[j].Id
+	})
+	return replicas
+}
+
+// followed records the high watermark of the leader at a fetch.
+func (rs *replicaSet) followed(leaderHighWatermark int, now time.Time) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	rs.leaderHighWatermark = leaderHighWatermark
+	rs.lastFetch = now
+}
+
+func (rs *replicaSet) following() (int, time.Time) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	return rs.leaderHighWatermark, rs.lastFetch
+}
+
+func (s *Server) replicaLagTimeout() time.Duration {
+	if s.replication == nil {
+		return defaultReplicaLagTimeout
+	}
+	return s.replication.LagTimeout
+}
+
+// replicasRequired returns how many in-sync followers a publish to t waits
+// for. System topics belong to each broker and are not replicated.
+func (s *Server) replicasRequired(t *topic) int {
+	if isSystemTopic(t.name) {
+		return 0
+	}
+	return t.cfg().MinInSyncReplicas
+}
+
+// checkReplicas refuses a publish up front when too few followers are in
+// sync to acknowledge it.
+func (s *Server) checkReplicas(t *topic, p *partition) error {
+	n := s.replicasRequired(t)
+	if n == 0 {
+		return nil
+	}
+
+	if count := p.replicas.inSync(0, s.replicaLagTimeout(), time.Now()); count < n {
+		return fmt.Errorf("%w: %d of %d followers are in sync", errNotEnoughReplicas, count, n)
+	}
+	return nil
+}
+
+// awaitReplicas waits until enough in-sync followers have the message at
+// offset.
+func (s *Server) awaitReplicas(t *topic, p *partition, offset int) error {
+	n := s.replicasRequired(t)
+	if n == 0 {
+		return nil
+	}
+
+	ackTimeout := defaultReplicaAckTimeout
+	if s.replication != nil {
+		ackTimeout = s.replication.AckTimeout
+	}
+
+	return p.replicas.await(offset+1, n, s.replicaLagTimeout(), ackTimeout, s.closing)
+}
+
+// leaderOnly wraps the routes that change topics, which only the leader
+// serves. Followers answer with the address of the leader.
+func (s *Server) leaderOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if isSystemTopic(getTopicFromUrl(r)) {
+			next(w, r)
+			return
+		}
+
+		if leader, ok := s.leads(); !ok {
+			if leader == "" {
+				http.Error(w, errNoLeader.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			writeNotLeader(w, leader)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// leads reports whether the broker serves what only the leader serves.
+// Otherwise it returns the address of the leader, empty while the cluster
+// has none.
+func (s *Server) leads() (string, bool) {
+	if s.cluster != nil {
+		return s.cluster.leader()
+	}
+	if f := s.follower.Load(); f != nil {
+		return f.leader, false
+	}
+	return "", true
+}
+
+func writeNotLeader(w http.ResponseWriter, leader string) {
+	w.Header().Set(LeaderHeader, leader)
+	http.Error(w, fmt.Sprintf("%v, the leader is %s", errNotLeader, leader), http.StatusMisdirectedRequest)
+}
+
+// promote makes the broker the leader. It keeps what it replicated so far.
+func (s *Server) promote() {
+	s.replicationMu.Lock()
+	defer s.replicationMu.Unlock()
+
+	if f := s.follower.Swap(nil); f != nil {
+		f.stop()
+	}
+}
+
+// follow makes the broker a follower of leader, replacing the topics it
+// has with those of the leader.
+func (s *Server) follow(leader string) {
+	s.replicationMu.Lock()
+	defer s.replicationMu.Unlock()
+
+	// writes stay refused while the broker switches leaders
+	if f := s.follower.Load(); f != nil {
+		f.stop()
+	}
+	s.follower.Store(s.startFollowing(leader))
+}
+
+func (s *Server) stopFollowing() {
+	s.replicationMu.Lock()
+	defer s.replicationMu.Unlock()
+
+	if f := s.follower.Load(); f != nil {
+		f.stop()
+	}
+}
+
+func (s *Server) replicationResponse() ReplicationResponse {
+	response := ReplicationResponse{
+		NodeId:     s.replication.NodeId,
+		Role:       RoleLeader,
+		Partitions: make([]PartitionReplicationResponse, 0),
+	}
+
+	f := s.follower.Load()
+	if f != nil {
+		response.Role = RoleFollower
+		response.Leader = f.leader
+	}
+
+	now := time.Now()
+	for _, t := range s.allTopics() {
+		if isSystemTopic(t.name) {
+			continue
+		}
+
+		for _, p := range t.partitions {
+			stats := p.storage.Stats()
+			partition := PartitionReplicationResponse{
+				Namespace:     t.ns.name,
+				Topic:         t.name,
+				Partition:     p.id,
+				HighWatermark: stats.HighWatermark,
+			}
+
+			if f == nil {
+				partition.Replicas = p.replicas.response(stats.HighWatermark, s.replication.LagTimeout, now)
+			} else if leaderHighWatermark, lastFetch := p.replicas.following(); !lastFetch.IsZero() {
+				partition.LeaderHighWatermark = leaderHighWatermark
+				partition.Lag = max(leaderHighWatermark-stats.HighWatermark, 0)
+				partition.LastFetch = &lastFetch
+			}
+
+			response.Partitions = append(response.Partitions, partition)
+		}
+	}
+
+	return response
+}
+
+func (s *Server) GetReplicationHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.replicationResponse())
+}
+
+func (s *Server) PromoteHandler(w http.ResponseWriter, r *http.Request) {
+	if s.cluster != nil {
+		http.Error(w, errClusterManaged.Error(), http.StatusConflict)
+		return
+	}
+
+	before := FollowRequest{}
+	if f := s.follower.Load(); f != nil {
+		before.Leader = f.leader
+	}
+
+	s.promote()
+
+	slog.Info("promoted to leader", "node", s.replication.NodeId)
+	s.audit(r, AuditPromote, s.replication.NodeId, before, FollowRequest{})
+	writeJSON(w, http.StatusOK, s.replicationResponse())
+}
+
+func (s *Server) FollowHandler(w http.ResponseWriter, r *http.Request) {
+	if s.cluster != nil {
+		http.Error(w, errClusterManaged.Error(), http.StatusConflict)
+		return
+	}
+
+	var request FollowRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		slog.Error("could not read request body", "err", err)
+		http.Error(w, "could not read request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := validateLeaderURL(request.Leader); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	before := FollowRequest{}
+	if f := s.follower.Load(); f != nil {
+		before.Leader = f.leader
+	}
+
+	s.follow(request.Leader)
+
+	slog.Info("following leader", "node", s.replication.NodeId, "leader", request.Leader)
+	s.audit(r, AuditFollow, s.replication.NodeId, before, request)
+	writeJSON(w, http.StatusOK, s.replicationResponse())
+}
+
+// GetReplicatedTopicsHandler lists the namespaces and topics followers
+// copy.
+func (s *Server) GetReplicatedTopicsHandler(w http.ResponseWriter, r *http.Request) {
+	if f := s.follower.Load(); f != nil {
+		writeNotLeader(w, f.leader)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, s.replicatedTopics())
+}
+
+// replicatedTopics returns the namespaces and topics of the broker, without
+// its system topics.
+func (s *Server) replicatedTopics() ReplicatedTopicsResponse {
+	response := ReplicatedTopicsResponse{
+		Namespaces: make([]ReplicatedNamespace, 0),
+		Topics:     make([]ReplicatedTopic, 0),
+	}
+	for _, ns := range s.namespaces.list() {
+		replicated := ReplicatedNamespace{
+			Name:      ns.name,
+			Config:    ns.cfg(),
+			CreatedAt: ns.createdAt,
+			Schemas:   ns.schemas.Snapshot(),
+		}
+		if ns.acl != nil {
+			replicated.ACLRules = ns.acl.dynamic()
+		}
+		response.Namespaces = append(response.Namespaces, replicated)
+
+		for _, t := range ns.topics.list() {
+			if isSystemTopic(t.name) {
+				continue
+			}
+			response.Topics = append(response.Topics, ReplicatedTopic{
+				Namespace: ns.name,
+				Name:      t.name,
+				Config:    t.cfg(),
+				CreatedAt: t.createdAt,
+			})
+		}
+	}
+
+	return response
+}
+
+// ReplicaFetchHandler returns the records of a partition from an offset
+// on. When the follower has every record it waits up to the requested time
+// for new ones.
+func (s *Server) ReplicaFetchHandler(w http.ResponseWriter, r *http.Request) {
+	if f := s.follower.Load(); f != nil {
+		writeNotLeader(w, f.leader)
+		return
+	}
+
+	replicaId := r.Header.Get(ReplicaIdHeader)
+	if replicaId == "" {
+		http.Error(w, "missing replica id", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	ns, err := s.getNamespace(query.Get("namespace"))
+	if err != nil {
+		writeNamespaceError(w, err)
+		return
+	}
+
+	t, err := s.getTopic(ns, query.Get("topic"))
+	if err != nil {
+		writeTopicError(w, err)
+		return
+	}
+
+	id, err := strconv.Atoi(query.Get("partition"))
+	if err != nil || id < 0 || id >= len(t.partitions) {
+		http.Error(w, fmt.Sprintf("%v: %q", errInvalidPartition, query.Get("partition")), http.StatusBadRequest)
+		return
+	}
+
+	from, err := strconv.Atoi(query.Get("from"))
+	if err != nil || from < 0 {
+		http.Error(w, "invalid from offset", http.StatusBadRequest)
+		return
+	}
+
+	// the records the follower holds, to find those deleted since it
+	// copied them
+	held := replicaHeld{low: -1}
+	if query.Has("low") {
+		held.low, err = strconv.Atoi(query.Get("low"))
+		if err != nil || held.low < 0 || held.low > from {
+			http.Error(w, "invalid low offset", http.StatusBadRequest)
+			return
+		}
+		held.count, err = strconv.Atoi(query.Get("count"))
+		if err != nil || held.count < 0 || held.count > from-held.low {
+			http.Error(w, "invalid record count", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var wait time.Duration
+	if param := query.Get("wait"); param != "" {
+		if wait, err = time.ParseDuration(param); err != nil || wait < 0 {
+			http.Error(w, "invalid wait", http.StatusBadRequest)
+			return
+		}
+	}
+	wait = min(wait, s.replicaLagTimeout())
+
+	p := t.partitions[id]
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+
+wait:
+	for {
+		available := t.wait()
+		stats := p.storage.Stats()
+		p.replicas.fetched(replicaId, from, stats.HighWatermark, time.Now())
+		if from != stats.HighWatermark {
+			break
+		}
+		// a follower that holds records the leader deleted is answered
+		// right away
+		if held.low == stats.LowWatermark && held.count > stats.Count {
+			break
+		}
+
+		select {
+		case <-available:
+		case <-deadline.C:
+			break wait
+		case <-t.done:
+			break wait
+		case <-s.closing:
+			break wait
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	response, err := readReplicated(p.storage, from, held)
+	if err != nil {
+		slog.Error("could not read records for a follower", "topic", t.name, "partition", p.id, "err", err)
+		http.Error(w, "could not read records", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// replicaHeld is what a follower holds below the offset it fetches from:
+// count records from offset low on. low is -1 when the follower did not
+// say.
+type replicaHeld struct {
+	low, count int
+}
+
+// readReplicated reads the records of st from offset from on. When the
+// follower holds more records below from than st, the response lists the
+// offsets that were deleted.
+func readReplicated(st storage.IStorage, from int, held replicaHeld) (ReplicaFetchResponse, error) {
+	stats := st.Stats()
+	response := ReplicaFetchResponse{
+		LowWatermark:  stats.LowWatermark,
+		HighWatermark: stats.HighWatermark,
+		NextOffset:    max(from, stats.LowWatermark),
+		Records:       make([]ReplicaRecord, 0),
+	}
+
+	start := response.NextOffset
+	for offset := start; offset < stats.HighWatermark && offset-start < maxReplicaFetchRecords; offset++ {
+		record, err := st.Get(offset)
+		response.NextOffset = offset + 1
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return ReplicaFetchResponse{}, err
+		}
+		response.Records = append(response.Records, ReplicaRecord{Offset: offset, Record: record})
+	}
+
+	// the records below from are only counted once the follower caught
+	// up, when the records of the response are every record above them
+	if held.low < stats.LowWatermark || from > stats.HighWatermark || response.NextOffset < stats.HighWatermark {
+		return response, nil
+	}
+
+	below, _, err := scanRecords(st, stats.LowWatermark, held.low)
+	if err != nil {
+		return ReplicaFetchResponse{}, err
+	}
+	if held.count > stats.Count-below-len(response.Records) {
+		if _, response.Deleted, err = scanRecords(st, held.low, from); err != nil {
+			return ReplicaFetchResponse{}, err
+		}
+	}
+
+	return response, nil
+}
+
+// scanRecords counts the records of st from offset from up to offset to and
+// returns the offsets in between that were deleted.
+func scanRecords(st storage.IStorage, from int, to int) (int, []int, error) {
+	count := 0
+	var deleted []int
+	for offset := from; offset < to; offset++ {
+		_, err := st.Get(offset)
+		if errors.Is(err, storage.ErrNotFound) {
+			deleted = append(deleted, offset)
+			continue
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		count++
+	}
+	return count, deleted, nil
+}
+
+// appendReplicated adds the records of a fetch to st at the offsets they
+// have on the leader and deletes those the leader deleted.
+func appendReplicated(st storage.IStorage, response ReplicaFetchResponse) error {
+	if response.LowWatermark > st.Stats().LowWatermark {
+		if _, err := st.Truncate(response.LowWatermark); err != nil {
+			return err
+		}
+	}
+
+	for _, offset := range response.Deleted {
+		if err := st.Delete(offset); err != nil && !errors.Is(err, storage.ErrNotFound) {
+			return err
+		}
+	}
+
+	for _, record := range response.Records {
+		if record.Offset < st.Len() {
+			continue
+		}
+		if err := fillTo(st, record.Offset); err != nil {
+			return err
+		}
+		if _, err := st.Put(record.Record); err != nil {
+			return err
+		}
+	}
+
+	return fillTo(st, response.NextOffset)
+}
+
+// fillTo adds deleted records to st up to offset, standing in for the
+// records that were deleted on the leader.
+func fillTo(st storage.IStorage, offset int) error {
+	for st.Len() < offset {
+		filler, err := st.Put(storage.Record{})
+		if err != nil {
+			return err
+		}
+		if err := st.Delete(filler); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// follower copies the topics of the leader until it is stopped.
+type follower struct {
+	s      *Server
+	leader string
+	client *http.Client
+	wait   time.Duration
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	// fetchers stops the fetch loops of a topic, it is only used by run
+	fetchers map[*topic]context.CancelFunc
+	wg       sync.WaitGroup
+
+	mu sync.Mutex
+	// diverged holds the topics whose log does not match the leader's
+	// anymore, they are copied again
+	diverged map[*topic]bool
+}
+
+func (s *Server) startFollowing(leader string) *follower {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	// long polls are answered within half the lag timeout so that a
+	// follower without anything to fetch stays in sync
+	wait := s.replication.LagTimeout / 2
+	f := &follower{
+		s:        s,
+		leader:   strings.TrimSuffix(leader, "/"),
+		client:   &http.Client{Timeout: wait + 10*time.Second},
+		wait:     wait,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		fetchers: make(map[*topic]context.CancelFunc),
+		diverged: make(map[*topic]bool),
+	}
+
+	go f.run(ctx)
+
+	return f
+}
+
+func (f *follower) stop() {
+	f.cancel()
+	<-f.done
+}
+
+func (f *follower) run(ctx context.Context) {
+	defer close(f.done)
+	defer f.wg.Wait()
+
+	for {
+		if err := f.sync(ctx); err != nil && ctx.Err() == nil {
+			slog.Warn("could not copy the topics of the leader", "leader", f.leader, "err", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(f.s.replication.SyncInterval):
+		}
+	}
+}
+
+// sync makes the namespaces and topics of the broker those of the leader
+// and fetches the partitions of new topics.
+func (f *follower) sync(ctx context.Context) error {
+	f.mu.Lock()
+	diverged := f.diverged
+	f.diverged = make(map[*topic]bool)
+	f.mu.Unlock()
+
+	for t := range diverged {
+		f.stopFetching(t)
+		if current, ok := t.ns.topics.get(t.name); ok && current == t {
+			if err := f.s.deleteTopic(t.ns, t.name); err != nil {
+				slog.Error("could not drop diverged topic", "topic", t.name, "err", err)
+			}
+		}
+	}
+
+	leader, ok, err := f.leaderTopics(ctx)
+	if err != nil || !ok {
+		return err
+	}
+
+	topics := f.s.applyReplicatedTopics(leader, f.stopFetching)
+	for t := range topics {
+		if _, ok := f.fetchers[t]; !ok {
+			f.startFetching(ctx, t)
+		}
+	}
+
+	for t := range f.fetchers {
+		if !topics[t] {
+			f.stopFetching(t)
+		}
+	}
+
+	return nil
+}
+
+// leaderTopics returns the namespaces and topics of the leader. Members of
+// a cluster take those the cluster agreed on, ok is false until there are
+// any.
+func (f *follower) leaderTopics(ctx context.Context) (ReplicatedTopicsResponse, bool, error) {
+	if f.s.cluster != nil {
+		return f.s.cluster.metadata()
+	}
+
+	var leader ReplicatedTopicsResponse
+	if err := f.get(ctx, "/replication/topics", &leader); err != nil {
+		return ReplicatedTopicsResponse{}, false, err
+	}
+	return leader, true, nil
+}
+
+// applyReplicatedTopics makes the namespaces and topics of the broker those
+// of the leader and returns the topics. drop is called with every topic
+// before it is deleted.
+func (s *Server) applyReplicatedTopics(leader ReplicatedTopicsResponse, drop func(*topic)) map[*topic]bool {
+	namespaces := map[string]bool{DefaultNamespace: true}
+	for _, replicated := range leader.Namespaces {
+		namespaces[replicated.Name] = true
+		if err := s.replicateNamespace(replicated); err != nil {
+			slog.Error("could not copy namespace", "namespace", replicated.Name, "err", err)
+		}
+	}
+
+	for _, ns := range s.namespaces.list() {
+		if namespaces[ns.name] {
+			continue
+		}
+		for _, t := range ns.topics.list() {
+			drop(t)
+		}
+		if err := s.deleteNamespace(ns.name); err != nil {
+			slog.Error("could not drop namespace", "namespace", ns.name, "err", err)
+		}
+	}
+
+	topics := make(map[*topic]bool)
+	for _, replicated := range leader.Topics {
+		if isSystemTopic(replicated.Name) {
+			continue
+		}
+
+		t, err := s.replicateTopic(replicated)
+		if err != nil {
+			slog.Error("could not copy topic", "namespace", replicated.Namespace, "topic", replicated.Name, "err", err)
+			continue
+		}
+		topics[t] = true
+	}
+
+	for _, t := range s.allTopics() {
+		if topics[t] || isSystemTopic(t.name) {
+			continue
+		}
+		drop(t)
+		if err := s.deleteTopic(t.ns, t.name); err != nil {
+			slog.Error("could not drop topic", "namespace", t.ns.name, "topic", t.name, "err", err)
+		}
+	}
+
+	return topics
+}
+
+func (f *follower) startFetching(ctx context.Context, t *topic) {
+	ctx, cancel := context.WithCancel(ctx)
+	f.fetchers[t] = cancel
+
+	for _, p := range t.partitions {
+		f.wg.Add(1)
+		go func(p *partition) {
+			defer f.wg.Done()
+			f.fetchLoop(ctx, t, p)
+		}(p)
+	}
+}
+
+func (f *follower) stopFetching(t *topic) {
+	if cancel, ok := f.fetchers[t]; ok {
+		cancel()
+		delete(f.fetchers, t)
+	}
+}
+
+func (f *follower) fetchLoop(ctx context.Context, t *topic, p *partition) {
+	for {
+		err := f.fetch(ctx, t, p)
+		if ctx.Err() != nil {
+			return
+		}
+
+		select {
+		case <-t.done:
+			return
+		default:
+		}
+
+		if errors.Is(err, errDiverged) {
+			slog.Warn("dropping topic to copy it again", "namespace", t.ns.name, "topic", t.name, "partition", p.id, "err", err)
+			f.mu.Lock()
+			f.diverged[t] = true
+			f.mu.Unlock()
+			return
+		}
+
+		if err != nil {
+			slog.Warn("could not fetch from the leader", "namespace", t.ns.name, "topic", t.name, "partition", p.id, "err", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(replicaRetryDelay):
+			}
+		}
+	}
+}
+
+// fetch copies the records of p the broker does not have yet, and deletes
+// those the leader deleted since they were copied.
+func (f *follower) fetch(ctx context.Context, t *topic, p *partition) error {
+	stats := p.storage.Stats()
+	from := stats.HighWatermark
+	query := url.Values{}
+	query.Set("namespace", t.ns.name)
+	query.Set("topic", t.name)
+	query.Set("partition", strconv.Itoa(p.id))
+	query.Set("from", strconv.Itoa(from))
+	query.Set("low", strconv.Itoa(stats.LowWatermark))
+	query.Set("count", strconv.Itoa(stats.Count))
+	query.Set("wait", f.wait.String())
+
+	var response ReplicaFetchResponse
+	if err := f.get(ctx, "/replication/fetch?"+query.Encode(), &response); err != nil {
+		return err
+	}
+
+	if response.HighWatermark < from {
+		return fmt.Errorf("%w: the leader has %d records, the follower %d", errDiverged, response.HighWatermark, from)
+	}
+
+	if err := appendReplicated(p.storage, response); err != nil {
+		return err
+	}
+	p.replicas.followed(response.HighWatermark, time.Now())
+
+	return nil
+}
+
+func (f *follower) get(ctx context.Context, path string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, f.leader+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(ReplicaIdHeader, f.s.replication.NodeId)
+	if f.s.replication.APIKey != "" {
+		req.Header.Set(APIKeyHeader, f.s.replication.APIKey)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("leader answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// replicateNamespace creates or updates a namespace, its schemas and its
+// acl rules to match the leader.
+func (s *Server) replicateNamespace(replicated ReplicatedNamespace) error {
+	ns, err := s.getNamespace(replicated.Name)
+	if errors.Is(err, errNamespaceNotFound) {
+		ns, err = s.namespaces.create(replicated.Name, func() (*namespace, error) {
+			ns := s.newNamespace(replicated.Name, replicated.Config, replicated.CreatedAt)
+			if err := s.enableACL(ns); err != nil {
+				return nil, err
+			}
+			return ns, nil
+		})
+		if err != nil {
+			return err
+		}
+		s.persistNamespaces()
+	} else if err != nil {
+		return err
+	} else if !reflect.DeepEqual(ns.cfg(), replicated.Config) {
+		if _, err := s.updateNamespaceConfig(replicated.Name, replicated.Config); err != nil {
+			return err
+		}
+	}
+
+	// messages carry the ids of their schemas, which the restored schemas
+	// keep
+	if !sameJSON(ns.schemas.Snapshot(), replicated.Schemas) {
+		if err := ns.schemas.Restore(replicated.Schemas); err != nil {
+			return err
+		}
+	}
+
+	if ns.acl == nil {
+		return nil
+	}
+	if rules := ns.acl.dynamic(); len(rules) == len(replicated.ACLRules) && (len(rules) == 0 || reflect.DeepEqual(rules, replicated.ACLRules)) {
+		return nil
+	}
+	return ns.acl.replace(replicated.ACLRules)
+}
+
+// replicateTopic creates or updates a topic to match the leader. A topic
+// that was deleted and created again on the leader is created again here.
+func (s *Server) replicateTopic(replicated ReplicatedTopic) (*topic, error) {
+	ns, err := s.getNamespace(replicated.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	t, ok := ns.topics.get(replicated.Name)
+	if ok && !t.createdAt.Equal(replicated.CreatedAt) {
+		if err := s.deleteTopic(ns, replicated.Name); err != nil {
+			return nil, err
+		}
+		ok = false
+	}
+
+	if !ok {
+		t, err = ns.topics.create(replicated.Name, func() (*topic, error) {
+			return s.newTopic(ns, replicated.Name, replicated.Config, replicated.CreatedAt)
+		})
+		if err != nil {
+			return nil, err
+		}
+		s.persistTopics()
+		return t, nil
+	}
+
+	if cfg := replicated.Config; !reflect.DeepEqual(t.cfg(), cfg) {
+		t.config.Store(&cfg)
+		s.persistTopics()
+	}
+	return t, nil
+}
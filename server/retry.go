@@ -0,0 +1,138 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/mdkelley02/message-queue/storage"
+)
+
+const defaultRetryMultiplier = 2
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.Multiplier == 0 {
+		p.Multiplier = defaultRetryMultiplier
+	}
+	return p
+}
+
+func (p RetryPolicy) validate() error {
+	if p.InitialDelay < 0 || p.MaxDelay < 0 {
+		return fmt.Errorf("%w: retry delays must not be negative", errInvalidTopicConfig)
+	}
+
+	if p.Multiplier < 1 {
+		return fmt.Errorf("%w: retry multiplier must be at least 1", errInvalidTopicConfig)
+	}
+
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("%w: retry jitter must be between 0 and 1", errInvalidTopicConfig)
+	}
+
+	if p.MaxAttempts < 0 {
+		return fmt.Errorf("%w: max attempts must not be negative", errInvalidTopicConfig)
+	}
+
+	return nil
+}
+
+// exhausted reports whether a message that failed on the given attempt may
+// not be delivered again. Without a policy messages are retried forever.
+func (p *RetryPolicy) exhausted(attempt int) bool {
+	return p != nil && p.MaxAttempts > 0 && attempt >= p.MaxAttempts
+}
+
+// delay returns how long to wait before delivering a message again that
+// failed on the given attempt. Without a policy it is redelivered right away.
+func (p *RetryPolicy) delay(attempt int) time.Duration {
+	if p == nil || p.InitialDelay <= 0 {
+		return 0
+	}
+
+	// without a MaxDelay the delay is bounded by what a Duration holds, the
+	// backoff of late attempts overflows a float64 to +Inf otherwise
+	limit := float64(math.MaxInt64)
+	if p.MaxDelay > 0 {
+		limit = float64(p.MaxDelay)
+	}
+	d := min(float64(p.InitialDelay)*math.Pow(p.Multiplier, float64(attempt-1)), limit)
+
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (2*rand.Float64() - 1)
+	}
+
+	// float64(math.MaxInt64) rounds up, past what a Duration holds
+	if d >= float64(math.MaxInt64) {
+		return time.Duration(math.MaxInt64)
+	}
+	return time.Duration(d)
+}
+
+// nack hands msg back to the group. It is delivered again once the backoff of
+// the topic's retry policy has passed, or moved to the dead letter topic when
+// it has no attempts left.
+func (s *Server) nack(t *topic, group string, msg Message) {
+	p := t.partitions[msg.Partition]
+	policy := t.cfg().Retry
+
+	attempt, ok := p.attempt(group, msg.Offset)
+	if !ok {
+		return
+	}
+	s.metrics.nacked.WithLabelValues(t.ns.name, t.name).Inc()
+
+	if policy.exhausted(attempt) {
+		err := s.deadLetter(t, group, msg)
+		if err == nil {
+			return
+		}
+
+		// keep the message rather than lose it
+		slog.Error("could not dead letter message", "messageId", msg.Id, "err", err)
+	}
+
+	delay := policy.delay(attempt)
+	p.retry(group, msg.Offset, delay)
+
+	t.signalAt(time.Now().Add(delay))
+}
+
+// deadLetter publishes msg to the dead letter topic of t and commits it for
+// the group.
+func (s *Server) deadLetter(t *topic, group string, msg Message) error {
+	record, err := t.partitions[msg.Partition].storage.Get(msg.Offset)
+	if errors.Is(err, storage.ErrNotFound) {
+		return t.ack(group, msg)
+	}
+	if err != nil {
+		return err
+	}
+
+	deadLetter := t.ns.cfg().DeadLetter
+	if deadLetter.Disabled {
+		slog.Info("dropped message without attempts left", "messageId", msg.Id, "group", group, "attempts", msg.Attempt)
+		return t.ack(group, msg)
+	}
+
+	if _, err := s.upsertTopicWithConfig(t.ns, DeadLetterTopic(t.name), deadLetter.Topic); err != nil {
+		return err
+	}
+
+	if _, err := s.publishMessage(t.ns, DeadLetterTopic(t.name), PublishRequest{
+		Body:    record.Value,
+		Key:     record.Key,
+		Headers: record.Headers,
+		Trace:   traceContextOf(record),
+	}); err != nil {
+		return err
+	}
+
+	slog.Info("dead lettered message", "messageId", msg.Id, "group", group, "attempts", msg.Attempt)
+	s.metrics.deadLettered.WithLabelValues(t.ns.name, t.name).Inc()
+
+	return t.ack(group, msg)
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/mdkelley02/message-queue/schema"
+)
+
+func (s *Server) GetSchemasHandler(w http.ResponseWriter, r *http.Request) {
+	topic := getTopicFromUrl(r)
+	if topic == "" {
+		slog.Error("missing topic")
+		http.Error(w, "missing topic", http.StatusBadRequest)
+		return
+	}
+
+	versions := s.namespace(r).schemas.List(topic)
+	response := GetSchemasResponse{
+		Compatibility: string(s.namespace(r).schemas.Compatibility(topic)),
+		Schemas:       make([]SchemaResponse, 0, len(versions)),
+	}
+
+	for _, version := range versions {
+		response.Schemas = append(response.Schemas, toSchemaResponse(version))
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *Server) GetSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	topic := getTopicFromUrl(r)
+	if topic == "" {
+		slog.Error("missing topic")
+		http.Error(w, "missing topic", http.StatusBadRequest)
+		return
+	}
+
+	var (
+		found schema.Schema
+		err   error
+	)
+
+	// version is either a number or "latest"
+	version := mux.Vars(r)["version"]
+	if version == "latest" {
+		found, err = s.namespace(r).schemas.Latest(topic)
+	} else {
+		number, convErr := strconv.Atoi(version)
+		if convErr != nil {
+			http.Error(w, "invalid schema version", http.StatusBadRequest)
+			return
+		}
+		found, err = s.namespace(r).schemas.Get(topic, number)
+	}
+
+	if errors.Is(err, schema.ErrNotFound) {
+		http.Error(w, "schema not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("could not read schema", "err", err)
+		http.Error(w, "could not read schema", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, toSchemaResponse(found))
+}
+
+func (s *Server) RegisterSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	topic := getTopicFromUrl(r)
+	if topic == "" {
+		slog.Error("missing topic")
+		http.Error(w, "missing topic", http.StatusBadRequest)
+		return
+	}
+
+	var request RegisterSchemaRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || len(request.Schema) == 0 {
+		slog.Error("could not read request body", "err", err)
+		http.Error(w, "could not read request body", http.StatusBadRequest)
+		return
+	}
+
+	registered, err := s.namespace(r).schemas.Register(topic, request.Schema)
+
+	var incompatible *schema.IncompatibleError
+	if errors.As(err, &incompatible) {
+		writeJSON(w, http.StatusConflict, ErrorResponse{
+			Error:  "schema is not " + string(incompatible.Mode) + " compatible with the latest version",
+			Errors: incompatible.Reasons,
+		})
+		return
+	}
+	if errors.Is(err, schema.ErrInvalidSchema) {
+		writeJSON(w, http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		slog.Error("could not register schema", "err", err)
+		http.Error(w, "could not register schema", http.StatusInternalServerError)
+		return
+	}
+
+	slog.Info("registered schema", "topic", topic, "id", registered.Id, "version", registered.Version)
+
+	writeJSON(w, http.StatusCreated, toSchemaResponse(registered))
+}
+
+func (s *Server) SetSchemaCompatibilityHandler(w http.ResponseWriter, r *http.Request) {
+	topic := getTopicFromUrl(r)
+	if topic == "" {
+		slog.Error("missing topic")
+		http.Error(w, "missing topic", http.StatusBadRequest)
+		return
+	}
+
+	var request SchemaCompatibilityRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		slog.Error("could not read request body", "err", err)
+		http.Error(w, "could not read request body", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.namespace(r).schemas.SetCompatibility(topic, schema.Compatibility(request.Compatibility)); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, SchemaCompatibilityResponse{
+		Topic:         topic,
+		Compatibility: request.Compatibility,
+	})
+}
+
+func toSchemaResponse(s schema.Schema) SchemaResponse {
+	return SchemaResponse{
+		Id:      s.Id,
+		Topic:   s.Topic,
+		Version: s.Version,
+		Schema:  s.Definition,
+	}
+}
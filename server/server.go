@@ -1,17 +1,23 @@
 package server
 
 import (
+	"crypto/tls"
+	"errors"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
 	"github.com/mdkelley02/message-queue/storage"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
-	metrics "github.com/slok/go-http-metrics/metrics/prometheus"
 	"github.com/slok/go-http-metrics/middleware"
 	"github.com/slok/go-http-metrics/middleware/std"
 )
@@ -20,12 +26,65 @@ type Server struct {
 	serverAddr      string
 	metricsAddr     string
 	sigChan         chan os.Signal
-	messages        map[string]chan Message
 	router          *mux.Router
-	storage         map[string]storage.IStorage
 	makeStorageFunc func() storage.IStorage
 	upgrader        websocket.Upgrader
 	deadLetterTopic string
+	dataDir         string
+	persistMu       sync.Mutex
+	ackTimeout      time.Duration
+	topicDefaults   TopicConfig
+	maxMessageBytes int
+	tls             *TLSConfig
+	authenticators  []IAuthenticator
+	requireAuth     bool
+	aclConfig       *ACLConfig
+	publishLimits   *rateLimits
+	consumeLimits   *rateLimits
+	metrics         *topicMetrics
+	registry        *prometheus.Registry
+	spanExporter    ISpanExporter
+	auditConfig     *AuditConfig
+	auditFile       *rotatingFile
+
+	// replication state, see replication.go. follower is set while the
+	// broker follows a leader.
+	replication   *ReplicationConfig
+	replicationMu sync.Mutex
+	follower      atomic.Pointer[follower]
+
+	// cluster state, see cluster.go. cluster is set once Start made the
+	// broker a member.
+	clusterConfig *ClusterConfig
+	cluster       *cluster
+
+	mirrors []IMirror
+
+	// binary protocol state, see binary.go. binaryConns is nil once the
+	// server stopped serving the protocol.
+	binaryAddr     string
+	binaryListener net.Listener
+	binaryMu       sync.Mutex
+	binaryConns    map[net.Conn]struct{}
+	binaryServing  sync.WaitGroup
+
+	namespaces            *namespaceRegistry
+	defaultNamespace      *namespace
+	maxTopicsPerNamespace int
+
+	// health state, see health.go
+	ready    atomic.Bool
+	draining atomic.Bool
+
+	// shutdown state, see shutdown.go
+	shutdownTimeout time.Duration
+	shutdownDelay   time.Duration
+	httpServer      *http.Server
+	metricsServer   *http.Server
+	subscriptions   sync.WaitGroup
+	subscribeMu     sync.Mutex
+	closing         chan struct{}
+	abort           chan struct{}
 }
 
 type ServerConfig struct {
@@ -35,18 +94,82 @@ type ServerConfig struct {
 	MakeStorageFunc          func() storage.IStorage
 	WebsocketReadBufferSize  int
 	WebsocketWriteBufferSize int
+	// DataDir is where topic configs and file backed topics are kept. Topics
+	// are not persisted when it is empty.
+	DataDir    string
+	AckTimeout time.Duration
+	// ShutdownTimeout bounds how long Start waits for in-flight deliveries to
+	// be acknowledged once it is asked to stop.
+	ShutdownTimeout time.Duration
+	// ShutdownDelay is how long Start keeps serving after it is asked to
+	// stop while /readyz fails, so that load balancers stop sending traffic
+	// before the broker refuses it.
+	ShutdownDelay time.Duration
+	// TopicDefaults fills in the settings a new topic is not given
+	// explicitly, including topics created implicitly on first use.
+	TopicDefaults TopicConfig
+	// MaxTopics and MaxMessageBytes limit the number of topics and the size
+	// of a published message body. Zero means no limit. MaxTopics applies to
+	// every namespace that does not set its own quota.
+	MaxTopics       int
+	MaxMessageBytes int
+	// TLS serves every listener over TLS when set.
+	TLS *TLSConfig
+	// Authenticators identify the principal of a request, before a verified
+	// client certificate is used. Requests without credentials are anonymous
+	// unless RequireAuth is set.
+	Authenticators []IAuthenticator
+	RequireAuth    bool
+	// ACL enables authorization with the given static rules when set. The
+	// static rules belong to the default namespace. Rules added at runtime
+	// are kept in DataDir.
+	ACL *ACLConfig
+	// RateLimits throttles publishers and subscribers.
+	RateLimits RateLimitConfig
+	// SpanExporter receives a span for every publish and delivery. Traces
+	// are only propagated, not recorded, without one.
+	SpanExporter ISpanExporter
+	// Audit enables the audit log of administrative and security events.
+	Audit *AuditConfig
+	// Replication replicates topics between a leader and its followers.
+	Replication *ReplicationConfig
+	// Cluster makes the broker a member of a cluster, which elects the
+	// leader among its members. It needs Replication.
+	Cluster *ClusterConfig
+	// Mirrors copy topics of other brokers into this one while it serves.
+	Mirrors []IMirror
+	// BinaryAddr serves the binary protocol, see the protocol package,
+	// when set. It is served over TLS like the HTTP API.
+	BinaryAddr string
 }
 
 func NewServer(cfg ServerConfig) *Server {
 	s := &Server{
-		deadLetterTopic: cfg.DeadLetterTopic,
-		sigChan:         make(chan os.Signal, 1),
-		metricsAddr:     cfg.MetricsAddr,
-		serverAddr:      cfg.ServerAddr,
-		messages:        make(map[string]chan Message),
-		router:          mux.NewRouter(),
-		storage:         make(map[string]storage.IStorage),
-		makeStorageFunc: cfg.MakeStorageFunc,
+		deadLetterTopic:       cfg.DeadLetterTopic,
+		sigChan:               make(chan os.Signal, 1),
+		metricsAddr:           cfg.MetricsAddr,
+		serverAddr:            cfg.ServerAddr,
+		binaryAddr:            cfg.BinaryAddr,
+		router:                mux.NewRouter(),
+		makeStorageFunc:       cfg.MakeStorageFunc,
+		dataDir:               cfg.DataDir,
+		ackTimeout:            cfg.AckTimeout,
+		shutdownTimeout:       cfg.ShutdownTimeout,
+		shutdownDelay:         cfg.ShutdownDelay,
+		topicDefaults:         cfg.TopicDefaults,
+		maxMessageBytes:       cfg.MaxMessageBytes,
+		tls:                   cfg.TLS,
+		authenticators:        append(append([]IAuthenticator{}, cfg.Authenticators...), tlsAuthenticator{}),
+		requireAuth:           cfg.RequireAuth,
+		aclConfig:             cfg.ACL,
+		publishLimits:         newRateLimits(DirectionPublish, cfg.RateLimits.Publish),
+		consumeLimits:         newRateLimits(DirectionConsume, cfg.RateLimits.Consume),
+		spanExporter:          cfg.SpanExporter,
+		auditConfig:           cfg.Audit,
+		namespaces:            newNamespaceRegistry(),
+		maxTopicsPerNamespace: cfg.MaxTopics,
+		closing:               make(chan struct{}),
+		abort:                 make(chan struct{}),
 		upgrader: websocket.Upgrader{
 			ReadBufferSize:  cfg.WebsocketReadBufferSize,
 			WriteBufferSize: cfg.WebsocketWriteBufferSize,
@@ -61,44 +184,217 @@ func NewServer(cfg ServerConfig) *Server {
 		s.upgrader.WriteBufferSize = 1024
 	}
 
+	if s.ackTimeout == 0 {
+		s.ackTimeout = 30 * time.Second
+	}
+
+	if s.shutdownTimeout == 0 {
+		s.shutdownTimeout = 30 * time.Second
+	}
+
+	if cfg.Replication != nil {
+		replication := cfg.Replication.withDefaults()
+		s.replication = &replication
+	}
+
+	if cfg.Cluster != nil {
+		cluster := cfg.Cluster.withDefaults()
+		s.clusterConfig = &cluster
+	}
+
+	s.mirrors = cfg.Mirrors
+
+	s.registry = prometheus.NewRegistry()
+	s.metrics = newTopicMetrics(s)
+
+	s.defaultNamespace = s.newNamespace(DefaultNamespace, NamespaceConfig{}, time.Now())
+	s.namespaces.create(DefaultNamespace, func() (*namespace, error) {
+		return s.defaultNamespace, nil
+	})
+
 	return s
 }
 
 func (s *Server) Start() error {
+	if err := s.enableACL(s.defaultNamespace); err != nil {
+		return err
+	}
+
+	// recover namespaces and topics from a previous run
+	if err := s.loadNamespaces(); err != nil {
+		return err
+	}
+	if err := s.loadTopics(); err != nil {
+		return err
+	}
+
+	if err := s.openAuditLog(); err != nil {
+		return err
+	}
+
+	if s.clusterConfig != nil {
+		cluster, err := s.newCluster(*s.clusterConfig)
+		if err != nil {
+			return err
+		}
+		s.cluster = cluster
+	}
+
+	var tlsConfig, binaryTLSConfig *tls.Config
+	if s.tls != nil {
+		reloader, err := newCertReloader(*s.tls)
+		if err != nil {
+			return err
+		}
+		tlsConfig = reloader.tlsConfig("h2", "http/1.1")
+		binaryTLSConfig = reloader.tlsConfig()
+	}
+
+	// bind the listeners up front so that a taken address fails Start and
+	// readiness is only reported once they accept connections
+	listener, err := net.Listen("tcp", s.serverAddr)
+	if err != nil {
+		return err
+	}
+
+	if s.binaryAddr != "" {
+		binaryListener, err := net.Listen("tcp", s.binaryAddr)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		if binaryTLSConfig != nil {
+			binaryListener = tls.NewListener(binaryListener, binaryTLSConfig)
+		}
+		s.binaryListener = binaryListener
+		s.binaryConns = make(map[net.Conn]struct{})
+	}
 
 	//  if metricsAddr is not empty, start metrics server
 	if s.metricsAddr != "" {
+		metricsListener, err := net.Listen("tcp", s.metricsAddr)
+		if err != nil {
+			listener.Close()
+			if s.binaryListener != nil {
+				s.binaryListener.Close()
+			}
+			return err
+		}
+
 		s.router.Use(std.HandlerProvider("", middleware.New(middleware.Config{
-			Recorder: metrics.NewRecorder(metrics.Config{}),
+			Recorder: newNamespaceRecorder(s.registry),
 		})))
+		s.registerLagMetrics()
+		s.registerTopicMetrics()
 
+		// the probes are served here as well, this server keeps running
+		// while subscribers drain
+		s.metricsServer = &http.Server{Handler: s.withProbes(promhttp.HandlerFor(prometheus.Gatherers{prometheus.DefaultGatherer, s.registry}, promhttp.HandlerOpts{})), TLSConfig: tlsConfig}
 		go func() {
 			slog.Info("starting metrics server")
-			if err := http.ListenAndServe(s.metricsAddr, promhttp.Handler()); err != nil {
-				slog.Info("metrics server failed: %v", err)
+			if err := serve(s.metricsServer, metricsListener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Info("metrics server failed", "err", err)
 			}
 		}()
 	}
 
+	s.router.Use(withRequestId, s.authenticate, s.resolveNamespace)
+
 	// initialize routes
-	s.router.HandleFunc("/topics", s.GetTopicsHandler).Methods(http.MethodGet)
-	s.router.HandleFunc("/topics/{topic}", s.PublishHandler).Methods(http.MethodPost)
-	s.router.HandleFunc("/topics/{topic}/subscribe", s.SubscribeHandler).Methods(http.MethodGet)
+	s.router.HandleFunc("/whoami", s.WhoAmIHandler).Methods(http.MethodGet)
+	s.router.HandleFunc("/namespaces", s.requireBrokerAdmin(s.GetNamespacesHandler)).Methods(http.MethodGet)
+	s.router.HandleFunc("/namespaces", s.leaderOnly(s.replicated(s.requireBrokerAdmin(s.CreateNamespaceHandler)))).Methods(http.MethodPost)
+	s.router.HandleFunc("/namespaces/{name}", s.requireBrokerAdmin(s.GetNamespaceHandler)).Methods(http.MethodGet)
+	s.router.HandleFunc("/namespaces/{name}", s.leaderOnly(s.replicated(s.requireBrokerAdmin(s.UpdateNamespaceConfigHandler)))).Methods(http.MethodPut)
+	s.router.HandleFunc("/namespaces/{name}", s.leaderOnly(s.replicated(s.requireBrokerAdmin(s.DeleteNamespaceHandler)))).Methods(http.MethodDelete)
+	s.router.HandleFunc("/ratelimits", s.requireBrokerAdmin(s.GetRateLimitsHandler)).Methods(http.MethodGet)
+	s.router.HandleFunc("/mirrors", s.requireBrokerAdmin(s.GetMirrorsHandler)).Methods(http.MethodGet)
+	s.router.Handle("/dashboard", http.RedirectHandler(dashboardPath, http.StatusMovedPermanently)).Methods(http.MethodGet)
+	s.router.PathPrefix(dashboardAPIPath + "/").Handler(s.dashboardAPIHandler())
+	s.router.PathPrefix(dashboardPath).Handler(s.dashboardHandler()).Methods(http.MethodGet)
+	if s.replication != nil {
+		s.router.HandleFunc("/replication", s.requireBrokerAdmin(s.GetReplicationHandler)).Methods(http.MethodGet)
+		s.router.HandleFunc("/replication/promote", s.requireBrokerAdmin(s.PromoteHandler)).Methods(http.MethodPost)
+		s.router.HandleFunc("/replication/follow", s.requireBrokerAdmin(s.FollowHandler)).Methods(http.MethodPost)
+		s.router.HandleFunc("/replication/topics", s.requireBrokerAdmin(s.GetReplicatedTopicsHandler)).Methods(http.MethodGet)
+		s.router.HandleFunc("/replication/fetch", s.requireBrokerAdmin(s.ReplicaFetchHandler)).Methods(http.MethodGet)
+	}
+	if s.cluster != nil {
+		s.router.HandleFunc("/cluster", s.requireBrokerAdmin(s.GetClusterHandler)).Methods(http.MethodGet)
+		s.router.HandleFunc("/cluster/members", s.leaderOnly(s.requireBrokerAdmin(s.AddClusterMemberHandler))).Methods(http.MethodPost)
+		s.router.HandleFunc("/cluster/members/{id}", s.leaderOnly(s.requireBrokerAdmin(s.RemoveClusterMemberHandler))).Methods(http.MethodDelete)
+		s.router.HandleFunc("/cluster/raft/vote", s.requireBrokerAdmin(s.RaftVoteHandler)).Methods(http.MethodPost)
+		s.router.HandleFunc("/cluster/raft/append", s.requireBrokerAdmin(s.RaftAppendHandler)).Methods(http.MethodPost)
+	}
+
+	// the topic routes of a namespace live under /ns/{ns}, the default
+	// namespace also serves them at the root
+	s.routes(s.router.PathPrefix("/ns/{ns}").Subrouter())
+	s.routes(s.router)
+
+	go s.enforceRetention()
 
 	// start message queue server
+	s.httpServer = &http.Server{Handler: s.withProbes(s.router), TLSConfig: tlsConfig}
 	go func() {
-		slog.Info("starting message queue server")
-		if err := http.ListenAndServe(s.serverAddr, s.router); err != nil {
-			slog.Error("message queue server failed: %v", err)
+		slog.Info("starting message queue server", "tls", tlsConfig != nil)
+		if err := serve(s.httpServer, listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("message queue server failed", "err", err)
 		}
 	}()
 
+	if s.binaryListener != nil {
+		go s.serveBinary(s.binaryListener)
+	}
+
+	if s.cluster != nil {
+		s.cluster.start()
+	} else if s.replication != nil && s.replication.Leader != "" {
+		s.follower.Store(s.startFollowing(s.replication.Leader))
+	}
+	s.startMirrors()
+
+	s.ready.Store(true)
+
 	signal.Notify(s.sigChan, syscall.SIGTERM, syscall.SIGINT)
 	<-s.sigChan
+	signal.Stop(s.sigChan)
 
 	slog.Info("shutting down message queue server")
 
-	return nil
+	return s.shutdown()
+}
+
+// routes registers the routes of a namespace on router.
+func (s *Server) routes(router *mux.Router) {
+	router.HandleFunc("/acls", s.requireACLs(s.GetACLsHandler)).Methods(http.MethodGet)
+	router.HandleFunc("/acls", s.leaderOnly(s.replicated(s.requireACLs(s.AddACLHandler)))).Methods(http.MethodPost)
+	router.HandleFunc("/acls/{id}", s.leaderOnly(s.replicated(s.requireACLs(s.DeleteACLHandler)))).Methods(http.MethodDelete)
+	router.HandleFunc("/lag", s.GetLagHandler).Methods(http.MethodGet)
+	router.HandleFunc("/topics", s.GetTopicsHandler).Methods(http.MethodGet)
+	router.HandleFunc("/topics", s.leaderOnly(s.replicated(s.CreateTopicHandler))).Methods(http.MethodPost)
+	router.HandleFunc("/topics/{topic}", s.authorize(s.GetTopicHandler, ActionPublish, ActionSubscribe)).Methods(http.MethodGet)
+	router.HandleFunc("/topics/{topic}", s.leaderOnly(s.authorize(s.PublishHandler, ActionPublish))).Methods(http.MethodPost)
+	router.HandleFunc("/topics/{topic}", s.leaderOnly(s.replicated(s.authorize(s.DeleteTopicHandler, ActionAdmin)))).Methods(http.MethodDelete)
+	router.HandleFunc("/topics/{topic}/config", s.leaderOnly(s.replicated(s.authorize(s.UpdateTopicConfigHandler, ActionAdmin)))).Methods(http.MethodPut)
+	router.HandleFunc("/topics/{topic}/messages", s.authorize(s.BrowseMessagesHandler, ActionSubscribe)).Methods(http.MethodGet)
+	router.HandleFunc("/topics/{topic}/messages/{messageId}", s.authorize(s.GetMessageHandler, ActionSubscribe)).Methods(http.MethodGet)
+	router.HandleFunc("/topics/{topic}/lag", s.authorize(s.GetTopicLagHandler, ActionPublish, ActionSubscribe)).Methods(http.MethodGet)
+	router.HandleFunc("/topics/{topic}/purge", s.leaderOnly(s.replicated(s.authorize(s.PurgeTopicHandler, ActionAdmin)))).Methods(http.MethodPost)
+	router.HandleFunc("/topics/{topic}/subscribe", s.leaderOnly(s.authorize(s.SubscribeHandler, ActionSubscribe))).Methods(http.MethodGet)
+	router.HandleFunc("/topics/{topic}/redrive", s.leaderOnly(s.replicated(s.authorize(s.RedriveHandler, ActionAdmin)))).Methods(http.MethodPost)
+	router.HandleFunc("/topics/{topic}/schemas", s.authorize(s.GetSchemasHandler, ActionPublish, ActionSubscribe)).Methods(http.MethodGet)
+	router.HandleFunc("/topics/{topic}/schemas", s.leaderOnly(s.replicated(s.authorize(s.RegisterSchemaHandler, ActionAdmin)))).Methods(http.MethodPost)
+	router.HandleFunc("/topics/{topic}/schemas/compatibility", s.leaderOnly(s.replicated(s.authorize(s.SetSchemaCompatibilityHandler, ActionAdmin)))).Methods(http.MethodPut)
+	router.HandleFunc("/topics/{topic}/schemas/{version}", s.authorize(s.GetSchemaHandler, ActionPublish, ActionSubscribe)).Methods(http.MethodGet)
+}
+
+// serve serves over TLS when the server has a TLS config.
+func serve(srv *http.Server, listener net.Listener) error {
+	if srv.TLSConfig != nil {
+		return srv.ServeTLS(listener, "", "")
+	}
+	return srv.Serve(listener)
 }
 
 func (s *Server) Stop() {
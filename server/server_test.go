@@ -0,0 +1,1184 @@
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/mdkelley02/message-queue/storage"
+)
+
+func newTestServer() *Server {
+	return NewServer(ServerConfig{
+		MakeStorageFunc: storage.NewStorage,
+	})
+}
+
+func Test_topicRegistry(t *testing.T) {
+	t.Run("concurrent upserts of the same topic return the same topic", func(t *testing.T) {
+		s := newTestServer()
+
+		const workers = 32
+		topics := make([]*topic, workers)
+
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				topic, err := s.upsertTopic(s.defaultNamespace, fmt.Sprintf("topic-%d", i%4))
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				topics[i] = topic
+			}(i)
+		}
+		wg.Wait()
+
+		for i := 4; i < workers; i++ {
+			assert.Same(t, topics[i%4], topics[i])
+		}
+		assert.Len(t, s.defaultNamespace.topics.list(), 4)
+	})
+
+	t.Run("only one of several concurrent creates succeeds", func(t *testing.T) {
+		s := newTestServer()
+
+		const workers = 16
+		errs := make(chan error, workers)
+
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, err := s.createTopic(s.defaultNamespace, "contended", TopicConfig{})
+				errs <- err
+			}()
+		}
+		wg.Wait()
+		close(errs)
+
+		created := 0
+		for err := range errs {
+			if err == nil {
+				created++
+				continue
+			}
+			assert.ErrorIs(t, err, errTopicExists)
+		}
+		assert.Equal(t, 1, created)
+	})
+
+	t.Run("topics created by a publish or subscribe have valid names", func(t *testing.T) {
+		s := newTestServer()
+
+		for _, name := range []string{"..", ".", "a/b", systemTopicPrefix + ".."} {
+			_, err := s.publishMessage(s.defaultNamespace, name, PublishRequest{Body: "m"})
+			assert.ErrorIs(t, err, errInvalidTopicConfig, name)
+			_, err = s.upsertTopic(s.defaultNamespace, name)
+			assert.ErrorIs(t, err, errInvalidTopicConfig, name)
+		}
+		assert.Empty(t, s.defaultNamespace.topics.list())
+
+		_, err := s.upsertTopic(s.defaultNamespace, AuditTopic)
+		assert.NoError(t, err)
+	})
+
+	t.Run("new topics inherit the server defaults and respect the limits", func(t *testing.T) {
+		s := NewServer(ServerConfig{
+			MakeStorageFunc: storage.NewStorage,
+			TopicDefaults:   TopicConfig{Partitions: 3, DeliveryMode: DeliveryAtLeastOnce},
+			MaxTopics:       2,
+			MaxMessageBytes: 4,
+		})
+
+		implicit, err := s.upsertTopic(s.defaultNamespace, "implicit")
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 3, implicit.cfg().Partitions)
+		assert.Equal(t, DeliveryAtLeastOnce, implicit.cfg().DeliveryMode)
+
+		explicit, err := s.createTopic(s.defaultNamespace, "explicit", TopicConfig{Partitions: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 1, explicit.cfg().Partitions)
+		assert.Equal(t, DeliveryAtLeastOnce, explicit.cfg().DeliveryMode)
+
+		_, err = s.createTopic(s.defaultNamespace, "one-too-many", TopicConfig{})
+		assert.ErrorIs(t, err, errTooManyTopics)
+
+		_, err = s.publishMessage(s.defaultNamespace, "explicit", PublishRequest{Body: "too long"})
+		assert.ErrorIs(t, err, errMessageTooLarge)
+	})
+
+	t.Run("topics can be listed, configured and deleted while others are published to", func(t *testing.T) {
+		s := newTestServer()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(3)
+
+			name := fmt.Sprintf("topic-%d", i)
+			scratch := fmt.Sprintf("scratch-%d", i)
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 50; j++ {
+					if _, err := s.publishMessage(s.defaultNamespace, name, PublishRequest{Body: "m"}); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					recorder := httptest.NewRecorder()
+					s.GetTopicsHandler(recorder, httptest.NewRequest(http.MethodGet, "/topics", nil))
+
+					var response GetTopicsResponse
+					if err := json.NewDecoder(recorder.Body).Decode(&response); err != nil {
+						t.Error(err)
+						return
+					}
+					s.lag(s.defaultNamespace, time.Now())
+				}
+			}()
+
+			go func() {
+				defer wg.Done()
+				for j := 0; j < 20; j++ {
+					if _, err := s.createTopic(s.defaultNamespace, scratch, TopicConfig{}); err != nil {
+						t.Error(err)
+						return
+					}
+					if _, err := s.updateTopicConfig(s.defaultNamespace, scratch, TopicConfig{MaxSize: j + 1}); err != nil {
+						t.Error(err)
+						return
+					}
+					if err := s.deleteTopic(s.defaultNamespace, scratch); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		for i := 0; i < 8; i++ {
+			topic, err := s.getTopic(s.defaultNamespace, fmt.Sprintf("topic-%d", i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, 50, topic.stats().Count)
+		}
+	})
+}
+
+func Test_dispatcher(t *testing.T) {
+	t.Run("every published message is claimed exactly once by concurrent subscribers", func(t *testing.T) {
+		s := newTestServer()
+		topic, err := s.createTopic(s.defaultNamespace, "dispatched", TopicConfig{Partitions: 4, Partitioner: PartitionerRoundRobin})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		const (
+			publishers  = 4
+			perProducer = 100
+			subscribers = 3
+		)
+
+		var mu sync.Mutex
+		seen := make(map[string]int)
+
+		done := make(chan struct{})
+		var consumers sync.WaitGroup
+		for i := 0; i < subscribers; i++ {
+			consumers.Add(1)
+			go func() {
+				defer consumers.Done()
+				ids := []int{0, 1, 2, 3}
+				next := 0
+				for {
+					wake := topic.wait()
+					message, record, ok := topic.claim(DefaultGroup, ids, &next)
+					if !ok {
+						select {
+						case <-wake:
+							continue
+						case <-done:
+							return
+						}
+					}
+
+					if err := topic.ack(DefaultGroup, message); err != nil {
+						t.Error(err)
+					}
+
+					mu.Lock()
+					seen[record.Value]++
+					mu.Unlock()
+				}
+			}()
+		}
+
+		var producers sync.WaitGroup
+		for i := 0; i < publishers; i++ {
+			producers.Add(1)
+			go func(i int) {
+				defer producers.Done()
+				for j := 0; j < perProducer; j++ {
+					if _, err := s.publishMessage(s.defaultNamespace, "dispatched", PublishRequest{Body: fmt.Sprintf("%d-%d", i, j)}); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}(i)
+		}
+		producers.Wait()
+
+		assert.Eventually(t, func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			return len(seen) == publishers*perProducer
+		}, 5*time.Second, 10*time.Millisecond)
+
+		close(done)
+		consumers.Wait()
+
+		for value, count := range seen {
+			assert.Equal(t, 1, count, value)
+		}
+		assert.Equal(t, 0, topic.stats().Count)
+	})
+
+	t.Run("acknowledged messages are removed in batches", func(t *testing.T) {
+		s := newTestServer()
+		topic, err := s.createTopic(s.defaultNamespace, "batched", TopicConfig{Partitions: 1, MaxSize: truncateBatch + 10})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < truncateBatch+10; i++ {
+			if _, err := s.publishMessage(s.defaultNamespace, "batched", PublishRequest{Body: "m"}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err = s.publishMessage(s.defaultNamespace, "batched", PublishRequest{Body: "m"})
+		assert.ErrorIs(t, err, errTopicFull)
+
+		p := topic.partitions[0]
+		for offset := 0; offset < truncateBatch-1; offset++ {
+			if err := p.ack(DefaultGroup, offset); err != nil {
+				t.Fatal(err)
+			}
+		}
+		assert.Equal(t, 0, p.storage.Stats().LowWatermark)
+
+		// the messages still stored are left out of the stats and reads
+		assert.Equal(t, storage.Stats{LowWatermark: truncateBatch - 1, HighWatermark: truncateBatch + 10, Count: 11, Bytes: 11}, p.stats())
+		next, err := p.read(0, 1, func(offset int, _ storage.Record) bool {
+			assert.Equal(t, truncateBatch-1, offset)
+			return true
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, truncateBatch, next)
+		if _, err := s.publishMessage(s.defaultNamespace, "batched", PublishRequest{Body: "m"}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := p.ack(DefaultGroup, truncateBatch-1); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, truncateBatch, p.storage.Stats().LowWatermark)
+
+		// the last messages are removed once they are all acknowledged
+		if err := p.commit(DefaultGroup, truncateBatch+11); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 0, topic.stats().Count)
+	})
+
+	t.Run("scheduled wakeups fire in order and not before they are due", func(t *testing.T) {
+		d := newDispatcher()
+		go d.run()
+		defer d.stop()
+
+		start := time.Now()
+		wake := d.wait()
+		d.signalAt(start.Add(80 * time.Millisecond))
+		d.signalAt(start.Add(40 * time.Millisecond))
+
+		<-wake
+		assert.GreaterOrEqual(t, time.Since(start), 40*time.Millisecond)
+
+		wake = d.wait()
+		<-wake
+		assert.GreaterOrEqual(t, time.Since(start), 80*time.Millisecond)
+	})
+
+	t.Run("signals do not block once the dispatcher stopped", func(t *testing.T) {
+		d := newDispatcher()
+		go d.run()
+		d.stop()
+
+		for i := 0; i < 3; i++ {
+			d.signal()
+		}
+		d.signalAt(time.Now().Add(time.Hour))
+	})
+}
+
+func Test_authenticate(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	now := time.Now()
+
+	s := NewServer(ServerConfig{
+		MakeStorageFunc: storage.NewStorage,
+		RequireAuth:     true,
+		Authenticators: []IAuthenticator{
+			NewAPIKeyAuthenticator([]APIKey{{Name: "billing", Key: "k1", Roles: []string{"publisher"}}}),
+			NewJWTAuthenticator(JWTConfig{Secret: secret, Issuer: "auth", Audience: "mq"}),
+		},
+	})
+	handler := s.authenticate(http.HandlerFunc(s.WhoAmIHandler))
+
+	whoami := func(header string, value string) (int, Principal) {
+		r := httptest.NewRequest(http.MethodGet, "/whoami", nil)
+		if header != "" {
+			r.Header.Set(header, value)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		var p Principal
+		if w.Code == http.StatusOK {
+			json.NewDecoder(w.Body).Decode(&p)
+		}
+		return w.Code, p
+	}
+
+	token := func(claims TokenClaims) string {
+		token, err := SignToken(secret, claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "Bearer " + token
+	}
+
+	t.Run("api keys map to their principal", func(t *testing.T) {
+		code, p := whoami(APIKeyHeader, "k1")
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, Principal{Name: "billing", Method: AuthMethodAPIKey, Roles: []string{"publisher"}}, p)
+
+		code, _ = whoami(APIKeyHeader, "k2")
+		assert.Equal(t, http.StatusUnauthorized, code)
+	})
+
+	t.Run("valid tokens map to their subject", func(t *testing.T) {
+		code, p := whoami("Authorization", token(TokenClaims{
+			Subject:   "alice",
+			Issuer:    "auth",
+			Audience:  audience{"other", "mq"},
+			ExpiresAt: now.Add(time.Minute).Unix(),
+			Roles:     []string{"admin"},
+		}))
+		assert.Equal(t, http.StatusOK, code)
+		assert.Equal(t, Principal{Name: "alice", Method: AuthMethodJWT, Roles: []string{"admin"}}, p)
+	})
+
+	t.Run("invalid tokens are rejected", func(t *testing.T) {
+		valid := TokenClaims{Subject: "alice", Issuer: "auth", Audience: audience{"mq"}}
+
+		expired := valid
+		expired.ExpiresAt = now.Add(-time.Minute).Unix()
+		early := valid
+		early.NotBefore = now.Add(time.Minute).Unix()
+		wrongIssuer := valid
+		wrongIssuer.Issuer = "someone"
+		wrongAudience := valid
+		wrongAudience.Audience = audience{"other"}
+		noSubject := valid
+		noSubject.Subject = ""
+
+		forged, err := SignToken([]byte("another secret"), valid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		payload := strings.Split(token(valid), ".")[1]
+		unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." + payload + "."
+
+		for name, value := range map[string]string{
+			"expired":        token(expired),
+			"not yet valid":  token(early),
+			"wrong issuer":   token(wrongIssuer),
+			"wrong audience": token(wrongAudience),
+			"no subject":     token(noSubject),
+			"forged":         "Bearer " + forged,
+			"unsigned":       "Bearer " + unsigned,
+			"malformed":      "Bearer abc",
+		} {
+			code, _ := whoami("Authorization", value)
+			assert.Equal(t, http.StatusUnauthorized, code, name)
+		}
+	})
+
+	t.Run("requests without credentials are rejected when required", func(t *testing.T) {
+		code, _ := whoami("", "")
+		assert.Equal(t, http.StatusUnauthorized, code)
+
+		open := newTestServer()
+		w := httptest.NewRecorder()
+		open.authenticate(http.HandlerFunc(open.WhoAmIHandler)).ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/whoami", nil))
+
+		var p Principal
+		json.NewDecoder(w.Body).Decode(&p)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, anonymous, p)
+	})
+}
+
+func Test_acl(t *testing.T) {
+	alice := Principal{Name: "alice", Method: AuthMethodJWT}
+	ops := Principal{Name: "bob", Method: AuthMethodAPIKey, Roles: []string{"ops"}}
+
+	t.Run("rules match principals, roles and topic patterns", func(t *testing.T) {
+		acl, err := newACLStore(ACLConfig{Rules: []ACLRule{
+			{Principal: "alice", Topic: "orders.*", Actions: []string{ActionPublish}},
+			{Role: "ops", Topic: "*", Actions: []string{ActionAdmin}},
+			{Principal: "*", Topic: "public", Actions: []string{ActionSubscribe}},
+		}}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.True(t, acl.allowed(alice, ActionPublish, "orders.eu"))
+		assert.False(t, acl.allowed(alice, ActionSubscribe, "orders.eu"))
+		assert.False(t, acl.allowed(alice, ActionPublish, "payments"))
+		assert.True(t, acl.allowed(alice, ActionPublish, DeadLetterTopic("orders.eu")))
+
+		assert.True(t, acl.allowed(ops, ActionPublish, "payments"))
+		assert.True(t, acl.allowed(ops, ActionAdmin, aclTopic))
+		assert.False(t, acl.allowed(alice, ActionAdmin, aclTopic))
+
+		assert.True(t, acl.allowed(anonymous, ActionSubscribe, "public"))
+		assert.False(t, acl.allowed(Principal{Name: "alice", Method: AuthMethodNone}, ActionPublish, "orders.eu"))
+	})
+
+	t.Run("only rules for every topic grant access to the rules", func(t *testing.T) {
+		carol := Principal{Name: "carol", Method: AuthMethodAPIKey}
+		acl, err := newACLStore(ACLConfig{Rules: []ACLRule{
+			{Role: "ops", Topic: "*", Actions: []string{ActionAdmin}},
+			{Principal: "carol", Topic: "?", Actions: []string{ActionAdmin}},
+		}}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// "?" matches the name "*" but not every topic
+		assert.True(t, acl.allowed(carol, ActionAdmin, "a"))
+		assert.False(t, acl.grantsEveryTopic(carol, ActionAdmin))
+		assert.True(t, acl.grantsEveryTopic(ops, ActionAdmin))
+	})
+
+	t.Run("only rules for every topic of the default namespace make broker admins", func(t *testing.T) {
+		carol := Principal{Name: "carol", Method: AuthMethodAPIKey}
+		s := NewServer(ServerConfig{
+			MakeStorageFunc: storage.NewStorage,
+			ACL: &ACLConfig{Rules: []ACLRule{
+				{Role: "ops", Topic: "*", Actions: []string{ActionAdmin}},
+				{Principal: "carol", Topic: "?", Actions: []string{ActionAdmin}},
+				{Principal: "carol", Topic: "[*]", Actions: []string{ActionAdmin}},
+			}},
+		})
+		if err := s.enableACL(s.defaultNamespace); err != nil {
+			t.Fatal(err)
+		}
+
+		assert.False(t, s.brokerAdmin(carol))
+		assert.True(t, s.brokerAdmin(ops))
+
+		for _, tc := range []struct {
+			p    Principal
+			code int
+		}{{carol, http.StatusForbidden}, {ops, http.StatusOK}} {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/acls", nil)
+			s.requireACLs(s.GetACLsHandler)(w, r.WithContext(withPrincipal(r.Context(), tc.p)))
+			assert.Equal(t, tc.code, w.Code, tc.p.Name)
+
+			w = httptest.NewRecorder()
+			s.requireBrokerAdmin(s.GetNamespacesHandler)(w, r.WithContext(withPrincipal(r.Context(), tc.p)))
+			assert.Equal(t, tc.code, w.Code, tc.p.Name)
+		}
+	})
+
+	t.Run("runtime rules are persisted and static rules cannot be removed", func(t *testing.T) {
+		dataDir := t.TempDir()
+		acl, err := newACLStore(ACLConfig{Rules: []ACLRule{
+			{Role: "ops", Topic: "*", Actions: []string{ActionAdmin}},
+		}}, dataDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = acl.add(ACLRule{Principal: "alice", Topic: "orders", Actions: []string{"read"}})
+		assert.ErrorIs(t, err, errInvalidACLRule)
+
+		rule, err := acl.add(ACLRule{Principal: "alice", Topic: "orders", Actions: []string{ActionSubscribe}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.ErrorIs(t, acl.remove("static-0"), errACLStatic)
+
+		reloaded, err := newACLStore(ACLConfig{}, dataDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := reloaded.load(); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, []ACLRule{rule}, reloaded.list())
+		assert.True(t, reloaded.allowed(alice, ActionSubscribe, "orders"))
+
+		assert.NoError(t, reloaded.remove(rule.Id))
+		assert.ErrorIs(t, reloaded.remove(rule.Id), errACLNotFound)
+		assert.False(t, reloaded.allowed(alice, ActionSubscribe, "orders"))
+	})
+}
+
+func Test_rateLimits(t *testing.T) {
+	start := time.Unix(1000, 0)
+	limits := newRateLimits(DirectionPublish, RateLimits{
+		Principal: RateLimit{MessagesPerSecond: 2},
+		Topic:     RateLimit{BytesPerSecond: 100},
+	})
+	alice := rateLimitKeys{principal: "alice", clientIP: "10.0.0.1", topic: "default/orders"}
+	bob := rateLimitKeys{principal: "bob", clientIP: "10.0.0.2", topic: "default/invoices"}
+
+	t.Run("publishes over the rate are refused until tokens refill", func(t *testing.T) {
+		assert.Zero(t, limits.tryTake(alice, 10, start))
+		assert.Zero(t, limits.tryTake(alice, 10, start))
+		assert.Equal(t, 500*time.Millisecond, limits.tryTake(alice, 10, start))
+
+		// other keys have buckets of their own
+		assert.Zero(t, limits.tryTake(bob, 10, start))
+
+		assert.Zero(t, limits.tryTake(alice, 10, start.Add(500*time.Millisecond)))
+	})
+
+	t.Run("a refused publish does not spend the tokens of the other buckets", func(t *testing.T) {
+		now := start.Add(time.Minute)
+		assert.Zero(t, limits.tryTake(alice, 100, now))
+		assert.Equal(t, time.Second, limits.tryTake(rateLimitKeys{principal: "carol", topic: "default/orders"}, 100, now))
+		assert.Zero(t, limits.tryTake(rateLimitKeys{principal: "carol", topic: "default/other"}, 1, now))
+		assert.Zero(t, limits.tryTake(rateLimitKeys{principal: "carol", topic: "default/other"}, 1, now))
+	})
+
+	t.Run("a publish one limit refuses does not spend the tokens of the others", func(t *testing.T) {
+		s := NewServer(ServerConfig{
+			MakeStorageFunc: storage.NewStorage,
+			RateLimits:      RateLimitConfig{Publish: RateLimits{Topic: RateLimit{MessagesPerSecond: 1}}},
+		})
+		s.defaultNamespace.publishes.setRate(2)
+
+		publish := func(topic string) int {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, "/topics/"+topic, strings.NewReader(`{"body": "m"}`))
+			s.PublishHandler(w, mux.SetURLVars(r, map[string]string{"topic": topic}))
+			return w.Code
+		}
+
+		assert.Equal(t, http.StatusOK, publish("a"))
+		// refused by the topic, the namespace gets its token back
+		assert.Equal(t, http.StatusTooManyRequests, publish("a"))
+		assert.Equal(t, http.StatusOK, publish("b"))
+
+		// refused by the namespace, the topic keeps its token
+		assert.Equal(t, http.StatusTooManyRequests, publish("c"))
+		s.defaultNamespace.publishes.setRate(0)
+		assert.Equal(t, http.StatusOK, publish("c"))
+	})
+
+	t.Run("deliveries run into debt and wait until it is paid", func(t *testing.T) {
+		consume := newRateLimits(DirectionConsume, RateLimits{Topic: RateLimit{BytesPerSecond: 100}})
+		now := start
+
+		assert.Zero(t, consume.wait(alice, now))
+		consume.take(alice, 300, now)
+		assert.Equal(t, 2*time.Second, consume.wait(alice, now))
+		assert.Zero(t, consume.wait(alice, now.Add(2*time.Second)))
+	})
+
+	t.Run("idle buckets are dropped", func(t *testing.T) {
+		later := start.Add(time.Hour)
+		limits.tryTake(bob, 1, later)
+
+		var keys []string
+		for _, l := range limits.list(later) {
+			keys = append(keys, l.Kind+":"+l.Key)
+		}
+		assert.ElementsMatch(t, []string{"principal:bob", "topic:default/invoices"}, keys)
+	})
+}
+
+func Test_retryPolicy(t *testing.T) {
+	t.Run("the delay grows by the multiplier up to the max delay", func(t *testing.T) {
+		p := &RetryPolicy{InitialDelay: Duration(time.Second), Multiplier: 2, MaxDelay: Duration(5 * time.Second)}
+		assert.Equal(t, time.Second, p.delay(1))
+		assert.Equal(t, 4*time.Second, p.delay(3))
+		assert.Equal(t, 5*time.Second, p.delay(4))
+		assert.Equal(t, 5*time.Second, p.delay(10000))
+	})
+
+	t.Run("the delay of late attempts does not overflow without a max delay", func(t *testing.T) {
+		p := &RetryPolicy{InitialDelay: Duration(time.Second), Multiplier: 2}
+		assert.Equal(t, time.Duration(math.MaxInt64), p.delay(10000))
+
+		p.Jitter = 0.5
+		for i := 0; i < 100; i++ {
+			assert.Positive(t, p.delay(10000))
+		}
+	})
+}
+
+func Test_metrics(t *testing.T) {
+	t.Run("every server exports the lag of its own groups", func(t *testing.T) {
+		for _, topicName := range []string{"first", "second"} {
+			s := newTestServer()
+			topic, err := s.createTopic(s.defaultNamespace, topicName, TopicConfig{Partitions: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.publishMessage(s.defaultNamespace, topicName, PublishRequest{Body: "m"}); err != nil {
+				t.Fatal(err)
+			}
+			if err := topic.partitions[0].ack(DefaultGroup, 0); err != nil {
+				t.Fatal(err)
+			}
+			s.registerLagMetrics()
+
+			families, err := s.registry.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var topics []string
+			for _, family := range families {
+				if family.GetName() != "mq_consumer_group_lag_messages" {
+					continue
+				}
+				for _, metric := range family.GetMetric() {
+					for _, label := range metric.GetLabel() {
+						if label.GetName() == "topic" {
+							topics = append(topics, label.GetValue())
+						}
+					}
+				}
+			}
+			assert.Equal(t, []string{topicName}, topics)
+		}
+	})
+}
+
+func Test_shutdown(t *testing.T) {
+	t.Run("subscriptions are refused once the server is closing", func(t *testing.T) {
+		s := newTestServer()
+		s.subscribeMu.Lock()
+		close(s.closing)
+		s.subscribeMu.Unlock()
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/topics/orders/subscribe", nil)
+		s.SubscribeHandler(w, mux.SetURLVars(r, map[string]string{"topic": "orders"}))
+		assert.Equal(t, http.StatusServiceUnavailable, w.Code)
+
+		// nothing was counted that shutdown would wait for
+		assert.False(t, s.addSubscription())
+		s.subscriptions.Wait()
+	})
+}
+
+func Test_traceContext(t *testing.T) {
+	header := func(traceparent string, tracestate ...string) http.Header {
+		h := http.Header{}
+		h.Set(TraceParentHeader, traceparent)
+		for _, state := range tracestate {
+			h.Add(TraceStateHeader, state)
+		}
+		return h
+	}
+
+	t.Run("valid trace context headers are extracted", func(t *testing.T) {
+		tc := TraceContextFromHeader(header("00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", "a=1", "b=2"))
+		assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", tc.TraceId())
+		assert.Equal(t, "b7ad6b7169203331", tc.SpanId())
+		assert.Equal(t, "a=1,b=2", tc.TraceState)
+
+		// later versions may add fields
+		tc = TraceContextFromHeader(header("01-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-extra"))
+		assert.Equal(t, "0af7651916cd43dd8448eb211c80319c", tc.TraceId())
+
+		h := http.Header{}
+		TraceContext{TraceParent: "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", TraceState: "a=1"}.Inject(h)
+		assert.Equal(t, "a=1", h.Get(TraceStateHeader))
+	})
+
+	t.Run("invalid traceparents are dropped with their state", func(t *testing.T) {
+		for _, traceparent := range []string{
+			"",
+			"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331",
+			"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-extra",
+			"ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+			"00-00000000000000000000000000000000-b7ad6b7169203331-01",
+			"00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01",
+			"00-0AF7651916CD43DD8448EB211C80319C-b7ad6b7169203331-01",
+			"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-1",
+		} {
+			assert.Equal(t, TraceContext{}, TraceContextFromHeader(header(traceparent, "a=1")), traceparent)
+		}
+	})
+
+	t.Run("the span log has a line of json per span", func(t *testing.T) {
+		var log strings.Builder
+		s := NewServer(ServerConfig{MakeStorageFunc: storage.NewStorage, SpanExporter: NewSpanLogExporter(&log)})
+
+		response, err := s.publishMessage(s.defaultNamespace, "traced", PublishRequest{Body: "m"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.publishMessage(s.defaultNamespace, "traced", PublishRequest{Body: "m2"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		lines := strings.Split(strings.TrimSpace(log.String()), "\n")
+		if assert.Len(t, lines, 2) {
+			var span Span
+			if err := json.Unmarshal([]byte(lines[0]), &span); err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, "publish traced", span.Name)
+			assert.Equal(t, response.MessageId, span.Attributes["messageId"])
+			assert.False(t, span.End.Before(span.Start))
+		}
+	})
+}
+
+func Test_audit(t *testing.T) {
+	t.Run("the audit file is rotated once it is full", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "audit.jsonl")
+		f, err := openRotatingFile(path, 10, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+			if _, err := f.Write([]byte(line)); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for name, want := range map[string]string{"": "fourth\n", ".1": "third\n", ".2": "second\n"} {
+			content, err := os.ReadFile(path + name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, want, string(content))
+		}
+		_, err = os.Stat(path + ".3")
+		assert.ErrorIs(t, err, os.ErrNotExist)
+	})
+
+	t.Run("request ids are taken from the client or generated", func(t *testing.T) {
+		var ids []string
+		handler := withRequestId(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ids = append(ids, requestIdFromContext(r.Context()))
+		}))
+
+		for _, id := range []string{"req-1", "", "has space", strings.Repeat("a", maxRequestIdLength+1)} {
+			r := httptest.NewRequest(http.MethodGet, "/topics", nil)
+			r.Header.Set(RequestIdHeader, id)
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			assert.Equal(t, ids[len(ids)-1], w.Header().Get(RequestIdHeader))
+		}
+
+		assert.Equal(t, "req-1", ids[0])
+		for _, id := range ids[1:] {
+			assert.Len(t, id, 32)
+		}
+	})
+
+	t.Run("system topics are only read by the broker admins", func(t *testing.T) {
+		s := newTestServer()
+		r := httptest.NewRequest(http.MethodGet, "/topics", nil)
+
+		assert.True(t, s.allowed(r, ActionSubscribe, AuditTopic))
+		assert.False(t, s.allowed(r, ActionPublish, AuditTopic))
+		assert.False(t, s.allowed(r, ActionAdmin, AuditTopic))
+	})
+}
+
+func Test_replication(t *testing.T) {
+	t.Run("records keep their offsets across deletes and truncation", func(t *testing.T) {
+		leader := storage.NewStorage()
+		for _, value := range []string{"m0", "m1", "m2", "m3", "m4"} {
+			if _, err := leader.Put(storage.Record{Value: value}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := leader.Truncate(1); err != nil {
+			t.Fatal(err)
+		}
+		if err := leader.Delete(2); err != nil {
+			t.Fatal(err)
+		}
+		if err := leader.Delete(4); err != nil {
+			t.Fatal(err)
+		}
+
+		response, err := readReplicated(leader, 0, replicaHeld{low: -1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, 1, response.LowWatermark)
+		assert.Equal(t, 5, response.NextOffset)
+		assert.Len(t, response.Records, 2)
+
+		follower := storage.NewStorage()
+		if err := appendReplicated(follower, response); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, leader.Stats(), follower.Stats())
+
+		record, err := follower.Get(3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, "m3", record.Value)
+		_, err = follower.Get(2)
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+	})
+
+	t.Run("records deleted after they were copied are deleted on followers", func(t *testing.T) {
+		leader := storage.NewStorage()
+		for _, value := range []string{"m0", "m1", "m2", "m3", "m4"} {
+			if _, err := leader.Put(storage.Record{Value: value}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		follower := storage.NewStorage()
+		response, err := readReplicated(leader, 0, replicaHeld{low: -1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := appendReplicated(follower, response); err != nil {
+			t.Fatal(err)
+		}
+
+		held := func() replicaHeld {
+			stats := follower.Stats()
+			return replicaHeld{low: stats.LowWatermark, count: stats.Count}
+		}
+
+		response, err = readReplicated(leader, 5, held())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Empty(t, response.Deleted)
+
+		for _, offset := range []int{1, 3} {
+			if err := leader.Delete(offset); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if _, err := leader.Put(storage.Record{Value: "m5"}); err != nil {
+			t.Fatal(err)
+		}
+
+		response, err = readReplicated(leader, 5, held())
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, []int{1, 3}, response.Deleted)
+		if err := appendReplicated(follower, response); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, leader.Stats(), follower.Stats())
+		_, err = follower.Get(3)
+		assert.ErrorIs(t, err, storage.ErrNotFound)
+	})
+
+	t.Run("followers are in sync once they caught up", func(t *testing.T) {
+		rs := newReplicaSet()
+		now := time.Now()
+
+		rs.fetched("b", 3, 5, now)
+		assert.Equal(t, 0, rs.inSync(0, time.Second, now))
+
+		rs.fetched("b", 5, 5, now)
+		rs.fetched("c", 5, 5, now.Add(-2*time.Second))
+		assert.Equal(t, 1, rs.inSync(5, time.Second, now))
+		assert.Equal(t, 0, rs.inSync(6, time.Second, now))
+
+		err := rs.await(6, 1, time.Second, 10*time.Millisecond, nil)
+		assert.ErrorIs(t, err, errNotEnoughReplicas)
+
+		go rs.fetched("b", 6, 6, time.Now())
+		assert.NoError(t, rs.await(6, 1, time.Second, time.Second, nil))
+	})
+}
+
+// memoryTransport connects raft nodes in memory. Nodes that are down
+// neither send nor receive.
+type memoryTransport struct {
+	mu    sync.Mutex
+	nodes map[string]*raftNode
+	down  map[string]bool
+}
+
+func (m *memoryTransport) node(from string, to string) (*raftNode, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.down[from] || m.down[to] {
+		return nil, errors.New("unreachable")
+	}
+	return m.nodes[to], nil
+}
+
+func (m *memoryTransport) setDown(id string, down bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.down[id] = down
+}
+
+func (m *memoryTransport) requestVote(ctx context.Context, addr string, req RaftVoteRequest) (RaftVoteResponse, error) {
+	n, err := m.node(req.CandidateId, addr)
+	if err != nil {
+		return RaftVoteResponse{}, err
+	}
+	return n.handleVote(req), nil
+}
+
+func (m *memoryTransport) appendEntries(ctx context.Context, addr string, req RaftAppendRequest) (RaftAppendResponse, error) {
+	n, err := m.node(req.LeaderId, addr)
+	if err != nil {
+		return RaftAppendResponse{}, err
+	}
+	return n.handleAppend(req), nil
+}
+
+// listFSM appends the commands it applies to a list.
+type listFSM struct {
+	mu       sync.Mutex
+	commands []string
+}
+
+func (f *listFSM) apply(command json.RawMessage) error {
+	var value string
+	if err := json.Unmarshal(command, &value); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.commands = append(f.commands, value)
+	return nil
+}
+
+func (f *listFSM) snapshot() (json.RawMessage, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return json.Marshal(f.commands)
+}
+
+func (f *listFSM) restore(state json.RawMessage) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return json.Unmarshal(state, &f.commands)
+}
+
+func (f *listFSM) list() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string{}, f.commands...)
+}
+
+func Test_raft(t *testing.T) {
+	transport := &memoryTransport{nodes: make(map[string]*raftNode), down: make(map[string]bool)}
+	fsms := make(map[string]*listFSM)
+	members := map[string]string{"a": "a", "b": "b", "c": "c"}
+
+	start := func(id string) *raftNode {
+		fsms[id] = &listFSM{}
+		n, err := newRaftNode(id, members, fsms[id], transport, 10*time.Millisecond, 50*time.Millisecond, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		n.maxLogEntries = 4
+		transport.mu.Lock()
+		transport.nodes[id] = n
+		transport.mu.Unlock()
+		n.start()
+		t.Cleanup(n.stop)
+		return n
+	}
+
+	// leader returns the only leader among nodes that every node up agrees
+	// on
+	leader := func(ids ...string) *raftNode {
+		var leader *raftNode
+		for _, id := range ids {
+			n := transport.nodes[id]
+			status := n.status()
+			if status.role == RoleLeader {
+				if leader != nil {
+					return nil
+				}
+				leader = n
+			}
+		}
+		if leader == nil {
+			return nil
+		}
+		for _, id := range ids {
+			if transport.nodes[id].status().leaderId != leader.id {
+				return nil
+			}
+		}
+		return leader
+	}
+
+	awaitLeader := func(t *testing.T, ids ...string) *raftNode {
+		var n *raftNode
+		assert.Eventually(t, func() bool {
+			n = leader(ids...)
+			return n != nil
+		}, 5*time.Second, 5*time.Millisecond)
+		if n == nil {
+			t.FailNow()
+		}
+		return n
+	}
+
+	propose := func(t *testing.T, n *raftNode, value string) {
+		command, _ := json.Marshal(value)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := n.propose(ctx, command); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	applied := func(want []string, ids ...string) func() bool {
+		return func() bool {
+			for _, id := range ids {
+				if !assert.ObjectsAreEqual(want, fsms[id].list()) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+
+	for _, id := range []string{"a", "b", "c"} {
+		start(id)
+	}
+
+	t.Run("a leader is elected and its commands are applied everywhere", func(t *testing.T) {
+		n := awaitLeader(t, "a", "b", "c")
+		propose(t, n, "x")
+		propose(t, n, "y")
+
+		assert.Eventually(t, applied([]string{"x", "y"}, "a", "b", "c"), 5*time.Second, 5*time.Millisecond)
+
+		for _, id := range []string{"a", "b", "c"} {
+			if id != n.id {
+				assert.ErrorIs(t, transport.nodes[id].propose(context.Background(), json.RawMessage(`"z"`)), errNotLeader)
+			}
+		}
+	})
+
+	t.Run("another leader is elected when the leader fails", func(t *testing.T) {
+		old := awaitLeader(t, "a", "b", "c")
+		transport.setDown(old.id, true)
+
+		var others []string
+		for _, id := range []string{"a", "b", "c"} {
+			if id != old.id {
+				others = append(others, id)
+			}
+		}
+
+		n := awaitLeader(t, others...)
+		assert.NotEqual(t, old.id, n.id)
+		propose(t, n, "z")
+		assert.Eventually(t, applied([]string{"x", "y", "z"}, others...), 5*time.Second, 5*time.Millisecond)
+
+		// the old leader steps down and catches up once it is back
+		assert.Eventually(t, func() bool {
+			return old.status().role != RoleLeader
+		}, 5*time.Second, 5*time.Millisecond)
+		transport.setDown(old.id, false)
+		assert.Eventually(t, applied([]string{"x", "y", "z"}, "a", "b", "c"), 5*time.Second, 5*time.Millisecond)
+	})
+
+	t.Run("a new member gets the compacted log as a snapshot", func(t *testing.T) {
+		n := awaitLeader(t, "a", "b", "c")
+		for _, value := range []string{"1", "2", "3", "4", "5"} {
+			propose(t, n, value)
+		}
+		assert.Eventually(t, func() bool {
+			return n.status().commitIndex > 0 && n.snapshotIndex() > 0
+		}, 5*time.Second, 5*time.Millisecond)
+
+		d := start("d")
+		assert.Equal(t, RoleFollower, d.status().role)
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		err := n.changeMembers(ctx, func(members map[string]string) error {
+			members["d"] = "d"
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := []string{"x", "y", "z", "1", "2", "3", "4", "5"}
+		assert.Eventually(t, applied(want, "a", "b", "c", "d"), 5*time.Second, 5*time.Millisecond)
+		assert.Len(t, d.status().members, 4)
+
+		// with four members a leader needs three of them
+		transport.setDown("d", true)
+		transport.setDown(n.id, true)
+		assert.Never(t, func() bool {
+			return leader("a", "b", "c") != nil && leader("a", "b", "c") != n
+		}, 300*time.Millisecond, 10*time.Millisecond)
+
+		transport.setDown("d", false)
+		transport.setDown(n.id, false)
+		awaitLeader(t, "a", "b", "c", "d")
+	})
+}
@@ -0,0 +1,125 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var errShuttingDown = errors.New("server is shutting down")
+
+// shutdown stops the server in order: readiness fails for the shutdown delay,
+// publishes are refused and subscribers stop claiming messages, the HTTP
+// server and the binary protocol finish the requests they are serving,
+// subscribers get to acknowledge what they hold before they are sent a close
+// frame, and finally the storage of every topic is flushed. Deliveries still
+// unacknowledged when the shutdown timeout expires are requeued.
+func (s *Server) shutdown() error {
+	// fail readiness first so that load balancers stop sending traffic
+	// while the broker still serves it
+	s.draining.Store(true)
+	if s.shutdownDelay > 0 {
+		slog.Info("waiting before shutting down", "delay", s.shutdownDelay)
+		time.Sleep(s.shutdownDelay)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+
+	// stop copying from other brokers while publishes are still accepted
+	s.stopMirrors()
+
+	// subscriptions are counted under the same lock, none is added once
+	// shutdown waits for them
+	s.subscribeMu.Lock()
+	close(s.closing)
+	s.subscribeMu.Unlock()
+
+	var errs []error
+
+	// subscribe requests register themselves before they are hijacked, so
+	// every subscription is counted once this returns
+	if err := s.httpServer.Shutdown(ctx); err != nil {
+		slog.Error("could not shut down message queue server", "err", err)
+		errs = append(errs, err)
+	}
+	s.stopBinary(ctx)
+
+	drained := make(chan struct{})
+	go func() {
+		s.subscriptions.Wait()
+		close(drained)
+	}()
+
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		slog.Error("timed out waiting for subscribers, requeueing in-flight deliveries")
+		close(s.abort)
+
+		// give the subscribers a moment to put their messages back
+		select {
+		case <-drained:
+		case <-time.After(time.Second):
+		}
+	}
+
+	// leave the cluster and stop copying from the leader before the storage
+	// is closed
+	if s.cluster != nil {
+		s.cluster.stop()
+	}
+	s.stopFollowing()
+
+	if s.metricsServer != nil {
+		if err := s.metricsServer.Shutdown(ctx); err != nil {
+			slog.Error("could not shut down metrics server", "err", err)
+			errs = append(errs, err)
+		}
+	}
+
+	for _, t := range s.allTopics() {
+		t.close()
+	}
+
+	if s.auditFile != nil {
+		if err := s.auditFile.Close(); err != nil {
+			slog.Error("could not close audit log", "err", err)
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// addSubscription counts a new subscription, unless the server started
+// shutting down.
+func (s *Server) addSubscription() bool {
+	s.subscribeMu.Lock()
+	defer s.subscribeMu.Unlock()
+
+	if s.isClosing() {
+		return false
+	}
+	s.subscriptions.Add(1)
+	return true
+}
+
+// isClosing reports whether the server started shutting down.
+func (s *Server) isClosing() bool {
+	select {
+	case <-s.closing:
+		return true
+	default:
+		return false
+	}
+}
+
+func closeConn(conn *websocket.Conn, code int, reason string) {
+	closeMsg := websocket.FormatCloseMessage(code, reason)
+	conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(time.Second))
+	conn.Close()
+}
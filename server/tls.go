@@ -0,0 +1,204 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	ClientAuthNone     = "none"
+	ClientAuthOptional = "optional"
+	ClientAuthRequire  = "require"
+)
+
+// tlsCheckInterval is how often handshakes look for rotated files.
+const tlsCheckInterval = time.Second
+
+// TLSConfig enables TLS on the message, binary protocol and metrics
+// listeners. The files are checked at handshakes, at most every
+// tlsCheckInterval, and reloaded when they change, so certificates can be
+// rotated without a restart.
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	// ClientCAFile is the CA bundle client certificates are verified
+	// against. ClientAuth decides whether clients must present one.
+	ClientCAFile string
+	ClientAuth   string
+}
+
+// Validate checks that the files needed for the client auth mode are given.
+func (c TLSConfig) Validate() error {
+	if c.CertFile == "" || c.KeyFile == "" {
+		return errors.New("tls needs both a certificate and a key file")
+	}
+
+	switch c.ClientAuth {
+	case "", ClientAuthNone:
+	case ClientAuthOptional, ClientAuthRequire:
+		if c.ClientCAFile == "" {
+			return fmt.Errorf("client auth %q needs a client CA file", c.ClientAuth)
+		}
+	default:
+		return fmt.Errorf("unknown client auth %q", c.ClientAuth)
+	}
+
+	return nil
+}
+
+// certReloader serves the certificate and client CAs of a TLSConfig,
+// reloading them when the files change. A failed reload keeps the previous
+// files in use.
+type certReloader struct {
+	cfg TLSConfig
+
+	mu      sync.Mutex
+	checked time.Time
+	cert    *tls.Certificate
+	certMod fileVersion
+	pool    *x509.CertPool
+	poolMod fileVersion
+}
+
+// fileVersion identifies the contents of a set of files well enough to
+// notice a rotation.
+type fileVersion struct {
+	modTime time.Time
+	size    int64
+}
+
+func newCertReloader(cfg TLSConfig) (*certReloader, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	r := &certReloader{cfg: cfg}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// tlsConfig returns the config for a listener that negotiates nextProtos by
+// ALPN.
+func (r *certReloader) tlsConfig(nextProtos ...string) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: nextProtos,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			r.mu.Lock()
+			defer r.mu.Unlock()
+			return r.cert, nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			if r.due(time.Now()) {
+				if err := r.reload(); err != nil {
+					slog.Error("could not reload tls files, keeping the previous ones", "err", err)
+				}
+			}
+
+			r.mu.Lock()
+			defer r.mu.Unlock()
+
+			// the config of the handshake replaces that of the listener,
+			// ALPN included
+			cfg := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				NextProtos:   nextProtos,
+				Certificates: []tls.Certificate{*r.cert},
+				ClientCAs:    r.pool,
+			}
+
+			switch r.cfg.ClientAuth {
+			case ClientAuthOptional:
+				cfg.ClientAuth = tls.VerifyClientCertIfGiven
+			case ClientAuthRequire:
+				cfg.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+
+			return cfg, nil
+		},
+	}
+}
+
+// due reports whether the files were last checked tlsCheckInterval ago, and
+// if so counts them as checked now.
+func (r *certReloader) due(now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if now.Sub(r.checked) < tlsCheckInterval {
+		return false
+	}
+	r.checked = now
+	return true
+}
+
+func (r *certReloader) reload() error {
+	certMod, err := versionOf(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	var poolMod fileVersion
+	if r.cfg.ClientCAFile != "" {
+		if poolMod, err = versionOf(r.cfg.ClientCAFile); err != nil {
+			return err
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cert == nil || certMod != r.certMod {
+		cert, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+		if err != nil {
+			return fmt.Errorf("could not load certificate: %w", err)
+		}
+		if r.cert != nil {
+			slog.Info("reloaded tls certificate", "file", r.cfg.CertFile)
+		}
+		r.cert, r.certMod = &cert, certMod
+	}
+
+	if r.cfg.ClientCAFile != "" && (r.pool == nil || poolMod != r.poolMod) {
+		data, err := os.ReadFile(r.cfg.ClientCAFile)
+		if err != nil {
+			return fmt.Errorf("could not read client CA file: %w", err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates found in %s", r.cfg.ClientCAFile)
+		}
+		if r.pool != nil {
+			slog.Info("reloaded client CAs", "file", r.cfg.ClientCAFile)
+		}
+		r.pool, r.poolMod = pool, poolMod
+	}
+
+	return nil
+}
+
+// versionOf combines the latest modification time and total size of the
+// files.
+func versionOf(paths ...string) (fileVersion, error) {
+	var version fileVersion
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return fileVersion{}, err
+		}
+		if info.ModTime().After(version.modTime) {
+			version.modTime = info.ModTime()
+		}
+		version.size += info.Size()
+	}
+	return version, nil
+}
@@ -0,0 +1,640 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/mdkelley02/message-queue/storage"
+)
+
+const (
+	topicsFileName         = "topics.json"
+	retentionCheckInterval = 5 * time.Second
+	maxPartitions          = 256
+)
+
+var (
+	errTopicNotFound      = errors.New("topic not found")
+	errTopicExists        = errors.New("topic already exists")
+	errTopicFull          = errors.New("topic is full")
+	errTooManyTopics      = errors.New("too many topics")
+	errInvalidTopicConfig = errors.New("invalid topic config")
+
+	topicNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+)
+
+type topic struct {
+	name          string
+	ns            *namespace
+	config        atomic.Pointer[TopicConfig]
+	createdAt     time.Time
+	partitions    []*partition
+	nextPartition atomic.Uint32
+	done          chan struct{}
+	subscribers   atomic.Int32
+	dispatcher    *dispatcher
+	// published and delivered count messages since the broker started
+	published atomic.Int64
+	delivered atomic.Int64
+}
+
+// cfg returns the current config of the topic. It can be replaced while the
+// topic is in use, so callers should read it once per operation.
+func (t *topic) cfg() TopicConfig {
+	return *t.config.Load()
+}
+
+// wait returns a channel that is closed the next time messages become
+// available on the topic. Callers must get it before looking for messages so
+// that a wakeup is not missed.
+func (t *topic) wait() <-chan struct{} {
+	return t.dispatcher.wait()
+}
+
+// signal wakes up every subscriber waiting for messages.
+func (t *topic) signal() {
+	t.dispatcher.signal()
+}
+
+// signalAt wakes up every subscriber waiting for messages at the given time.
+func (t *topic) signalAt(at time.Time) {
+	t.dispatcher.signalAt(at)
+}
+
+func (t *topic) stats() storage.Stats {
+	var total storage.Stats
+	for _, p := range t.partitions {
+		stats := p.stats()
+		total.Count += stats.Count
+		total.Bytes += stats.Bytes
+	}
+	return total
+}
+
+func (t *topic) response() TopicResponse {
+	stats := t.stats()
+
+	response := TopicResponse{
+		Name:        t.name,
+		Config:      t.cfg(),
+		CreatedAt:   t.createdAt,
+		Depth:       stats.Count,
+		Bytes:       stats.Bytes,
+		Subscribers: int(t.subscribers.Load()),
+		Published:   t.published.Load(),
+		Delivered:   t.delivered.Load(),
+		Partitions:  make([]PartitionResponse, 0, len(t.partitions)),
+	}
+
+	for _, p := range t.partitions {
+		response.Partitions = append(response.Partitions, p.response())
+	}
+
+	return response
+}
+
+func (c TopicConfig) withDefaults() TopicConfig {
+	if c.Storage == "" {
+		c.Storage = StorageMemory
+	}
+	if c.DeliveryMode == "" {
+		c.DeliveryMode = DeliveryAtMostOnce
+	}
+	if c.Partitions == 0 {
+		c.Partitions = 1
+	}
+	if c.Partitioner == "" {
+		c.Partitioner = PartitionerHash
+	}
+	if c.Retry != nil {
+		retry := c.Retry.withDefaults()
+		c.Retry = &retry
+	}
+	return c
+}
+
+// inherit fills in the settings of c that are not set from d.
+func (c TopicConfig) inherit(d TopicConfig) TopicConfig {
+	if c.Storage == "" {
+		c.Storage = d.Storage
+	}
+	if c.Retention == 0 {
+		c.Retention = d.Retention
+	}
+	if c.MaxSize == 0 {
+		c.MaxSize = d.MaxSize
+	}
+	if c.DeliveryMode == "" {
+		c.DeliveryMode = d.DeliveryMode
+	}
+	if c.Partitions == 0 {
+		c.Partitions = d.Partitions
+	}
+	if c.Partitioner == "" {
+		c.Partitioner = d.Partitioner
+	}
+	if c.Retry == nil {
+		c.Retry = d.Retry
+	}
+	if c.MinInSyncReplicas == 0 {
+		c.MinInSyncReplicas = d.MinInSyncReplicas
+	}
+	return c
+}
+
+// Validate reports whether c, with the built-in defaults filled in, is a
+// valid topic config.
+func (c TopicConfig) Validate() error {
+	return c.withDefaults().validate()
+}
+
+func (c TopicConfig) validate() error {
+	switch c.Storage {
+	case StorageMemory, StorageFile:
+	default:
+		return fmt.Errorf("%w: unknown storage %q", errInvalidTopicConfig, c.Storage)
+	}
+
+	switch c.DeliveryMode {
+	case DeliveryAtMostOnce, DeliveryAtLeastOnce:
+	default:
+		return fmt.Errorf("%w: unknown delivery mode %q", errInvalidTopicConfig, c.DeliveryMode)
+	}
+
+	switch c.Partitioner {
+	case PartitionerHash, PartitionerRoundRobin:
+	default:
+		return fmt.Errorf("%w: unknown partitioner %q", errInvalidTopicConfig, c.Partitioner)
+	}
+
+	if c.Partitions < 1 || c.Partitions > maxPartitions {
+		return fmt.Errorf("%w: partitions must be between 1 and %d", errInvalidTopicConfig, maxPartitions)
+	}
+
+	if c.Retention < 0 {
+		return fmt.Errorf("%w: retention must not be negative", errInvalidTopicConfig)
+	}
+
+	if c.MaxSize < 0 {
+		return fmt.Errorf("%w: max size must not be negative", errInvalidTopicConfig)
+	}
+
+	if c.MinInSyncReplicas < 0 {
+		return fmt.Errorf("%w: min in-sync replicas must not be negative", errInvalidTopicConfig)
+	}
+
+	if c.Retry != nil {
+		if err := c.Retry.validate(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func validateTopicName(name string) error {
+	if !topicNamePattern.MatchString(name) || name == "." || name == ".." {
+		return fmt.Errorf("invalid topic name %q", name)
+	}
+	return nil
+}
+
+func (ns *namespace) topicDir(name string) string {
+	return filepath.Join(ns.dir, "topics", url.PathEscape(name))
+}
+
+func (s *Server) newTopic(ns *namespace, name string, cfg TopicConfig, createdAt time.Time) (*topic, error) {
+	t := &topic{
+		name:       name,
+		ns:         ns,
+		createdAt:  createdAt,
+		partitions: make([]*partition, 0, cfg.Partitions),
+		done:       make(chan struct{}),
+		dispatcher: newDispatcher(),
+	}
+	t.config.Store(&cfg)
+
+	for id := 0; id < cfg.Partitions; id++ {
+		partitionStorage, err := s.newPartitionStorage(ns, name, cfg, id)
+		if err != nil {
+			t.close()
+			return nil, err
+		}
+		t.partitions = append(t.partitions, newPartition(id, partitionStorage))
+	}
+
+	go t.dispatcher.run()
+
+	return t, nil
+}
+
+func (t *topic) close() {
+	t.dispatcher.stop()
+	for _, p := range t.partitions {
+		if err := p.storage.Close(); err != nil {
+			slog.Error("could not close partition storage", "topic", t.name, "partition", p.id, "err", err)
+		}
+	}
+}
+
+func (s *Server) getTopic(ns *namespace, name string) (*topic, error) {
+	t, ok := ns.topics.get(name)
+	if !ok {
+		return nil, errTopicNotFound
+	}
+	return t, nil
+}
+
+// upsertTopic returns the named topic, creating it with the default config
+// if it does not exist yet.
+func (s *Server) upsertTopic(ns *namespace, name string) (*topic, error) {
+	return s.upsertTopicWithConfig(ns, name, TopicConfig{})
+}
+
+// upsertTopicWithConfig is upsertTopic for topics that are created with cfg
+// instead of the default config.
+func (s *Server) upsertTopicWithConfig(ns *namespace, name string, cfg TopicConfig) (*topic, error) {
+	// the names of system topics follow the same rules past their prefix
+	if err := validateTopicName(strings.TrimPrefix(name, systemTopicPrefix)); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidTopicConfig, err)
+	}
+
+	t, created, err := ns.topics.getOrCreate(name, func() (*topic, error) {
+		return s.newTopic(ns, name, cfg.inherit(s.topicDefaults).withDefaults(), time.Now())
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if created {
+		s.persistTopics()
+	}
+
+	return t, nil
+}
+
+func (s *Server) createTopic(ns *namespace, name string, cfg TopicConfig) (*topic, error) {
+	if err := validateTopicName(name); err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidTopicConfig, err)
+	}
+
+	cfg = cfg.inherit(s.topicDefaults).withDefaults()
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	t, err := ns.topics.create(name, func() (*topic, error) {
+		return s.newTopic(ns, name, cfg, time.Now())
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.persistTopics()
+
+	return t, nil
+}
+
+func (s *Server) updateTopicConfig(ns *namespace, name string, cfg TopicConfig) (*topic, error) {
+	t, err := s.getTopic(ns, name)
+	if err != nil {
+		return nil, err
+	}
+
+	// storage and partitions are fixed at creation and may be left out
+	current := t.cfg()
+	cfg = cfg.inherit(TopicConfig{Storage: current.Storage, Partitions: current.Partitions})
+	cfg = cfg.inherit(s.topicDefaults).withDefaults()
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	if cfg.Storage != current.Storage {
+		return nil, fmt.Errorf("%w: storage cannot be changed after creation", errInvalidTopicConfig)
+	}
+
+	if cfg.Partitions != current.Partitions {
+		return nil, fmt.Errorf("%w: partitions cannot be changed after creation", errInvalidTopicConfig)
+	}
+
+	t.config.Store(&cfg)
+	s.persistTopics()
+
+	return t, nil
+}
+
+func (s *Server) purgeTopic(ns *namespace, name string) (int, error) {
+	t, err := s.getTopic(ns, name)
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, p := range t.partitions {
+		n, err := p.storage.Truncate(p.storage.Len())
+		if err != nil {
+			return purged, err
+		}
+		purged += n
+	}
+
+	return purged, nil
+}
+
+// deleteTopic removes the topic and its messages. Subscribers are sent a
+// close frame and pending deliveries are dropped.
+func (s *Server) deleteTopic(ns *namespace, name string) error {
+	t, ok := ns.topics.remove(name)
+	if !ok {
+		return errTopicNotFound
+	}
+
+	close(t.done)
+	t.close()
+	s.metrics.forget(t)
+
+	if t.cfg().Storage == StorageFile {
+		if err := os.RemoveAll(ns.topicDir(name)); err != nil {
+			slog.Error("could not remove topic data", "topic", name, "err", err)
+		}
+	}
+
+	s.persistTopics()
+
+	return nil
+}
+
+type persistedTopic struct {
+	Namespace string      `json:"namespace,omitempty"`
+	Name      string      `json:"name"`
+	Config    TopicConfig `json:"config"`
+	CreatedAt time.Time   `json:"createdAt"`
+}
+
+type topicsFile struct {
+	Topics []persistedTopic `json:"topics"`
+}
+
+func (s *Server) persistTopics() {
+	if s.dataDir == "" {
+		return
+	}
+
+	// writes share a temporary file, and the last one has to win
+	s.persistMu.Lock()
+	defer s.persistMu.Unlock()
+
+	if err := s.saveTopics(); err != nil {
+		slog.Error("could not persist topics", "err", err)
+	}
+}
+
+func (s *Server) saveTopics() error {
+	topics := s.allTopics()
+	file := topicsFile{Topics: make([]persistedTopic, 0, len(topics))}
+	for _, t := range topics {
+		// topics of the default namespace are saved as before namespaces
+		namespace := t.ns.name
+		if namespace == DefaultNamespace {
+			namespace = ""
+		}
+
+		file.Topics = append(file.Topics, persistedTopic{
+			Namespace: namespace,
+			Name:      t.name,
+			Config:    t.cfg(),
+			CreatedAt: t.createdAt,
+		})
+	}
+
+	return writeFileAtomic(filepath.Join(s.dataDir, topicsFileName), file, 0o644)
+}
+
+// loadTopics recreates the topics saved in the data directory, recovering
+// the messages of file backed topics.
+func (s *Server) loadTopics() error {
+	if s.dataDir == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(s.dataDir, topicsFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var file topicsFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return fmt.Errorf("could not parse %s: %w", topicsFileName, err)
+	}
+
+	for _, persisted := range file.Topics {
+		ns := s.defaultNamespace
+		if persisted.Namespace != "" {
+			if ns, err = s.getNamespace(persisted.Namespace); err != nil {
+				return fmt.Errorf("could not recover topic %s: %w", persisted.Name, err)
+			}
+		}
+
+		t, err := ns.topics.create(persisted.Name, func() (*topic, error) {
+			return s.newTopic(ns, persisted.Name, persisted.Config.withDefaults(), persisted.CreatedAt)
+		})
+		if err != nil {
+			return fmt.Errorf("could not recover topic %s: %w", persisted.Name, err)
+		}
+
+		slog.Info("recovered topic", "namespace", ns.name, "topic", t.name, "depth", t.stats().Count)
+	}
+
+	return nil
+}
+
+func (s *Server) enforceRetention() {
+	ticker := time.NewTicker(retentionCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.closing:
+			return
+		}
+
+		for _, t := range s.allTopics() {
+			retention := t.cfg().Retention
+			if retention <= 0 {
+				continue
+			}
+
+			cutoff := time.Now().Add(-time.Duration(retention))
+			for _, p := range t.partitions {
+				removed, err := expireMessages(p.storage, cutoff)
+				if err != nil {
+					slog.Error("could not expire messages", "topic", t.name, "partition", p.id, "err", err)
+					continue
+				}
+
+				if removed > 0 {
+					slog.Info("expired messages", "topic", t.name, "partition", p.id, "count", removed)
+					s.metrics.expired.WithLabelValues(t.ns.name, t.name).Add(float64(removed))
+				}
+			}
+		}
+	}
+}
+
+// expireMessages truncates the leading messages that were published before
+// cutoff.
+func expireMessages(topicStorage storage.IStorage, cutoff time.Time) (int, error) {
+	stats := topicStorage.Stats()
+
+	offset := stats.LowWatermark
+	for ; offset < stats.HighWatermark; offset++ {
+		record, err := topicStorage.Get(offset)
+		if errors.Is(err, storage.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		if !record.Timestamp.Before(cutoff) {
+			break
+		}
+	}
+
+	return topicStorage.Truncate(offset)
+}
+
+func (s *Server) CreateTopicHandler(w http.ResponseWriter, r *http.Request) {
+	var request CreateTopicRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		slog.Error("could not read request body", "err", err)
+		http.Error(w, "could not read request body", http.StatusBadRequest)
+		return
+	}
+
+	if !s.allowed(r, ActionAdmin, request.Name) {
+		s.writeForbidden(w, r, ActionAdmin, request.Name)
+		return
+	}
+
+	t, err := s.createTopic(s.namespace(r), request.Name, request.Config)
+	if err != nil {
+		writeTopicError(w, err)
+		return
+	}
+
+	slog.Info("created topic", "topic", t.name)
+	s.audit(r, AuditTopicCreate, t.name, nil, t.cfg())
+
+	writeJSON(w, http.StatusCreated, t.response())
+}
+
+func (s *Server) GetTopicHandler(w http.ResponseWriter, r *http.Request) {
+	t, err := s.getTopic(s.namespace(r), getTopicFromUrl(r))
+	if err != nil {
+		writeTopicError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, t.response())
+}
+
+func (s *Server) UpdateTopicConfigHandler(w http.ResponseWriter, r *http.Request) {
+	var config TopicConfig
+	if err := json.NewDecoder(r.Body).Decode(&config); err != nil {
+		slog.Error("could not read request body", "err", err)
+		http.Error(w, "could not read request body", http.StatusBadRequest)
+		return
+	}
+
+	before, err := s.getTopic(s.namespace(r), getTopicFromUrl(r))
+	if err != nil {
+		writeTopicError(w, err)
+		return
+	}
+	beforeConfig := before.cfg()
+
+	t, err := s.updateTopicConfig(s.namespace(r), getTopicFromUrl(r), config)
+	if err != nil {
+		writeTopicError(w, err)
+		return
+	}
+
+	slog.Info("updated topic config", "topic", t.name)
+	s.audit(r, AuditTopicConfig, t.name, beforeConfig, t.cfg())
+
+	writeJSON(w, http.StatusOK, t.response())
+}
+
+func (s *Server) PurgeTopicHandler(w http.ResponseWriter, r *http.Request) {
+	topic := getTopicFromUrl(r)
+
+	t, err := s.getTopic(s.namespace(r), topic)
+	if err != nil {
+		writeTopicError(w, err)
+		return
+	}
+	before := t.response()
+
+	purged, err := s.purgeTopic(s.namespace(r), topic)
+	if err != nil {
+		writeTopicError(w, err)
+		return
+	}
+
+	slog.Info("purged topic", "topic", topic, "count", purged)
+	s.audit(r, AuditTopicPurge, topic, before, t.response())
+
+	writeJSON(w, http.StatusOK, PurgeTopicResponse{Purged: purged})
+}
+
+func (s *Server) DeleteTopicHandler(w http.ResponseWriter, r *http.Request) {
+	topic := getTopicFromUrl(r)
+
+	t, err := s.getTopic(s.namespace(r), topic)
+	if err != nil {
+		writeTopicError(w, err)
+		return
+	}
+	before := t.response()
+
+	if err := s.deleteTopic(s.namespace(r), topic); err != nil {
+		writeTopicError(w, err)
+		return
+	}
+
+	slog.Info("deleted topic", "topic", topic)
+	s.audit(r, AuditTopicDelete, topic, before, nil)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeTopicError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errTopicNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errTopicExists):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, errInvalidTopicConfig):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, errTooManyTopics):
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+	default:
+		slog.Error("topic operation failed", "err", err)
+		http.Error(w, "topic operation failed", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,253 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mdkelley02/message-queue/storage"
+)
+
+// The W3C trace context headers.
+const (
+	TraceParentHeader = "traceparent"
+	TraceStateHeader  = "tracestate"
+)
+
+const (
+	traceVersion = "00"
+	flagSampled  = 0x01
+)
+
+// TraceContext is the W3C trace context a message was published in. It is
+// stored with the message and handed to every subscriber, who can continue
+// the trace with it.
+type TraceContext struct {
+	TraceParent string `json:"traceparent,omitempty"`
+	TraceState  string `json:"tracestate,omitempty"`
+}
+
+// TraceContextFromHeader returns the trace context of h. Without a valid
+// traceparent the trace state is meaningless and dropped as well.
+func TraceContextFromHeader(h http.Header) TraceContext {
+	tc := TraceContext{
+		TraceParent: strings.TrimSpace(h.Get(TraceParentHeader)),
+		TraceState:  strings.TrimSpace(strings.Join(h.Values(TraceStateHeader), ",")),
+	}
+	if _, _, _, ok := tc.parse(); !ok {
+		return TraceContext{}
+	}
+	return tc
+}
+
+// Inject sets the trace context headers of h.
+func (tc TraceContext) Inject(h http.Header) {
+	if tc.TraceParent == "" {
+		return
+	}
+	h.Set(TraceParentHeader, tc.TraceParent)
+	if tc.TraceState != "" {
+		h.Set(TraceStateHeader, tc.TraceState)
+	}
+}
+
+// TraceId returns the id of the trace, or an empty string when there is
+// none.
+func (tc TraceContext) TraceId() string {
+	traceId, _, _, _ := tc.parse()
+	return traceId
+}
+
+// SpanId returns the id of the span the context was created in.
+func (tc TraceContext) SpanId() string {
+	_, spanId, _, _ := tc.parse()
+	return spanId
+}
+
+// parse splits the traceparent into its fields and reports whether it is
+// valid. Versions after 00 may append fields, which are ignored.
+func (tc TraceContext) parse() (traceId string, spanId string, flags byte, ok bool) {
+	fields := strings.Split(tc.TraceParent, "-")
+	if len(fields) < 4 {
+		return "", "", 0, false
+	}
+
+	version, traceId, spanId := fields[0], fields[1], fields[2]
+	if !isLowerHex(version, 2) || version == "ff" || (version == traceVersion && len(fields) != 4) {
+		return "", "", 0, false
+	}
+	if !isLowerHex(traceId, 32) || traceId == strings.Repeat("0", 32) {
+		return "", "", 0, false
+	}
+	if !isLowerHex(spanId, 16) || spanId == strings.Repeat("0", 16) {
+		return "", "", 0, false
+	}
+	if !isLowerHex(fields[3], 2) {
+		return "", "", 0, false
+	}
+
+	f, _ := strconv.ParseUint(fields[3], 16, 8)
+	return traceId, spanId, byte(f), true
+}
+
+func isLowerHex(s string, n int) bool {
+	if len(s) != n {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func newTraceParent(traceId string, spanId string, flags byte) string {
+	return traceVersion + "-" + traceId + "-" + spanId + "-" + hex.EncodeToString([]byte{flags})
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+const (
+	SpanKindProducer = "producer"
+	SpanKindConsumer = "consumer"
+)
+
+// Span is an operation of the broker within a trace.
+type Span struct {
+	TraceId      string            `json:"traceId"`
+	SpanId       string            `json:"spanId"`
+	ParentSpanId string            `json:"parentSpanId,omitempty"`
+	Name         string            `json:"name"`
+	Kind         string            `json:"kind"`
+	Start        time.Time         `json:"start"`
+	End          time.Time         `json:"end"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+	Error        string            `json:"error,omitempty"`
+}
+
+// ISpanExporter receives the spans of the broker once they end.
+type ISpanExporter interface {
+	ExportSpan(span Span) error
+}
+
+type spanLogExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewSpanLogExporter writes every span as a line of JSON to w, so traces
+// can be followed without a collector.
+func NewSpanLogExporter(w io.Writer) ISpanExporter {
+	return &spanLogExporter{w: w}
+}
+
+func (e *spanLogExporter) ExportSpan(span Span) error {
+	line, err := json.Marshal(span)
+	if err != nil {
+		return err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	_, err = e.w.Write(append(line, '\n'))
+	return err
+}
+
+// span is a span that has not ended yet. A nil span does nothing, so
+// callers need not check whether tracing is enabled.
+type span struct {
+	Span
+	exporter ISpanExporter
+	sampled  bool
+	context  TraceContext
+}
+
+// startSpan starts a span in the trace of parent, or in a new trace when
+// parent has none. Without an exporter it returns nil.
+func (s *Server) startSpan(name string, kind string, parent TraceContext) *span {
+	if s.spanExporter == nil {
+		return nil
+	}
+
+	traceId, parentSpanId, flags, ok := parent.parse()
+	if !ok {
+		traceId, parentSpanId, flags = randomHex(16), "", flagSampled
+		parent = TraceContext{}
+	}
+
+	sp := &span{
+		Span: Span{
+			TraceId:      traceId,
+			SpanId:       randomHex(8),
+			ParentSpanId: parentSpanId,
+			Name:         name,
+			Kind:         kind,
+			Start:        time.Now(),
+			Attributes:   make(map[string]string),
+		},
+		exporter: s.spanExporter,
+		sampled:  flags&flagSampled != 0,
+	}
+	sp.context = TraceContext{
+		TraceParent: newTraceParent(traceId, sp.SpanId, flags),
+		TraceState:  parent.TraceState,
+	}
+	return sp
+}
+
+// traceContext returns the context of the span, or parent when there is no
+// span.
+func (sp *span) traceContext(parent TraceContext) TraceContext {
+	if sp == nil {
+		return parent
+	}
+	return sp.context
+}
+
+func (sp *span) setAttribute(key string, value any) {
+	if sp == nil {
+		return
+	}
+	sp.Attributes[key] = fmt.Sprint(value)
+}
+
+// end ends the span, failed when err is set, and exports it when its trace
+// is sampled.
+func (sp *span) end(err error) {
+	if sp == nil {
+		return
+	}
+
+	sp.End = time.Now()
+	if err != nil {
+		sp.Error = err.Error()
+	}
+
+	if !sp.sampled {
+		return
+	}
+	if err := sp.exporter.ExportSpan(sp.Span); err != nil {
+		slog.Error("could not export span", "span", sp.Name, "err", err)
+	}
+}
+
+// traceContextOf returns the trace context stored with record.
+func traceContextOf(record storage.Record) TraceContext {
+	return TraceContext{TraceParent: record.TraceParent, TraceState: record.TraceState}
+}
@@ -1,10 +1,14 @@
 package server
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/mdkelley02/message-queue/storage"
 )
 
 func getTopicFromUrl(r *http.Request) string {
@@ -12,38 +16,101 @@ func getTopicFromUrl(r *http.Request) string {
 	return vars["topic"]
 }
 
-func (s *Server) upsertTopic(topic string) {
-	if _, ok := s.messages[topic]; !ok {
-		s.messages[topic] = make(chan Message)
+var errMessageTooLarge = errors.New("message is too large")
+
+func (s *Server) publishMessage(ns *namespace, topic string, req PublishRequest) (response PublishResponse, err error) {
+	sp := s.startSpan("publish "+topic, SpanKindProducer, req.Trace)
+	sp.setAttribute("namespace", ns.name)
+	sp.setAttribute("topic", topic)
+	defer func() {
+		if err == nil {
+			sp.setAttribute("messageId", response.MessageId)
+			sp.setAttribute("partition", response.Partition)
+			sp.setAttribute("offset", response.Offset)
+		}
+		sp.end(err)
+	}()
+
+	if s.maxMessageBytes > 0 && len(req.Body) > s.maxMessageBytes {
+		return PublishResponse{}, fmt.Errorf("%w: %d bytes exceeds the limit of %d", errMessageTooLarge, len(req.Body), s.maxMessageBytes)
 	}
 
-	if _, ok := s.storage[topic]; !ok {
-		s.storage[topic] = s.makeStorageFunc()
+	if maxBytes := ns.cfg().Quotas.MaxBytes; maxBytes > 0 && ns.storedBytes()+len(req.Body) > maxBytes {
+		return PublishResponse{}, fmt.Errorf("%w: namespace %s may store at most %d bytes", errQuotaExceeded, ns.name, maxBytes)
 	}
-}
 
-func (s *Server) publishMessage(topic string, req PublishRequest) (PublishResponse, error) {
 	// create topic if it doesn't exist
-	s.upsertTopic(topic)
+	t, err := s.upsertTopic(ns, topic)
+	if err != nil {
+		return PublishResponse{}, err
+	}
 
-	// write message to storage
-	offset, err := s.storage[topic].Put(req.Body)
+	if maxSize := t.cfg().MaxSize; maxSize > 0 && t.stats().Count >= maxSize {
+		return PublishResponse{}, errTopicFull
+	}
+
+	p, err := t.selectPartition(req)
 	if err != nil {
 		return PublishResponse{}, err
 	}
 
-	msg := Message{
-		Id:     fmt.Sprintf("%s-%d", topic, offset),
-		Offset: offset,
+	// validate message against the topic's latest schema, if any
+	schemaId, err := ns.schemas.Validate(topic, req.Body)
+	if err != nil {
+		return PublishResponse{}, err
 	}
 
-	// send message to subscribers
-	go func() {
-		s.messages[topic] <- msg
-	}()
+	if err := s.checkReplicas(t, p); err != nil {
+		return PublishResponse{}, err
+	}
 
-	return PublishResponse{
+	// write message to storage, in the trace of the publish span so that
+	// deliveries are linked to it
+	trace := sp.traceContext(req.Trace)
+	offset, err := p.storage.Put(storage.Record{
+		Key:         req.Key,
+		Value:       req.Body,
+		SchemaId:    schemaId,
+		Timestamp:   time.Now(),
+		TraceParent: trace.TraceParent,
+		TraceState:  trace.TraceState,
+		Headers:     req.Headers,
+	})
+	if err != nil {
+		return PublishResponse{}, err
+	}
+
+	msg := newMessage(topic, p.id, offset)
+	t.published.Add(1)
+	s.metrics.published.WithLabelValues(ns.name, topic).Inc()
+	s.metrics.payloadSize.WithLabelValues(ns.name, topic).Observe(float64(len(req.Body)))
+
+	// wake up subscribers, and followers waiting for the message
+	t.signal()
+
+	response = PublishResponse{
+		Partition: msg.Partition,
 		Offset:    msg.Offset,
 		MessageId: msg.Id,
-	}, nil
+	}
+
+	if err := s.awaitReplicas(t, p, offset); err != nil {
+		return response, fmt.Errorf("message %s is stored but not acknowledged: %w", msg.Id, err)
+	}
+
+	return response, nil
+}
+
+func newMessage(topic string, partition int, offset int) Message {
+	return Message{
+		Id:        fmt.Sprintf("%s-%d-%d", topic, partition, offset),
+		Partition: partition,
+		Offset:    offset,
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
 }
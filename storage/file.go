@@ -0,0 +1,247 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+var errClosed = errors.New("storage is closed")
+
+const (
+	opPut      = "put"
+	opDelete   = "delete"
+	opTruncate = "truncate"
+	opExtend   = "extend"
+)
+
+type fileEntry struct {
+	Op     string  `json:"op"`
+	Offset int     `json:"offset"`
+	Record *Record `json:"record,omitempty"`
+}
+
+// FileStorage keeps records in memory and appends every change to a log file
+// so they survive restarts. The log is compacted each time it is opened.
+type FileStorage struct {
+	mem  *Storage
+	path string
+	file *os.File
+	// err is the error of the last failed write, cleared by the next write
+	// that succeeds
+	err    error
+	closed bool
+}
+
+func NewFileStorage(path string) (IStorage, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+
+	mem := newStorage()
+	if err := replay(path, mem); err != nil {
+		return nil, fmt.Errorf("could not replay %s: %w", path, err)
+	}
+
+	if err := compact(path, mem); err != nil {
+		return nil, fmt.Errorf("could not compact %s: %w", path, err)
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileStorage{
+		mem:  mem,
+		path: path,
+		file: file,
+	}, nil
+}
+
+func (s *FileStorage) Get(offset int) (Record, error) {
+	return s.mem.Get(offset)
+}
+
+func (s *FileStorage) Put(record Record) (int, error) {
+	s.mem.rwLock.Lock()
+	defer s.mem.rwLock.Unlock()
+
+	offset := s.mem.start + len(s.mem.store)
+	if err := s.append(fileEntry{Op: opPut, Offset: offset, Record: &record}); err != nil {
+		return 0, err
+	}
+
+	return s.mem.putLocked(record), nil
+}
+
+func (s *FileStorage) Delete(offset int) error {
+	s.mem.rwLock.Lock()
+	defer s.mem.rwLock.Unlock()
+
+	if i := offset - s.mem.start; i < 0 || i >= len(s.mem.store) {
+		return ErrNotFound
+	}
+
+	if err := s.append(fileEntry{Op: opDelete, Offset: offset}); err != nil {
+		return err
+	}
+
+	return s.mem.deleteLocked(offset)
+}
+
+func (s *FileStorage) Len() int {
+	return s.mem.Len()
+}
+
+func (s *FileStorage) Truncate(offset int) (int, error) {
+	s.mem.rwLock.Lock()
+	defer s.mem.rwLock.Unlock()
+
+	if offset <= s.mem.start {
+		return 0, nil
+	}
+
+	if err := s.append(fileEntry{Op: opTruncate, Offset: offset}); err != nil {
+		return 0, err
+	}
+
+	return s.mem.truncateLocked(offset), nil
+}
+
+func (s *FileStorage) Stats() Stats {
+	return s.mem.Stats()
+}
+
+// Health reports the storage unhealthy when it is closed, the last write
+// failed or the log file is gone.
+func (s *FileStorage) Health() error {
+	s.mem.rwLock.RLock()
+	defer s.mem.rwLock.RUnlock()
+
+	if s.closed {
+		return errClosed
+	}
+	if s.err != nil {
+		return fmt.Errorf("last write failed: %w", s.err)
+	}
+	if _, err := os.Stat(s.path); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *FileStorage) Close() error {
+	s.mem.rwLock.Lock()
+	defer s.mem.rwLock.Unlock()
+
+	s.closed = true
+
+	if err := s.file.Sync(); err != nil {
+		s.file.Close()
+		return err
+	}
+
+	return s.file.Close()
+}
+
+func (s *FileStorage) append(entry fileEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.file.Write(append(line, '\n'))
+	s.err = err
+	return err
+}
+
+func replay(path string, mem *Storage) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+
+	for scanner.Scan() {
+		var entry fileEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// a torn write at the end of the log is dropped
+			break
+		}
+
+		switch entry.Op {
+		case opPut:
+			if entry.Record == nil {
+				continue
+			}
+			mem.extendLocked(entry.Offset)
+			if entry.Offset == mem.start+len(mem.store) {
+				mem.putLocked(*entry.Record)
+			}
+		case opDelete:
+			mem.deleteLocked(entry.Offset)
+		case opTruncate:
+			mem.truncateLocked(entry.Offset)
+		case opExtend:
+			mem.extendLocked(entry.Offset)
+		}
+	}
+
+	return scanner.Err()
+}
+
+// compact rewrites the log so it only contains the live records, keeping
+// their offsets and the high watermark.
+func compact(path string, mem *Storage) error {
+	tmp := path + ".tmp"
+
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+
+	entries := []fileEntry{{Op: opTruncate, Offset: mem.start}}
+	for i, record := range mem.store {
+		if !mem.deleted[i] {
+			record := record
+			entries = append(entries, fileEntry{Op: opPut, Offset: mem.start + i, Record: &record})
+		}
+	}
+	entries = append(entries, fileEntry{Op: opExtend, Offset: mem.start + len(mem.store)})
+
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			file.Close()
+			return err
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
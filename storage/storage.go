@@ -3,60 +3,209 @@ package storage
 import (
 	"errors"
 	"sync"
+	"time"
 )
 
 var ErrNotFound = errors.New("not found")
 
+type Record struct {
+	Key       string    `json:"key,omitempty"`
+	Value     string    `json:"value"`
+	SchemaId  int       `json:"schemaId,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	// TraceParent and TraceState are the W3C trace context the record was
+	// published in
+	TraceParent string `json:"traceparent,omitempty"`
+	TraceState  string `json:"tracestate,omitempty"`
+	// Headers are application metadata the record was published with
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+type Stats struct {
+	// LowWatermark is the lowest offset that has not been truncated
+	LowWatermark int `json:"lowWatermark"`
+	// HighWatermark is the offset the next Put will be assigned
+	HighWatermark int `json:"highWatermark"`
+	Count         int `json:"count"`
+	Bytes         int `json:"bytes"`
+}
+
 type IStorage interface {
-	Get(offset int) (string, error)
-	Put(string) (int, error)
+	Get(offset int) (Record, error)
+	Put(Record) (int, error)
 	Delete(offset int) error
+	Len() int
+	// Truncate removes every record below offset and returns how many live
+	// records were removed. Offsets are never reused.
+	Truncate(offset int) (int, error)
+	Stats() Stats
+	Close() error
+}
+
+// IHealthChecker is implemented by storages that can break while the broker
+// runs, e.g. when a disk fills up. Health returns why the storage does not
+// work, or nil.
+type IHealthChecker interface {
+	Health() error
 }
 
 type Storage struct {
-	rwLock *sync.RWMutex
-	store  []string
+	rwLock  *sync.RWMutex
+	start   int
+	store   []Record
+	deleted []bool
+	count   int
+	bytes   int
 }
 
 func NewStorage() IStorage {
+	return newStorage()
+}
+
+func newStorage() *Storage {
 	return &Storage{
-		store:  make([]string, 0),
-		rwLock: &sync.RWMutex{},
+		store:   make([]Record, 0),
+		deleted: make([]bool, 0),
+		rwLock:  &sync.RWMutex{},
 	}
 }
 
-func (s *Storage) Get(offset int) (string, error) {
+func (s *Storage) Get(offset int) (Record, error) {
 	s.rwLock.RLock()
 	defer s.rwLock.RUnlock()
 
-	if offset >= len(s.store) || offset < 0 {
-		return "", ErrNotFound
+	i := offset - s.start
+	if i >= len(s.store) || i < 0 {
+		return Record{}, ErrNotFound
 	}
 
-	value := s.store[offset]
-	if value == "" {
-		return "", ErrNotFound
+	if s.deleted[i] {
+		return Record{}, ErrNotFound
 	}
 
-	return value, nil
+	return s.store[i], nil
 }
 
-func (s *Storage) Put(data string) (int, error) {
+func (s *Storage) Put(record Record) (int, error) {
 	s.rwLock.Lock()
 	defer s.rwLock.Unlock()
 
-	s.store = append(s.store, data)
-	return len(s.store) - 1, nil
+	return s.putLocked(record), nil
 }
 
 func (s *Storage) Delete(offset int) error {
 	s.rwLock.Lock()
 	defer s.rwLock.Unlock()
 
-	if offset >= len(s.store) {
+	return s.deleteLocked(offset)
+}
+
+// Len returns the offset the next Put will be assigned, deleted records
+// included.
+func (s *Storage) Len() int {
+	s.rwLock.RLock()
+	defer s.rwLock.RUnlock()
+
+	return s.start + len(s.store)
+}
+
+func (s *Storage) Truncate(offset int) (int, error) {
+	s.rwLock.Lock()
+	defer s.rwLock.Unlock()
+
+	return s.truncateLocked(offset), nil
+}
+
+func (s *Storage) Stats() Stats {
+	s.rwLock.RLock()
+	defer s.rwLock.RUnlock()
+
+	return Stats{
+		LowWatermark:  s.start,
+		HighWatermark: s.start + len(s.store),
+		Count:         s.count,
+		Bytes:         s.bytes,
+	}
+}
+
+func (s *Storage) Close() error {
+	return nil
+}
+
+func (s *Storage) putLocked(record Record) int {
+	s.store = append(s.store, record)
+	s.deleted = append(s.deleted, false)
+	s.count++
+	s.bytes += len(record.Value)
+	return s.start + len(s.store) - 1
+}
+
+func (s *Storage) deleteLocked(offset int) error {
+	i := offset - s.start
+	if i >= len(s.store) || i < 0 {
 		return ErrNotFound
 	}
 
-	s.store[offset] = ""
+	if !s.deleted[i] {
+		s.count--
+		s.bytes -= len(s.store[i].Value)
+	}
+
+	s.store[i] = Record{}
+	s.deleted[i] = true
 	return nil
 }
+
+func (s *Storage) truncateLocked(offset int) int {
+	n := offset - s.start
+	if n <= 0 {
+		return 0
+	}
+
+	// truncating past the end moves the start forward so offsets are not reused
+	if n >= len(s.store) {
+		removed := s.count
+		s.store = make([]Record, 0)
+		s.deleted = make([]bool, 0)
+		s.count = 0
+		s.bytes = 0
+		s.start = offset
+		return removed
+	}
+
+	removed := 0
+	for i := 0; i < n; i++ {
+		if !s.deleted[i] {
+			removed++
+			s.bytes -= len(s.store[i].Value)
+		}
+	}
+	s.count -= removed
+
+	// reslicing keeps a truncate as cheap as the records it removes, the
+	// records left are only copied once they fill a quarter of the array
+	clear(s.store[:n])
+	s.store = s.store[n:]
+	s.deleted = s.deleted[n:]
+	if len(s.store) < cap(s.store)/4 {
+		s.store = append([]Record(nil), s.store...)
+		s.deleted = append([]bool(nil), s.deleted...)
+	}
+	s.start = offset
+
+	return removed
+}
+
+// extendLocked fills the gap up to offset with deleted slots so the next
+// put is assigned offset.
+func (s *Storage) extendLocked(offset int) {
+	if len(s.store) == 0 && offset > s.start {
+		s.start = offset
+		return
+	}
+
+	for s.start+len(s.store) < offset {
+		s.store = append(s.store, Record{})
+		s.deleted = append(s.deleted, true)
+	}
+}
@@ -2,6 +2,8 @@ package storage
 
 import (
 	"errors"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -9,11 +11,13 @@ import (
 
 func Test_storage(t *testing.T) {
 	storage := NewStorage()
-	messageBody := `
+	messageBody := Record{
+		Value: `
 		{
 			"body": "MY_MESSAGE_1"
 		}
-	`
+	`,
+	}
 	t.Run("read previously put message", func(t *testing.T) {
 		offset, err := storage.Put(messageBody)
 		if err != nil {
@@ -50,6 +54,159 @@ func Test_storage(t *testing.T) {
 		if !errors.Is(err, ErrNotFound) {
 			t.Fatal(err)
 		}
-		assert.Equal(t, "", item)
+		assert.Equal(t, Record{}, item)
 	})
+
+	t.Run("schema id is kept with the stored message", func(t *testing.T) {
+		offset, err := storage.Put(Record{Value: `{"id":1}`, SchemaId: 7})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		item, err := storage.Get(offset)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, 7, item.SchemaId)
+	})
+
+	t.Run("len counts deleted messages", func(t *testing.T) {
+		before := storage.Len()
+
+		offset, err := storage.Put(messageBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := storage.Delete(offset); err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, before+1, storage.Len())
+	})
+}
+
+func Test_truncate(t *testing.T) {
+	storage := NewStorage()
+	for i := 0; i < 5; i++ {
+		if _, err := storage.Put(Record{Value: "abc"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := storage.Delete(1); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := storage.Truncate(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assert.Equal(t, 2, removed)
+	assert.Equal(t, Stats{LowWatermark: 3, HighWatermark: 5, Count: 2, Bytes: 6}, storage.Stats())
+
+	_, err = storage.Get(2)
+	assert.True(t, errors.Is(err, ErrNotFound))
+
+	removed, err = storage.Truncate(storage.Len())
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 2, removed)
+
+	offset, err := storage.Put(Record{Value: "abc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 5, offset)
+}
+
+func Test_fileStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "topic", "messages.log")
+
+	storage, err := NewFileStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, value := range []string{"a", "b", "c", "d", "e"} {
+		if _, err := storage.Put(Record{Value: value, SchemaId: 2}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := storage.Truncate(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Delete(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Delete(4); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// reopen twice so the compacted log is replayed as well
+	for i := 0; i < 2; i++ {
+		storage, err = NewFileStorage(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(t, Stats{LowWatermark: 1, HighWatermark: 5, Count: 2, Bytes: 2}, storage.Stats())
+
+		record, err := storage.Get(3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, Record{Value: "d", SchemaId: 2}, record)
+
+		_, err = storage.Get(2)
+		assert.True(t, errors.Is(err, ErrNotFound))
+
+		if err := storage.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	storage, err = NewFileStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+
+	offset, err := storage.Put(Record{Value: "f"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, 5, offset)
+}
+
+func Test_fileStorageHealth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "messages.log")
+
+	storage, err := NewFileStorage(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checker := storage.(IHealthChecker)
+
+	assert.NoError(t, checker.Health())
+
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	assert.Error(t, checker.Health())
+
+	if err := storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+	assert.ErrorContains(t, checker.Health(), "closed")
+
+	_, err = storage.Put(Record{Value: "a"})
+	assert.Error(t, err)
 }